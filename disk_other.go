@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// CheckDiskSpace is not implemented on this platform, callers carry on without the check
+func (cm *ClipManager) CheckDiskSpace() (uint64, error) {
+	return 0, fmt.Errorf("checking disk space is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || windows
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	cm := &ClipManager{tempDir: t.TempDir()}
+	available, err := cm.CheckDiskSpace()
+	if err != nil {
+		t.Fatalf("CheckDiskSpace: %v", err)
+	}
+	if available == 0 {
+		t.Errorf("CheckDiskSpace reported no free space in %s", cm.tempDir)
+	}
+
+	cm.tempDir = filepath.Join(cm.tempDir, "missing")
+	if _, err := cm.CheckDiskSpace(); err == nil {
+		t.Errorf("CheckDiskSpace succeeded for a directory that doesn't exist")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// CheckDiskSpace returns the bytes available to unprivileged users in the clips directory
+func (cm *ClipManager) CheckDiskSpace() (uint64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(cm.tempDir, &stat)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get filesystem stats: %v", err)
+	}
+
+	// The field types differ between platforms
+	availableSpace := uint64(stat.Bavail) * uint64(stat.Bsize)
+	return availableSpace, nil
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// CheckDiskSpace returns the bytes available to the current user in the clips directory
+func (cm *ClipManager) CheckDiskSpace() (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(cm.tempDir)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clips directory path: %v", err)
+	}
+
+	var freeBytesAvailable, totalBytes, totalFreeBytes uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &freeBytesAvailable, &totalBytes, &totalFreeBytes); err != nil {
+		return 0, fmt.Errorf("failed to get filesystem stats: %v", err)
+	}
+
+	return freeBytesAvailable, nil
+}
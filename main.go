@@ -3,29 +3,56 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/textproto"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/time/rate"
-	"github.com/gorilla/websocket"
 )
 
 // ANSI color codes
@@ -41,6 +68,7 @@ const (
 // Logger struct to handle custom logging
 type Logger struct {
 	logger *log.Logger
+	prefix string // Prepended to every message, e.g. "[req_123] [camera default] "
 }
 
 // NewLogger creates a new custom logger
@@ -52,38 +80,195 @@ func NewLogger() *Logger {
 
 // Info logs an informational message (blue with ℹ️ emoji)
 func (l *Logger) Info(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
+	msg := l.prefix + fmt.Sprintf(format, v...)
 	l.logger.Printf("%sℹ️  %s%s%s", Blue, Cyan, msg, Reset)
 }
 
 // Success logs a success message (green with ✅ emoji)
 func (l *Logger) Success(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
+	msg := l.prefix + fmt.Sprintf(format, v...)
 	l.logger.Printf("%s✅ %s%s%s", Green, Green, msg, Reset)
 }
 
 // Warning logs a warning message (yellow with ⚠️ emoji)
 func (l *Logger) Warning(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
+	msg := l.prefix + fmt.Sprintf(format, v...)
 	l.logger.Printf("%s⚠️  %s%s%s", Yellow, Yellow, msg, Reset)
 }
 
 // Error logs an error message (red with ❌ emoji)
 func (l *Logger) Error(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
+	msg := l.prefix + fmt.Sprintf(format, v...)
 	l.logger.Printf("%s❌ %s%s%s", Red, Red, msg, Reset)
 }
 
 // Debug logs a debug message (cyan with 🔧 emoji)
 func (l *Logger) Debug(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
+	msg := l.prefix + fmt.Sprintf(format, v...)
 	l.logger.Printf("%s🔧 %s%s%s", Cyan, Cyan, msg, Reset)
 }
 
+// With returns a child logger that prefixes every message, so all lines about one clip
+// can be found by its request ID
+func (l *Logger) With(format string, v ...interface{}) *Logger {
+	return &Logger{
+		logger: l.logger,
+		prefix: l.prefix + fmt.Sprintf(format, v...) + " ",
+	}
+}
+
+// Metrics holds the counters exposed on /metrics. They live on a registry of their own, with the
+// Go and process collectors promhttp.Handler serves by default, so every ClipManager has its own set.
+type Metrics struct {
+	registry         *prometheus.Registry
+	handler          http.Handler
+	clipsRequested   prometheus.Counter
+	clipsRecorded    prometheus.Counter
+	clipsFailed      prometheus.Counter
+	clipsRejected    prometheus.Counter
+	destinationSends *prometheus.CounterVec // Labelled by destination and result
+	compressions     *prometheus.CounterVec // Labelled by destination
+	recorderStalls   *prometheus.CounterVec // Labelled by camera
+}
+
+// NewMetrics creates an empty set of metrics
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		clipsRequested: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "clipmanager_clips_requested_total",
+			Help: "Number of clip requests received.",
+		}),
+		clipsRecorded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "clipmanager_clips_recorded_total",
+			Help: "Number of clips successfully extracted.",
+		}),
+		clipsFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "clipmanager_clips_failed_total",
+			Help: "Number of clips that could not be extracted.",
+		}),
+		clipsRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "clipmanager_clips_rejected_total",
+			Help: "Number of clip requests rejected because the clip queue was full.",
+		}),
+		destinationSends: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clipmanager_destination_sends_total",
+			Help: "Number of clip sends per destination and result.",
+		}, []string{"destination", "result"}),
+		compressions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clipmanager_compressions_total",
+			Help: "Number of FFmpeg compression runs per destination.",
+		}, []string{"destination"}),
+		recorderStalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clipmanager_recorder_stalls_total",
+			Help: "Number of FFmpeg recorders restarted because they stopped producing segments.",
+		}, []string{"camera"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.clipsRequested,
+		m.clipsRecorded,
+		m.clipsFailed,
+		m.clipsRejected,
+		m.destinationSends,
+		m.compressions,
+		m.recorderStalls,
+	)
+	m.handler = promhttp.InstrumentMetricHandler(m.registry, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return m
+}
+
+// IncClipsRequested counts a clip request
+func (m *Metrics) IncClipsRequested() {
+	m.clipsRequested.Inc()
+}
+
+// IncClipsRecorded counts a successfully extracted clip
+func (m *Metrics) IncClipsRecorded() {
+	m.clipsRecorded.Inc()
+}
+
+// IncClipsFailed counts a clip that could not be extracted
+func (m *Metrics) IncClipsFailed() {
+	m.clipsFailed.Inc()
+}
+
+// IncClipsRejected counts a clip request turned away because the clip queue was full
+func (m *Metrics) IncClipsRejected() {
+	m.clipsRejected.Inc()
+}
+
+// IncDestinationSend counts a send attempt to a destination by its outcome
+func (m *Metrics) IncDestinationSend(destination string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	m.destinationSends.WithLabelValues(destination, result).Inc()
+}
+
+// IncCompressions counts an FFmpeg compression run for a destination
+func (m *Metrics) IncCompressions(destination string) {
+	m.compressions.WithLabelValues(destination).Inc()
+}
+
+// IncRecorderStalls counts an FFmpeg recorder that was restarted because it stopped producing segments
+func (m *Metrics) IncRecorderStalls(cameraID string) {
+	m.recorderStalls.WithLabelValues(cameraID).Inc()
+}
+
+var (
+	segmentsDesc        = prometheus.NewDesc("clipmanager_segments", "Number of buffered segments per camera.", []string{"camera"}, nil)
+	clipsProcessingDesc = prometheus.NewDesc("clipmanager_clips_processing", "Number of clip requests being processed.", nil, nil)
+	clipsQueuedDesc     = prometheus.NewDesc("clipmanager_clips_queued", "Number of clip requests waiting for a processing slot.", nil, nil)
+	availableDiskDesc   = prometheus.NewDesc("clipmanager_available_disk_mb", "Available disk space in the clips directory in MB.", nil, nil)
+	wsClientsDesc       = prometheus.NewDesc("clipmanager_websocket_clients", "Number of connected WebSocket clients.", nil, nil)
+)
+
+// clipManagerCollector reports the gauges, which are read from the ClipManager's state on every scrape
+type clipManagerCollector struct {
+	cm *ClipManager
+}
+
+// Describe sends the descriptors of the gauges
+func (c clipManagerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- segmentsDesc
+	ch <- clipsProcessingDesc
+	ch <- clipsQueuedDesc
+	ch <- availableDiskDesc
+	ch <- wsClientsDesc
+}
+
+// Collect sends the current value of every gauge
+func (c clipManagerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, cam := range c.cm.cameras {
+		cam.segmentsMutex.RLock()
+		segments := len(cam.segments)
+		cam.segmentsMutex.RUnlock()
+		ch <- prometheus.MustNewConstMetric(segmentsDesc, prometheus.GaugeValue, float64(segments), cam.ID)
+	}
+
+	processing, queued := c.cm.clipQueueDepth()
+	ch <- prometheus.MustNewConstMetric(clipsProcessingDesc, prometheus.GaugeValue, float64(processing))
+	ch <- prometheus.MustNewConstMetric(clipsQueuedDesc, prometheus.GaugeValue, float64(queued))
+
+	// Left out rather than reported as 0 when the free space can't be read
+	if availableSpace, err := c.cm.CheckDiskSpace(); err == nil {
+		ch <- prometheus.MustNewConstMetric(availableDiskDesc, prometheus.GaugeValue, float64(availableSpace/(1024*1024)))
+	}
+
+	c.cm.wsClientsLock.RLock()
+	wsClients := len(c.cm.wsClients)
+	c.cm.wsClientsLock.RUnlock()
+	ch <- prometheus.MustNewConstMetric(wsClientsDesc, prometheus.GaugeValue, float64(wsClients))
+}
+
 type ClipRequest struct {
+	CameraID          string `json:"camera_id"`
 	CameraIP          string `json:"camera_ip"`
-	BacktrackSeconds  int    `json:"backtrack_seconds"`
-	DurationSeconds   int    `json:"duration_seconds"`
+	BacktrackSeconds  float64 `json:"backtrack_seconds"` // Fractions of a second are allowed, e.g. 2.5
+	DurationSeconds   float64 `json:"duration_seconds"`
 	ChatApps          string `json:"chat_app"` 
 	Category          string `json:"category"`
 	Title             string `json:"title"`
@@ -92,1736 +277,8664 @@ type ClipRequest struct {
 	AdditionalText    string `json:"additional_text"`
 	TelegramBotToken  string `json:"telegram_bot_token"`
 	TelegramChatID    string `json:"telegram_chat_id"`
+	TelegramAsDocument bool  `json:"telegram_as_document"` // Send with sendDocument so Telegram doesn't re-encode the clip
+	TelegramSupportsStreaming bool `json:"telegram_supports_streaming"` // Let clients play a sendVideo clip before it's downloaded
+	TelegramDisableNotification bool `json:"telegram_disable_notification"` // Deliver silently
+	TelegramMessageThreadID string `json:"telegram_message_thread_id"` // Forum topic to post in
 	MattermostURL     string `json:"mattermost_url"`
 	MattermostToken   string `json:"mattermost_token"`
 	MattermostChannel string `json:"mattermost_channel"`
+	MattermostRootID  string `json:"mattermost_root_id"` // Post ID of the thread to reply in
 	DiscordWebhookURL string `json:"discord_webhook_url"`
+	DiscordEmbed      bool   `json:"discord_embed"` // Post a rich embed instead of the plain message
+	DiscordUsername   string `json:"discord_username"`   // Overrides the webhook's name for this message
+	DiscordAvatarURL  string `json:"discord_avatar_url"` // Overrides the webhook's avatar for this message
 	SFTPHost          string `json:"sftp_host"`     // New field
 	SFTPPort          string `json:"sftp_port"`     // New field
 	SFTPUser          string `json:"sftp_user"`     // New field
 	SFTPPassword      string `json:"sftp_password"` // New field
 	SFTPPath          string `json:"sftp_path"`     // New field
+	SFTPPrivateKey    string `json:"sftp_private_key"` // PEM content or path to a key file
+	SFTPPassphrase    string `json:"sftp_passphrase"`
+	SFTPThumbnail     bool   `json:"sftp_thumbnail"` // Upload a JPEG poster frame next to the clip
+	SlackBotToken     string `json:"slack_bot_token"`
+	SlackChannel      string `json:"slack_channel"`
+	S3Endpoint        string `json:"s3_endpoint"`
+	S3Bucket          string `json:"s3_bucket"`
+	S3AccessKey       string `json:"s3_access_key"`
+	S3SecretKey       string `json:"s3_secret_key"`
+	S3Region          string `json:"s3_region"`
+	S3Prefix          string `json:"s3_prefix"`
+	S3PathStyle       bool   `json:"s3_path_style"`
+	YouTubeAccessToken  string `json:"youtube_access_token"`
+	YouTubeRefreshToken string `json:"youtube_refresh_token"`
+	YouTubeClientID     string `json:"youtube_client_id"`
+	YouTubeClientSecret string `json:"youtube_client_secret"`
+	YouTubePrivacy      string `json:"youtube_privacy_status"` // private, unlisted or public
+	SMTPHost          string `json:"smtp_host"`
+	SMTPPort          string `json:"smtp_port"`
+	SMTPUser          string `json:"smtp_user"`
+	SMTPPassword      string `json:"smtp_password"`
+	SMTPSecurity      string `json:"smtp_security"` // starttls (default), tls or none
+	EmailFrom         string `json:"email_from"`
+	EmailTo           string `json:"email_to"` // Comma-separated recipients
+	WebhookURL        string `json:"webhook_url"`        // Receives the clip as a multipart/form-data POST
+	WebhookToken      string `json:"webhook_token"`      // Sent as "Authorization: Bearer <token>"
+	WebhookHeader     string `json:"webhook_header"`     // Extra header as "Name: value", e.g. for an API key
+	WebhookFileField  string `json:"webhook_file_field"` // Form field of the clip (default file)
+	WebhookTextField  string `json:"webhook_text_field"` // Form field of the clip message (default message)
+	OutputFormat      string `json:"output_format"` // copy (default), h264 or vp9
+	Container         string `json:"container"`     // mp4, mkv or webm; defaults to webm for vp9 and mp4 otherwise
+	Accurate          bool   `json:"accurate"`      // Re-encode the video so the clip starts on the requested frame instead of a keyframe
+	PlaceholderSize   string `json:"placeholder_size"`      // WxH of the video generated for audio-only cameras, overrides PLACEHOLDER_SIZE
+	PlaceholderFramerate int `json:"placeholder_framerate"` // Overrides PLACEHOLDER_FRAMERATE
+	PlaceholderColor  string `json:"placeholder_color"`     // Overrides PLACEHOLDER_COLOR
+	VideoTrack        *int   `json:"video_track"`   // Video track of the buffer to clip, see /api/tracks; nil lets FFmpeg choose
+	AudioTrack        *int   `json:"audio_track"`   // Audio track of the buffer to clip, see /api/tracks; nil lets FFmpeg choose
+	Overlay           bool   `json:"overlay"`          // Burn team names, category and capture time into the clip
+	OverlayPosition   string `json:"overlay_position"` // top-left, top-right, bottom-left or bottom-right (default)
+	OverlayFontSize   int    `json:"overlay_font_size"`
+	AudioNormalize    bool    `json:"audio_normalize"`      // Normalize loudness with the EBU R128 loudnorm filter
+	AudioNormalizeMode string `json:"audio_normalize_mode"` // two-pass (default, accurate) or one-pass (faster)
+	LoudnormI         float64 `json:"loudnorm_i"`           // Integrated loudness target in LUFS
+	LoudnormLRA       float64 `json:"loudnorm_lra"`         // Loudness range target in LU
+	LoudnormTP        float64 `json:"loudnorm_tp"`          // True peak target in dBTP
+	Resolution        string `json:"resolution"` // source, 720p, 1080p or WxH; empty keeps the default 1280px cap
+	Wait              bool   `json:"wait"` // Block until the clip has been recorded and sent
+	Keep              bool   `json:"keep"`      // Move the finished clip into the archive directory instead of deleting it
+	DryRun            bool   `json:"dry_run"`   // Record the clip but don't send it anywhere (implies wait)
+	DryRunKeep        bool   `json:"dry_run_keep"` // Leave the dry-run clip in the clips directory for inspection
+	CallbackURL       string `json:"callback_url"` // Receives a ClipCallback when the clip is done
+	CRFStart          int     `json:"crf_start"`        // Overrides COMPRESSION_CRF_START
+	CRFMax            int     `json:"crf_max"`          // Overrides COMPRESSION_CRF_MAX
+	CRFStep           int     `json:"crf_step"`         // Overrides COMPRESSION_CRF_STEP
+	CompressionMode   string  `json:"compression_mode"` // crf or bitrate, overrides COMPRESSION_MODE
+	MaxFileSizeMB     float64 `json:"max_file_size_mb"` // Compress below this size, capped at each destination's limit
+	Filename          string `json:"filename"`     // Overrides the generated upload filename, without extension
+
+	RequestID string `json:"-"` // Assigned by HandleClipRequest
 }
 
+const (
+	// shutdownTimeout bounds how long shutdown waits for recorders and in-flight clips
+	shutdownTimeout = 90 * time.Second
+
+	// clipWaitTimeout bounds how long a wait=true request blocks beyond the clip duration
+	clipWaitTimeout = 5 * time.Minute
+
+	// HTTP server defaults in seconds (MAX_BODY_SIZE_KB in KB), 0 disables a timeout. Streaming
+	// and wait=true clip requests extend the write timeout for themselves.
+	defaultHTTPReadTimeout    = 30
+	defaultHTTPWriteTimeout   = 120
+	defaultHTTPIdleTimeout    = 120
+	defaultStreamWriteTimeout = 3600
+	defaultMaxBodySizeKB      = 1024
+
+	// Connecting to a destination fails after destinationConnectTimeout (HTTP, SMTP) or
+	// SFTP_CONNECT_TIMEOUT seconds, however long the destination's own timeout is
+	destinationConnectTimeout = 10 * time.Second
+	defaultSFTPConnectTimeout = 10
+
+	// Clip requests processed at once, and how many more may wait for a slot before new ones get a 503
+	defaultMaxConcurrentClips = 4
+	defaultClipQueueSize      = 20
+
+	// Requests per client IP, and the ceiling across all clients
+	defaultRateLimit       = 10
+	defaultRateBurst       = 20
+	defaultGlobalRateLimit = 100
+	defaultGlobalRateBurst = 100
+
+	// EBU R128 loudnorm defaults and the ranges FFmpeg accepts
+	defaultLoudnormI   = -16.0
+	defaultLoudnormLRA = 11.0
+	defaultLoudnormTP  = -1.5
+
+	// Compression starts at defaultInitialCRF and raises it by defaultCRFStep until the clip fits,
+	// giving up after defaultMaxCRF. x264 accepts CRF 0-51.
+	defaultInitialCRF = 23
+	defaultMaxCRF     = 40
+	defaultCRFStep    = 5
+	maxCRFValue       = 51
+	maxCRFStep        = 20
+
+	// Bitrate mode aims for compressionSizeMargin of the limit to leave room for the container,
+	// and gives up on it below minVideoBitrateKbps where the result would be unwatchable
+	compressionSizeMargin = 0.95
+	compressionAudioKbps  = 96
+	minVideoBitrateKbps   = 100
+
+	defaultOverlayFontSize = 24
+	minOverlayFontSize     = 8
+	maxOverlayFontSize     = 200
+
+	// Camera track selection from VIDEO_TRACK and AUDIO_TRACK besides a track number: trackDefault
+	// lets FFmpeg pick one track, trackAll records every track of that kind into the buffer
+	trackDefault = -1
+	trackAll     = -2
+
+	// Audio-only cameras get a generated placeholder video of this size, frame rate and color
+	defaultPlaceholderSize      = "640x480"
+	defaultPlaceholderFramerate = 25
+	defaultPlaceholderColor     = "black"
+	maxPlaceholderFramerate     = 60
+
+	// defaultThumbnailOffset is where thumbnails are taken from, in seconds into the clip
+	defaultThumbnailOffset = 1.0
+
+	// Stream tokens replace SFTP credentials in /api/clip/stream and /api/clip/thumbnail URLs.
+	// They expire after STREAM_TOKEN_TTL seconds; one request mints at most maxStreamTokenPaths.
+	defaultStreamTokenTTL = 900
+	maxStreamTokenPaths   = 100
+
+	// authTokenTTL is how long a single-use token for /ws or /api/preview stays valid
+	authTokenTTL = 30 * time.Second
+
+	// Retries back off exponentially from defaultRetryBaseDelay seconds by defaultRetryFactor, up to
+	// defaultRetryMaxDelay seconds. A Retry-After from the service is followed up to maxRetryAfter.
+	// Failed sends are retried defaultMaxRetries times, /api/config accepts up to maxRetriesLimit
+	defaultMaxRetries     = 3
+	maxRetriesLimit       = 10
+	defaultRetryBaseDelay = 2
+	defaultRetryFactor    = 2.0
+	defaultRetryMaxDelay  = 30
+	maxRetryAfter         = 5 * time.Minute
+
+	// The preview is an MJPEG stream of previewFPS frames per second at most previewWidth pixels wide
+	previewFPS      = 2
+	previewWidth    = 640
+	maxPreviewFrame = 4 * 1024 * 1024
+
+	// previewWriteTimeout bounds writing one preview frame, so a viewer that stops reading is dropped
+	previewWriteTimeout = 10 * time.Second
+
+	// discordEmbedColor is the accent color of Discord embeds (Discord blurple)
+	discordEmbedColor = 0x5865F2
+
+	maxDiscordUsernameLength = 80
+
+	// jobRetention is how long finished and abandoned jobs stay available on /api/clip/status
+	jobRetention = time.Hour
+
+	// maxFilenameLength caps the filename parameter, leaving room for an extension and numbering
+	maxFilenameLength = 200
+
+	// Longest title, category and team names, and additional_text, in characters. Longer values are cut off.
+	maxTextFieldLength      = 100
+	maxAdditionalTextLength = 500
+
+	// A recorder that produces no segment for stallSegmentMultiplier segment durations (and at
+	// least minStallTimeout, which leaves time to connect) is considered stalled and restarted
+	stallSegmentMultiplier = 3
+	minStallTimeout        = 15 * time.Second
+
+	// segmentPollInterval is how often a camera's segment directory is checked for new segments
+	// when it can't be watched. While it is watched, segmentRescanInterval catches anything the
+	// watcher missed, and scans wait segmentEventDebounce after the last event so a burst of
+	// writes leads to a single scan.
+	segmentPollInterval   = 500 * time.Millisecond
+	segmentRescanInterval = 5 * time.Second
+	segmentEventDebounce  = 100 * time.Millisecond
+
+	// maxStderrLines is how much of FFmpeg's output is kept for error messages
+	maxStderrLines = 50
+
+	// recorderStopTimeout bounds how long /api/recording/stop and restart wait for FFmpeg to exit
+	recorderStopTimeout = 15 * time.Second
+
+	// callbackTimeout bounds each attempt to deliver a callback_url notification
+	callbackTimeout = 10 * time.Second
+
+	// minScheduleInterval keeps schedules from capturing more often than the encoder can keep up with
+	minScheduleInterval = 10
+
+	defaultMaxBacktrackSeconds = 300
+	maxClipDurationSeconds     = 300
+	minMaxBacktrackSeconds     = 10
+	maxMaxBacktrackSeconds     = 3600
+
+	defaultSegmentDuration = 5
+	minSegmentDuration     = 1
+	maxSegmentDuration     = 30
+)
+
 type ClipResponse struct {
-	Message string `json:"message"`
+	Message   string             `json:"message"`
+	RequestID string             `json:"request_id,omitempty"`
+	Warning   string             `json:"warning,omitempty"`
+	Backtrack *BacktrackCoverage `json:"backtrack,omitempty"` // Only set when less footage is buffered than requested
+	Result    *ClipResult        `json:"result,omitempty"`    // Only set for wait=true requests
 }
 
-type SegmentInfo struct {
-	Path      string
-	Timestamp time.Time
+// BacktrackCoverage compares the requested backtrack with the footage buffered when the request arrived
+type BacktrackCoverage struct {
+	RequestedSeconds float64 `json:"requested_seconds"`
+	AvailableSeconds int     `json:"available_seconds"`
 }
 
-type ClipManager struct {
-	tempDir           string
-	httpClient        *http.Client
-	limiter           *rate.Limiter
-	hostPort          string
-	maxRetries        int
-	retryDelay        time.Duration
-	cameraIP          string
-	segmentPattern    string
-	recording         bool
-	segments          []SegmentInfo
-	segmentsMutex     sync.RWMutex
-	segmentChan       chan SegmentInfo
-	segmentDuration   int
-	recordingStartTime time.Time // New field to track recording start time
-	log               *Logger 
-	wsClients         map[*websocket.Conn]bool
-	wsClientsLock     sync.RWMutex
-}
-
-func NewClipManager(tempDir string, hostPort string, cameraIP string) (*ClipManager, error) {
-    if err := os.MkdirAll(tempDir, 0755); err != nil {
-        return nil, fmt.Errorf("failed to create temp directory %s: %v", tempDir, err)
-    }
-    absTemp, err := filepath.Abs(tempDir)
-    if err != nil {
-        return nil, fmt.Errorf("failed to resolve absolute path for %s: %v", tempDir, err)
-    }
-    segmentPattern := filepath.Join(absTemp, "segment_%03d.ts")
+// ClipResult describes the outcome of recording a clip and sending it to its destinations
+type ClipResult struct {
+	Success         bool                `json:"success"`
+	DryRun          bool                `json:"dry_run,omitempty"`
+	FilePath        string              `json:"file_path,omitempty"` // Set when a dry-run clip is kept
+	Error           string              `json:"error,omitempty"`
+	DurationSeconds float64             `json:"duration_seconds,omitempty"`
+	FileSizeBytes   int64               `json:"file_size_bytes,omitempty"`
+	RequestedStart  *time.Time          `json:"requested_start,omitempty"`
+	RequestedEnd    *time.Time          `json:"requested_end,omitempty"`
+	StartTime       *time.Time          `json:"start_time,omitempty"` // Wall-clock time of the first frame in the clip
+	EndTime         *time.Time          `json:"end_time,omitempty"`
+	Gaps            []ClipGap           `json:"gaps,omitempty"` // Footage missing between StartTime and EndTime
+	Destinations    []DestinationResult `json:"destinations,omitempty"`
+}
 
-    cm := &ClipManager{
-        tempDir:         absTemp,
-        httpClient:      &http.Client{Timeout: 60 * time.Second},
-        limiter:         rate.NewLimiter(rate.Limit(100), 100),
-        hostPort:        hostPort,
-        maxRetries:      3,
-        retryDelay:      5 * time.Second,
-        cameraIP:        cameraIP,
-        segmentPattern:  segmentPattern,
-        segmentChan:     make(chan SegmentInfo, 200), // Increased buffer size provides more headroom
-        segmentDuration: 5,
-        log:             NewLogger(),
-        wsClients:       make(map[*websocket.Conn]bool),
-    }
-    
-    // Start a background goroutine to manage the channel
-    go cm.manageSegmentChannel()
-    
-    return cm, nil
+// ClipGap is a stretch of wall-clock time inside a clip for which no footage was recorded, e.g.
+// while the camera was reconnecting. The clip jumps from Start to End.
+type ClipGap struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Seconds float64   `json:"seconds"`
 }
 
-// New method to manage the segment channel
-func (cm *ClipManager) manageSegmentChannel() {
-    for {
-        // Sleep briefly to avoid busy waiting
-        time.Sleep(100 * time.Millisecond)
-        
-        // If the channel is getting full (more than 80% capacity), remove oldest items
-        if len(cm.segmentChan) > 80 {
-            // Read and discard the oldest item(s)
-            select {
-            case <-cm.segmentChan:
-                cm.log.Debug("Removed oldest segment notification from channel to prevent overflow")
-            default:
-                // Channel not full anymore
-            }
-        }
-    }
+// ClipRange is the stretch of the buffer a clip actually covers, which differs from the request
+// when the segments don't reach back far enough or end early
+type ClipRange struct {
+	Start           time.Time
+	End             time.Time
+	DurationSeconds float64
+	Gaps            []ClipGap // Missing footage between Start and End, which DurationSeconds doesn't include
 }
 
-func (cm *ClipManager) RateLimit(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !cm.limiter.Allow() {
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			cm.log.Error("Rate limit exceeded for IP: %s", r.RemoteAddr)
-			return
-		}
-		next(w, r)
-	}
+// Job phases reported on /api/clip/status
+const (
+	JobPending   = "pending"
+	JobQueued    = "queued" // Waiting for one of the MAX_CONCURRENT_CLIPS processing slots
+	JobRecording = "recording"
+	JobSending   = "sending"
+	JobDone      = "done"
+	JobFailed    = "failed"
+)
+
+// Job tracks the progress of a single clip request
+type Job struct {
+	ID        string               `json:"id"`
+	CameraID  string               `json:"camera_id"`
+	Status    string               `json:"status"`
+	Error     string               `json:"error,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	Phases    map[string]time.Time `json:"phases"` // Time each phase was entered
+	Result    *ClipResult          `json:"result,omitempty"`
 }
 
-func (cm *ClipManager) HandleClipRequest(w http.ResponseWriter, r *http.Request) {
-    startTime := time.Now()
-    requestID := fmt.Sprintf("req_%d", time.Now().UnixNano())
+// Schedule captures a clip from one camera every IntervalSeconds until it ends or is cancelled
+type Schedule struct {
+	ID               string     `json:"id"`
+	CameraID         string     `json:"camera_id"`
+	ChatApps         string     `json:"chat_app"`
+	IntervalSeconds  int        `json:"interval_seconds"`
+	BacktrackSeconds float64    `json:"backtrack_seconds"`
+	DurationSeconds  float64    `json:"duration_seconds"`
+	Title            string     `json:"title,omitempty"`
+	Category         string     `json:"category,omitempty"`
+	Team1            string     `json:"team1,omitempty"`
+	Team2            string     `json:"team2,omitempty"`
+	StartTime        time.Time  `json:"start_time"`
+	EndTime          *time.Time `json:"end_time,omitempty"` // Runs until cancelled when unset
+	NextCapture      time.Time  `json:"next_capture"`
+	Captures         int        `json:"captures"`
+	Skipped          int        `json:"skipped"` // Slots missed because the previous capture was still running
+	LastRequestID    string     `json:"last_request_id,omitempty"`
+
+	request *ClipRequest // Destination credentials stay out of the JSON above
+	cancel  context.CancelFunc
+}
 
-    if r.Method != http.MethodGet && r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed, use GET or POST", http.StatusMethodNotAllowed)
-        return
-    }
+// ScheduleRequest is the body of POST /api/schedule: the usual clip parameters plus the cadence
+type ScheduleRequest struct {
+	ClipRequest
+	IntervalSeconds int    `json:"interval_seconds"`
+	StartTime       string `json:"start_time"`     // RFC 3339, defaults to now
+	EndTime         string `json:"end_time"`       // RFC 3339
+	WindowSeconds   int    `json:"window_seconds"` // Alternative to end_time, counted from start_time
+}
 
-    fileName := fmt.Sprintf("clip_%d.mp4", time.Now().Unix())
-    filePath := filepath.Join(cm.tempDir, fileName)
+// Compression modes: crf re-encodes with a rising CRF until the clip fits, bitrate computes the
+// bitrate that fits the limit and encodes once (two passes with libx264)
+const (
+	compressionModeCRF     = "crf"
+	compressionModeBitrate = "bitrate"
+)
 
-    response := ClipResponse{Message: "Clip recording and sending started"}
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
+// CompressionSettings controls how PrepareClipForChatApp shrinks a clip that exceeds a destination's limit
+type CompressionSettings struct {
+	Mode          string // compressionModeCRF or compressionModeBitrate
+	InitialCRF    int
+	MaxCRF        int
+	CRFStep       int
+	MaxFileSizeMB float64 // Lowers every destination's limit when set, never raises it
+}
 
-    go func() {
-        defer func() {
-            processingTime := time.Since(startTime)
-            cm.log.Info("[%s] Total processing time: %v", requestID, processingTime)
-        }()
+// validate checks the mode and that the CRF range is one x264 accepts. The CRF range is also
+// needed in bitrate mode, which falls back to it when the encode overshoots.
+func (c CompressionSettings) validate() error {
+	if c.Mode != compressionModeCRF && c.Mode != compressionModeBitrate {
+		return fmt.Errorf("the compression mode must be %s or %s", compressionModeCRF, compressionModeBitrate)
+	}
+	if c.InitialCRF < 0 || c.InitialCRF > maxCRFValue || c.MaxCRF < 0 || c.MaxCRF > maxCRFValue {
+		return fmt.Errorf("CRF values must be between 0 and %d", maxCRFValue)
+	}
+	if c.InitialCRF > c.MaxCRF {
+		return fmt.Errorf("the starting CRF must not be above the maximum CRF")
+	}
+	if c.CRFStep < 1 || c.CRFStep > maxCRFStep {
+		return fmt.Errorf("the CRF step must be between 1 and %d", maxCRFStep)
+	}
+	return nil
+}
 
-		backtrackSeconds, _ := strconv.Atoi(r.URL.Query().Get("backtrack_seconds"))
-		durationSeconds, _ := strconv.Atoi(r.URL.Query().Get("duration_seconds"))
-		category := r.URL.Query().Get("category")
+// RuntimeConfig holds the settings that /api/config can change without a restart. An update
+// replaces it as a whole, so a copy from currentConfig is consistent.
+type RuntimeConfig struct {
+	Compression     CompressionSettings // Default CRF range and mode, requests can override it
+	FileSizeLimits  map[string]float64  // Per destination size limit in MB, clips above it are compressed
+	RateLimit       float64             // Requests per second per client IP
+	RateBurst       int
+	GlobalRateLimit float64 // Requests per second across all clients
+	GlobalRateBurst int
+	MaxRetries      int
+	RetryDelay      time.Duration // Wait before the first retry, later ones back off from it
+	RetryFactor     float64       // Multiplies the wait after every retry
+	RetryMaxDelay   time.Duration // Upper bound of the backoff
+}
 
-		cm.log.Info("[%s] Extracting clip for backtrack: %d seconds, duration: %d seconds with category: %s",
-			requestID, backtrackSeconds, durationSeconds, category)
-        err := cm.RecordClip(backtrackSeconds, durationSeconds, filePath, startTime)
-        if err != nil {
-            cm.log.Error("[%s] Recording error: %v", requestID, err)
-            return
-        }
-        cm.log.Success("[%s] Clip recording completed", requestID)
+// currentConfig returns the settings in effect now
+func (cm *ClipManager) currentConfig() RuntimeConfig {
+	cm.configMutex.RLock()
+	defer cm.configMutex.RUnlock()
+	return cm.config
+}
 
-        if err := cm.SendToChatApp(filePath, r); err != nil {
-            cm.log.Error("[%s] Error sending clip: %v", requestID, err)
-        }
+// compressionKey identifies the output of PrepareClipForChatApp, destinations of a request with
+// the same key get the same file
+type compressionKey struct {
+	SizeMB     float64
+	Resolution string
+	Encoder    string
+}
 
-        os.Remove(filePath)
-    }()
+// preparedClip is a clip prepared once for all destinations of a request with the same compressionKey
+type preparedClip struct {
+	done     chan struct{} // Closed once filePath and err are set
+	filePath string
+	err      error
 }
 
-func (cm *ClipManager) validateRequest(req *ClipRequest) error {
-	req.CameraIP = cm.cameraIP
+// discordPayload is the payload_json of a Discord webhook message
+type discordPayload struct {
+	Content     string              `json:"content,omitempty"`
+	Username    string              `json:"username,omitempty"`
+	AvatarURL   string              `json:"avatar_url,omitempty"`
+	Embeds      []discordEmbed      `json:"embeds,omitempty"`
+	Attachments []discordAttachment `json:"attachments,omitempty"`
+	AllowedMentions *discordAllowedMentions `json:"allowed_mentions,omitempty"`
+}
 
-	if req.ChatApps == "" {
-		return fmt.Errorf("missing required parameter: chat_app")
-	}
+// discordAllowedMentions limits which mentions in a message notify anyone, an empty Parse none at all
+type discordAllowedMentions struct {
+	Parse []string `json:"parse"`
+}
 
-	if req.BacktrackSeconds < 0 {
-		return fmt.Errorf("invalid or missing parameter: backtrack_seconds must be 0 or greater")
-	}
+type discordEmbed struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Color       int                 `json:"color"`
+	Timestamp   string              `json:"timestamp"`
+	Fields      []discordEmbedField `json:"fields,omitempty"`
+	Image       *discordEmbedImage  `json:"image,omitempty"`
+}
 
-	if req.DurationSeconds <= 0 {
-		return fmt.Errorf("invalid or missing parameter: duration_seconds must be greater than 0")
-	}
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
 
-	if req.BacktrackSeconds > 300 {
-		return fmt.Errorf("invalid parameter: backtrack_seconds must be between 0 and 300")
-	}
+type discordEmbedImage struct {
+	URL string `json:"url"`
+}
 
-	if req.DurationSeconds > 300 {
-		return fmt.Errorf("invalid parameter: duration_seconds must be less than 300")
-	}
+// discordAttachment describes the files[n] form field with the same ID
+type discordAttachment struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+}
 
-	chatApps := strings.Split(strings.ToLower(req.ChatApps), ",")
+// DestinationResult is the outcome of sending a clip to a single destination
+type DestinationResult struct {
+	Destination string `json:"destination"`
+	Success     bool   `json:"success"`
+	Location    string `json:"location,omitempty"` // Remote path of the clip for SFTP and S3
+	PostID      string `json:"post_id,omitempty"`  // ID of the Mattermost post, usable as mattermost_root_id
+	Error       string `json:"error,omitempty"`
+}
 
-	for _, app := range chatApps {
-		app = strings.TrimSpace(app)
+// ClipCallback is POSTed to a request's callback_url once the clip has been processed
+type ClipCallback struct {
+	RequestID string `json:"request_id"`
+	CameraID  string `json:"camera_id"`
+	ClipResult
+}
 
-		switch app {
-		case "telegram":
-			if req.TelegramBotToken == "" {
-				return fmt.Errorf("missing required parameter for Telegram: telegram_bot_token")
-			}
-			if req.TelegramChatID == "" {
-				return fmt.Errorf("missing required parameter for Telegram: telegram_chat_id")
-			}
-		case "mattermost":
-			if req.MattermostURL == "" {
-				return fmt.Errorf("missing required parameter for Mattermost: mattermost_url")
-			}
-			if req.MattermostToken == "" {
-				return fmt.Errorf("missing required parameter for Mattermost: mattermost_token")
-			}
-			if req.MattermostChannel == "" {
-				return fmt.Errorf("missing required parameter for Mattermost: mattermost_channel")
-			}
-			req.MattermostURL = strings.TrimSuffix(req.MattermostURL, "/")
-		case "discord":
-			if req.DiscordWebhookURL == "" {
-				return fmt.Errorf("missing required parameter for Discord: discord_webhook_url")
-			}
-		case "sftp":
-			if req.SFTPHost == "" {
-				return fmt.Errorf("missing required parameter for SFTP: sftp_host")
-			}
-			if req.SFTPPort == "" {
-				req.SFTPPort = "22" // Default SFTP port
-			} else if port, err := strconv.Atoi(req.SFTPPort); err != nil || port < 1 || port > 65535 {
-				return fmt.Errorf("invalid sftp_port: must be a valid port number between 1 and 65535")
-			}
-			if req.SFTPUser == "" {
-				return fmt.Errorf("missing required parameter for SFTP: sftp_user")
-			}
-			if req.SFTPPassword == "" {
-				return fmt.Errorf("missing required parameter for SFTP: sftp_password")
-			}
-			if req.SFTPPath == "" {
-				req.SFTPPath = "." // Default to current directory
-			}
-		default:
-			return fmt.Errorf("invalid chat_app parameter '%s'. Supported values are: 'telegram', 'mattermost', 'discord', 'sftp'", app)
-		}
-	}
+type SegmentInfo struct {
+	Path      string
+	Timestamp time.Time     // Wall-clock time of the segment's first frame
+	Duration  time.Duration // Actual length, FFmpeg cuts at keyframes so it varies around SEGMENT_DURATION
+}
 
-	return nil
+// End returns the wall-clock time at which the segment's footage ends
+func (s SegmentInfo) End() time.Time {
+	return s.Timestamp.Add(s.Duration)
 }
 
-// hasAudioStream checks if the RTSP stream contains an audio stream
-func (cm *ClipManager) hasAudioStream(rtspURL string) (bool, error) {
-    cmd := exec.Command("ffprobe",
-        "-rtsp_transport", "tcp",
-        "-i", rtspURL,
-        "-show_streams",
-        "-select_streams", "a", // Select only audio streams
-        "-print_format", "json",
-        "-v", "error",
-    )
+// Camera holds the recording state of a single RTSP stream
+type Camera struct {
+	ID                 string
+	URL                string
+	segmentDir         string
+	segmentPattern     string
+	recording          bool      // Guarded by recordingMutex, use IsRecording
+	recordingStartTime time.Time // Guarded by recordingMutex
+	cancelRecording    context.CancelFunc // Stops the running recorder, guarded by recordingMutex
+	recordingDone      chan struct{}      // Closed when the running recorder has exited, guarded by recordingMutex
+	recordingMutex     sync.Mutex
+	hasAudio           bool // Cached stream probe, guarded by streamsMutex
+	hasVideo           bool
+	codecs             StreamCodecs
+	tracks             []StreamTrack // Every track found by the last probe
+	streamsProbed      bool // Whether hasAudio and hasVideo come from a successful probe
+	videoTrack         int  // Recorded video track from VIDEO_TRACK, or trackDefault or trackAll
+	audioTrack         int  // Recorded audio track from AUDIO_TRACK, or trackDefault or trackAll
+	streamsMutex       sync.Mutex
+	segments           []SegmentInfo
+	segmentsMutex      sync.RWMutex
+	subscribers        map[chan SegmentInfo]struct{} // Notified of every new segment, guarded by segmentsMutex
+	nextCycle          int                           // First recording cycle number not used by segments on disk
+	lastSegmentAt      time.Time                     // When the recorder last produced a segment, guarded by segmentsMutex
+	currentCycle       int                           // Recording cycle of the newest segment, guarded by segmentsMutex
+}
 
-    var out bytes.Buffer
-    cmd.Stdout = &out
-    cmd.Stderr = &out // Capture errors as well
+type ClipManager struct {
+	tempDir                 string
+	httpClient              *http.Client             // Quick API calls
+	callbackClient          *http.Client             // callback_url notifications, restricted by targetGuard
+	targetGuard             *TargetGuard             // Keeps callback_url and webhook_url off private networks
+	httpClients             map[string]*http.Client  // Per destination clients with their own timeouts, see httpClientFor
+	destinationTimeouts     map[string]time.Duration // Per attempt timeout of each destination from <DESTINATION>_TIMEOUT, 0 for none
+	sftpConnectTimeout      time.Duration            // SSH dial and handshake timeout from SFTP_CONNECT_TIMEOUT
+	sftpVerifyChecksum      bool                     // Read SFTP uploads back and compare checksums (SFTP_VERIFY_CHECKSUM)
+	limiter                 *rate.Limiter            // Global ceiling across all clients from GLOBAL_RATE_LIMIT and GLOBAL_RATE_BURST
+	ipLimiters              *IPRateLimiter           // Per client IP limits from RATE_LIMIT and RATE_BURST
+	hostPort                string
+	config                  RuntimeConfig // Settings /api/config can change, read them with currentConfig
+	configMutex             sync.RWMutex
+	cameras                 map[string]*Camera
+	defaultCameraID         string
+	segmentDuration         int
+	maxBacktrackSeconds     int
+	maxSegments             int
+	defaultBacktrackSeconds float64 // Used when a request has no backtrack_seconds (DEFAULT_BACKTRACK_SECONDS)
+	defaultDurationSeconds  float64 // Used when a request has no duration_seconds (DEFAULT_DURATION_SECONDS)
+	log                     *Logger
+	wsClients               map[*websocket.Conn]*wsClient
+	wsClientsLock           sync.RWMutex
+	previews                map[string]*previewStream // Running preview pipelines keyed by camera ID
+	previewsMutex           sync.Mutex
+	previewDisabled         bool          // DISABLE_PREVIEW turns /api/preview off
+	placeholder             Placeholder   // Video of audio-only cameras from the PLACEHOLDER_* variables
+	encodeSlots             chan struct{} // Limits concurrent FFmpeg encodes across all requests (MAX_CONCURRENT_ENCODES)
+	clipSlots               chan struct{} // Clip requests being processed (MAX_CONCURRENT_CLIPS)
+	clipQueue               chan struct{} // Clip requests processing or waiting for a slot, MAX_CONCURRENT_CLIPS + CLIP_QUEUE_SIZE
+	sftpKnownHosts          string        // Path to the known_hosts file used to verify SFTP servers
+	sftpInsecure            bool          // Skip host key verification when no known_hosts file is configured
+	sftpTrustOnFirstUse     bool          // Append unknown host keys to sftpKnownHosts instead of rejecting them
+	sftpKeyDir              string        // Directory requests may name private key files from (SFTP_KEY_DIR), empty allows inline keys only
+	knownHostsMutex         sync.Mutex
+	sftpPool                *SFTPPool               // Reused SFTP connections
+	maxBodyBytes            int64                   // Larger request bodies are rejected with 413
+	writeTimeout            time.Duration           // HTTP server write timeout, some handlers extend it
+	streamWriteTimeout      time.Duration           // Write timeout for clip streaming, 0 for none
+	streamTokens            map[string]*streamToken // Short-lived tokens for clip streaming keyed by token
+	streamTokensMutex       sync.Mutex
+	streamTokenTTL          time.Duration             // How long a stream token stays valid (STREAM_TOKEN_TTL)
+	clipInfoProbes          map[string]*clipInfoProbe // Clip info probes in progress keyed by cache path
+	clipInfoMutex           sync.Mutex
+	ctx                     context.Context // Cancelled once in-flight clips have drained on shutdown, stops the recorders
+	cancel                  context.CancelFunc
+	acceptCtx               context.Context // Cancelled when shutdown begins, new clips are refused and schedules stop
+	stopAccepting           context.CancelFunc
+	recordersWG             sync.WaitGroup // Tracks background recording loops
+	clipsWG                 sync.WaitGroup // Tracks in-flight clip requests
+	metrics                 *Metrics
+	jobs                    map[string]*Job      // Clip jobs keyed by request ID
+	schedules               map[string]*Schedule // Active schedules keyed by schedule ID
+	schedulesMutex          sync.Mutex
+	schedulesWG             sync.WaitGroup // Tracks schedule loops
+	ffmpegPath              string         // FFmpeg binary from FFMPEG_PATH
+	ffprobePath             string         // ffprobe binary from FFPROBE_PATH
+	encoder                 string         // Video encoder used for compression (libx264 or a hardware encoder)
+	rtspTransport           string         // RTSP lower transport: tcp, udp, udp_multicast or http
+	segmentFormat           string         // Segment container from SEGMENT_FORMAT: mpegts or mp4 (fragmented)
+	apiKey                  string         // Required on protected endpoints when set
+	strictBacktrack         bool           // Reject requests that backtrack further than the buffer reaches
+	keepLocalClips          bool           // Archive every clip, not only requests with keep=true
+	archiveDir              string         // Where kept clips are stored
+	templatesDir            string         // Web interface templates from TEMPLATES_DIR
+	archiveMaxClips         int            // Prune the oldest archived clips beyond this count (0 = unlimited)
+	archiveMaxAge           time.Duration  // Prune archived clips older than this (0 = unlimited)
+	archiveMutex            sync.Mutex
+	apiKeyExempt            map[string]bool // Paths that skip the API key check
+	authTokens              map[string]*authToken // Single-use tokens for /ws and /api/preview keyed by token
+	authTokensMutex         sync.Mutex
+	jobsMutex               sync.RWMutex
+}
 
-    err := cmd.Run()
+func NewClipManager(tempDir string, hostPort string, cameraURLs map[string]string) (*ClipManager, error) {
+    if len(cameraURLs) == 0 {
+        return nil, fmt.Errorf("at least one camera must be configured")
+    }
+    if err := os.MkdirAll(tempDir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create temp directory %s: %v", tempDir, err)
+    }
+    absTemp, err := filepath.Abs(tempDir)
     if err != nil {
-        cm.log.Error("ffprobe failed: %v\nOutput: %s", err, out.String())
-        return false, err
+        return nil, fmt.Errorf("failed to resolve absolute path for %s: %v", tempDir, err)
+    }
+    if err := checkWritable(absTemp); err != nil {
+        return nil, fmt.Errorf("clips directory %v", err)
     }
 
-    var result struct {
-        Streams []interface{} `json:"streams"`
+    // Keep enough segments to cover the maximum backtrack window plus two segments of headroom
+    segmentDuration := getSegmentDuration()
+    maxBacktrackSeconds := getMaxBacktrackSeconds()
+    maxSegments := (maxBacktrackSeconds+segmentDuration-1)/segmentDuration + 2
+
+    ctx, cancel := context.WithCancel(context.Background())
+    acceptCtx, stopAccepting := context.WithCancel(ctx)
+    ffmpegPath := getFFmpegPath()
+    maxConcurrentClips := getMaxConcurrentClips()
+
+    // Every client shares one transport, which gives up quickly on hosts that can't be reached.
+    // Callbacks and webhooks go to URLs chosen by the caller and get one that refuses private addresses.
+    proxy := getOutboundProxy()
+    transport := newHTTPTransport(proxy)
+    targetGuard := NewTargetGuard(getAllowedPrivateNetworks(), proxy)
+    guardedTransport := newHTTPTransport(proxy)
+    guardedTransport.DialContext = targetGuard.DialContext
+    destinationTimeouts := getDestinationTimeouts()
+    httpClients := make(map[string]*http.Client, len(destinationTimeouts))
+    for destination, timeout := range destinationTimeouts {
+        httpClients[destination] = &http.Client{Transport: transport, Timeout: timeout}
+        if destination == "webhook" {
+            httpClients[destination].Transport = guardedTransport
+        }
     }
-    if err := json.Unmarshal(out.Bytes(), &result); err != nil {
-        cm.log.Error("Failed to parse ffprobe output: %v", err)
-        return false, err
+
+    config := RuntimeConfig{
+        Compression:     getCompressionSettings(),
+        FileSizeLimits:  getFileSizeLimits(),
+        RateLimit:       getRateLimit("RATE_LIMIT", defaultRateLimit),
+        RateBurst:       getRateBurst("RATE_BURST", defaultRateBurst),
+        GlobalRateLimit: getRateLimit("GLOBAL_RATE_LIMIT", defaultGlobalRateLimit),
+        GlobalRateBurst: getRateBurst("GLOBAL_RATE_BURST", defaultGlobalRateBurst),
+        MaxRetries:      defaultMaxRetries,
+        RetryDelay:      time.Duration(getEnvInt("RETRY_BASE_DELAY", defaultRetryBaseDelay)) * time.Second,
+        RetryFactor:     getRetryFactor(),
+        RetryMaxDelay:   time.Duration(getEnvInt("RETRY_MAX_DELAY", defaultRetryMaxDelay)) * time.Second,
     }
 
-    return len(result.Streams) > 0, nil
-}
+    cm := &ClipManager{
+        ctx:             ctx,
+        cancel:          cancel,
+        acceptCtx:       acceptCtx,
+        stopAccepting:   stopAccepting,
+        tempDir:         absTemp,
+        httpClient:      &http.Client{Transport: transport, Timeout: 60 * time.Second},
+        httpClients:     httpClients,
+        callbackClient:  &http.Client{Transport: guardedTransport},
+        targetGuard:     targetGuard,
+        destinationTimeouts: destinationTimeouts,
+        sftpConnectTimeout: time.Duration(getEnvInt("SFTP_CONNECT_TIMEOUT", defaultSFTPConnectTimeout)) * time.Second,
+        sftpVerifyChecksum: getEnvBool("SFTP_VERIFY_CHECKSUM"),
+        limiter:         rate.NewLimiter(rate.Limit(config.GlobalRateLimit), config.GlobalRateBurst),
+        ipLimiters:      NewIPRateLimiter(config.RateLimit, config.RateBurst),
+        hostPort:        hostPort,
+        config:          config,
+        cameras:         make(map[string]*Camera),
+        segmentDuration: segmentDuration,
+        maxBacktrackSeconds: maxBacktrackSeconds,
+        maxSegments:     maxSegments,
+        defaultBacktrackSeconds: getDefaultClipSeconds("DEFAULT_BACKTRACK_SECONDS", 0, float64(maxBacktrackSeconds)),
+        defaultDurationSeconds:  getDefaultClipSeconds("DEFAULT_DURATION_SECONDS", 0, maxClipDurationSeconds),
+        log:             NewLogger(),
+        metrics:         NewMetrics(),
+        jobs:            make(map[string]*Job),
+        schedules:       make(map[string]*Schedule),
+        ffmpegPath:      ffmpegPath,
+        ffprobePath:     getFFprobePath(),
+        encoder:         getEncoder(ffmpegPath),
+        rtspTransport:   getRTSPTransport(),
+        segmentFormat:   getSegmentFormat(),
+        apiKey:          os.Getenv("API_KEY"),
+        strictBacktrack: getEnvBool("STRICT_BACKTRACK"),
+        keepLocalClips:  getEnvBool("KEEP_LOCAL_CLIPS"),
+        archiveDir:      getArchiveDir(),
+        templatesDir:    getTemplatesDir(),
+        archiveMaxClips: getEnvInt("ARCHIVE_MAX_CLIPS", 0),
+        archiveMaxAge:   time.Duration(getEnvInt("ARCHIVE_MAX_AGE_DAYS", 0)) * 24 * time.Hour,
+        apiKeyExempt:    getAPIKeyExemptPaths(),
+        authTokens:      make(map[string]*authToken),
+        wsClients:       make(map[*websocket.Conn]*wsClient),
+        previews:        make(map[string]*previewStream),
+        previewDisabled: getEnvBool("DISABLE_PREVIEW"),
+        placeholder:     getPlaceholder(),
+        encodeSlots:     make(chan struct{}, getMaxConcurrentEncodes()),
+        clipSlots:       make(chan struct{}, maxConcurrentClips),
+        clipQueue:       make(chan struct{}, maxConcurrentClips+getEnvInt("CLIP_QUEUE_SIZE", defaultClipQueueSize)),
+        sftpKnownHosts:  os.Getenv("SFTP_KNOWN_HOSTS"),
+        sftpInsecure:    getEnvBool("SFTP_INSECURE"),
+        sftpKeyDir:      getSFTPKeyDir(),
+        sftpTrustOnFirstUse: getEnvBool("SFTP_TRUST_ON_FIRST_USE"),
+        sftpPool:        NewSFTPPool(time.Duration(getEnvInt("SFTP_IDLE_TIMEOUT", 300)) * time.Second),
+        maxBodyBytes:    int64(getEnvInt("MAX_BODY_SIZE_KB", defaultMaxBodySizeKB)) * 1024,
+        writeTimeout:    time.Duration(getEnvInt("HTTP_WRITE_TIMEOUT", defaultHTTPWriteTimeout)) * time.Second,
+        streamWriteTimeout: time.Duration(getEnvInt("STREAM_WRITE_TIMEOUT", defaultStreamWriteTimeout)) * time.Second,
+        streamTokens:    make(map[string]*streamToken),
+        streamTokenTTL:  getStreamTokenTTL(),
+        clipInfoProbes:  make(map[string]*clipInfoProbe),
+    }
+    go cm.sftpPool.expireIdle(ctx)
+    go cm.ipLimiters.expireIdle(ctx)
 
-// hasVideoStream checks if the RTSP stream contains a video stream
-func (cm *ClipManager) hasVideoStream(rtspURL string) (bool, error) {
-    cmd := exec.Command("ffprobe",
-        "-rtsp_transport", "tcp",
-        "-i", rtspURL,
-        "-show_streams",
-        "-select_streams", "v", // Select only video streams
-        "-print_format", "json",
-        "-v", "error",
-    )
+    cameraIDs := make([]string, 0, len(cameraURLs))
+    for id := range cameraURLs {
+        cameraIDs = append(cameraIDs, id)
+    }
+    sort.Strings(cameraIDs)
+
+    cleanMode := getCleanOnStart()
+    for _, id := range cameraIDs {
+        // Each camera records into its own subdirectory so segment names never collide
+        segmentDir := filepath.Join(absTemp, id)
+        if err := os.MkdirAll(segmentDir, 0755); err != nil {
+            return nil, fmt.Errorf("failed to create segment directory %s: %v", segmentDir, err)
+        }
 
-    var out bytes.Buffer
-    cmd.Stdout = &out
-    cmd.Stderr = &out // Capture errors as well
+        cam := &Camera{
+            ID:             id,
+            URL:            cameraURLs[id],
+            segmentDir:     segmentDir,
+            segmentPattern: filepath.Join(segmentDir, "segment_%03d"+segmentExtension(cm.segmentFormat)),
+            subscribers:    make(map[chan SegmentInfo]struct{}),
+            videoTrack:     getCameraTrack("VIDEO_TRACK", id),
+            audioTrack:     getCameraTrack("AUDIO_TRACK", id),
+        }
+        cm.cameras[id] = cam
 
-    err := cmd.Run()
-    if err != nil {
-        cm.log.Error("ffprobe failed to detect video: %v\nOutput: %s", err, out.String())
-        return false, err
-    }
+        // Remove files left behind by a previous run that the rewind buffer can't use anymore
+        cm.cleanSegmentDir(cam, cleanMode)
 
-    var result struct {
-        Streams []interface{} `json:"streams"`
+        // Restore the rewind buffer from segments left behind by a previous run
+        cm.rebuildSegmentIndex(cam)
     }
-    if err := json.Unmarshal(out.Bytes(), &result); err != nil {
-        cm.log.Error("Failed to parse ffprobe output for video detection: %v", err)
-        return false, err
+
+    // Requests without a camera_id use the camera from CAMERA_IP, or the first configured one
+    if _, ok := cm.cameras["default"]; ok {
+        cm.defaultCameraID = "default"
+    } else {
+        cm.defaultCameraID = cameraIDs[0]
     }
 
-    return len(result.Streams) > 0, nil
+    cm.metrics.registry.MustRegister(clipManagerCollector{cm: cm})
+
+    return cm, nil
 }
 
-func (cm *ClipManager) StartBackgroundRecording() {
-    if cm.recording {
-        cm.log.Warning("Background recording is already running")
-        return
+// getCamera returns the camera for the given ID, or the default camera when the ID is empty
+func (cm *ClipManager) getCamera(cameraID string) (*Camera, error) {
+    cameraID = strings.ToLower(strings.TrimSpace(cameraID))
+    if cameraID == "" {
+        cameraID = cm.defaultCameraID
     }
 
-    cm.recording = true
-    cm.recordingStartTime = time.Now()
-    cm.log.Info("Starting background recording with segments for backtracking capability at %s...", 
-        cm.recordingStartTime.Format("15:04:05"))
-
-    // Check if the stream has audio and video
-    hasAudio, audioErr := cm.hasAudioStream(cm.cameraIP)
-    hasVideo, videoErr := cm.hasVideoStream(cm.cameraIP)
-    
-    if audioErr != nil {
-        cm.log.Warning("Could not determine if stream has audio, assuming no audio: %v", audioErr)
-        hasAudio = false
+    cam, ok := cm.cameras[cameraID]
+    if !ok {
+        return nil, fmt.Errorf("unknown camera_id '%s'", cameraID)
     }
-    if videoErr != nil {
-        cm.log.Warning("Could not determine if stream has video, assuming no video: %v", videoErr)
-        hasVideo = false
-    }
-    
-    if hasAudio && hasVideo {
-        cm.log.Info("Both audio and video detected in stream")
-    } else if hasAudio {
-        cm.log.Info("Audio-only stream detected (no video)")
-    } else if hasVideo {
-        cm.log.Info("Video-only stream detected (no audio)")
-    } else {
-        cm.log.Warning("Neither audio nor video detected in stream. Recording might not work correctly.")
+    return cam, nil
+}
+
+// cleanSegmentDir removes segments, segment lists and concat lists left in the camera's segment
+// directory by a previous run. In stale mode only files older than the rewind window go, plus
+// concat lists, which no clip is using at startup; in all mode the buffer starts empty.
+func (cm *ClipManager) cleanSegmentDir(cam *Camera, mode string) {
+    if mode == "none" {
+        return
     }
 
-    go func() {
-        attempt := 1
-        cycle := 0
+    entries, err := os.ReadDir(cam.segmentDir)
+    if err != nil {
+        cm.log.Warning("[camera %s] Could not scan %s for stale files: %v", cam.ID, cam.segmentDir, err)
+        return
+    }
 
-        for {
-            availableSpace, err := cm.CheckDiskSpace()
-            if err != nil {
-                cm.log.Error("Error checking disk space: %v, continuing with recording", err)
-            } else {
-                availableSpaceMB := availableSpace / (1024 * 1024)
-                cm.log.Info("Available disk space: %d MB", availableSpaceMB)
-                if availableSpaceMB < 500 {
-                    cm.log.Warning("Low disk space (< 500MB), skipping recording cycle, retrying in 30 seconds...")
-                    time.Sleep(30 * time.Second)
-                    continue
-                }
-            }
+    cutoff := time.Now().Add(-time.Duration(cm.maxSegments*cm.segmentDuration) * time.Second)
+    removed := 0
+    var freed int64
+    for _, entry := range entries {
+        name := entry.Name()
+        if entry.IsDir() {
+            continue
+        }
 
-            segmentPattern := fmt.Sprintf("%s_cycle%d_%%03d.ts", strings.TrimSuffix(cm.segmentPattern, "_%03d.ts"), cycle)
-            segmentList := filepath.Join(cm.tempDir, fmt.Sprintf("segments_cycle%d.m3u8", cycle))
+        isConcatList := strings.HasPrefix(name, "concat_list_") && strings.HasSuffix(name, ".txt")
+        isSegmentList := strings.HasPrefix(name, "segments_cycle") && strings.HasSuffix(name, ".m3u8")
+        isSegment := strings.HasPrefix(name, "segment_cycle") && segmentCyclePattern.MatchString(name)
+        if !isConcatList && !isSegmentList && !isSegment {
+            continue
+        }
 
-            args := []string{
-                "-rtsp_transport", "tcp",
-                "-i", cm.cameraIP,
-                "-f", "segment",
-                "-segment_time", "5",
-                "-segment_format", "mpegts",
-                "-reset_timestamps", "1",
-                "-segment_list", segmentList,
-                "-segment_list_type", "m3u8",
-            }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
 
-            if hasVideo {
-                args = append(args, "-c:v", "copy")
-            } else if hasAudio {
-                args = append(args, "-f", "lavfi", "-i", "color=c=black:s=640x480:r=25")
-            }
-            if hasAudio {
-                args = append(args, "-c:a", "copy")
-            } else {
-                args = append(args, "-an")
-            }
+        // Segment lists are rewritten after every segment, so a stale list only names stale segments
+        stale := isConcatList || info.Size() == 0 || info.ModTime().Before(cutoff)
+        if mode != "all" && !stale {
+            continue
+        }
 
-            args = append(args, "-y", segmentPattern)
+        if err := os.Remove(filepath.Join(cam.segmentDir, name)); err != nil {
+            cm.log.Error("[camera %s] Failed to remove stale file %s: %v", cam.ID, name, err)
+            continue
+        }
+        cm.log.Debug("[camera %s] Removed stale file %s", cam.ID, name)
+        removed++
+        freed += info.Size()
+    }
 
-            logCmd := fmt.Sprintf("ffmpeg %s", strings.Join(args, " "))
-            cm.log.Debug("Segment recording FFmpeg command: %s", logCmd)
-
-            cmd := exec.Command("ffmpeg", args...)
-            stderr, err := cmd.StderrPipe()
-            if err != nil {
-                cm.log.Error("Error getting stderr pipe: %v", err)
-                time.Sleep(5 * time.Second)
-                continue
-            }
-
-            if err := cmd.Start(); err != nil {
-                cm.log.Error("Error starting FFmpeg: %v", err)
-                time.Sleep(5 * time.Second)
-                continue
-            }
-
-            go func(cycle int) {
-                scanner := bufio.NewScanner(stderr)
-                segmentRegex := regexp.MustCompile(fmt.Sprintf(`Opening '.*/(segment_cycle%d_\d+\.ts)' for writing`, cycle))
-
-                for scanner.Scan() {
-                    line := scanner.Text()
-                    matches := segmentRegex.FindStringSubmatch(line)
-                    if len(matches) > 1 {
-                        segmentFile := matches[1]
-                        creationTime := time.Now() // Time when FFmpeg creates the segment
-                        cm.log.Success("New segment created: %s at %s", segmentFile, creationTime.Format("15:04:05"))
-                        cm.addSegment(segmentFile, creationTime)
-                    }
-                }
-                if err := scanner.Err(); err != nil {
-                    cm.log.Error("Error reading FFmpeg stderr: %v", err)
-                }
-            }(cycle)
-
-            err = cmd.Wait()
-            if err != nil {
-                stderrBytes, _ := io.ReadAll(stderr)
-                errMsg := string(stderrBytes)
-                cm.log.Error("FFmpeg error: %v\nFFmpeg output: %s", err, errMsg)
-                if isConnectionError(errMsg) {
-                    cm.log.Warning("Camera disconnected, retrying connection (attempt %d)...", attempt)
-                    attempt++
-                    time.Sleep(10 * time.Second)
-                    continue
-                }
-                cm.log.Error("Background recording error: %v", err)
-                time.Sleep(5 * time.Second)
-                attempt++
-                continue
-            }
-
-            cm.log.Info("Background recording cycle completed, starting next cycle...")
-            attempt = 1
-            cycle++
-        }
-    }()
+    if removed > 0 {
+        cm.log.Info("[camera %s] Startup cleanup (%s) removed %d files from a previous run, freeing %.1f MB",
+            cam.ID, mode, removed, float64(freed)/(1024*1024))
+    }
 }
 
-func (cm *ClipManager) CheckDiskSpace() (uint64, error) {
-	var stat syscall.Statfs_t
-
-	err := syscall.Statfs(cm.tempDir, &stat)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get filesystem stats: %v", err)
-	}
+// rebuildSegmentIndex repopulates the camera's segment list from segment files already on disk
+func (cm *ClipManager) rebuildSegmentIndex(cam *Camera) {
+    entries, err := os.ReadDir(cam.segmentDir)
+    if err != nil {
+        cm.log.Warning("[camera %s] Could not scan %s for existing segments: %v", cam.ID, cam.segmentDir, err)
+        return
+    }
 
-	availableSpace := stat.Bavail * uint64(stat.Bsize)
-	return availableSpace, nil
-}
+    extension := segmentExtension(cm.segmentFormat)
+    durations := make(map[string]map[string]time.Duration) // Per cycle, read from its segment list
+    var segments []SegmentInfo
+    for _, entry := range entries {
+        matches := segmentCyclePattern.FindStringSubmatch(entry.Name())
+        if entry.IsDir() || matches == nil || !strings.HasPrefix(entry.Name(), "segment_cycle") {
+            continue
+        }
 
-func (cm *ClipManager) addSegment(segmentPath string, creationTime time.Time) {
-    cm.segmentsMutex.Lock()
-    defer cm.segmentsMutex.Unlock()
+        // Segments in the other format are left over from before SEGMENT_FORMAT changed and can't
+        // be joined with new ones
+        if filepath.Ext(entry.Name()) != extension {
+            cm.log.Info("[camera %s] Removing segment %s recorded in another SEGMENT_FORMAT", cam.ID, entry.Name())
+            os.Remove(filepath.Join(cam.segmentDir, entry.Name()))
+            continue
+        }
 
-    absolutePath := filepath.Join(cm.tempDir, segmentPath)
+        info, err := entry.Info()
+        if err != nil || info.Size() == 0 {
+            continue
+        }
 
-    // Parse segment number for logging
-    filenameRegex := regexp.MustCompile(`segment_cycle(\d+)_(\d+)\.ts$`)
-    matches := filenameRegex.FindStringSubmatch(segmentPath)
-    segmentNum := 0
-    if len(matches) == 3 {
-        segNum, err := strconv.Atoi(matches[2])
-        if err != nil {
-            cm.log.Warning("Failed to parse segment number from %s: %v, assuming 0", segmentPath, err)
-            segmentNum = 0
-        } else {
-            segmentNum = segNum
+        // New recordings must not reuse a cycle number, or FFmpeg would overwrite these segments
+        cycle, err := strconv.Atoi(matches[1])
+        if err == nil && cycle >= cam.nextCycle {
+            cam.nextCycle = cycle + 1
+        }
+        if _, ok := durations[matches[1]]; !ok {
+            durations[matches[1]] = readSegmentDurations(segmentListPath(cam.segmentDir, cycle))
         }
-    } else {
-        cm.log.Warning("Failed to parse cycle and segment numbers from %s, assuming segment 0", segmentPath)
-    }
 
-    // Timestamp is creationTime (einde segment) minus segmentDuration
-    timestamp := creationTime.Add(-time.Duration(cm.segmentDuration) * time.Second)
+        // The modification time is when FFmpeg finished writing, i.e. the end of the segment
+        duration := cm.segmentLength(durations[matches[1]], entry.Name())
+        segments = append(segments, SegmentInfo{
+            Path:      filepath.Join(cam.segmentDir, entry.Name()),
+            Timestamp: info.ModTime().Add(-duration),
+            Duration:  duration,
+        })
+    }
 
-    segmentInfo := SegmentInfo{
-        Path:      absolutePath,
-        Timestamp: timestamp,
+    if len(segments) == 0 {
+        return
     }
-    cm.segments = append(cm.segments, segmentInfo)
 
-    sort.Slice(cm.segments, func(i, j int) bool {
-        return cm.segments[i].Timestamp.Before(cm.segments[j].Timestamp)
+    sort.Slice(segments, func(i, j int) bool {
+        return segments[i].Timestamp.Before(segments[j].Timestamp)
     })
 
-    const maxSegments = 62
-    if len(cm.segments) > maxSegments {
-        for _, old := range cm.segments[:len(cm.segments)-maxSegments] {
+    if len(segments) > cm.maxSegments {
+        for _, old := range segments[:len(segments)-cm.maxSegments] {
             if err := os.Remove(old.Path); err != nil {
                 cm.log.Error("Failed to remove old segment %s: %v", old.Path, err)
-            } else {
-                cm.log.Info("Removed old segment: %s", filepath.Base(old.Path))
             }
         }
-        cm.segments = cm.segments[len(cm.segments)-maxSegments:]
+        segments = segments[len(segments)-cm.maxSegments:]
     }
 
-    // Modified to ensure the channel never blocks - if full, make room by removing old items
-    select {
-    case cm.segmentChan <- segmentInfo:
-        // Successfully sent
-    default:
-        // Channel full, remove oldest item and then send
-        select {
-        case <-cm.segmentChan:
-            cm.log.Debug("Removed oldest segment notification to make room for new one")
-        default:
-            // This shouldn't happen if the buffer is >0, but just in case
-        }
-        // Now try to send again
-        select {
-        case cm.segmentChan <- segmentInfo:
-            cm.log.Debug("Sent notification after making room")
-        default:
-            // This really shouldn't happen, but log it if it does
-            cm.log.Warning("Failed to send segment notification even after making room")
-        }
-    }
+    cam.segmentsMutex.Lock()
+    cam.segments = segments
+    cam.currentCycle = cam.nextCycle - 1
+    cam.segmentsMutex.Unlock()
 
-    cm.log.Info("Added segment: %s (seg %d) with timestamp %s, total: %d (up to %d seconds)",
-        segmentPath, segmentNum, segmentInfo.Timestamp.Format("15:04:05"), len(cm.segments), len(cm.segments)*cm.segmentDuration)
+    cm.log.Info("[camera %s] Restored %d segments from disk (%s to %s), next recording cycle: %d",
+        cam.ID, len(segments),
+        segments[0].Timestamp.Format("15:04:05"),
+        segments[len(segments)-1].Timestamp.Format("15:04:05"),
+        cam.nextCycle)
 }
 
-func (cm *ClipManager) getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height",
-		"-of", "json",
-		filePath)
+// subscribeSegments registers a channel that receives every segment added to the camera
+// from now on. Callers must release it with unsubscribeSegments.
+func (cm *ClipManager) subscribeSegments(cam *Camera) chan SegmentInfo {
+    ch := make(chan SegmentInfo, 16)
+    cam.segmentsMutex.Lock()
+    cam.subscribers[ch] = struct{}{}
+    cam.segmentsMutex.Unlock()
+    return ch
+}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffprobe failed to get video dimensions: %v", err)
-	}
+// unsubscribeSegments stops delivering segments to a channel from subscribeSegments
+func (cm *ClipManager) unsubscribeSegments(cam *Camera, ch chan SegmentInfo) {
+    cam.segmentsMutex.Lock()
+    delete(cam.subscribers, ch)
+    cam.segmentsMutex.Unlock()
+}
 
-	var result struct {
-		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-		} `json:"streams"`
-	}
+// RateLimit rejects requests beyond the client's own limit or the global ceiling with
+// 429 Too Many Requests and a Retry-After header. A request only uses up tokens when both
+// limits let it through.
+func (cm *ClipManager) RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		now := time.Now()
+		ipReservation, delay := reserveToken(cm.ipLimiters.get(ip), now)
+		if delay > 0 {
+			cm.log.Error("Rate limit exceeded for IP: %s", ip)
+		} else if _, delay = reserveToken(cm.limiter, now); delay > 0 {
+			// Give the client its token back, the request isn't served. Cancelling at the time
+			// of the reservation, as a reservation that is due already can't be cancelled.
+			ipReservation.CancelAt(now)
+			cm.log.Error("Global rate limit exceeded, rejecting request from IP: %s", ip)
+		}
 
-	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
-		return "", fmt.Errorf("failed to parse ffprobe output: %v", err)
+		if delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((delay+time.Second-1)/time.Second)))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
 	}
+}
 
-	if len(result.Streams) == 0 {
-		return "", fmt.Errorf("no video stream found in file")
+// reserveToken takes a token from limiter if one is available at now and returns its
+// reservation. Otherwise it takes nothing and returns how long until one is.
+func reserveToken(limiter *rate.Limiter, now time.Time) (*rate.Reservation, time.Duration) {
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return nil, time.Minute
 	}
-
-	width := result.Streams[0].Width
-	height := result.Streams[0].Height
-
-	if width == 0 || height == 0 {
-		return "", fmt.Errorf("invalid video dimensions: width=%d, height=%d", width, height)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+		return nil, delay
 	}
+	return reservation, 0
+}
 
-	gcd := func(a, b int) int {
-		for b != 0 {
-			a, b = b, a%b
-		}
-		return a
+// clientIP returns the IP address of the client without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	divisor := gcd(width, height)
-	aspectRatio := fmt.Sprintf("%d:%d", width/divisor, height/divisor)
+	return host
+}
+
+// ipLimiterIdle is how long a client's limiter is kept after its last request
+const ipLimiterIdle = 10 * time.Minute
 
-	return aspectRatio, nil
+// IPRateLimiter hands out a token bucket per client IP, so one busy client can't use up the
+// limit for everyone else. Limiters of clients that went quiet are evicted.
+type IPRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*ipLimiterEntry
+	limit    rate.Limit
+	burst    int
 }
 
-func (cm *ClipManager) RecordClip(backtrackSeconds, durationSeconds int, outputPath string, requestTime time.Time) error {
-    startTime := requestTime.Add(-time.Duration(backtrackSeconds) * time.Second)
-    endTime := startTime.Add(time.Duration(durationSeconds) * time.Second)
+type ipLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
 
-    cm.log.Info("📹 Requested clip from %s to %s", startTime.Format("15:04:05.000"), endTime.Format("15:04:05.000"))
+func NewIPRateLimiter(limit float64, burst int) *IPRateLimiter {
+	return &IPRateLimiter{
+		limiters: make(map[string]*ipLimiterEntry),
+		limit:    rate.Limit(limit),
+		burst:    burst,
+	}
+}
 
-    var neededSegments []SegmentInfo
-    cm.log.Info("Starting segment selection...")
-    
-    hasAudio, audioErr := cm.hasAudioStream(cm.cameraIP)
-    hasVideo, videoErr := cm.hasVideoStream(cm.cameraIP)
-    if audioErr != nil {
-        cm.log.Warning("Could not determine if stream has audio, assuming no audio: %v", audioErr)
-        hasAudio = false
-    }
-    if videoErr != nil {
-        cm.log.Warning("Could not determine if stream has video, assuming no video: %v", videoErr)
-        hasVideo = false
-    }
+// setLimit changes the limit of every client, including those that already have a limiter
+func (l *IPRateLimiter) setLimit(limit float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-    for {
-        cm.segmentsMutex.RLock()
-        segments := make([]SegmentInfo, len(cm.segments))
-        copy(segments, cm.segments)
-        cm.segmentsMutex.RUnlock()
-        cm.log.Info("Copied %d segments", len(segments))
+	l.limit = rate.Limit(limit)
+	l.burst = burst
+	for _, entry := range l.limiters {
+		entry.limiter.SetLimit(l.limit)
+		entry.limiter.SetBurst(burst)
+	}
+}
 
-        if len(segments) == 0 {
-            cm.log.Warning("No segments available, waiting for first segment...")
-            select {
-            case newSegment := <-cm.segmentChan:
-                cm.log.Info("📼 Received first segment: %s at %s", filepath.Base(newSegment.Path), newSegment.Timestamp.Format("15:04:05.000"))
-                continue
-            case <-time.After(10 * time.Second):
-                return fmt.Errorf("timeout waiting for first segment")
-            }
-        }
+// get returns the limiter for ip, creating it on first use
+func (l *IPRateLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-        neededSegments = []SegmentInfo{}
-        earliestTime := segments[0].Timestamp
-        latestTime := segments[len(segments)-1].Timestamp
-        latestSegmentEnd := latestTime.Add(time.Duration(cm.segmentDuration) * time.Second)
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
 
-        cm.log.Info("Segment range: %s to %s (end: %s)", 
-            earliestTime.Format("15:04:05.000"), 
-            latestTime.Format("15:04:05.000"),
-            latestSegmentEnd.Format("15:04:05.000"))
+// expireIdle evicts limiters of clients that haven't made a request for ipLimiterIdle until ctx is cancelled
+func (l *IPRateLimiter) expireIdle(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 
-        if startTime.Before(earliestTime) {
-            cm.log.Warning("Requested start time %s is before earliest segment at %s, adjusting", 
-                startTime.Format("15:04:05.000"), earliestTime.Format("15:04:05.000"))
-            startTime = earliestTime
-            endTime = startTime.Add(time.Duration(durationSeconds) * time.Second)
-        }
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-        // Wacht alleen als we te weinig dekking hebben
-        if endTime.After(latestSegmentEnd) && latestSegmentEnd.Before(startTime.Add(time.Duration(durationSeconds/2)*time.Second)) {
-            cm.log.Info("⏳ End time %s is after latest segment end %s, waiting for more segments...", 
-                endTime.Format("15:04:05.000"), latestSegmentEnd.Format("15:04:05.000"))
-            select {
-            case newSegment := <-cm.segmentChan:
-                cm.log.Info("📼 Received new segment: %s at %s", 
-                    filepath.Base(newSegment.Path), newSegment.Timestamp.Format("15:04:05.000"))
-                continue
-            case <-time.After(5 * time.Second):
-                cm.log.Warning("Timeout waiting for segments, checking available segments")
-                // Ga verder als we enige overlap hebben
-                break
-            }
-        }
+		l.mu.Lock()
+		for ip, entry := range l.limiters {
+			if time.Since(entry.lastSeen) > ipLimiterIdle {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
 
-        for _, segment := range segments {
-            segmentStart := segment.Timestamp
-            segmentEnd := segmentStart.Add(time.Duration(cm.segmentDuration) * time.Second)
-            if segmentEnd.After(startTime) && segmentStart.Before(endTime) {
-                neededSegments = append(neededSegments, segment)
-                cm.log.Debug("Selected segment: %s (%s to %s)", 
-                    filepath.Base(segment.Path), 
-                    segmentStart.Format("15:04:05.000"), 
-                    segmentEnd.Format("15:04:05.000"))
-            }
-        }
+// LimitRequestBody caps every request body at maxBodyBytes, reading past it fails with an
+// *http.MaxBytesError that handlers report as 413 through bodyErrorStatus
+func (cm *ClipManager) LimitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cm.maxBodyBytes > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, cm.maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-        if len(neededSegments) > 0 {
-            sort.Slice(neededSegments, func(i, j int) bool {
-                return neededSegments[i].Timestamp.Before(neededSegments[j].Timestamp)
-            })
-            firstSegmentStart := neededSegments[0].Timestamp
-            lastSegmentEnd := neededSegments[len(neededSegments)-1].Timestamp.Add(time.Duration(cm.segmentDuration) * time.Second)
+// GzipJSON compresses JSON responses for clients that accept gzip. Other responses, such as
+// errors, video and images, which are compressed already, pass through unchanged.
+func GzipJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
 
-            cm.log.Info("Selected %d segments, range: %s to %s", 
-                len(neededSegments), 
-                firstSegmentStart.Format("15:04:05.000"), 
-                lastSegmentEnd.Format("15:04:05.000"))
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next(gw, r)
+	}
+}
 
-            // Accepteer als we enige overlap hebben, zelfs als niet volledig gedekt
-            if firstSegmentStart.Before(endTime) && lastSegmentEnd.After(startTime) {
-                cm.log.Info("Partial overlap found, proceeding with available segments")
-                break
-            }
-            cm.log.Warning("No sufficient overlap, waiting for more segments...")
-        }
+// acceptsGzip reports whether the request's Accept-Encoding allows a gzip response
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := 1.0
+		if name, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+			q, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		}
+		return q > 0
+	}
+	return false
+}
 
-        select {
-        case newSegment := <-cm.segmentChan:
-            cm.log.Info("📼 Received new segment: %s at %s", 
-                filepath.Base(newSegment.Path), newSegment.Timestamp.Format("15:04:05.000"))
-            continue
-        case <-time.After(5 * time.Second):
-            if len(neededSegments) > 0 {
-                cm.log.Warning("Timeout waiting for full coverage, using partial segments")
-                break
-            }
-            return fmt.Errorf("timeout waiting for overlapping segments")
-        }
-    }
+// gzipResponseWriter decides on the first write whether to compress, based on the Content-Type
+// the handler has set by then
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
 
-    cm.log.Success("Selected %d segments for clip", len(neededSegments))
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	isJSON := strings.HasPrefix(header.Get("Content-Type"), "application/json")
+	if isJSON && header.Get("Content-Encoding") == "" && status != http.StatusNoContent && status != http.StatusNotModified {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
 
-    concatListPath := filepath.Join(cm.tempDir, "concat_list.txt")
-    concatFile, err := os.Create(concatListPath)
-    if err != nil {
-        return fmt.Errorf("failed to create concat list: %v", err)
-    }
-    defer os.Remove(concatListPath)
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
 
-    for _, segment := range neededSegments {
-        fmt.Fprintf(concatFile, "file '%s'\n", segment.Path)
-    }
-    concatFile.Close()
+// Flush sends what has been compressed so far, so long running handlers can stream progress
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
 
-    firstSegmentStart := neededSegments[0].Timestamp
-    startOffset := startTime.Sub(firstSegmentStart).Seconds()
-    if startOffset < 0 {
-        startOffset = 0
-    }
-    totalDuration := endTime.Sub(startTime).Seconds()
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend the write deadline
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
 
-    args := []string{
-        "-f", "concat",
-        "-safe", "0",
-        "-i", concatListPath,
-        "-ss", fmt.Sprintf("%.3f", startOffset),
-        "-t", fmt.Sprintf("%.3f", totalDuration),
-    }
+// Close writes the end of the gzip stream
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
 
-    if hasVideo {
-        args = append(args, "-c:v", "copy")
-    } else if hasAudio {
-        args = append(args, "-f", "lavfi", "-i", "color=c=black:s=640x480:r=25:d="+fmt.Sprintf("%.3f", totalDuration))
-    }
-    if hasAudio {
-        args = append(args, "-c:a", "copy")
-    } else {
-        args = append(args, "-an")
-    }
+// bodyErrorStatus is the status for a request body that couldn't be read or decoded: 413 when it
+// was over the size limit, 400 otherwise
+func bodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
 
-    args = append(args, "-movflags", "+faststart", "-y", outputPath)
+// extendWriteDeadline replaces the server's write timeout for a handler that legitimately writes
+// for longer. A zero timeout removes the deadline.
+func extendWriteDeadline(w http.ResponseWriter, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	http.NewResponseController(w).SetWriteDeadline(deadline)
+}
 
-    cm.log.Debug("Clip extraction FFmpeg command: ffmpeg %s", strings.Join(args, " "))
-    cmd := exec.Command("ffmpeg", args...)
-    var stderr bytes.Buffer
-    cmd.Stderr = &stderr
-    err = cmd.Run()
-    if err != nil {
-        return fmt.Errorf("failed to extract clip: %v\nFFmpeg output: %s", err, stderr.String())
-    }
+// RequireAPIKey rejects requests without a valid API key when API_KEY is set. The key is accepted
+// as "Authorization: Bearer <key>" or an X-API-Key header, never in the URL where it would end up
+// in logs and browser history. WebSockets and the preview image can't set headers, so /ws and
+// /api/preview also accept a single-use token from HandleAuthToken as the token parameter.
+func (cm *ClipManager) RequireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cm.apiKey == "" || cm.apiKeyExempt[r.URL.Path] {
+			next(w, r)
+			return
+		}
 
-    extractedDuration, err := cm.verifyClipDuration(outputPath)
-    if err != nil {
-        os.Remove(outputPath)
-        return err
-    }
+		key := r.Header.Get("X-API-Key")
+		if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
 
-    cm.log.Success("Successfully extracted clip with duration %.2f seconds", extractedDuration)
-    return nil
+		if subtle.ConstantTimeCompare([]byte(key), []byte(cm.apiKey)) != 1 &&
+			!(key == "" && cm.consumeAuthToken(r.URL.Query().Get("token"), r.URL.Path)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ClipManager"`)
+			http.Error(w, "Missing or invalid API key", http.StatusUnauthorized)
+			cm.log.Warning("Rejected request to %s from %s: missing or invalid API key", r.URL.Path, r.RemoteAddr)
+			return
+		}
+		next(w, r)
+	}
 }
 
-func (cm *ClipManager) verifyClipDuration(filePath string) (float64, error) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		filePath)
+// authToken lets a client that can't set headers open one connection to Path without the API key
+type authToken struct {
+	Path    string
+	Expires time.Time
+}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
+// authTokenPaths are the endpoints browsers open without being able to set headers
+var authTokenPaths = map[string]bool{"/ws": true, "/api/preview": true}
 
-	if err := cmd.Run(); err != nil {
-		return 0, fmt.Errorf("verification failed: ffprobe could not analyze clip: %v", err)
+// HandleAuthToken mints a single-use token for one of authTokenPaths. It sits behind the API key,
+// so only a client holding the key can get one, and the key itself never appears in a URL.
+func (cm *ClipManager) HandleAuthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return
 	}
 
-	durationStr := strings.TrimSpace(out.String())
-	duration, err := strconv.ParseFloat(durationStr, 64)
-	if err != nil {
-		return 0, fmt.Errorf("verification failed: could not parse clip duration: %v", err)
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", bodyErrorStatus(err))
+		return
+	}
+	if !authTokenPaths[req.Path] {
+		http.Error(w, "Invalid path: tokens are only issued for /ws and /api/preview", http.StatusBadRequest)
+		return
 	}
 
-	if duration < 0.5 {
-		return duration, fmt.Errorf("verification failed: clip duration too short (%.2f seconds)", duration)
+	id, err := newStreamTokenID()
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		cm.log.Error("Failed to create auth token: %v", err)
+		return
 	}
+	now := time.Now()
+	expires := now.Add(authTokenTTL)
+	cm.authTokensMutex.Lock()
+	for unused, token := range cm.authTokens {
+		if now.After(token.Expires) {
+			delete(cm.authTokens, unused)
+		}
+	}
+	cm.authTokens[id] = &authToken{Path: req.Path, Expires: expires}
+	cm.authTokensMutex.Unlock()
 
-	return duration, nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      id,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
 }
 
-func isConnectionError(errMsg string) bool {
-	connectionErrors := []string{
-		"connection refused",
-		"Connection refused",
-		"no route to host",
-		"No route to host",
-		"network is unreachable",
-		"Network is unreachable",
-		"connection timed out",
-		"Connection timed out",
-		"failed to connect",
-		"EOF",
-		"timeout",
-		"Timeout",
+// consumeAuthToken reports whether id is an unexpired token minted for path, and invalidates it
+func (cm *ClipManager) consumeAuthToken(id, path string) bool {
+	if id == "" {
+		return false
 	}
+	cm.authTokensMutex.Lock()
+	defer cm.authTokensMutex.Unlock()
 
-	for _, connErr := range connectionErrors {
-		if strings.Contains(errMsg, connErr) {
-			return true
-		}
+	token, ok := cm.authTokens[id]
+	if !ok || token.Path != path {
+		return false
 	}
+	delete(cm.authTokens, id)
+	return time.Now().Before(token.Expires)
+}
 
-	return false
+func (cm *ClipManager) HandleClipRequest(w http.ResponseWriter, r *http.Request) {
+    startTime := time.Now()
+    requestID := fmt.Sprintf("req_%d", time.Now().UnixNano())
+
+    if r.Method != http.MethodGet && r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use GET or POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if cm.acceptCtx.Err() != nil {
+        http.Error(w, "ClipManager is shutting down", http.StatusServiceUnavailable)
+        return
+    }
+
+    req, err := cm.parseClipRequest(r)
+    if err != nil {
+        http.Error(w, err.Error(), bodyErrorStatus(err))
+        return
+    }
+    if err := cm.validateRequest(req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    req.RequestID = requestID
+    cam := cm.cameras[req.CameraID]
+
+    // A dry run is for checking the camera setup, so report the clip instead of returning early
+    wait := req.Wait || req.DryRun
+
+    extension, _ := clipExtension(req.OutputFormat, req.Container)
+
+    // RecordClip starts at the earliest segment when the buffer doesn't reach back far enough,
+    // so tell the caller up front (or refuse when STRICT_BACKTRACK is set)
+    var coverage *BacktrackCoverage
+    var warning string
+    if available := cm.bufferedSeconds(cam, startTime); req.BacktrackSeconds > float64(available) {
+        coverage = &BacktrackCoverage{RequestedSeconds: req.BacktrackSeconds, AvailableSeconds: available}
+        warning = fmt.Sprintf("Requested %g seconds of backtrack but only %d seconds are buffered", req.BacktrackSeconds, available)
+        if cm.strictBacktrack {
+            http.Error(w, warning, http.StatusBadRequest)
+            return
+        }
+    }
+
+    // Admit the request to the clip queue, or turn it away when the queue is full so a flood of
+    // triggers can't start more FFmpeg work than the machine can take
+    select {
+    case cm.clipQueue <- struct{}{}:
+    default:
+        processing, queued := cm.clipQueueDepth()
+        cm.metrics.IncClipsRejected()
+        cm.log.Warning("[%s] Rejected clip request: %d clips processing and %d queued", requestID, processing, queued)
+        http.Error(w, fmt.Sprintf("Too many clip requests: %d clips are being processed and %d are queued, try again later", processing, queued), http.StatusServiceUnavailable)
+        return
+    }
+
+    cm.metrics.IncClipsRequested()
+    cm.createJob(requestID, cam.ID)
+    logger := cm.log.With("[%s] [camera %s]", requestID, cam.ID)
+    if warning != "" {
+        logger.Warning("%s, the clip will start at the earliest buffered segment", warning)
+    }
+
+    fileName := fmt.Sprintf("clip_%s_%d%s", cam.ID, time.Now().Unix(), extension)
+    filePath := filepath.Join(cm.tempDir, fileName)
+
+    if !wait {
+        response := ClipResponse{Message: "Clip recording and sending started", RequestID: requestID, Warning: warning, Backtrack: coverage}
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(response)
+    }
+
+    results := make(chan ClipResult, 1)
+
+    cm.clipsWG.Add(1)
+    go func() {
+        defer cm.clipsWG.Done()
+        defer func() { <-cm.clipQueue }()
+        defer func() {
+            processingTime := time.Since(startTime)
+            logger.Info("Total processing time: %v", processingTime)
+        }()
+
+        release := cm.acquireClipSlot(logger, requestID)
+        defer release()
+        results <- cm.processClip(logger, cam, filePath, startTime, req)
+    }()
+
+    if !wait {
+        return
+    }
+
+    timeout := clipWaitTimeout + secondsDuration(req.DurationSeconds)
+    if cm.writeTimeout > 0 {
+        extendWriteDeadline(w, timeout+cm.writeTimeout)
+    }
+    var result ClipResult
+    select {
+    case result = <-results:
+    case <-time.After(timeout):
+        logger.Warning("Clip did not finish within %v, it keeps processing in the background", timeout)
+        http.Error(w, fmt.Sprintf("Clip did not finish within %v, it is still being processed as %s", timeout, requestID), http.StatusGatewayTimeout)
+        return
+    }
+
+    status := http.StatusOK
+    message := "Clip recorded and sent"
+    if result.DryRun {
+        message = "Dry run: clip recorded but not sent"
+    }
+    if !result.Success {
+        status = http.StatusBadGateway
+        message = "Clip could not be recorded or sent to every destination"
+        if len(result.Destinations) == 0 {
+            status = http.StatusInternalServerError
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(ClipResponse{Message: message, RequestID: requestID, Warning: warning, Backtrack: coverage, Result: &result})
 }
 
-func (cm *ClipManager) PrepareClipForChatApp(originalFilePath, chatApp string) (string, error) {
-	fileSizeLimits := map[string]float64{
-		"discord":    10.0,
-		"telegram":   50.0,
-		"mattermost": 100.0,
-		"sftp":       10000.0, // High value to avoid compression for SFTP
-	}
+// parseClipRequest reads the clip parameters once: the JSON body of a POST request, with any query
+// parameters taking precedence, so downstream code never has to look at the request again
+func (cm *ClipManager) parseClipRequest(r *http.Request) (*ClipRequest, error) {
+    req := cm.newClipRequest()
+    if err := decodeRequest(r, req); err != nil {
+        return nil, err
+    }
+    return req, nil
+}
 
-	const maxCRF = 40
-	const initialCRF = 23
-	const crfStep = 5
+// newClipRequest returns a request holding the DEFAULT_BACKTRACK_SECONDS and DEFAULT_DURATION_SECONDS
+// defaults, which decoding only overwrites with parameters the request actually has. That way a
+// request can still ask for a backtrack of 0 explicitly.
+func (cm *ClipManager) newClipRequest() *ClipRequest {
+    return &ClipRequest{
+        BacktrackSeconds: cm.defaultBacktrackSeconds,
+        DurationSeconds:  cm.defaultDurationSeconds,
+    }
+}
 
-	targetSizeMB, exists := fileSizeLimits[chatApp]
-	if !exists {
-		return "", fmt.Errorf("unknown chat app: %s", chatApp)
-	}
+// decodeRequest fills target from the JSON body of a POST request and then from the query string
+func decodeRequest(r *http.Request, target interface{}) error {
+    if r.Method == http.MethodPost && r.Body != nil {
+        body, err := io.ReadAll(r.Body)
+        if err != nil {
+            return fmt.Errorf("could not read request body: %w", err)
+        }
+        if len(bytes.TrimSpace(body)) > 0 {
+            if err := json.Unmarshal(body, target); err != nil {
+                return fmt.Errorf("invalid JSON body: %v", err)
+            }
+        }
+    }
 
-	fileInfo, err := os.Stat(originalFilePath)
-	if err != nil {
-		return "", fmt.Errorf("could not access the clip file: %v", err)
-	}
+    return applyQueryParams(reflect.ValueOf(target).Elem(), r.URL.Query())
+}
 
-	fileSizeMB := float64(fileInfo.Size()) / 1024 / 1024
-	cm.log.Info("📏 Original file size for %s: %.2f MB (limit: %.2f MB)", chatApp, fileSizeMB, targetSizeMB)
+// applyQueryParams sets the struct fields whose JSON name appears in the query string,
+// including those of embedded structs
+func applyQueryParams(v reflect.Value, query url.Values) error {
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        if t.Field(i).Anonymous && v.Field(i).Kind() == reflect.Struct {
+            if err := applyQueryParams(v.Field(i), query); err != nil {
+                return err
+            }
+            continue
+        }
 
-	if fileSizeMB <= targetSizeMB {
-		cm.log.Success("File size is under the limit for %s, using original file", chatApp)
-		return originalFilePath, nil
-	}
+        name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+        if name == "" || name == "-" || !query.Has(name) {
+            continue
+        }
+        value := query.Get(name)
+
+        field := v.Field(i)
+        switch field.Kind() {
+        case reflect.String:
+            field.SetString(value)
+        case reflect.Int:
+            parsed, err := strconv.Atoi(value)
+            if err != nil {
+                return fmt.Errorf("invalid %s: must be a whole number", name)
+            }
+            field.SetInt(int64(parsed))
+        case reflect.Float64:
+            // ParseFloat also accepts NaN and Inf, which would slip through every range check
+            parsed, err := strconv.ParseFloat(value, 64)
+            if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+                return fmt.Errorf("invalid %s: must be a number", name)
+            }
+            field.SetFloat(parsed)
+        case reflect.Bool:
+            field.SetBool(value == "true")
+        case reflect.Ptr:
+            if field.Type().Elem().Kind() != reflect.Int {
+                continue
+            }
+            parsed, err := strconv.Atoi(value)
+            if err != nil {
+                return fmt.Errorf("invalid %s: must be a whole number", name)
+            }
+            field.Set(reflect.ValueOf(&parsed))
+        }
+    }
+    return nil
+}
 
-	duration, err := cm.verifyClipDuration(originalFilePath)
-	if err != nil {
-		return "", fmt.Errorf("could not verify clip duration: %v", err)
+// secondsDuration converts a possibly fractional number of seconds to a time.Duration
+func secondsDuration(s float64) time.Duration {
+    return time.Duration(s * float64(time.Second))
+}
+
+// bufferedSeconds returns how many whole seconds before now the camera's oldest segment starts
+func (cm *ClipManager) bufferedSeconds(cam *Camera, now time.Time) int {
+    cam.segmentsMutex.RLock()
+    defer cam.segmentsMutex.RUnlock()
+
+    if len(cam.segments) == 0 {
+        return 0
+    }
+    return int(now.Sub(cam.segments[0].Timestamp).Seconds())
+}
+
+// createJob registers a pending job and drops jobs older than jobRetention
+func (cm *ClipManager) createJob(id, cameraID string) {
+    now := time.Now()
+
+    cm.jobsMutex.Lock()
+    defer cm.jobsMutex.Unlock()
+
+    for jobID, job := range cm.jobs {
+        if now.Sub(job.CreatedAt) > jobRetention {
+            delete(cm.jobs, jobID)
+        }
+    }
+
+    cm.jobs[id] = &Job{
+        ID:        id,
+        CameraID:  cameraID,
+        Status:    JobPending,
+        CreatedAt: now,
+        UpdatedAt: now,
+        Phases:    map[string]time.Time{JobPending: now},
+    }
+}
+
+// updateJob moves a job to a new phase, recording the error or final result when given
+func (cm *ClipManager) updateJob(id, status, errMsg string, result *ClipResult) {
+    now := time.Now()
+
+    cm.jobsMutex.Lock()
+    defer cm.jobsMutex.Unlock()
+
+    job, ok := cm.jobs[id]
+    if !ok {
+        return
+    }
+    job.Status = status
+    job.Error = errMsg
+    job.UpdatedAt = now
+    job.Phases[status] = now
+    if result != nil {
+        job.Result = result
+    }
+}
+
+// HandleClipStatus returns the state of a clip job by its request ID
+func (cm *ClipManager) HandleClipStatus(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id := r.URL.Query().Get("id")
+    if id == "" {
+        http.Error(w, "Missing required parameter: id", http.StatusBadRequest)
+        return
+    }
+
+    cm.jobsMutex.RLock()
+    defer cm.jobsMutex.RUnlock()
+
+    job, ok := cm.jobs[id]
+    if !ok || time.Since(job.CreatedAt) > jobRetention {
+        http.Error(w, fmt.Sprintf("Unknown job: %s", id), http.StatusNotFound)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(job)
+}
+
+// HandleCreateSchedule starts capturing a clip every interval_seconds with the given clip parameters
+func (cm *ClipManager) HandleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if cm.acceptCtx.Err() != nil {
+        http.Error(w, "ClipManager is shutting down", http.StatusServiceUnavailable)
+        return
+    }
+
+    req := ScheduleRequest{ClipRequest: *cm.newClipRequest()}
+    if err := decodeRequest(r, &req); err != nil {
+        http.Error(w, err.Error(), bodyErrorStatus(err))
+        return
+    }
+    if err := cm.validateRequest(&req.ClipRequest); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    sched, err := newSchedule(&req, time.Now())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    ctx, cancel := context.WithCancel(cm.acceptCtx)
+    sched.cancel = cancel
+
+    cm.schedulesMutex.Lock()
+    cm.schedules[sched.ID] = sched
+    snapshot := *sched
+    cm.schedulesMutex.Unlock()
+
+    cm.schedulesWG.Add(1)
+    go cm.runSchedule(ctx, sched)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(snapshot)
+}
+
+// newSchedule checks the cadence of a schedule request and builds the schedule from it
+func newSchedule(req *ScheduleRequest, now time.Time) (*Schedule, error) {
+    if req.IntervalSeconds < minScheduleInterval {
+        return nil, fmt.Errorf("invalid interval_seconds: must be at least %d", minScheduleInterval)
+    }
+
+    start := now
+    if req.StartTime != "" {
+        parsed, err := time.Parse(time.RFC3339, req.StartTime)
+        if err != nil {
+            return nil, fmt.Errorf("invalid start_time: %v", err)
+        }
+        if parsed.After(now) {
+            start = parsed
+        }
+    }
+
+    var end *time.Time
+    switch {
+    case req.EndTime != "" && req.WindowSeconds != 0:
+        return nil, fmt.Errorf("use either end_time or window_seconds, not both")
+    case req.EndTime != "":
+        parsed, err := time.Parse(time.RFC3339, req.EndTime)
+        if err != nil {
+            return nil, fmt.Errorf("invalid end_time: %v", err)
+        }
+        end = &parsed
+    case req.WindowSeconds < 0:
+        return nil, fmt.Errorf("invalid window_seconds: must be greater than 0")
+    case req.WindowSeconds > 0:
+        parsed := start.Add(time.Duration(req.WindowSeconds) * time.Second)
+        end = &parsed
+    }
+    if end != nil && !end.After(start) {
+        return nil, fmt.Errorf("invalid end_time: must be after the start of the schedule")
+    }
+
+    clipReq := req.ClipRequest
+    return &Schedule{
+        ID:               fmt.Sprintf("sched_%d", now.UnixNano()),
+        CameraID:         clipReq.CameraID,
+        ChatApps:         clipReq.ChatApps,
+        IntervalSeconds:  req.IntervalSeconds,
+        BacktrackSeconds: clipReq.BacktrackSeconds,
+        DurationSeconds:  clipReq.DurationSeconds,
+        Title:            clipReq.Title,
+        Category:         clipReq.Category,
+        Team1:            clipReq.Team1,
+        Team2:            clipReq.Team2,
+        StartTime:        start,
+        EndTime:          end,
+        NextCapture:      start,
+        request:          &clipReq,
+    }, nil
+}
+
+// runSchedule captures clips on the schedule's cadence until it ends, is cancelled or ClipManager
+// shuts down. Captures run one at a time, so a slot that arrives while the previous clip is still
+// being sent is skipped rather than started alongside it.
+func (cm *ClipManager) runSchedule(ctx context.Context, sched *Schedule) {
+    defer cm.schedulesWG.Done()
+    defer func() {
+        cm.schedulesMutex.Lock()
+        delete(cm.schedules, sched.ID)
+        cm.schedulesMutex.Unlock()
+    }()
+
+    logger := cm.log.With("[%s] [camera %s]", sched.ID, sched.CameraID)
+    cam := cm.cameras[sched.CameraID]
+    interval := time.Duration(sched.IntervalSeconds) * time.Second
+    logger.Info("Capturing a %g-second clip every %v starting %s", sched.DurationSeconds, interval, sched.StartTime.Format(time.RFC3339))
+
+    next := sched.StartTime
+    for {
+        if sched.EndTime != nil && next.After(*sched.EndTime) {
+            logger.Info("Schedule finished after %d captures", sched.Captures)
+            return
+        }
+        if !sleepContext(ctx, time.Until(next)) || ctx.Err() != nil {
+            logger.Info("Schedule stopped after %d captures", sched.Captures)
+            return
+        }
+
+        requestID, captured := cm.captureScheduledClip(logger, cam, sched.request)
+
+        next = next.Add(interval)
+        skipped := 0
+        if !captured {
+            skipped++
+        }
+        for now := time.Now(); next.Before(now); next = next.Add(interval) {
+            skipped++
+        }
+        if skipped > 0 {
+            logger.Warning("Capture took longer than the interval, skipping %d slot(s)", skipped)
+        }
+
+        cm.schedulesMutex.Lock()
+        if captured {
+            sched.Captures++
+            sched.LastRequestID = requestID
+        }
+        sched.Skipped += skipped
+        sched.NextCapture = next
+        cm.schedulesMutex.Unlock()
+    }
+}
+
+// captureScheduledClip records and sends one clip for a schedule like a regular clip request,
+// returning the request ID it ran under. It goes through the clip queue and slots like
+// HandleClipRequest; when the queue is full the capture is skipped and false is returned.
+func (cm *ClipManager) captureScheduledClip(logger *Logger, cam *Camera, template *ClipRequest) (string, bool) {
+	startTime := time.Now()
+	req := *template
+	req.RequestID = fmt.Sprintf("req_%d", startTime.UnixNano())
+
+	select {
+	case cm.clipQueue <- struct{}{}:
+	default:
+		processing, queued := cm.clipQueueDepth()
+		cm.metrics.IncClipsRejected()
+		logger.Warning("Skipping scheduled capture: %d clips processing and %d queued", processing, queued)
+		return "", false
 	}
-	cm.log.Info("⏱️ Clip duration for %s: %.2f seconds", chatApp, duration)
+	defer func() { <-cm.clipQueue }()
 
-	aspectRatio, err := cm.getVideoAspectRatio(originalFilePath)
-	if err != nil {
-		cm.log.Warning("Warning: Could not determine aspect ratio for compression: %v", err)
-		aspectRatio = "16:9"
+	cm.clipsWG.Add(1)
+	defer cm.clipsWG.Done()
+
+	cm.metrics.IncClipsRequested()
+	cm.createJob(req.RequestID, cam.ID)
+	requestLogger := logger.With("[%s]", req.RequestID)
+	release := cm.acquireClipSlot(requestLogger, req.RequestID)
+	defer release()
+
+	extension, _ := clipExtension(req.OutputFormat, req.Container)
+	filePath := filepath.Join(cm.tempDir, fmt.Sprintf("clip_%s_%d%s", cam.ID, startTime.Unix(), extension))
+
+	result := cm.processClip(requestLogger, cam, filePath, startTime, &req)
+	if !result.Success {
+		logger.Warning("Scheduled capture %s failed: %s", req.RequestID, result.Error)
 	}
-	cm.log.Info("📏 Using aspect ratio for compression: %s", aspectRatio)
+	return req.RequestID, true
+}
 
-	crf := initialCRF
-	compressedFilePath := filepath.Join(filepath.Dir(originalFilePath), fmt.Sprintf("compressed_%s_%s", chatApp, filepath.Base(originalFilePath)))
+// HandleListSchedules returns the active schedules
+func (cm *ClipManager) HandleListSchedules(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+        return
+    }
 
-	for crf <= maxCRF {
-		cm.log.Info("🔧 Compressing for %s with CRF %d", chatApp, crf)
-
-		args := []string{
-			"-i", originalFilePath,
-			"-vf", "scale='min(1280,iw)':-2",
-			"-c:v", "libx264",
-			"-crf", strconv.Itoa(crf),
-			"-preset", "medium",
-			"-c:a", "aac",
-			"-b:a", "96k",
-			"-movflags", "+faststart",
-			"-aspect", aspectRatio,
-			"-y",
-			compressedFilePath,
-		}
-
-		cm.log.Debug("Compression command for %s: ffmpeg %s", chatApp, strings.Join(args, " "))
-		cmd := exec.Command("ffmpeg", args...)
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		err = cmd.Run()
-		if err != nil {
-			cm.log.Error("Compression failed for %s: %v\nFFmpeg output: %s", chatApp, err, stderr.String())
-			return originalFilePath, fmt.Errorf("compression failed: %v", err)
-		}
+    cm.schedulesMutex.Lock()
+    schedules := make([]Schedule, 0, len(cm.schedules))
+    for _, sched := range cm.schedules {
+        schedules = append(schedules, *sched)
+    }
+    cm.schedulesMutex.Unlock()
 
-		compressedInfo, err := os.Stat(compressedFilePath)
-		if err != nil {
-			cm.log.Error("Error checking compressed file for %s: %v, falling back to original", chatApp, err)
-			return originalFilePath, fmt.Errorf("could not access compressed file: %v", err)
-		}
+    sort.Slice(schedules, func(i, j int) bool {
+        return schedules[i].StartTime.Before(schedules[j].StartTime)
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(schedules)
+}
+
+// HandleCancelSchedule stops a schedule by ID. A capture that is already running still finishes.
+func (cm *ClipManager) HandleCancelSchedule(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id := r.URL.Query().Get("id")
+    if id == "" {
+        http.Error(w, "Missing required parameter: id", http.StatusBadRequest)
+        return
+    }
+
+    cm.schedulesMutex.Lock()
+    sched, ok := cm.schedules[id]
+    cm.schedulesMutex.Unlock()
+    if !ok {
+        http.Error(w, fmt.Sprintf("Unknown schedule: %s", id), http.StatusNotFound)
+        return
+    }
+    sched.cancel()
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "message": "Schedule cancelled"})
+}
+
+// processClip records a clip, sends it to the requested destinations and removes the local file,
+// then notifies the callback_url in the background
+func (cm *ClipManager) processClip(logger *Logger, cam *Camera, filePath string, startTime time.Time, req *ClipRequest) ClipResult {
+    result := cm.recordAndSendClip(logger, cam, filePath, startTime, req)
+
+    if req.CallbackURL != "" {
+        cm.clipsWG.Add(1)
+        go func() {
+            defer cm.clipsWG.Done()
+            cm.sendCallback(logger, req, result)
+        }()
+    }
+    return result
+}
+
+func (cm *ClipManager) recordAndSendClip(logger *Logger, cam *Camera, filePath string, startTime time.Time, req *ClipRequest) ClipResult {
+    requestID := req.RequestID
+    backtrackSeconds := req.BacktrackSeconds
+    durationSeconds := req.DurationSeconds
+
+    logger.Info("Extracting clip for backtrack: %g seconds, duration: %g seconds with category: %s",
+        backtrackSeconds, durationSeconds, req.Category)
+    cm.updateJob(requestID, JobRecording, "", nil)
+    cm.broadcastClipEvent(EventRecordingStarted, req, ClipEventPayload{BacktrackSeconds: backtrackSeconds, DurationSeconds: durationSeconds})
+    requestedStart := startTime.Add(-secondsDuration(backtrackSeconds))
+    requestedEnd := requestedStart.Add(secondsDuration(durationSeconds))
+    clipRange, err := cm.RecordClip(cm.ctx, logger, cam, backtrackSeconds, durationSeconds, filePath, RecordOptions{
+        OutputFormat: req.OutputFormat,
+        Accurate:     req.Accurate,
+        VideoTrack:   req.VideoTrack,
+        AudioTrack:   req.AudioTrack,
+        Placeholder:  cm.clipPlaceholder(req),
+    }, startTime)
+    if err != nil {
+        logger.Error("Recording error: %v", err)
+        cm.metrics.IncClipsFailed()
+        result := ClipResult{Error: fmt.Sprintf("recording failed: %v", err), RequestedStart: &requestedStart, RequestedEnd: &requestedEnd}
+        cm.updateJob(requestID, JobFailed, result.Error, &result)
+        cm.broadcastClipEvent(EventError, req, ClipEventPayload{Error: result.Error})
+        return result
+    }
+    logger.Success("Clip recording completed")
+    cm.metrics.IncClipsRecorded()
+
+    dryRun := req.DryRun
+    keepFile := dryRun && req.DryRunKeep
+    if !keepFile {
+        defer os.Remove(filePath)
+    }
+    // Deferred after the removal so it runs first and moves the clip out of the way
+    if !dryRun && (cm.keepLocalClips || req.Keep) {
+        defer cm.archiveClip(logger, filePath, req)
+    }
+
+    if req.Overlay {
+        if err := cm.applyOverlay(logger, filePath, req, clipRange.Start); err != nil {
+            logger.Warning("Could not add overlay, sending the clip without it: %v", err)
+        }
+    }
+
+    result := ClipResult{
+        Success:         true,
+        DurationSeconds: clipRange.DurationSeconds,
+        RequestedStart:  &requestedStart,
+        RequestedEnd:    &requestedEnd,
+        StartTime:       &clipRange.Start,
+        EndTime:         &clipRange.End,
+        Gaps:            clipRange.Gaps,
+    }
+    if info, err := os.Stat(filePath); err == nil {
+        result.FileSizeBytes = info.Size()
+    }
+    if duration, err := cm.verifyClipDuration(filePath); err == nil {
+        result.DurationSeconds = duration
+    }
+    cm.broadcastClipEvent(EventRecordingFinished, req, ClipEventPayload{
+        DurationSeconds: result.DurationSeconds,
+        FileSizeBytes:   result.FileSizeBytes,
+        StartTime:       result.StartTime,
+        EndTime:         result.EndTime,
+        Gaps:            result.Gaps,
+    })
+
+    if dryRun {
+        result.DryRun = true
+        if keepFile {
+            result.FilePath = filePath
+        }
+        logger.Info("Dry run: recorded %s (%.2f seconds, %d bytes), not sending it", filePath, result.DurationSeconds, result.FileSizeBytes)
+        cm.updateJob(requestID, JobDone, "", &result)
+        return result
+    }
+
+    cm.updateJob(requestID, JobSending, "", nil)
+    destinations, err := cm.SendToChatApp(logger, filePath, req)
+    result.Destinations = destinations
+    for _, dest := range destinations {
+        success := dest.Success
+        cm.broadcastClipEvent(EventDestinationResult, req, ClipEventPayload{Destination: dest.Destination, Success: &success, Error: dest.Error})
+    }
+    if err != nil {
+        logger.Error("Error sending clip: %v", err)
+        result.Success = false
+        result.Error = err.Error()
+        cm.updateJob(requestID, JobFailed, result.Error, &result)
+        cm.broadcastClipEvent(EventError, req, ClipEventPayload{Error: result.Error})
+        return result
+    }
+
+    cm.updateJob(requestID, JobDone, "", &result)
+    return result
+}
+
+// archiveClip moves a finished clip into the archive directory, named like SFTP uploads,
+// and prunes the archive according to the retention settings
+func (cm *ClipManager) archiveClip(logger *Logger, filePath string, req *ClipRequest) {
+    if err := os.MkdirAll(cm.archiveDir, 0755); err != nil {
+        logger.Error("Could not create archive directory %s: %v", cm.archiveDir, err)
+        return
+    }
+
+    cm.archiveMutex.Lock()
+    defer cm.archiveMutex.Unlock()
+
+    ext := filepath.Ext(filePath)
+    baseName := strings.TrimSuffix(cm.clipFilename(req, filePath), ext)
+    archivePath := filepath.Join(cm.archiveDir, baseName+ext)
+    for i := 2; ; i++ {
+        if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+            break
+        }
+        archivePath = filepath.Join(cm.archiveDir, fmt.Sprintf("%s_%d%s", baseName, i, ext))
+    }
+
+    if err := os.Rename(filePath, archivePath); err != nil {
+        logger.Error("Could not move clip to archive: %v", err)
+        return
+    }
+    logger.Success("Kept local copy of clip at %s", archivePath)
+    cm.broadcastNewClip("local", archivePath, req)
+
+    cm.pruneArchive(logger)
+}
+
+// pruneArchive removes archived clips beyond archiveMaxClips or older than archiveMaxAge.
+// Only files named like generated clips count, so anything else kept in archiveDir, including
+// clips archived under a custom filename, is left alone. The caller must hold archiveMutex.
+func (cm *ClipManager) pruneArchive(logger *Logger) {
+    if cm.archiveMaxClips <= 0 && cm.archiveMaxAge <= 0 {
+        return
+    }
+
+    entries, err := os.ReadDir(cm.archiveDir)
+    if err != nil {
+        logger.Warning("Could not read archive directory: %v", err)
+        return
+    }
+
+    type archivedClip struct {
+        path    string
+        modTime time.Time
+    }
+    var clips []archivedClip
+    for _, entry := range entries {
+        if entry.IsDir() || !clipFilenamePattern.MatchString(entry.Name()) {
+            continue
+        }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        clips = append(clips, archivedClip{path: filepath.Join(cm.archiveDir, entry.Name()), modTime: info.ModTime()})
+    }
+
+    // Newest first, so everything past the limit is the oldest
+    sort.Slice(clips, func(i, j int) bool {
+        return clips[i].modTime.After(clips[j].modTime)
+    })
+
+    for i, clip := range clips {
+        tooMany := cm.archiveMaxClips > 0 && i >= cm.archiveMaxClips
+        tooOld := cm.archiveMaxAge > 0 && time.Since(clip.modTime) > cm.archiveMaxAge
+        if tooMany || tooOld {
+            if err := os.Remove(clip.path); err != nil {
+                logger.Warning("Could not prune archived clip %s: %v", clip.path, err)
+                continue
+            }
+            logger.Info("Pruned archived clip %s", clip.path)
+        }
+    }
+}
+
+func (cm *ClipManager) validateRequest(req *ClipRequest) error {
+	cam, err := cm.getCamera(req.CameraID)
+	if err != nil {
+		return fmt.Errorf("invalid camera_id parameter: %v", err)
+	}
+	req.CameraID = cam.ID
+	req.CameraIP = cam.URL
+
+	if req.ChatApps == "" && !req.DryRun {
+		return fmt.Errorf("missing required parameter: chat_app")
+	}
+
+	if req.BacktrackSeconds < 0 || math.IsNaN(req.BacktrackSeconds) {
+		return fmt.Errorf("invalid or missing parameter: backtrack_seconds must be 0 or greater")
+	}
+
+	if req.DurationSeconds <= 0 || math.IsNaN(req.DurationSeconds) {
+		return fmt.Errorf("invalid or missing parameter: duration_seconds must be greater than 0")
+	}
+
+	if req.BacktrackSeconds > float64(cm.maxBacktrackSeconds) {
+		return fmt.Errorf("invalid parameter: backtrack_seconds must be between 0 and %d", cm.maxBacktrackSeconds)
+	}
+
+	if req.DurationSeconds > maxClipDurationSeconds {
+		return fmt.Errorf("invalid parameter: duration_seconds must be less than %d", maxClipDurationSeconds)
+	}
+
+	if _, err := parseResolution(req.Resolution); err != nil {
+		return err
+	}
+
+	req.OutputFormat = strings.ToLower(req.OutputFormat)
+	req.Container = strings.ToLower(req.Container)
+	if _, err := clipExtension(req.OutputFormat, req.Container); err != nil {
+		return err
+	}
+
+	if req.PlaceholderSize != "" {
+		if _, _, err := parsePlaceholderSize(req.PlaceholderSize); err != nil {
+			return fmt.Errorf("invalid placeholder_size: %v", err)
+		}
+	}
+	if req.PlaceholderFramerate < 0 || req.PlaceholderFramerate > maxPlaceholderFramerate {
+		return fmt.Errorf("invalid placeholder_framerate: must be between 1 and %d", maxPlaceholderFramerate)
+	}
+	if req.PlaceholderColor != "" && !placeholderColorPattern.MatchString(req.PlaceholderColor) {
+		return fmt.Errorf("invalid placeholder_color '%s': use a color name (e.g. navy) or hex (e.g. #1a1a2e)", req.PlaceholderColor)
+	}
+
+	if req.VideoTrack != nil && *req.VideoTrack < 0 {
+		return fmt.Errorf("invalid video_track %d: must be 0 or more", *req.VideoTrack)
+	}
+	if req.AudioTrack != nil && *req.AudioTrack < 0 {
+		return fmt.Errorf("invalid audio_track %d: must be 0 or more", *req.AudioTrack)
+	}
+
+	if _, err := overlayPosition(req.OverlayPosition); err != nil {
+		return err
+	}
+
+	if _, err := req.audioNormalization(); err != nil {
+		return err
+	}
+
+	if err := req.compressionSettings(cm.currentConfig().Compression).validate(); err != nil {
+		return fmt.Errorf("invalid compression settings: %v", err)
+	}
+	if req.MaxFileSizeMB < 0 {
+		return fmt.Errorf("invalid max_file_size_mb: must be greater than 0")
+	}
+
+	req.Title = sanitizeText(req.Title, maxTextFieldLength)
+	req.Category = sanitizeText(req.Category, maxTextFieldLength)
+	req.Team1 = sanitizeText(req.Team1, maxTextFieldLength)
+	req.Team2 = sanitizeText(req.Team2, maxTextFieldLength)
+	req.AdditionalText = sanitizeText(req.AdditionalText, maxAdditionalTextLength)
+
+	if req.Filename != "" {
+		if req.Filename = sanitizeFilename(req.Filename); req.Filename == "" {
+			return fmt.Errorf("invalid filename: must contain letters, digits, '-' or '_'")
+		}
+	}
+
+	if req.CallbackURL != "" {
+		callbackURL, err := url.Parse(req.CallbackURL)
+		if err != nil || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") || callbackURL.Host == "" {
+			return fmt.Errorf("invalid callback_url: must be an absolute http or https URL")
+		}
+		if err := cm.targetGuard.CheckHost(callbackURL.Hostname()); err != nil {
+			return fmt.Errorf("invalid callback_url: %v", err)
+		}
+	}
+	if req.OverlayFontSize == 0 {
+		req.OverlayFontSize = defaultOverlayFontSize
+	} else if req.OverlayFontSize < minOverlayFontSize || req.OverlayFontSize > maxOverlayFontSize {
+		return fmt.Errorf("invalid overlay_font_size: must be between %d and %d", minOverlayFontSize, maxOverlayFontSize)
+	}
+
+	req.ChatApps = strings.ToLower(req.ChatApps)
+	var chatApps []string
+	if req.ChatApps != "" {
+		chatApps = strings.Split(req.ChatApps, ",")
+	}
+
+	for _, app := range chatApps {
+		app = strings.TrimSpace(app)
+		applyEnvDefaults(req, app)
+
+		switch app {
+		case "telegram":
+			if req.TelegramBotToken == "" {
+				return fmt.Errorf("missing required parameter for Telegram: telegram_bot_token")
+			}
+			if req.TelegramChatID == "" {
+				return fmt.Errorf("missing required parameter for Telegram: telegram_chat_id")
+			}
+			if req.TelegramMessageThreadID != "" {
+				if _, err := strconv.ParseInt(req.TelegramMessageThreadID, 10, 64); err != nil {
+					return fmt.Errorf("invalid telegram_message_thread_id: must be a number")
+				}
+			}
+		case "mattermost":
+			if req.MattermostURL == "" {
+				return fmt.Errorf("missing required parameter for Mattermost: mattermost_url")
+			}
+			if req.MattermostToken == "" {
+				return fmt.Errorf("missing required parameter for Mattermost: mattermost_token")
+			}
+			if req.MattermostChannel == "" {
+				return fmt.Errorf("missing required parameter for Mattermost: mattermost_channel")
+			}
+			req.MattermostURL = strings.TrimSuffix(req.MattermostURL, "/")
+			if req.MattermostRootID != "" && !mattermostIDPattern.MatchString(req.MattermostRootID) {
+				return fmt.Errorf("invalid mattermost_root_id: must be a 26-character Mattermost post ID")
+			}
+		case "discord":
+			if req.DiscordWebhookURL == "" {
+				return fmt.Errorf("missing required parameter for Discord: discord_webhook_url")
+			}
+			// Discord rejects names longer than 80 characters or containing "discord"
+			if len([]rune(req.DiscordUsername)) > maxDiscordUsernameLength || strings.Contains(strings.ToLower(req.DiscordUsername), "discord") {
+				return fmt.Errorf("invalid discord_username: must be at most %d characters and not contain \"discord\"", maxDiscordUsernameLength)
+			}
+			if req.DiscordAvatarURL != "" {
+				avatarURL, err := url.Parse(req.DiscordAvatarURL)
+				if err != nil || (avatarURL.Scheme != "http" && avatarURL.Scheme != "https") || avatarURL.Host == "" {
+					return fmt.Errorf("invalid discord_avatar_url: must be an absolute http or https URL")
+				}
+			}
+		case "sftp":
+			if req.SFTPHost = sftpHostname(req.SFTPHost); req.SFTPHost == "" {
+				return fmt.Errorf("missing required parameter for SFTP: sftp_host")
+			}
+			if req.SFTPPort == "" {
+				req.SFTPPort = "22" // Default SFTP port
+			} else if port, err := strconv.Atoi(req.SFTPPort); err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("invalid sftp_port: must be a valid port number between 1 and 65535")
+			}
+			if req.SFTPUser == "" {
+				return fmt.Errorf("missing required parameter for SFTP: sftp_user")
+			}
+			if req.SFTPPassword == "" && req.SFTPPrivateKey == "" {
+				return fmt.Errorf("missing required parameter for SFTP: sftp_password or sftp_private_key")
+			}
+			if req.SFTPPath == "" {
+				req.SFTPPath = "." // Default to current directory
+			}
+		case "slack":
+			if req.SlackBotToken == "" {
+				return fmt.Errorf("missing required parameter for Slack: slack_bot_token")
+			}
+			if req.SlackChannel == "" {
+				return fmt.Errorf("missing required parameter for Slack: slack_channel")
+			}
+		case "s3":
+			if req.S3Bucket == "" {
+				return fmt.Errorf("missing required parameter for S3: s3_bucket")
+			}
+			if req.S3AccessKey == "" {
+				return fmt.Errorf("missing required parameter for S3: s3_access_key")
+			}
+			if req.S3SecretKey == "" {
+				return fmt.Errorf("missing required parameter for S3: s3_secret_key")
+			}
+			if req.S3Region == "" {
+				req.S3Region = "us-east-1"
+			}
+			if req.S3Endpoint != "" {
+				if _, err := parseS3Endpoint(req.S3Endpoint); err != nil {
+					return fmt.Errorf("invalid s3_endpoint: %v", err)
+				}
+			}
+		case "email":
+			if req.SMTPHost == "" {
+				return fmt.Errorf("missing required parameter for email: smtp_host")
+			}
+			if req.SMTPPort == "" {
+				req.SMTPPort = "587" // Default submission port
+			} else if port, err := strconv.Atoi(req.SMTPPort); err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("invalid smtp_port: must be a valid port number between 1 and 65535")
+			}
+			switch req.SMTPSecurity {
+			case "":
+				req.SMTPSecurity = "starttls"
+			case "starttls", "tls", "none":
+			default:
+				return fmt.Errorf("invalid smtp_security: must be starttls, tls or none")
+			}
+			if req.EmailFrom == "" {
+				return fmt.Errorf("missing required parameter for email: email_from")
+			}
+			if req.EmailTo == "" {
+				return fmt.Errorf("missing required parameter for email: email_to")
+			}
+		case "youtube":
+			canRefresh := req.YouTubeRefreshToken != "" && req.YouTubeClientID != "" && req.YouTubeClientSecret != ""
+			if req.YouTubeAccessToken == "" && !canRefresh {
+				return fmt.Errorf("missing required parameter for YouTube: youtube_access_token or youtube_refresh_token with client credentials")
+			}
+			switch req.YouTubePrivacy {
+			case "":
+				req.YouTubePrivacy = "private"
+			case "private", "unlisted", "public":
+			default:
+				return fmt.Errorf("invalid youtube_privacy_status: must be private, unlisted or public")
+			}
+		case "webhook":
+			if req.WebhookURL == "" {
+				return fmt.Errorf("missing required parameter for webhook: webhook_url")
+			}
+			webhookURL, err := url.Parse(req.WebhookURL)
+			if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+				return fmt.Errorf("invalid webhook_url: must be an absolute http or https URL")
+			}
+			if err := cm.targetGuard.CheckHost(webhookURL.Hostname()); err != nil {
+				return fmt.Errorf("invalid webhook_url: %v", err)
+			}
+			if req.WebhookHeader != "" {
+				if _, _, err := parseWebhookHeader(req.WebhookHeader); err != nil {
+					return fmt.Errorf("invalid webhook_header: %v", err)
+				}
+			}
+			if req.WebhookFileField == "" {
+				req.WebhookFileField = "file"
+			}
+			if req.WebhookTextField == "" {
+				req.WebhookTextField = "message"
+			}
+		default:
+			return fmt.Errorf("invalid chat_app parameter '%s'. Supported values are: 'telegram', 'mattermost', 'discord', 'sftp', 'slack', 's3', 'youtube', 'email', 'webhook'", app)
+		}
+	}
+
+	return nil
+}
+
+// envDefaultPrefixes are the parameter prefixes of each destination. Its text parameters that a
+// request leaves empty fall back to the environment variable of the same name in upper case,
+// e.g. discord_webhook_url to DISCORD_WEBHOOK_URL.
+var envDefaultPrefixes = map[string][]string{
+	"telegram":   {"telegram_"},
+	"mattermost": {"mattermost_"},
+	"discord":    {"discord_"},
+	"sftp":       {"sftp_"},
+	"slack":      {"slack_"},
+	"s3":         {"s3_"},
+	"youtube":    {"youtube_"},
+	"email":      {"smtp_", "email_"},
+	"webhook":    {"webhook_"},
+}
+
+// envDefaultServerParams choose the server a destination's credentials are sent to. A request that
+// sets one of them gets none of the destination's environment defaults, so it can't send the
+// configured credentials to a server of its own.
+var envDefaultServerParams = map[string][]string{
+	"mattermost": {"mattermost_url"},
+	"sftp":       {"sftp_host", "sftp_port"},
+	"s3":         {"s3_endpoint"},
+	"email":      {"smtp_host", "smtp_port"},
+	"webhook":    {"webhook_url"},
+}
+
+// applyEnvDefaults fills the destination's text parameters the request left empty from the environment
+func applyEnvDefaults(req *ClipRequest, app string) {
+	prefixes, ok := envDefaultPrefixes[app]
+	if !ok {
+		return
+	}
+
+	v := reflect.ValueOf(req).Elem()
+	t := v.Type()
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) && v.Field(i).Kind() == reflect.String {
+				fields[name] = v.Field(i)
+			}
+		}
+	}
+
+	for _, name := range envDefaultServerParams[app] {
+		if fields[name].String() != "" {
+			return
+		}
+	}
+	for name, field := range fields {
+		if field.String() == "" {
+			field.SetString(os.Getenv(strings.ToUpper(name)))
+		}
+	}
+}
+
+// streams returns the cached stream probe, with ok false when the camera hasn't been probed successfully
+func (cam *Camera) streams() (hasAudio, hasVideo, ok bool) {
+    cam.streamsMutex.Lock()
+    defer cam.streamsMutex.Unlock()
+    return cam.hasAudio, cam.hasVideo, cam.streamsProbed
+}
+
+// streamCodecs returns the codecs found by the last stream probe
+func (cam *Camera) streamCodecs() StreamCodecs {
+    cam.streamsMutex.Lock()
+    defer cam.streamsMutex.Unlock()
+    return cam.codecs
+}
+
+// StreamCodecs are the codec names of a stream's first video and audio track, empty when absent
+type StreamCodecs struct {
+    Video string
+    Audio string
+}
+
+// StreamTrack is a video or audio track of a camera stream as reported by ffprobe
+type StreamTrack struct {
+    Index      int    `json:"index"` // Stream index in the camera stream
+    Type       string `json:"type"`  // video or audio
+    Track      int    `json:"track"` // Index among the tracks of the same type, as used by video_track and audio_track
+    Codec      string `json:"codec"`
+    Width      int    `json:"width,omitempty"`
+    Height     int    `json:"height,omitempty"`
+    Channels   int    `json:"channels,omitempty"`
+    SampleRate string `json:"sample_rate,omitempty"`
+    Language   string `json:"language,omitempty"`
+    Title      string `json:"title,omitempty"`
+}
+
+// probeTracks asks ffprobe for all streams of the RTSP URL at once, so the camera only has to
+// set up a single connection
+func (cm *ClipManager) probeTracks(logger *Logger, rtspURL string) ([]StreamTrack, error) {
+    cmd := exec.Command(cm.ffprobePath,
+        "-rtsp_transport", cm.rtspTransport,
+        "-i", rtspURL,
+        "-show_entries", "stream=index,codec_type,codec_name,width,height,channels,sample_rate:stream_tags=language,title",
+        "-print_format", "json",
+        "-v", "error",
+    )
+
+    var out bytes.Buffer
+    cmd.Stdout = &out
+    cmd.Stderr = &out // Capture errors as well
+
+    if err := cmd.Run(); err != nil {
+        logger.Error("ffprobe failed: %v\nOutput: %s", err, out.String())
+        return nil, err
+    }
+
+    var result struct {
+        Streams []struct {
+            Index      int    `json:"index"`
+            CodecType  string `json:"codec_type"`
+            CodecName  string `json:"codec_name"`
+            Width      int    `json:"width"`
+            Height     int    `json:"height"`
+            Channels   int    `json:"channels"`
+            SampleRate string `json:"sample_rate"`
+            Tags       struct {
+                Language string `json:"language"`
+                Title    string `json:"title"`
+            } `json:"tags"`
+        } `json:"streams"`
+    }
+    if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+        logger.Error("Failed to parse ffprobe output: %v", err)
+        return nil, err
+    }
+
+    tracks := []StreamTrack{}
+    counts := map[string]int{}
+    for _, stream := range result.Streams {
+        if stream.CodecType != "video" && stream.CodecType != "audio" {
+            continue
+        }
+        tracks = append(tracks, StreamTrack{
+            Index:      stream.Index,
+            Type:       stream.CodecType,
+            Track:      counts[stream.CodecType],
+            Codec:      stream.CodecName,
+            Width:      stream.Width,
+            Height:     stream.Height,
+            Channels:   stream.Channels,
+            SampleRate: stream.SampleRate,
+            Language:   stream.Tags.Language,
+            Title:      stream.Tags.Title,
+        })
+        counts[stream.CodecType]++
+    }
+    return tracks, nil
+}
+
+// selectTrack returns track number selection of the given type, or the first one for trackDefault
+// and trackAll. ok is false when there is no such track.
+func selectTrack(tracks []StreamTrack, trackType string, selection int) (track StreamTrack, ok bool) {
+    if selection < 0 {
+        selection = 0
+    }
+    for _, t := range tracks {
+        if t.Type == trackType && t.Track == selection {
+            return t, true
+        }
+    }
+    return StreamTrack{}, false
+}
+
+// countTracks returns how many tracks of the given type there are
+func countTracks(tracks []StreamTrack, trackType string) int {
+    count := 0
+    for _, t := range tracks {
+        if t.Type == trackType {
+            count++
+        }
+    }
+    return count
+}
+
+// probeCameraStreams checks the camera for audio and video streams and caches the result on the
+// camera. A failed probe is treated as no stream of that kind and isn't cached, so the next
+// reconnect or clip request probes again.
+func (cm *ClipManager) probeCameraStreams(cam *Camera) (hasAudio, hasVideo bool) {
+    logger := cm.log.With("[camera %s]", cam.ID)
+    tracks, err := cm.probeTracks(logger, cam.URL)
+    if err != nil {
+        logger.Warning("Could not determine the camera's streams, assuming no audio or video: %v", err)
+    }
+
+    // The codecs are those of the recorded tracks
+    video, hasVideo := selectTrack(tracks, "video", cam.videoTrack)
+    if !hasVideo && cam.videoTrack >= 0 && countTracks(tracks, "video") > 0 {
+        logger.Warning("Camera has no video track %d (VIDEO_TRACK), only %d, recording the default track instead", cam.videoTrack, countTracks(tracks, "video"))
+        video, hasVideo = selectTrack(tracks, "video", trackDefault)
+    }
+    audio, hasAudio := selectTrack(tracks, "audio", cam.audioTrack)
+    if !hasAudio && cam.audioTrack >= 0 && countTracks(tracks, "audio") > 0 {
+        logger.Warning("Camera has no audio track %d (AUDIO_TRACK), only %d, recording the default track instead", cam.audioTrack, countTracks(tracks, "audio"))
+        audio, hasAudio = selectTrack(tracks, "audio", trackDefault)
+    }
+    codecs := StreamCodecs{Video: video.Codec, Audio: audio.Codec}
+
+    if hasAudio && hasVideo {
+        logger.Info("Both audio (%s) and video (%s) detected in stream", codecs.Audio, codecs.Video)
+    } else if hasAudio {
+        logger.Info("Audio-only stream detected (%s, no video)", codecs.Audio)
+    } else if hasVideo {
+        logger.Info("Video-only stream detected (%s, no audio)", codecs.Video)
+    } else {
+        logger.Warning("Neither audio nor video detected in stream. Recording might not work correctly.")
+    }
+    if len(tracks) > 2 {
+        logger.Info("Stream has %d video and %d audio tracks, see /api/tracks", countTracks(tracks, "video"), countTracks(tracks, "audio"))
+    }
+
+    cam.streamsMutex.Lock()
+    cam.hasAudio = hasAudio
+    cam.hasVideo = hasVideo
+    cam.codecs = codecs
+    cam.tracks = tracks
+    cam.streamsProbed = err == nil
+    cam.streamsMutex.Unlock()
+
+    return hasAudio, hasVideo
+}
+
+// trackSelection returns the camera's recorded track of the given type, falling back to
+// trackDefault when the configured track wasn't found by the last probe
+func (cam *Camera) trackSelection(trackType string) int {
+    selection := cam.videoTrack
+    if trackType == "audio" {
+        selection = cam.audioTrack
+    }
+
+    cam.streamsMutex.Lock()
+    defer cam.streamsMutex.Unlock()
+    if selection >= 0 {
+        if _, ok := selectTrack(cam.tracks, trackType, selection); !ok {
+            return trackDefault
+        }
+    }
+    return selection
+}
+
+// bufferedTracks returns how many tracks of the given type the camera's segments hold
+func (cam *Camera) bufferedTracks(trackType string) int {
+    selection := cam.trackSelection(trackType)
+
+    cam.streamsMutex.Lock()
+    defer cam.streamsMutex.Unlock()
+    count := countTracks(cam.tracks, trackType)
+    if selection != trackAll && count > 1 {
+        count = 1
+    }
+    return count
+}
+
+// trackSpecifier returns the FFmpeg stream specifier of the track selection, e.g. 0:a:1
+func trackSpecifier(stream string, selection int) string {
+    switch selection {
+    case trackAll:
+        return stream
+    case trackDefault:
+        return stream + ":0"
+    }
+    return fmt.Sprintf("%s:%d", stream, selection)
+}
+
+// recordingMapArgs maps the camera's configured tracks into the segments. Without a configured
+// track it returns nothing, so FFmpeg picks one video and one audio track as before.
+func (cam *Camera) recordingMapArgs(hasAudio, hasVideo bool) []string {
+    videoTrack, audioTrack := cam.trackSelection("video"), cam.trackSelection("audio")
+    if videoTrack == trackDefault && audioTrack == trackDefault {
+        return nil
+    }
+
+    var args []string
+    if hasVideo {
+        args = append(args, "-map", trackSpecifier("0:v", videoTrack))
+    } else if hasAudio {
+        args = append(args, "-map", "1:v")
+    }
+    if hasAudio {
+        args = append(args, "-map", trackSpecifier("0:a", audioTrack))
+    }
+    return args
+}
+
+// IsRecording reports whether the camera's background recorder is running
+func (cam *Camera) IsRecording() bool {
+    cam.recordingMutex.Lock()
+    defer cam.recordingMutex.Unlock()
+    return cam.recording
+}
+
+// RecordingStartTime returns when the running background recorder was started
+func (cam *Camera) RecordingStartTime() time.Time {
+    cam.recordingMutex.Lock()
+    defer cam.recordingMutex.Unlock()
+    return cam.recordingStartTime
+}
+
+// beginRecording flags the camera as recording, returning false when a recorder is already running
+func (cam *Camera) beginRecording(cancel context.CancelFunc) bool {
+    cam.recordingMutex.Lock()
+    defer cam.recordingMutex.Unlock()
+
+    if cam.recording {
+        return false
+    }
+    cam.recording = true
+    cam.recordingStartTime = time.Now()
+    cam.cancelRecording = cancel
+    cam.recordingDone = make(chan struct{})
+    return true
+}
+
+// endRecording clears the recording flag once the recorder has exited
+func (cam *Camera) endRecording() {
+    cam.recordingMutex.Lock()
+    defer cam.recordingMutex.Unlock()
+
+    cam.recording = false
+    cam.cancelRecording = nil
+    close(cam.recordingDone)
+}
+
+// StopRecording stops the camera's background recorder and waits up to timeout for it to exit.
+// It returns false when the camera wasn't recording.
+func (cam *Camera) StopRecording(timeout time.Duration) (bool, error) {
+    cam.recordingMutex.Lock()
+    if !cam.recording {
+        cam.recordingMutex.Unlock()
+        return false, nil
+    }
+    cancel, done := cam.cancelRecording, cam.recordingDone
+    cam.recordingMutex.Unlock()
+
+    cancel()
+    select {
+    case <-done:
+        return true, nil
+    case <-time.After(timeout):
+        return true, fmt.Errorf("recorder for camera %s did not stop within %v", cam.ID, timeout)
+    }
+}
+
+// stallTimeout is how long a recorder may go without producing a segment before it is restarted
+func (cm *ClipManager) stallTimeout() time.Duration {
+    timeout := time.Duration(stallSegmentMultiplier*cm.segmentDuration) * time.Second
+    if timeout < minStallTimeout {
+        timeout = minStallTimeout
+    }
+    return timeout
+}
+
+// watchForStall kills FFmpeg when the camera hasn't produced a segment for stallTimeout, which
+// happens when the RTSP connection stays up but the stream freezes. stalled is closed before
+// the kill so the recording loop knows to restart right away.
+func (cm *ClipManager) watchForStall(cam *Camera, process *os.Process, started time.Time, processDone <-chan struct{}, stalled chan<- struct{}) {
+    timeout := cm.stallTimeout()
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-processDone:
+            return
+        case <-ticker.C:
+        }
+
+        cam.segmentsMutex.RLock()
+        lastSegmentAt := cam.lastSegmentAt
+        cam.segmentsMutex.RUnlock()
+        if lastSegmentAt.Before(started) {
+            lastSegmentAt = started
+        }
+
+        if since := time.Since(lastSegmentAt); since > timeout {
+            cm.log.Warning("[camera %s] No new segment for %v, FFmpeg appears to be stalled, killing it", cam.ID, since.Round(time.Second))
+            cm.metrics.IncRecorderStalls(cam.ID)
+            close(stalled)
+            if err := process.Kill(); err != nil {
+                cm.log.Error("[camera %s] Failed to kill stalled FFmpeg: %v", cam.ID, err)
+            }
+            return
+        }
+    }
+}
+
+// StartBackgroundRecording records the camera into segments until ctx is cancelled or StopRecording
+// is called. It returns false without starting anything when the camera is already recording.
+func (cm *ClipManager) StartBackgroundRecording(ctx context.Context, cam *Camera) bool {
+    ctx, cancel := context.WithCancel(ctx)
+    if !cam.beginRecording(cancel) {
+        cancel()
+        cm.log.Warning("[camera %s] Background recording is already running", cam.ID)
+        return false
+    }
+
+    cm.log.Info("[camera %s] Starting background recording with segments for backtracking capability at %s...", 
+        cam.ID, cam.RecordingStartTime().Format("15:04:05"))
+
+    cm.recordersWG.Add(1)
+    go cm.runBackgroundRecording(ctx, cancel, cam)
+    return true
+}
+
+// runBackgroundRecording probes the stream and keeps FFmpeg recording segments until ctx is cancelled
+func (cm *ClipManager) runBackgroundRecording(ctx context.Context, cancel context.CancelFunc, cam *Camera) {
+    defer cm.recordersWG.Done()
+    defer cancel()
+
+    // Probe on every (re)start, the camera may have come back with different streams
+    hasAudio, hasVideo := cm.probeCameraStreams(cam)
+    reprobe := false
+
+    attempt := 1
+    cycle := cam.nextCycle
+    defer func() {
+        // A restarted recorder continues with fresh cycle numbers instead of overwriting segments
+        cam.nextCycle = cycle + 1
+        cam.endRecording()
+        cm.log.Info("[camera %s] Background recording stopped", cam.ID)
+    }()
+
+    for {
+        if ctx.Err() != nil {
+            return
+        }
+
+        if reprobe {
+            hasAudio, hasVideo = cm.probeCameraStreams(cam)
+            reprobe = false
+        }
+
+        availableSpace, err := cm.CheckDiskSpace()
+        if err != nil {
+            cm.log.Error("Error checking disk space: %v, continuing with recording", err)
+        } else {
+            availableSpaceMB := availableSpace / (1024 * 1024)
+            cm.log.Info("Available disk space: %d MB", availableSpaceMB)
+            if availableSpaceMB < 500 {
+                cm.log.Warning("Low disk space (< 500MB), skipping recording cycle, retrying in 30 seconds...")
+                sleepContext(ctx, 30*time.Second)
+                continue
+            }
+        }
+
+        extension := segmentExtension(cm.segmentFormat)
+        segmentPattern := fmt.Sprintf("%s_cycle%d_%%03d%s", strings.TrimSuffix(cam.segmentPattern, "_%03d"+extension), cycle, extension)
+        segmentList := segmentListPath(cam.segmentDir, cycle)
+
+        args := []string{
+            "-rtsp_transport", cm.rtspTransport,
+            "-i", cam.URL,
+        }
+        if !hasVideo && hasAudio {
+            // Placeholder video as a second input, before the output options so they apply to the segments
+            args = append(args, cm.placeholder.inputArgs()...)
+        }
+        args = append(args, cam.recordingMapArgs(hasAudio, hasVideo)...)
+        args = append(args,
+            "-f", "segment",
+            "-segment_time", strconv.Itoa(cm.segmentDuration),
+            "-segment_format", cm.segmentFormat,
+            "-reset_timestamps", "1",
+            "-segment_list", segmentList,
+            "-segment_list_type", "m3u8",
+        )
+        if cm.segmentFormat == "mp4" {
+            // Fragmented MP4 writes the header up front, so a segment is readable without a finished moov
+            args = append(args, "-segment_format_options", "movflags=+frag_keyframe+empty_moov+default_base_moof")
+        }
+
+        if hasVideo {
+            args = append(args, "-c:v", "copy")
+        } else if hasAudio {
+            args = append(args, cm.placeholder.filterArgs()...)
+        }
+        if hasAudio {
+            args = append(args, "-c:a", "copy")
+        } else {
+            args = append(args, "-an")
+        }
+
+        args = append(args, "-y", segmentPattern)
+
+        logCmd := fmt.Sprintf("ffmpeg %s", strings.Join(args, " "))
+        cm.log.Debug("[camera %s] Segment recording FFmpeg command: %s", cam.ID, logCmd)
+
+        cmd := exec.Command(cm.ffmpegPath, args...)
+        stderr, err := cmd.StderrPipe()
+        if err != nil {
+            cm.log.Error("Error getting stderr pipe: %v", err)
+            sleepContext(ctx, 5*time.Second)
+            continue
+        }
+
+        if err := cmd.Start(); err != nil {
+            cm.log.Error("Error starting FFmpeg: %v", err)
+            sleepContext(ctx, 5*time.Second)
+            continue
+        }
+
+        // On shutdown, ask FFmpeg to stop gracefully so it flushes the current segment
+        processDone := make(chan struct{})
+        go func() {
+            select {
+            case <-ctx.Done():
+                cm.log.Info("[camera %s] Stopping FFmpeg...", cam.ID)
+                if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+                    cm.log.Warning("[camera %s] Failed to send SIGTERM to FFmpeg, killing it: %v", cam.ID, err)
+                    cmd.Process.Kill()
+                }
+            case <-processDone:
+            }
+        }()
+
+        stalled := make(chan struct{})
+        go cm.watchForStall(cam, cmd.Process, time.Now(), processDone, stalled)
+
+        watchDone := make(chan struct{})
+        go func(cycle int) {
+            defer close(watchDone)
+            cm.watchSegmentDir(cam, cycle, extension, processDone)
+        }(cycle)
+
+        // Stderr is only kept for error messages and connection detection, segments are found on disk
+        var stderrTail []string
+        stderrDone := make(chan struct{})
+        go func() {
+            defer close(stderrDone)
+            scanner := bufio.NewScanner(stderr)
+            for scanner.Scan() {
+                stderrTail = append(stderrTail, scanner.Text())
+                if len(stderrTail) > maxStderrLines {
+                    stderrTail = stderrTail[1:]
+                }
+            }
+            if err := scanner.Err(); err != nil {
+                cm.log.Error("Error reading FFmpeg stderr: %v", err)
+                // Keep draining so FFmpeg never blocks on a full pipe
+                io.Copy(io.Discard, stderr)
+            }
+        }()
+
+        <-stderrDone
+        err = cmd.Wait()
+        close(processDone)
+        <-watchDone
+        if ctx.Err() != nil {
+            return
+        }
+        select {
+        case <-stalled:
+            // Continue in a new cycle so the restarted FFmpeg doesn't overwrite this cycle's segments
+            cm.log.Info("[camera %s] Restarting FFmpeg after stall...", cam.ID)
+            cycle++
+            reprobe = true
+            continue
+        default:
+        }
+        if err != nil {
+            errMsg := strings.Join(stderrTail, "\n")
+            cm.log.Error("FFmpeg error: %v\nFFmpeg output: %s", err, errMsg)
+            if isConnectionError(errMsg) {
+                cm.log.Warning("[camera %s] Camera disconnected, retrying connection (attempt %d)...", cam.ID, attempt)
+                attempt++
+                reprobe = true
+                sleepContext(ctx, 10*time.Second)
+                continue
+            }
+            cm.log.Error("Background recording error: %v", err)
+            sleepContext(ctx, 5*time.Second)
+            attempt++
+            continue
+        }
+
+        cm.log.Info("[camera %s] Background recording cycle completed, starting next cycle...", cam.ID)
+        attempt = 1
+        cycle++
+    }
+}
+
+// watchSegmentDir indexes a recording cycle's segments by watching the camera's segment directory,
+// which works with every FFmpeg version and log format. FFmpeg only starts the next segment once
+// the previous one is complete, so the newest file is left alone until a newer one appears or
+// processDone is closed, after which one last scan picks it up. File system events trigger the
+// scans; where the directory can't be watched it is polled instead.
+func (cm *ClipManager) watchSegmentDir(cam *Camera, cycle int, extension string, processDone <-chan struct{}) {
+    prefix := fmt.Sprintf("segment_cycle%d_", cycle)
+    listName := filepath.Base(segmentListPath(cam.segmentDir, cycle))
+
+    var events <-chan fsnotify.Event
+    var watchErrors <-chan error
+    interval := segmentPollInterval
+    watcher, err := fsnotify.NewWatcher()
+    if err == nil {
+        if err = watcher.Add(cam.segmentDir); err != nil {
+            watcher.Close()
+        }
+    }
+    if err != nil {
+        cm.log.Warning("[camera %s] Could not watch %s, polling for new segments instead: %v", cam.ID, cam.segmentDir, err)
+    } else {
+        defer watcher.Close()
+        events, watchErrors = watcher.Events, watcher.Errors
+        interval = segmentRescanInterval
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    debounce := time.NewTimer(segmentEventDebounce)
+    debounce.Stop()
+    defer debounce.Stop()
+
+    indexed := make(map[string]bool)
+    for {
+        finished := false
+        select {
+        case <-processDone:
+            finished = true
+        case <-ticker.C:
+        case <-debounce.C:
+        case event := <-events:
+            // A new segment completes the previous one, and FFmpeg rewrites the list as it does
+            if name := filepath.Base(event.Name); strings.HasPrefix(name, prefix) || name == listName {
+                debounce.Reset(segmentEventDebounce)
+            }
+            continue
+        case err := <-watchErrors:
+            cm.log.Warning("[camera %s] Watching %s for new segments: %v", cam.ID, cam.segmentDir, err)
+            continue
+        }
+
+        entries, err := os.ReadDir(cam.segmentDir)
+        if err != nil {
+            cm.log.Warning("[camera %s] Could not scan %s for new segments: %v", cam.ID, cam.segmentDir, err)
+        }
+
+        present := make(map[string]bool)
+        var pending []string
+        for _, entry := range entries {
+            name := entry.Name()
+            if entry.IsDir() || !strings.HasPrefix(name, prefix) || filepath.Ext(name) != extension {
+                continue
+            }
+            present[name] = true
+            if !indexed[name] {
+                pending = append(pending, name)
+            }
+        }
+        // Forget segments that were rotated out, they never come back
+        for name := range indexed {
+            if !present[name] {
+                delete(indexed, name)
+            }
+        }
+
+        sort.Slice(pending, func(i, j int) bool {
+            return segmentNumber(pending[i]) < segmentNumber(pending[j])
+        })
+        if !finished && len(pending) > 0 {
+            pending = pending[:len(pending)-1]
+        }
+
+        // FFmpeg lists a segment with its exact length when it closes it
+        var durations map[string]time.Duration
+        if len(pending) > 0 {
+            durations = readSegmentDurations(segmentListPath(cam.segmentDir, cycle))
+        }
+        for _, name := range pending {
+            indexed[name] = true
+            info, err := os.Stat(filepath.Join(cam.segmentDir, name))
+            if err != nil || info.Size() == 0 {
+                continue
+            }
+            // The modification time is when FFmpeg finished writing, i.e. the end of the segment
+            cm.log.Success("[camera %s] New segment created: %s at %s", cam.ID, name, info.ModTime().Format("15:04:05"))
+            cm.addSegment(cam, name, info.ModTime(), cm.segmentLength(durations, name))
+        }
+
+        if finished {
+            return
+        }
+    }
+}
+
+// segmentListPath returns the path of the m3u8 list FFmpeg writes for a recording cycle
+func segmentListPath(segmentDir string, cycle int) string {
+    return filepath.Join(segmentDir, fmt.Sprintf("segments_cycle%d.m3u8", cycle))
+}
+
+// readSegmentDurations returns the length of every segment in an m3u8 segment list, keyed by file name
+func readSegmentDurations(listPath string) map[string]time.Duration {
+    data, err := os.ReadFile(listPath)
+    if err != nil {
+        return nil
+    }
+
+    durations := make(map[string]time.Duration)
+    var duration time.Duration
+    for _, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if value, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+            value, _, _ = strings.Cut(value, ",")
+            seconds, err := strconv.ParseFloat(value, 64)
+            if err == nil && seconds > 0 {
+                duration = time.Duration(seconds * float64(time.Second))
+            }
+            continue
+        }
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if duration > 0 {
+            durations[filepath.Base(filepath.FromSlash(line))] = duration
+        }
+        duration = 0
+    }
+    return durations
+}
+
+// segmentLength returns a segment's length from its cycle's segment list, or SEGMENT_DURATION when
+// it isn't listed (yet)
+func (cm *ClipManager) segmentLength(durations map[string]time.Duration, name string) time.Duration {
+    if duration, ok := durations[name]; ok {
+        return duration
+    }
+    return time.Duration(cm.segmentDuration) * time.Second
+}
+
+// segmentNumber returns the number of a segment within its recording cycle, or -1 for other files
+func segmentNumber(name string) int {
+    matches := segmentCyclePattern.FindStringSubmatch(name)
+    if matches == nil {
+        return -1
+    }
+    number, err := strconv.Atoi(matches[2])
+    if err != nil {
+        return -1
+    }
+    return number
+}
+
+// checkBufferDiskRequirement estimates the disk space needed to hold the full backtrack
+// window for all cameras and warns when it exceeds the available space
+func (cm *ClipManager) checkBufferDiskRequirement() {
+	var requiredBytes uint64
+	for _, cam := range cm.cameras {
+		cam.segmentsMutex.RLock()
+		segments := make([]SegmentInfo, len(cam.segments))
+		copy(segments, cam.segments)
+		cam.segmentsMutex.RUnlock()
+
+		// Segments are only indexed once complete, so every one is a fair sample
+		var totalSize int64
+		var sampled int64
+		for _, segment := range segments {
+			if info, err := os.Stat(segment.Path); err == nil {
+				totalSize += info.Size()
+				sampled++
+			}
+		}
+		if sampled == 0 {
+			continue
+		}
+		requiredBytes += uint64(totalSize/sampled) * uint64(cm.maxSegments)
+	}
+
+	if requiredBytes == 0 {
+		return
+	}
+
+	availableSpace, err := cm.CheckDiskSpace()
+	if err != nil {
+		cm.log.Warning("Could not verify disk space for the backtrack buffer: %v", err)
+		return
+	}
+
+	requiredMB := requiredBytes / (1024 * 1024)
+	availableMB := availableSpace / (1024 * 1024)
+	if requiredBytes > availableSpace {
+		cm.log.Warning("Backtrack buffer of %d seconds needs about %d MB but only %d MB is available, consider lowering MAX_BACKTRACK_SECONDS",
+			cm.maxBacktrackSeconds, requiredMB, availableMB)
+	} else {
+		cm.log.Info("Backtrack buffer of %d seconds needs about %d MB (%d MB available)",
+			cm.maxBacktrackSeconds, requiredMB, availableMB)
+	}
+}
+
+// addSegment indexes a complete segment that finished writing at completedAt and is duration long
+func (cm *ClipManager) addSegment(cam *Camera, segmentPath string, completedAt time.Time, duration time.Duration) {
+    cam.segmentsMutex.Lock()
+    defer cam.segmentsMutex.Unlock()
+
+    absolutePath := filepath.Join(cam.segmentDir, segmentPath)
+
+    // Parse segment number for logging
+    matches := segmentCyclePattern.FindStringSubmatch(segmentPath)
+    segmentNum := 0
+    if len(matches) == 3 {
+        if cycle, err := strconv.Atoi(matches[1]); err == nil {
+            cam.currentCycle = cycle
+        }
+        segNum, err := strconv.Atoi(matches[2])
+        if err != nil {
+            cm.log.Warning("Failed to parse segment number from %s: %v, assuming 0", segmentPath, err)
+            segmentNum = 0
+        } else {
+            segmentNum = segNum
+        }
+    } else {
+        cm.log.Warning("Failed to parse cycle and segment numbers from %s, assuming segment 0", segmentPath)
+    }
+
+    // The segment's footage started its length before FFmpeg finished writing it
+    segmentInfo := SegmentInfo{
+        Path:      absolutePath,
+        Timestamp: completedAt.Add(-duration),
+        Duration:  duration,
+    }
+    cam.segments = append(cam.segments, segmentInfo)
+    cam.lastSegmentAt = completedAt
+
+    // Once a few segments are complete we know the stream's real bitrate, so check the buffer fits on disk
+    if len(cam.segments) == 3 {
+        go cm.checkBufferDiskRequirement()
+    }
+
+    sort.Slice(cam.segments, func(i, j int) bool {
+        return cam.segments[i].Timestamp.Before(cam.segments[j].Timestamp)
+    })
+
+    if len(cam.segments) > cm.maxSegments {
+        for _, old := range cam.segments[:len(cam.segments)-cm.maxSegments] {
+            if err := os.Remove(old.Path); err != nil {
+                cm.log.Error("Failed to remove old segment %s: %v", old.Path, err)
+            } else {
+                cm.log.Info("Removed old segment: %s", filepath.Base(old.Path))
+            }
+        }
+        cam.segments = cam.segments[len(cam.segments)-cm.maxSegments:]
+    }
+
+    // Notify waiting clip requests without ever blocking the recorder. A subscriber with a full
+    // buffer already has pending wake-ups and re-reads cam.segments, so nothing is lost by skipping it.
+    for ch := range cam.subscribers {
+        select {
+        case ch <- segmentInfo:
+        default:
+            cm.log.Debug("[camera %s] Segment subscriber is busy, skipping notification", cam.ID)
+        }
+    }
+
+    cm.log.Info("[camera %s] Added segment: %s (seg %d) with timestamp %s, total: %d (up to %d seconds)",
+        cam.ID, segmentPath, segmentNum, segmentInfo.Timestamp.Format("15:04:05"), len(cam.segments), len(cam.segments)*cm.segmentDuration)
+}
+
+func (cm *ClipManager) getVideoAspectRatio(filePath string) (string, error) {
+	cmd := exec.Command(cm.ffprobePath,
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "json",
+		filePath)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ffprobe failed to get video dimensions: %v", err)
+	}
+
+	var result struct {
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+	}
+
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		return "", fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	if len(result.Streams) == 0 {
+		return "", fmt.Errorf("no video stream found in file")
+	}
+
+	width := result.Streams[0].Width
+	height := result.Streams[0].Height
+
+	if width == 0 || height == 0 {
+		return "", fmt.Errorf("invalid video dimensions: width=%d, height=%d", width, height)
+	}
+
+	return aspectRatio(width, height), nil
+}
+
+// aspectRatio reduces video dimensions to a ratio such as 16:9
+func aspectRatio(width, height int) string {
+	gcd := func(a, b int) int {
+		for b != 0 {
+			a, b = b, a%b
+		}
+		return a
+	}
+	divisor := gcd(width, height)
+	return fmt.Sprintf("%d:%d", width/divisor, height/divisor)
+}
+
+// AudioNormalization holds the loudnorm targets for a clip
+type AudioNormalization struct {
+    I       float64
+    LRA     float64
+    TP      float64
+    OnePass bool
+}
+
+// validate checks the targets against the ranges the loudnorm filter accepts
+func (n *AudioNormalization) validate() error {
+    if n.I < -70 || n.I > -5 {
+        return fmt.Errorf("invalid loudnorm_i: must be between -70 and -5 LUFS")
+    }
+    if n.LRA < 1 || n.LRA > 20 {
+        return fmt.Errorf("invalid loudnorm_lra: must be between 1 and 20 LU")
+    }
+    if n.TP < -9 || n.TP > 0 {
+        return fmt.Errorf("invalid loudnorm_tp: must be between -9 and 0 dBTP")
+    }
+    return nil
+}
+
+// compressionSettings applies the request's CRF overrides and size cap to the configured defaults
+func (req *ClipRequest) compressionSettings(defaults CompressionSettings) CompressionSettings {
+    settings := defaults
+    if req.CRFStart != 0 {
+        settings.InitialCRF = req.CRFStart
+    }
+    if req.CRFMax != 0 {
+        settings.MaxCRF = req.CRFMax
+    }
+    if req.CRFStep != 0 {
+        settings.CRFStep = req.CRFStep
+    }
+    if req.CompressionMode != "" {
+        settings.Mode = strings.ToLower(req.CompressionMode)
+    }
+    settings.MaxFileSizeMB = req.MaxFileSizeMB
+    return settings
+}
+
+// audioNormalization returns the loudness normalization settings for the request, or nil when
+// audio_normalize isn't set. Targets that weren't given use the EBU R128 defaults.
+func (req *ClipRequest) audioNormalization() (*AudioNormalization, error) {
+    if !req.AudioNormalize {
+        return nil, nil
+    }
+
+    n := &AudioNormalization{I: req.LoudnormI, LRA: req.LoudnormLRA, TP: req.LoudnormTP}
+    if n.I == 0 {
+        n.I = defaultLoudnormI
+    }
+    if n.LRA == 0 {
+        n.LRA = defaultLoudnormLRA
+    }
+    if n.TP == 0 {
+        n.TP = defaultLoudnormTP
+    }
+
+    switch req.AudioNormalizeMode {
+    case "", "two-pass":
+    case "one-pass":
+        n.OnePass = true
+    default:
+        return nil, fmt.Errorf("invalid audio_normalize_mode: must be one-pass or two-pass")
+    }
+
+    return n, n.validate()
+}
+
+// loudnormFilter builds the loudnorm filter for a clip. In two-pass mode the clip is measured
+// first so the second pass can apply a linear gain instead of dynamic compression.
+func (cm *ClipManager) loudnormFilter(logger *Logger, filePath string, n *AudioNormalization) (string, error) {
+    filter := fmt.Sprintf("loudnorm=I=%g:LRA=%g:TP=%g", n.I, n.LRA, n.TP)
+    if n.OnePass {
+        return filter, nil
+    }
+
+    cmd := exec.Command(cm.ffmpegPath, "-hide_banner", "-i", filePath, "-af", filter+":print_format=json", "-vn", "-f", "null", "-")
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return "", fmt.Errorf("loudness measurement failed: %v", err)
+    }
+
+    // The measurement is the last JSON object FFmpeg prints
+    output := stderr.String()
+    start := strings.LastIndex(output, "{")
+    end := strings.LastIndex(output, "}")
+    if start < 0 || end < start {
+        return "", fmt.Errorf("loudness measurement returned no results")
+    }
+
+    var measured struct {
+        InputI       string `json:"input_i"`
+        InputLRA     string `json:"input_lra"`
+        InputTP      string `json:"input_tp"`
+        InputThresh  string `json:"input_thresh"`
+        TargetOffset string `json:"target_offset"`
+    }
+    if err := json.Unmarshal([]byte(output[start:end+1]), &measured); err != nil {
+        return "", fmt.Errorf("failed to parse loudness measurement: %v", err)
+    }
+    // Silent clips measure as -inf and can't be normalized linearly
+    if strings.Contains(measured.InputI, "inf") {
+        return filter, nil
+    }
+
+    logger.Info("🔊 Measured loudness: %s LUFS, range %s LU, true peak %s dBTP", measured.InputI, measured.InputLRA, measured.InputTP)
+    return fmt.Sprintf("%s:measured_I=%s:measured_LRA=%s:measured_TP=%s:measured_thresh=%s:offset=%s:linear=true",
+        filter, measured.InputI, measured.InputLRA, measured.InputTP, measured.InputThresh, measured.TargetOffset), nil
+}
+
+// overlayPosition returns the drawtext x/y expressions for an overlay_position parameter
+func overlayPosition(position string) (string, error) {
+	const margin = "20"
+	switch strings.ToLower(position) {
+	case "top-left":
+		return "x=" + margin + ":y=" + margin, nil
+	case "top-right":
+		return "x=w-tw-" + margin + ":y=" + margin, nil
+	case "bottom-left":
+		return "x=" + margin + ":y=h-th-" + margin, nil
+	case "", "bottom-right":
+		return "x=w-tw-" + margin + ":y=h-th-" + margin, nil
+	default:
+		return "", fmt.Errorf("invalid overlay_position '%s': use top-left, top-right, bottom-left or bottom-right", position)
+	}
+}
+
+// filterOptionEscaper and filtergraphEscaper escape a value for the two levels FFmpeg parses a
+// -vf argument at: the filter's options, split at colons, and the filtergraph, split at commas,
+// semicolons and brackets. Both treat backslashes and single quotes as escapes.
+var (
+	filterOptionEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	filtergraphEscaper  = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+)
+
+// escapeFilterValue escapes a filter option value, such as a file path, for use in a -vf argument
+func escapeFilterValue(value string) string {
+	return filtergraphEscaper.Replace(filterOptionEscaper.Replace(value))
+}
+
+// applyOverlay re-encodes a clip in place with team names, category and capture time drawn in a corner.
+// The text is passed through a file so the filtergraph never sees it, and drawn with expansion=none so
+// drawtext doesn't expand % sequences in team names. The paths of the text file and the font are
+// escaped, as they can hold colons (C:\ on Windows) or quotes.
+func (cm *ClipManager) applyOverlay(logger *Logger, filePath string, req *ClipRequest, captureTime time.Time) error {
+	coordinates, err := overlayPosition(req.OverlayPosition)
+	if err != nil {
+		return err
+	}
+	fontSize := req.OverlayFontSize
+	if fontSize == 0 {
+		fontSize = defaultOverlayFontSize
+	}
+
+	var lines []string
+	team1, team2 := req.Team1, req.Team2
+	if team1 != "" && team2 != "" {
+		lines = append(lines, fmt.Sprintf("%s vs %s", team1, team2))
+	} else if team1 != "" || team2 != "" {
+		lines = append(lines, team1+team2)
+	}
+	if req.Category != "" {
+		lines = append(lines, req.Category)
+	}
+	lines = append(lines, captureTime.Format("2006-01-02 15:04:05"))
+
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	textPath := base + "_overlay.txt"
+	if err := os.WriteFile(textPath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		return fmt.Errorf("failed to write overlay text: %v", err)
+	}
+	defer os.Remove(textPath)
+
+	drawtext := fmt.Sprintf("drawtext=textfile=%s:expansion=none:%s:fontsize=%d:fontcolor=white:line_spacing=6:box=1:boxcolor=black@0.5:boxborderw=10",
+		escapeFilterValue(textPath), coordinates, fontSize)
+	if font := os.Getenv("OVERLAY_FONT"); font != "" {
+		if _, err := os.Stat(font); err == nil {
+			drawtext += ":fontfile=" + escapeFilterValue(font)
+		} else {
+			logger.Warning("OVERLAY_FONT %s not found, using the default font", font)
+		}
+	}
+
+	videoArgs := []string{"-c:v", "libx264", "-crf", "20", "-preset", "veryfast", "-pix_fmt", "yuv420p"}
+	if filepath.Ext(filePath) == ".webm" {
+		videoArgs = []string{"-c:v", "libvpx-vp9", "-crf", "32", "-b:v", "0", "-deadline", "realtime", "-cpu-used", "8", "-row-mt", "1"}
+	}
+
+	overlayPath := base + "_overlay" + filepath.Ext(filePath)
+	args := []string{"-i", filePath, "-vf", drawtext}
+	args = append(args, videoArgs...)
+	args = append(args, "-c:a", "copy")
+	args = append(args, muxerArgs(overlayPath)...)
+	args = append(args, "-y", overlayPath)
+
+	release := cm.acquireEncodeSlot(logger)
+	logger.Info("🖋️ Adding overlay to clip")
+	logger.Debug("Overlay FFmpeg command: ffmpeg %s", strings.Join(args, " "))
+	cmd := exec.Command(cm.ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	release()
+	if err != nil {
+		os.Remove(overlayPath)
+		return fmt.Errorf("failed to draw overlay: %v\nFFmpeg output: %s", err, stderr.String())
+	}
+
+	if err := os.Rename(overlayPath, filePath); err != nil {
+		os.Remove(overlayPath)
+		return fmt.Errorf("failed to replace clip with overlay version: %v", err)
+	}
+	return nil
+}
+
+// clipExtension returns the file extension for the output_format and container parameters.
+// Without a container VP9 goes into WebM and everything else into MP4. WebM only holds VP9/Opus,
+// Matroska holds whatever the camera sends.
+func clipExtension(format, container string) (string, error) {
+    switch strings.ToLower(format) {
+    case "", "copy", "h264", "vp9":
+    default:
+        return "", fmt.Errorf("invalid output_format '%s': use copy, h264 or vp9", format)
+    }
+
+    switch strings.ToLower(container) {
+    case "":
+        if strings.ToLower(format) == "vp9" {
+            return ".webm", nil
+        }
+        return ".mp4", nil
+    case "mp4":
+        return ".mp4", nil
+    case "mkv":
+        return ".mkv", nil
+    case "webm":
+        if strings.ToLower(format) != "vp9" {
+            return "", fmt.Errorf("container webm requires output_format vp9")
+        }
+        return ".webm", nil
+    default:
+        return "", fmt.Errorf("invalid container '%s': use mp4, mkv or webm", container)
+    }
+}
+
+// isClipFile reports whether a filename has one of the clip extensions clipExtension produces
+func isClipFile(name string) bool {
+    switch strings.ToLower(filepath.Ext(name)) {
+    case ".mp4", ".mkv", ".webm":
+        return true
+    }
+    return false
+}
+
+// muxerArgs returns the container specific FFmpeg output flags for a clip path. MP4 moves its
+// index to the front so playback can start before the download finishes; Matroska and WebM
+// are streamable as written.
+func muxerArgs(outputPath string) []string {
+    if strings.EqualFold(filepath.Ext(outputPath), ".mp4") {
+        return []string{"-movflags", "+faststart"}
+    }
+    return nil
+}
+
+// videoContentType returns the MIME type for a clip based on its extension
+func videoContentType(filePath string) string {
+    switch strings.ToLower(filepath.Ext(filePath)) {
+    case ".webm":
+        return "video/webm"
+    case ".mkv":
+        return "video/x-matroska"
+    }
+    return "video/mp4"
+}
+
+// probeCodecs returns the codec names of the first video and audio stream in a file
+func (cm *ClipManager) probeCodecs(filePath string) (videoCodec, audioCodec string, err error) {
+    cmd := exec.Command(cm.ffprobePath,
+        "-v", "error",
+        "-show_entries", "stream=codec_type,codec_name",
+        "-of", "json",
+        filePath)
+
+    var out bytes.Buffer
+    cmd.Stdout = &out
+    if err := cmd.Run(); err != nil {
+        return "", "", fmt.Errorf("ffprobe failed to get codecs: %v", err)
+    }
+
+    var result struct {
+        Streams []struct {
+            CodecType string `json:"codec_type"`
+            CodecName string `json:"codec_name"`
+        } `json:"streams"`
+    }
+    if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+        return "", "", fmt.Errorf("failed to parse ffprobe output: %v", err)
+    }
+
+    for _, stream := range result.Streams {
+        if stream.CodecType == "video" && videoCodec == "" {
+            videoCodec = stream.CodecName
+        } else if stream.CodecType == "audio" && audioCodec == "" {
+            audioCodec = stream.CodecName
+        }
+    }
+    return videoCodec, audioCodec, nil
+}
+
+// ClipMetadata describes a clip on the SFTP server as reported by ffprobe
+type ClipMetadata struct {
+    Path            string    `json:"path"`
+    SizeBytes       int64     `json:"size_bytes"`
+    ModTime         time.Time `json:"mod_time"`
+    DurationSeconds float64   `json:"duration_seconds"`
+    BitRate         int64     `json:"bit_rate"` // Overall bits per second
+    Width           int       `json:"width,omitempty"`
+    Height          int       `json:"height,omitempty"`
+    AspectRatio     string    `json:"aspect_ratio,omitempty"`
+    VideoCodec      string    `json:"video_codec,omitempty"`
+    AudioCodec      string    `json:"audio_codec,omitempty"`
+}
+
+// probeClipMetadata reads the duration, bitrate, dimensions and codecs of a file with a single ffprobe run
+func (cm *ClipManager) probeClipMetadata(filePath string) (ClipMetadata, error) {
+    cmd := exec.Command(cm.ffprobePath,
+        "-v", "error",
+        "-show_entries", "format=duration,bit_rate:stream=codec_type,codec_name,width,height",
+        "-of", "json",
+        filePath)
+
+    var out bytes.Buffer
+    cmd.Stdout = &out
+    if err := cmd.Run(); err != nil {
+        return ClipMetadata{}, fmt.Errorf("ffprobe could not analyze clip: %v", err)
+    }
+
+    var result struct {
+        Format struct {
+            Duration string `json:"duration"`
+            BitRate  string `json:"bit_rate"`
+        } `json:"format"`
+        Streams []struct {
+            CodecType string `json:"codec_type"`
+            CodecName string `json:"codec_name"`
+            Width     int    `json:"width"`
+            Height    int    `json:"height"`
+        } `json:"streams"`
+    }
+    if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+        return ClipMetadata{}, fmt.Errorf("failed to parse ffprobe output: %v", err)
+    }
+
+    var info ClipMetadata
+    duration, err := strconv.ParseFloat(result.Format.Duration, 64)
+    if err != nil {
+        return ClipMetadata{}, fmt.Errorf("could not parse clip duration: %v", err)
+    }
+    info.DurationSeconds = duration
+    // Some containers don't report a bitrate, it is left at 0 then
+    info.BitRate, _ = strconv.ParseInt(result.Format.BitRate, 10, 64)
+
+    for _, stream := range result.Streams {
+        if stream.CodecType == "video" && info.VideoCodec == "" {
+            info.VideoCodec = stream.CodecName
+            info.Width = stream.Width
+            info.Height = stream.Height
+            if stream.Width > 0 && stream.Height > 0 {
+                info.AspectRatio = aspectRatio(stream.Width, stream.Height)
+            }
+        } else if stream.CodecType == "audio" && info.AudioCodec == "" {
+            info.AudioCodec = stream.CodecName
+        }
+    }
+    return info, nil
+}
+
+// isTranscode reports whether codec arguments from codecArgs re-encode the stream instead of copying it
+func isTranscode(codecArgs []string) bool {
+    return len(codecArgs) >= 2 && codecArgs[1] != "copy"
+}
+
+// codecArgs returns the FFmpeg codec arguments for an output format, copying streams
+// whose codec the target container already supports and transcoding the rest
+func codecArgs(format, videoCodec, audioCodec string) (videoArgs, audioArgs []string) {
+    switch strings.ToLower(format) {
+    case "h264":
+        videoArgs = []string{"-c:v", "libx264", "-crf", "23", "-preset", "veryfast", "-pix_fmt", "yuv420p"}
+        if videoCodec == "h264" {
+            videoArgs = []string{"-c:v", "copy"}
+        }
+        audioArgs = []string{"-c:a", "aac", "-b:a", "128k"}
+        if audioCodec == "aac" {
+            audioArgs = []string{"-c:a", "copy"}
+        }
+    case "vp9":
+        videoArgs = []string{"-c:v", "libvpx-vp9", "-crf", "32", "-b:v", "0", "-deadline", "realtime", "-cpu-used", "8", "-row-mt", "1"}
+        if videoCodec == "vp9" || videoCodec == "vp8" {
+            videoArgs = []string{"-c:v", "copy"}
+        }
+        audioArgs = []string{"-c:a", "libopus", "-b:a", "128k"}
+        if audioCodec == "opus" || audioCodec == "vorbis" {
+            audioArgs = []string{"-c:a", "copy"}
+        }
+    default:
+        videoArgs = []string{"-c:v", "copy"}
+        audioArgs = []string{"-c:a", "copy"}
+    }
+    return videoArgs, audioArgs
+}
+
+// writeConcatList writes an FFmpeg concat demuxer list of segments next to the camera's segments
+// and returns its path, named after the output file so concurrent clips don't collide
+func writeConcatList(cam *Camera, outputPath string, segments []SegmentInfo) (string, error) {
+    concatListPath := filepath.Join(cam.segmentDir, fmt.Sprintf("concat_list_%s.txt", strings.TrimSuffix(filepath.Base(outputPath), filepath.Ext(outputPath))))
+    concatFile, err := os.Create(concatListPath)
+    if err != nil {
+        return "", fmt.Errorf("failed to create concat list: %v", err)
+    }
+
+    for _, segment := range segments {
+        fmt.Fprintf(concatFile, "file '%s'\n", segment.Path)
+    }
+    if err := concatFile.Close(); err != nil {
+        os.Remove(concatListPath)
+        return "", fmt.Errorf("failed to write concat list: %v", err)
+    }
+    return concatListPath, nil
+}
+
+// segmentCyclePattern matches segment filenames, capturing the recording cycle and segment number
+var segmentCyclePattern = regexp.MustCompile(`segment_cycle(\d+)_(\d+)\.(?:ts|mp4)$`)
+
+// segmentDiscontinuity is a break between two consecutive segments: footage is missing, or FFmpeg
+// was restarted and the second segment starts a new recording cycle with new timestamps
+type segmentDiscontinuity struct {
+    Before, After SegmentInfo
+    Missing       time.Duration
+    NewCycle      bool
+}
+
+// findDiscontinuities returns the breaks between consecutive segments. Segment timestamps come from
+// file modification times, which lag a little behind the footage, so gaps up to half a segment (at
+// least a second) count as continuous.
+func findDiscontinuities(segments []SegmentInfo, segmentDuration int) []segmentDiscontinuity {
+    tolerance := time.Duration(segmentDuration) * time.Second / 2
+    if tolerance < time.Second {
+        tolerance = time.Second
+    }
+
+    var breaks []segmentDiscontinuity
+    for i := 1; i < len(segments); i++ {
+        before, after := segments[i-1], segments[i]
+        missing := after.Timestamp.Sub(before.End())
+        beforeCycle := segmentCyclePattern.FindStringSubmatch(filepath.Base(before.Path))
+        afterCycle := segmentCyclePattern.FindStringSubmatch(filepath.Base(after.Path))
+        newCycle := beforeCycle != nil && afterCycle != nil && beforeCycle[1] != afterCycle[1]
+        if missing > tolerance || newCycle {
+            if missing < 0 {
+                missing = 0
+            }
+            breaks = append(breaks, segmentDiscontinuity{Before: before, After: after, Missing: missing, NewCycle: newCycle})
+        }
+    }
+    return breaks
+}
+
+// Placeholder is the video generated for an audio-only camera, which containers and destinations
+// expect a video stream from: a solid color, or Image scaled onto it
+type Placeholder struct {
+    Size      string // WxH with even dimensions
+    Framerate int
+    Color     string // FFmpeg color name or hex
+    Image     string // Optional background image from PLACEHOLDER_IMAGE
+}
+
+var placeholderColorPattern = regexp.MustCompile(`^(?:#|0x)[0-9a-fA-F]{6}(?:[0-9a-fA-F]{2})?$|^[a-zA-Z]+$`)
+
+// parsePlaceholderSize parses a WxH placeholder size, rounding odd dimensions down for the encoders
+func parsePlaceholderSize(size string) (width, height int, err error) {
+    if n, err := fmt.Sscanf(strings.ToLower(size), "%dx%d", &width, &height); err != nil || n != 2 ||
+        width < 16 || height < 16 || width > 3840 || height > 2160 || fmt.Sprintf("%dx%d", width, height) != strings.ToLower(size) {
+        return 0, 0, fmt.Errorf("'%s' must be WxH between 16x16 and 3840x2160 (e.g. 1280x720)", size)
+    }
+    return width - width%2, height - height%2, nil
+}
+
+// inputArgs returns the FFmpeg input of the placeholder video
+func (p Placeholder) inputArgs() []string {
+    width, height, _ := parsePlaceholderSize(p.Size)
+    if p.Image != "" {
+        return []string{"-loop", "1", "-framerate", strconv.Itoa(p.Framerate), "-i", p.Image}
+    }
+    return []string{"-f", "lavfi", "-i", fmt.Sprintf("color=c=%s:s=%dx%d:r=%d", p.Color, width, height, p.Framerate)}
+}
+
+// filterArgs returns the video filter that fits the background image into the placeholder size,
+// or nothing for a solid color
+func (p Placeholder) filterArgs() []string {
+    if p.Image == "" {
+        return nil
+    }
+    width, height, _ := parsePlaceholderSize(p.Size)
+    return []string{"-filter:v", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=%s,format=yuv420p",
+        width, height, width, height, p.Color)}
+}
+
+// clipPlaceholder returns the placeholder configured by the PLACEHOLDER_* variables with the
+// request's overrides
+func (cm *ClipManager) clipPlaceholder(req *ClipRequest) Placeholder {
+    placeholder := cm.placeholder
+    if req.PlaceholderSize != "" {
+        placeholder.Size = req.PlaceholderSize
+    }
+    if req.PlaceholderFramerate > 0 {
+        placeholder.Framerate = req.PlaceholderFramerate
+    }
+    if req.PlaceholderColor != "" {
+        placeholder.Color = req.PlaceholderColor
+    }
+    return placeholder
+}
+
+// overlappingSegments returns the segments with footage between start and end, oldest first
+func overlappingSegments(segments []SegmentInfo, start, end time.Time) []SegmentInfo {
+    var overlapping []SegmentInfo
+    for _, segment := range segments {
+        if segment.End().After(start) && segment.Timestamp.Before(end) {
+            overlapping = append(overlapping, segment)
+        }
+    }
+    sort.Slice(overlapping, func(i, j int) bool {
+        return overlapping[i].Timestamp.Before(overlapping[j].Timestamp)
+    })
+    return overlapping
+}
+
+// clipStartOffset is how far into the first of the selected segments the clip starts
+func clipStartOffset(segments []SegmentInfo, start time.Time) time.Duration {
+    if len(segments) == 0 {
+        return 0
+    }
+    offset := start.Sub(segments[0].Timestamp)
+    if offset < 0 {
+        return 0
+    }
+    return offset
+}
+
+// RecordOptions are the request options that change how RecordClip cuts the clip from the buffer
+type RecordOptions struct {
+    OutputFormat string
+    Accurate     bool
+    VideoTrack   *int // Track of the buffer, nil lets FFmpeg choose
+    AudioTrack   *int
+    Placeholder  Placeholder // Video of clips from an audio-only camera
+}
+
+func (cm *ClipManager) RecordClip(ctx context.Context, logger *Logger, cam *Camera, backtrackSeconds, durationSeconds float64, outputPath string, opts RecordOptions, requestTime time.Time) (ClipRange, error) {
+    outputFormat, accurate := opts.OutputFormat, opts.Accurate
+    startTime := requestTime.Add(-secondsDuration(backtrackSeconds))
+    endTime := startTime.Add(secondsDuration(durationSeconds))
+
+    logger.Info("📹 Requested clip from %s to %s", startTime.Format("15:04:05.000"), endTime.Format("15:04:05.000"))
+
+    var neededSegments []SegmentInfo
+    logger.Info("Starting segment selection...")
+
+    // Subscribe before the first copy of the segment list so no new segment can be missed
+    segmentUpdates := cm.subscribeSegments(cam)
+    defer cm.unsubscribeSegments(cam, segmentUpdates)
+    
+    hasAudio, hasVideo, probed := cam.streams()
+    if !probed {
+        hasAudio, hasVideo = cm.probeCameraStreams(cam)
+    }
+
+    // A track can only be clipped when the recorder keeps it, see VIDEO_TRACK and AUDIO_TRACK
+    if opts.VideoTrack != nil && hasVideo {
+        if count := cam.bufferedTracks("video"); *opts.VideoTrack >= count {
+            return ClipRange{}, fmt.Errorf("video_track %d is not in the buffer, camera %s records %d video track(s)", *opts.VideoTrack, cam.ID, count)
+        }
+    }
+    if opts.AudioTrack != nil && hasAudio {
+        if count := cam.bufferedTracks("audio"); *opts.AudioTrack >= count {
+            return ClipRange{}, fmt.Errorf("audio_track %d is not in the buffer, camera %s records %d audio track(s)", *opts.AudioTrack, cam.ID, count)
+        }
+    }
+
+    for {
+        cam.segmentsMutex.RLock()
+        segments := make([]SegmentInfo, len(cam.segments))
+        copy(segments, cam.segments)
+        cam.segmentsMutex.RUnlock()
+        logger.Info("Copied %d segments", len(segments))
+
+        if len(segments) == 0 {
+            logger.Warning("No segments available, waiting for first segment...")
+            select {
+            case newSegment := <-segmentUpdates:
+                logger.Info("📼 Received first segment: %s at %s", filepath.Base(newSegment.Path), newSegment.Timestamp.Format("15:04:05.000"))
+                continue
+            case <-time.After(10 * time.Second):
+                return ClipRange{}, fmt.Errorf("timeout waiting for first segment")
+            case <-ctx.Done():
+                return ClipRange{}, fmt.Errorf("recording stopped while waiting for first segment")
+            }
+        }
+
+        neededSegments = []SegmentInfo{}
+        earliestTime := segments[0].Timestamp
+        latestTime := segments[len(segments)-1].Timestamp
+        latestSegmentEnd := segments[len(segments)-1].End()
+
+        logger.Info("Segment range: %s to %s (end: %s)", 
+            earliestTime.Format("15:04:05.000"), 
+            latestTime.Format("15:04:05.000"),
+            latestSegmentEnd.Format("15:04:05.000"))
+
+        if startTime.Before(earliestTime) {
+            logger.Warning("Requested start time %s is before earliest segment at %s, adjusting", 
+                startTime.Format("15:04:05.000"), earliestTime.Format("15:04:05.000"))
+            startTime = earliestTime
+            endTime = startTime.Add(secondsDuration(durationSeconds))
+        }
+
+        // Wacht alleen als we te weinig dekking hebben
+        if endTime.After(latestSegmentEnd) && latestSegmentEnd.Before(startTime.Add(secondsDuration(durationSeconds/2))) {
+            logger.Info("⏳ End time %s is after latest segment end %s, waiting for more segments...", 
+                endTime.Format("15:04:05.000"), latestSegmentEnd.Format("15:04:05.000"))
+            select {
+            case newSegment := <-segmentUpdates:
+                logger.Info("📼 Received new segment: %s at %s", 
+                    filepath.Base(newSegment.Path), newSegment.Timestamp.Format("15:04:05.000"))
+                continue
+            case <-time.After(5 * time.Second):
+                logger.Warning("Timeout waiting for segments, checking available segments")
+                // Ga verder als we enige overlap hebben
+                break
+            case <-ctx.Done():
+                logger.Warning("Recording stopped, checking available segments")
+                break
+            }
+        }
+
+        neededSegments = overlappingSegments(segments, startTime, endTime)
+        for _, segment := range neededSegments {
+            logger.Debug("Selected segment: %s (%s to %s)", 
+                filepath.Base(segment.Path), 
+                segment.Timestamp.Format("15:04:05.000"), 
+                segment.End().Format("15:04:05.000"))
+        }
+
+        if len(neededSegments) > 0 {
+            firstSegmentStart := neededSegments[0].Timestamp
+            lastSegmentEnd := neededSegments[len(neededSegments)-1].End()
+
+            logger.Info("Selected %d segments, range: %s to %s", 
+                len(neededSegments), 
+                firstSegmentStart.Format("15:04:05.000"), 
+                lastSegmentEnd.Format("15:04:05.000"))
+
+            // Accepteer als we enige overlap hebben, zelfs als niet volledig gedekt
+            if firstSegmentStart.Before(endTime) && lastSegmentEnd.After(startTime) {
+                logger.Info("Partial overlap found, proceeding with available segments")
+                break
+            }
+            logger.Warning("No sufficient overlap, waiting for more segments...")
+        }
+
+        select {
+        case newSegment := <-segmentUpdates:
+            logger.Info("📼 Received new segment: %s at %s", 
+                filepath.Base(newSegment.Path), newSegment.Timestamp.Format("15:04:05.000"))
+            continue
+        case <-time.After(5 * time.Second):
+            if len(neededSegments) > 0 {
+                logger.Warning("Timeout waiting for full coverage, using partial segments")
+                break
+            }
+            return ClipRange{}, fmt.Errorf("timeout waiting for overlapping segments")
+        case <-ctx.Done():
+            return ClipRange{}, fmt.Errorf("recording stopped while waiting for overlapping segments")
+        }
+    }
+
+    logger.Success("Selected %d segments for clip", len(neededSegments))
+
+    // Copying streams across a reconnect joins two timelines, which shows up as frozen or skipped
+    // video. Re-encoding gives the clip one continuous timeline; the missing footage is left out.
+    discontinuities := findDiscontinuities(neededSegments, cm.segmentDuration)
+    var missing time.Duration
+    var gaps []ClipGap
+    for _, d := range discontinuities {
+        missing += d.Missing
+        if d.Missing > 0 {
+            gapStart := d.Before.End()
+            gaps = append(gaps, ClipGap{Start: gapStart, End: d.After.Timestamp, Seconds: d.Missing.Seconds()})
+        }
+        if d.NewCycle {
+            logger.Warning("Clip spans a recorder restart between %s and %s, %.1f seconds of footage are missing",
+                filepath.Base(d.Before.Path), filepath.Base(d.After.Path), d.Missing.Seconds())
+        } else {
+            logger.Warning("Clip spans a gap in the recording between %s and %s, %.1f seconds of footage are missing",
+                filepath.Base(d.Before.Path), filepath.Base(d.After.Path), d.Missing.Seconds())
+        }
+    }
+    if len(discontinuities) > 0 {
+        logger.Warning("Re-encoding the clip to join the footage around %d discontinuities, it will be up to %.1f seconds shorter than requested",
+            len(discontinuities), missing.Seconds())
+        if outputFormat == "" || outputFormat == "copy" {
+            outputFormat = "h264"
+        }
+    }
+
+    concatListPath, err := writeConcatList(cam, outputPath, neededSegments)
+    if err != nil {
+        return ClipRange{}, err
+    }
+    defer os.Remove(concatListPath)
+
+    firstSegmentStart := neededSegments[0].Timestamp
+    startOffset := clipStartOffset(neededSegments, startTime).Seconds()
+    totalDuration := endTime.Sub(startTime).Seconds()
+
+    // Stream copy can only start on a keyframe, so a copied clip starts up to a GOP early. An
+    // accurate clip seeks on the input and re-encodes the video, which decodes from the keyframe
+    // before the start and drops the frames up to it.
+    if accurate && hasVideo && (outputFormat == "" || outputFormat == "copy") {
+        outputFormat = "h264"
+    }
+    // Audio-only clips seek on the input too: every audio packet is a keyframe, and an output -ss
+    // would also skip into the generated placeholder video
+    inputSeek := accurate || !hasVideo
+    seekArgs := []string{"-ss", fmt.Sprintf("%.3f", startOffset)}
+    args := []string{"-f", "concat", "-safe", "0"}
+    if inputSeek {
+        args = append(args, seekArgs...)
+    }
+    args = append(args, "-i", concatListPath)
+    if !hasVideo && hasAudio {
+        // Placeholder video as a second input; -shortest ends it with the trimmed audio
+        args = append(args, opts.Placeholder.inputArgs()...)
+    }
+    if !inputSeek {
+        args = append(args, seekArgs...)
+    }
+    args = append(args, "-t", fmt.Sprintf("%.3f", totalDuration))
+
+    // Copy is the fast default; other formats only transcode streams the container can't hold, and
+    // across discontinuities everything is transcoded
+    var videoCodec, audioCodec string
+    if outputFormat != "" && outputFormat != "copy" && len(discontinuities) == 0 {
+        videoCodec, audioCodec, err = cm.probeCodecs(neededSegments[0].Path)
+        if err != nil {
+            logger.Warning("Could not detect source codecs, transcoding all streams: %v", err)
+        } else {
+            logger.Info("Source codecs: video %s, audio %s", videoCodec, audioCodec)
+        }
+    }
+    if accurate && hasVideo {
+        // The video has to be re-encoded to cut between keyframes, even when its codec fits
+        videoCodec = ""
+        logger.Info("Accurate clip requested, re-encoding the video to start on the requested frame")
+    }
+    videoArgs, audioArgs := codecArgs(outputFormat, videoCodec, audioCodec)
+    if !hasVideo && hasAudio {
+        // The placeholder video is generated, so it is always encoded: to VP9 for a VP9 clip, H.264 otherwise
+        placeholderFormat := outputFormat
+        if placeholderFormat == "" || placeholderFormat == "copy" {
+            placeholderFormat = "h264"
+        }
+        videoArgs, _ = codecArgs(placeholderFormat, "", "")
+    }
+
+    // Without a requested track FFmpeg picks one of each, as the recorder does
+    audioMap := "0:a"
+    if opts.AudioTrack != nil {
+        audioMap = fmt.Sprintf("0:a:%d", *opts.AudioTrack)
+    }
+    if hasVideo {
+        if opts.VideoTrack != nil || opts.AudioTrack != nil {
+            videoMap := "0:v:0"
+            if opts.VideoTrack != nil {
+                videoMap = fmt.Sprintf("0:v:%d", *opts.VideoTrack)
+            }
+            args = append(args, "-map", videoMap)
+            if hasAudio {
+                args = append(args, "-map", audioMap)
+            }
+        }
+        args = append(args, videoArgs...)
+    } else if hasAudio {
+        args = append(args, "-map", audioMap, "-map", "1:v")
+        args = append(args, opts.Placeholder.filterArgs()...)
+        args = append(args, videoArgs...)
+        args = append(args, "-shortest")
+    }
+    if hasAudio {
+        args = append(args, audioArgs...)
+    } else {
+        args = append(args, "-an")
+    }
+
+    args = append(args, muxerArgs(outputPath)...)
+    args = append(args, "-y", outputPath)
+
+    // Copying streams is cheap, only a transcode has to wait for an encoder slot
+    release := func() {}
+    if isTranscode(videoArgs) || isTranscode(audioArgs) {
+        release = cm.acquireEncodeSlot(logger)
+    }
+    logger.Debug("Clip extraction FFmpeg command: ffmpeg %s", strings.Join(args, " "))
+    cmd := exec.Command(cm.ffmpegPath, args...)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    err = cmd.Run()
+    release()
+    if err != nil {
+        return ClipRange{}, fmt.Errorf("failed to extract clip: %v\nFFmpeg output: %s", err, stderr.String())
+    }
+
+    extractedDuration, err := cm.verifyClipDuration(outputPath)
+    if err != nil {
+        os.Remove(outputPath)
+        return ClipRange{}, err
+    }
+
+    // The gaps were cut out of the footage, so the clip ends that much later on the wall clock
+    actualStart := firstSegmentStart.Add(time.Duration(startOffset * float64(time.Second)))
+    clipRange := ClipRange{
+        Start:           actualStart,
+        End:             actualStart.Add(time.Duration(extractedDuration*float64(time.Second)) + missing),
+        DurationSeconds: extractedDuration,
+        Gaps:            gaps,
+    }
+
+    logger.Success("Successfully extracted clip with duration %.2f seconds (%s to %s)", extractedDuration,
+        clipRange.Start.Format("15:04:05.000"), clipRange.End.Format("15:04:05.000"))
+    return clipRange, nil
+}
+
+func (cm *ClipManager) verifyClipDuration(filePath string) (float64, error) {
+	cmd := exec.Command(cm.ffprobePath,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		filePath)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("verification failed: ffprobe could not analyze clip: %v", err)
+	}
+
+	durationStr := strings.TrimSpace(out.String())
+	duration, err := strconv.ParseFloat(durationStr, 64)
+	if err != nil {
+		return 0, fmt.Errorf("verification failed: could not parse clip duration: %v", err)
+	}
+
+	if duration < 0.5 {
+		return duration, fmt.Errorf("verification failed: clip duration too short (%.2f seconds)", duration)
+	}
+
+	return duration, nil
+}
+
+// checkEncoders makes sure FFmpeg has the encoders every compressed clip needs, and warns about
+// the ones that only some request options need
+func (cm *ClipManager) checkEncoders() error {
+	encoders, err := listEncoders(cm.ffmpegPath)
+	if err != nil {
+		return fmt.Errorf("could not list FFmpeg encoders: %v", err)
+	}
+
+	for _, encoder := range []string{cm.encoder, "aac"} {
+		if !encoders[encoder] {
+			return fmt.Errorf("FFmpeg at '%s' has no %s encoder, which is needed to compress clips; install an FFmpeg build with it or point FFMPEG_PATH to one", cm.ffmpegPath, encoder)
+		}
+	}
+
+	optional := []struct{ encoder, usedFor string }{
+		{"libx264", "output_format=h264, accurate clips and overlays"},
+		{"libvpx-vp9", "output_format=vp9"},
+		{"libopus", "output_format=vp9 with audio"},
+	}
+	for _, o := range optional {
+		if !encoders[o.encoder] {
+			cm.log.Warning("FFmpeg has no %s encoder, %s will fail", o.encoder, o.usedFor)
+		}
+	}
+	return nil
+}
+
+// Shutdown stops accepting clips, waits for in-flight clips to finish recording and sending,
+// then stops background recording and closes all WebSocket clients
+func (cm *ClipManager) Shutdown(timeout time.Duration) {
+	cm.log.Info("Shutting down ClipManager...")
+	deadline := time.Now().Add(timeout)
+
+	// Refuse new work and stop the schedules first; clips already being recorded still need the
+	// recorders to write their remaining segments
+	cm.stopAccepting()
+	if !waitTimeout(&cm.schedulesWG, time.Until(deadline)) {
+		cm.log.Warning("Timed out waiting for schedules to stop")
+	}
+
+	cm.log.Info("Waiting for in-flight clips to finish...")
+	if !waitTimeout(&cm.clipsWG, time.Until(deadline)) {
+		cm.log.Warning("Timed out after %v waiting for in-flight clips, some clips may not have been sent", timeout)
+	}
+
+	cm.cancel()
+	if !waitTimeout(&cm.recordersWG, timeout) {
+		cm.log.Warning("Timed out waiting for FFmpeg recorders to stop")
+	}
+
+	cm.closeWebSocketClients()
+	cm.sftpPool.CloseAll()
+	cm.log.Success("ClipManager shut down cleanly")
+}
+
+// sleepContext sleeps for the given duration and returns false early if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// waitTimeout waits for the WaitGroup and returns false if the timeout expires first
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func isConnectionError(errMsg string) bool {
+	connectionErrors := []string{
+		"connection refused",
+		"Connection refused",
+		"no route to host",
+		"No route to host",
+		"network is unreachable",
+		"Network is unreachable",
+		"connection timed out",
+		"Connection timed out",
+		"failed to connect",
+		"EOF",
+		"timeout",
+		"Timeout",
+	}
+
+	for _, connErr := range connectionErrors {
+		if strings.Contains(errMsg, connErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseResolution turns a resolution parameter into an FFmpeg scale filter.
+// An empty result means the source resolution is kept.
+func parseResolution(resolution string) (string, error) {
+	switch strings.ToLower(resolution) {
+	case "":
+		return "scale='min(1280,iw)':-2", nil
+	case "source":
+		return "", nil
+	case "720p":
+		return "scale=-2:'min(720,ih)'", nil
+	case "1080p":
+		return "scale=-2:'min(1080,ih)'", nil
+	}
+
+	var width, height int
+	if n, err := fmt.Sscanf(strings.ToLower(resolution), "%dx%d", &width, &height); err != nil || n != 2 ||
+		width < 16 || height < 16 || width > 7680 || height > 4320 || fmt.Sprintf("%dx%d", width, height) != strings.ToLower(resolution) {
+		return "", fmt.Errorf("invalid resolution '%s': use source, 720p, 1080p or WxH (e.g. 1280x720)", resolution)
+	}
+	// libx264 needs even dimensions
+	return fmt.Sprintf("scale=%d:%d", width-width%2, height-height%2), nil
+}
+
+// normalizeAudio writes a copy of the clip with the video stream copied and the audio re-encoded
+// through audioFilter
+func (cm *ClipManager) normalizeAudio(logger *Logger, originalFilePath, chatApp, audioFilter string) (string, error) {
+	ext := filepath.Ext(originalFilePath)
+	baseName := strings.TrimSuffix(filepath.Base(originalFilePath), ext)
+	normalizedFilePath := filepath.Join(filepath.Dir(originalFilePath), fmt.Sprintf("normalized_%s_%s%s", chatApp, baseName, ext))
+
+	audioCodec := []string{"-c:a", "aac", "-b:a", "128k"}
+	if ext == ".webm" {
+		audioCodec = []string{"-c:a", "libopus", "-b:a", "128k"}
+	}
+
+	args := []string{"-i", originalFilePath, "-c:v", "copy", "-af", audioFilter, "-ar", "48000"}
+	args = append(args, audioCodec...)
+	args = append(args, muxerArgs(normalizedFilePath)...)
+	args = append(args, "-y", normalizedFilePath)
+
+	release := cm.acquireEncodeSlot(logger)
+	defer release()
+
+	logger.Info("🔊 Normalizing audio for %s", chatApp)
+	logger.Debug("Audio normalization command for %s: ffmpeg %s", chatApp, strings.Join(args, " "))
+	cmd := exec.Command(cm.ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(normalizedFilePath)
+		logger.Error("Audio normalization failed for %s: %v\nFFmpeg output: %s", chatApp, err, stderr.String())
+		return originalFilePath, fmt.Errorf("audio normalization failed: %v", err)
+	}
+
+	return normalizedFilePath, nil
+}
+
+// encoderArgs returns the FFmpeg arguments for an encoder at the given quality: arguments that go
+// before the input, filters appended to the video filter chain, and the video codec arguments.
+// CRF maps to -cq for NVENC, -global_quality for QSV and -qp for VAAPI.
+func encoderArgs(encoder string, crf int) (inputArgs []string, filters []string, codecArgs []string) {
+	quality := strconv.Itoa(crf)
+	switch encoder {
+	case "h264_nvenc":
+		return nil, nil, []string{"-c:v", "h264_nvenc", "-preset", "p5", "-rc", "vbr", "-cq", quality, "-b:v", "0"}
+	case "h264_qsv":
+		return []string{"-init_hw_device", "qsv=hw", "-filter_hw_device", "hw"},
+			[]string{"format=nv12", "hwupload=extra_hw_frames=64"},
+			[]string{"-c:v", "h264_qsv", "-preset", "medium", "-global_quality", quality}
+	case "h264_vaapi":
+		device := os.Getenv("VAAPI_DEVICE")
+		if device == "" {
+			device = "/dev/dri/renderD128"
+		}
+		return []string{"-init_hw_device", "vaapi=hw:" + device, "-filter_hw_device", "hw"},
+			[]string{"format=nv12", "hwupload"},
+			[]string{"-c:v", "h264_vaapi", "-rc_mode", "CQP", "-qp", quality}
+	default:
+		return nil, nil, []string{"-c:v", "libx264", "-crf", quality, "-preset", "medium"}
+	}
+}
+
+// bitrateEncoderArgs is encoderArgs for bitrate mode: the encoder targets an average bitrate in
+// kbit/s, capped by -maxrate so short complex scenes can't push the file over the limit
+func bitrateEncoderArgs(encoder string, kbps int) (inputArgs []string, filters []string, codecArgs []string) {
+	rate := []string{"-b:v", fmt.Sprintf("%dk", kbps), "-maxrate", fmt.Sprintf("%dk", kbps), "-bufsize", fmt.Sprintf("%dk", 2*kbps)}
+	switch encoder {
+	case "h264_nvenc":
+		return nil, nil, append([]string{"-c:v", "h264_nvenc", "-preset", "p5", "-rc", "vbr"}, rate...)
+	case "h264_qsv":
+		return []string{"-init_hw_device", "qsv=hw", "-filter_hw_device", "hw"},
+			[]string{"format=nv12", "hwupload=extra_hw_frames=64"},
+			append([]string{"-c:v", "h264_qsv", "-preset", "medium"}, rate...)
+	case "h264_vaapi":
+		device := os.Getenv("VAAPI_DEVICE")
+		if device == "" {
+			device = "/dev/dri/renderD128"
+		}
+		return []string{"-init_hw_device", "vaapi=hw:" + device, "-filter_hw_device", "hw"},
+			[]string{"format=nv12", "hwupload"},
+			append([]string{"-c:v", "h264_vaapi", "-rc_mode", "VBR"}, rate...)
+	default:
+		return nil, nil, append([]string{"-c:v", "libx264", "-preset", "medium"}, rate...)
+	}
+}
+
+// targetVideoBitrate returns the video bitrate in kbit/s that makes a clip of the given duration
+// come out just under sizeMB, after the audio track and a margin for the container
+func targetVideoBitrate(sizeMB, duration float64) int {
+	totalKbps := sizeMB * compressionSizeMargin * 1024 * 1024 * 8 / 1000 / duration
+	return int(totalKbps) - compressionAudioKbps
+}
+
+// sizeLimit returns the size in MB a clip for the destination is compressed below, which the
+// request's max_file_size_mb can lower
+func (cm *ClipManager) sizeLimit(chatApp string, compression CompressionSettings) (float64, bool) {
+	limit, exists := cm.currentConfig().FileSizeLimits[chatApp]
+	if exists && compression.MaxFileSizeMB > 0 && compression.MaxFileSizeMB < limit {
+		limit = compression.MaxFileSizeMB
+	}
+	return limit, exists
+}
+
+// acquireEncodeSlot blocks until fewer than MAX_CONCURRENT_ENCODES encodes are running, so the
+// segment recorders keep enough CPU, and returns the function that frees the slot again
+func (cm *ClipManager) acquireEncodeSlot(logger *Logger) func() {
+	select {
+	case cm.encodeSlots <- struct{}{}:
+	default:
+		logger.Info("⏳ Waiting for an encoder slot (%d encodes running)", cap(cm.encodeSlots))
+		start := time.Now()
+		cm.encodeSlots <- struct{}{}
+		logger.Info("Got an encoder slot after %.1f seconds", time.Since(start).Seconds())
+	}
+	return func() { <-cm.encodeSlots }
+}
+
+// acquireClipSlot waits for one of the MAX_CONCURRENT_CLIPS processing slots, marking the job
+// as queued while it waits, and returns the function that releases it
+func (cm *ClipManager) acquireClipSlot(logger *Logger, requestID string) func() {
+	select {
+	case cm.clipSlots <- struct{}{}:
+	default:
+		_, queued := cm.clipQueueDepth()
+		cm.updateJob(requestID, JobQueued, "", nil)
+		logger.Info("⏳ Queued behind %d running clips (%d waiting)", cap(cm.clipSlots), queued)
+		start := time.Now()
+		cm.clipSlots <- struct{}{}
+		logger.Info("Started processing after %.1f seconds in the queue", time.Since(start).Seconds())
+	}
+	return func() { <-cm.clipSlots }
+}
+
+// clipQueueDepth returns how many clip requests are being processed and how many wait for a slot
+func (cm *ClipManager) clipQueueDepth() (processing, queued int) {
+	processing = len(cm.clipSlots)
+	queued = len(cm.clipQueue) - processing
+	if queued < 0 {
+		queued = 0
+	}
+	return processing, queued
+}
+
+// PrepareClipForChatApp compresses a clip when it exceeds the destination's size limit.
+// An explicit resolution (720p, 1080p or WxH) always re-encodes so the requested size is honoured.
+// A non-empty audioFilter (loudnorm) re-encodes the audio even when the video can be copied.
+func (cm *ClipManager) PrepareClipForChatApp(logger *Logger, originalFilePath, chatApp, resolution, audioFilter string, compression CompressionSettings) (string, error) {
+	targetSizeMB, exists := cm.sizeLimit(chatApp, compression)
+	if !exists {
+		return "", fmt.Errorf("unknown chat app: %s", chatApp)
+	}
+	initialCRF, maxCRF, crfStep := compression.InitialCRF, compression.MaxCRF, compression.CRFStep
+
+	fileInfo, err := os.Stat(originalFilePath)
+	if err != nil {
+		return "", fmt.Errorf("could not access the clip file: %v", err)
+	}
+
+	scaleFilter, err := parseResolution(resolution)
+	if err != nil {
+		return "", err
+	}
+	forceResize := resolution != "" && strings.ToLower(resolution) != "source"
+
+	fileSizeMB := float64(fileInfo.Size()) / 1024 / 1024
+	logger.Info("📏 Original file size for %s: %.2f MB (limit: %.2f MB)", chatApp, fileSizeMB, targetSizeMB)
+
+	if fileSizeMB <= targetSizeMB && !forceResize {
+		if audioFilter != "" {
+			return cm.normalizeAudio(logger, originalFilePath, chatApp, audioFilter)
+		}
+		logger.Success("File size is under the limit for %s, using original file", chatApp)
+		return originalFilePath, nil
+	}
+
+	duration, err := cm.verifyClipDuration(originalFilePath)
+	if err != nil {
+		return "", fmt.Errorf("could not verify clip duration: %v", err)
+	}
+	logger.Info("⏱️ Clip duration for %s: %.2f seconds", chatApp, duration)
+
+	aspectRatio, err := cm.getVideoAspectRatio(originalFilePath)
+	if err != nil {
+		logger.Warning("Warning: Could not determine aspect ratio for compression: %v", err)
+		aspectRatio = "16:9"
+	}
+	logger.Info("📏 Using aspect ratio for compression: %s", aspectRatio)
+
+	release := cm.acquireEncodeSlot(logger)
+	defer release()
+
+	crf := initialCRF
+	encoder := cm.encoder
+	// Compression always produces H.264/AAC, which Matroska holds but WebM doesn't, so WebM clips
+	// become MP4s
+	extension := ".mp4"
+	if strings.EqualFold(filepath.Ext(originalFilePath), ".mkv") {
+		extension = ".mkv"
+	}
+	baseName := strings.TrimSuffix(filepath.Base(originalFilePath), filepath.Ext(originalFilePath))
+	compressedFilePath := filepath.Join(filepath.Dir(originalFilePath), fmt.Sprintf("compressed_%s_%s%s", chatApp, baseName, extension))
+
+	// videoArgs builds the input and video arguments around an encoder's arguments, outputArgs
+	// holds the audio and container arguments that follow them
+	videoArgs := func(inputArgs, hwFilters, codecArgs []string) []string {
+		args := append(inputArgs, "-i", originalFilePath)
+		var filters []string
+		if scaleFilter != "" {
+			filters = append(filters, scaleFilter)
+		}
+		filters = append(filters, hwFilters...)
+		if len(filters) > 0 {
+			args = append(args, "-vf", strings.Join(filters, ","))
+		}
+		return append(args, codecArgs...)
+	}
+	var outputArgs []string
+	if audioFilter != "" {
+		outputArgs = append(outputArgs, "-af", audioFilter, "-ar", "48000")
+	}
+	outputArgs = append(outputArgs,
+		"-c:a", "aac",
+		"-b:a", fmt.Sprintf("%dk", compressionAudioKbps),
+		"-aspect", aspectRatio,
+	)
+	outputArgs = append(outputArgs, muxerArgs(compressedFilePath)...)
+
+	if compression.Mode == compressionModeBitrate {
+		compressedSizeMB, err := cm.compressToBitrate(logger, chatApp, compressedFilePath, targetSizeMB, duration, videoArgs, outputArgs)
+		switch {
+		case err != nil:
+			logger.Warning("Bitrate compression failed for %s, falling back to CRF: %v", chatApp, err)
+		case compressedSizeMB <= targetSizeMB:
+			logger.Success("Compression succeeded for %s in bitrate mode", chatApp)
+			return compressedFilePath, nil
+		default:
+			logger.Warning("Bitrate compression for %s overshot the limit (%.2f MB), falling back to CRF", chatApp, compressedSizeMB)
+		}
+	}
+
+	softwareRetry := false
+	for crf <= maxCRF {
+		logger.Info("🔧 Compressing for %s with CRF %d using %s", chatApp, crf, encoder)
+		// Retrying a failed hardware encode in software is still the same compression
+		if !softwareRetry {
+			cm.metrics.IncCompressions(chatApp)
+		}
+		softwareRetry = false
+
+		args := append(videoArgs(encoderArgs(encoder, crf)), outputArgs...)
+		args = append(args, "-y", compressedFilePath)
+
+		logger.Debug("Compression command for %s: ffmpeg %s", chatApp, strings.Join(args, " "))
+		cmd := exec.Command(cm.ffmpegPath, args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		if err != nil && encoder != "libx264" {
+			// The encoder can be listed while the GPU or driver is missing, retry in software
+			logger.Warning("Compression with %s failed for %s, falling back to libx264: %v\nFFmpeg output: %s", encoder, chatApp, err, stderr.String())
+			encoder = "libx264"
+			softwareRetry = true
+			continue
+		}
+		if err != nil {
+			logger.Error("Compression failed for %s: %v\nFFmpeg output: %s", chatApp, err, stderr.String())
+			return originalFilePath, fmt.Errorf("compression failed: %v", err)
+		}
+
+		compressedInfo, err := os.Stat(compressedFilePath)
+		if err != nil {
+			logger.Error("Error checking compressed file for %s: %v, falling back to original", chatApp, err)
+			return originalFilePath, fmt.Errorf("could not access compressed file: %v", err)
+		}
+
+		compressedSizeMB := float64(compressedInfo.Size()) / 1024 / 1024
+		logger.Info("📏 Compressed file size for %s: %.2f MB", chatApp, compressedSizeMB)
+
+		if compressedSizeMB <= targetSizeMB {
+			logger.Success("Compression succeeded for %s with CRF %d", chatApp, crf)
+			return compressedFilePath, nil
+		}
+
+		crf += crfStep
+	}
+
+	logger.Error("Could not compress file under %.2f MB for %s, even with CRF %d", targetSizeMB, chatApp, maxCRF)
+	return compressedFilePath, fmt.Errorf("file size still exceeds %.2f MB for %s after maximum compression", targetSizeMB, chatApp)
+}
+
+// compressToBitrate encodes the clip once at the bitrate that fits targetSizeMB and returns the
+// resulting size. libx264 runs two passes so the bitrate is spread by scene complexity, hardware
+// encoders do a single pass. videoArgs and outputArgs are the ones PrepareClipForChatApp builds.
+func (cm *ClipManager) compressToBitrate(logger *Logger, chatApp, outputPath string, targetSizeMB, duration float64, videoArgs func(inputArgs, hwFilters, codecArgs []string) []string, outputArgs []string) (float64, error) {
+	if duration <= 0 {
+		return 0, fmt.Errorf("clip duration is unknown")
+	}
+	kbps := targetVideoBitrate(targetSizeMB, duration)
+	if kbps < minVideoBitrateKbps {
+		return 0, fmt.Errorf("a %.2f MB limit leaves only %d kbit/s of video for %.0f seconds", targetSizeMB, kbps, duration)
+	}
+
+	logger.Info("🔧 Compressing for %s at %d kbit/s using %s", chatApp, kbps, cm.encoder)
+	cm.metrics.IncCompressions(chatApp)
+
+	run := func(args []string) error {
+		logger.Debug("Compression command for %s: ffmpeg %s", chatApp, strings.Join(args, " "))
+		cmd := exec.Command(cm.ffmpegPath, args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%v\nFFmpeg output: %s", err, stderr.String())
+		}
+		return nil
+	}
+
+	args := videoArgs(bitrateEncoderArgs(cm.encoder, kbps))
+	if cm.encoder == "libx264" {
+		// The first pass only writes the rate control log, so skip the audio and discard the video
+		passLog := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "_passlog"
+		defer func() {
+			matches, _ := filepath.Glob(passLog + "*")
+			for _, match := range matches {
+				os.Remove(match)
+			}
+		}()
+
+		firstPass := append(append([]string{}, args...), "-pass", "1", "-passlogfile", passLog, "-an", "-f", "null", "-y", os.DevNull)
+		if err := run(firstPass); err != nil {
+			return 0, fmt.Errorf("first pass failed: %v", err)
+		}
+		args = append(args, "-pass", "2", "-passlogfile", passLog)
+	}
+	args = append(args, outputArgs...)
+	if err := run(append(args, "-y", outputPath)); err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not access compressed file: %v", err)
+	}
+	sizeMB := float64(info.Size()) / 1024 / 1024
+	logger.Info("📏 Compressed file size for %s: %.2f MB", chatApp, sizeMB)
+	return sizeMB, nil
+}
+
+// sendCallback POSTs the outcome of a clip request to its callback_url
+func (cm *ClipManager) sendCallback(logger *Logger, req *ClipRequest, result ClipResult) {
+    body, err := json.Marshal(ClipCallback{RequestID: req.RequestID, CameraID: req.CameraID, ClipResult: result})
+    if err != nil {
+        logger.Error("Could not encode callback: %v", err)
+        return
+    }
+
+    operation := func() error {
+        ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+        defer cancel()
+
+        httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, req.CallbackURL, bytes.NewReader(body))
+        if err != nil {
+            return fmt.Errorf("error creating callback request: %v", err)
+        }
+        httpReq.Header.Set("Content-Type", "application/json")
+
+        resp, err := cm.callbackClient.Do(httpReq)
+        if err != nil {
+            return fmt.Errorf("error sending callback: %v", err)
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode >= 300 {
+            bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+            return responseError(resp, fmt.Errorf("callback error: %s - %s", resp.Status, string(bodyBytes)))
+        }
+        return nil
+    }
+
+    if err := cm.RetryOperation(logger, operation, "callback"); err == nil {
+        logger.Success("Notified callback URL")
+    }
+}
+
+// RetryAfterError is returned by an operation when the service said how long to wait before
+// trying again, RetryOperation waits that long instead of its own backoff
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string { return e.Err.Error() }
+func (e *RetryAfterError) Unwrap() error { return e.Err }
+
+// PermanentError is returned by an operation for a failure a retry can't fix, like a rejected
+// token or an unknown channel. RetryOperation gives up on it right away.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// responseError classifies an error response of a destination's API. 408, 429 and 5xx can
+// succeed on a retry, other 4xx mean bad credentials or settings and are permanent.
+func responseError(resp *http.Response, err error) error {
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &PermanentError{Err: err}
+	}
+	return withRetryAfter(resp, err)
+}
+
+// slackPermanentErrors are Slack API error codes caused by the token or channel
+var slackPermanentErrors = map[string]bool{
+	"invalid_auth":      true,
+	"not_authed":        true,
+	"account_inactive":  true,
+	"token_revoked":     true,
+	"token_expired":     true,
+	"missing_scope":     true,
+	"channel_not_found": true,
+	"not_in_channel":    true,
+	"is_archived":       true,
+	"invalid_arguments": true,
+}
+
+// slackError reports a Slack API error code, marking configuration errors as permanent
+func slackError(method, code string) error {
+	err := fmt.Errorf("slack API error (%s): %s", method, code)
+	if slackPermanentErrors[code] {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// smtpError marks err as permanent when the server's reply was a 5xx, which it sends for
+// rejected credentials, senders and recipients
+func smtpError(reply error, err error) error {
+	var textErr *textproto.Error
+	if errors.As(reply, &textErr) && textErr.Code >= 500 {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// withRetryAfter wraps err in a RetryAfterError when the response has a Retry-After header
+func withRetryAfter(resp *http.Response, err error) error {
+	if delay := parseRetryAfter(resp.Header.Get("Retry-After")); delay > 0 {
+		return &RetryAfterError{Err: err, RetryAfter: delay}
+	}
+	return err
+}
+
+// discordRetryAfter reads the wait from a Discord rate limit response, where retry_after is in
+// seconds with a fractional part
+func discordRetryAfter(body []byte) time.Duration {
+	var rateLimit struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if err := json.Unmarshal(body, &rateLimit); err != nil || rateLimit.RetryAfter <= 0 {
+		return 0
+	}
+	return time.Duration(rateLimit.RetryAfter * float64(time.Second))
+}
+
+// telegramRetryAfter reads the wait from a Telegram "Too Many Requests" response, where it is
+// given in whole seconds as parameters.retry_after
+func telegramRetryAfter(body []byte) time.Duration {
+	var response struct {
+		Parameters struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Parameters.RetryAfter <= 0 {
+		return 0
+	}
+	return time.Duration(response.Parameters.RetryAfter) * time.Second
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date, 0 when absent or invalid
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(header, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// retryBackoff returns the wait before retry number attempt: retryDelay multiplied by retryFactor
+// for every earlier retry and capped at retryMaxDelay. The upper half is randomized so that
+// destinations that failed together don't retry in lockstep.
+func retryBackoff(config RuntimeConfig, attempt int) time.Duration {
+	delay := float64(config.RetryDelay) * math.Pow(config.RetryFactor, float64(attempt-1))
+	if config.RetryMaxDelay > 0 && delay > float64(config.RetryMaxDelay) {
+		delay = float64(config.RetryMaxDelay)
+	}
+	return time.Duration(delay/2 + rand.Float64()*delay/2)
+}
+
+func (cm *ClipManager) RetryOperation(logger *Logger, operation func() error, serviceName string) error {
+	var err error
+
+	err = operation()
+	if err == nil {
+		return nil
+	}
+
+	logger.Error("Error sending clip to %s: %v", serviceName, err)
+
+	// Retries keep the settings the first attempt started with, even when /api/config changes them
+	config := cm.currentConfig()
+	var permanent *PermanentError
+	for attempt := 1; attempt <= config.MaxRetries; attempt++ {
+		if errors.As(err, &permanent) {
+			logger.Error("Not retrying %s, the error won't go away by itself", serviceName)
+			return fmt.Errorf("failed to send clip to %s: %v", serviceName, err)
+		}
+
+		delay := retryBackoff(config, attempt)
+		var retryAfter *RetryAfterError
+		if errors.As(err, &retryAfter) {
+			delay = retryAfter.RetryAfter
+			if delay > maxRetryAfter {
+				delay = maxRetryAfter
+			}
+		}
+		logger.Warning("Retry %d/%d for %s in %v...", attempt, config.MaxRetries, serviceName, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+
+		err = operation()
+		if err == nil {
+			logger.Success("Retry %d/%d for %s succeeded", attempt, config.MaxRetries, serviceName)
+			return nil
+		}
+
+		logger.Error("Retry %d/%d for %s failed: %v", attempt, config.MaxRetries, serviceName, err)
+	}
+
+	logger.Error("All %d retries failed for %s", config.MaxRetries, serviceName)
+	return fmt.Errorf("failed to send clip to %s after %d attempts: %v", serviceName, config.MaxRetries+1, err)
+}
+
+func (cm *ClipManager) sendToTelegram(logger *Logger, filePath, botToken, chatID string, req *ClipRequest) error {
+    fileName := cm.clipFilename(req, filePath)
+
+    operation := func() error {
+        file, err := os.Open(filePath)
+        if (err != nil) {
+            return fmt.Errorf("could not open file for sending to Telegram: %v", err)
+        }
+        defer file.Close()
+
+        captionText := cm.buildClipMessage(req)
+
+        chatID = strings.Trim(chatID, `"'`)
+        if chatID == "" {
+            return &PermanentError{Err: fmt.Errorf("error: telegram_chat_id is empty, cannot send to Telegram")}
+        }
+
+        // sendVideo re-encodes the clip for playback in the chat, sendDocument delivers the exact file
+        method, fileField := "sendVideo", "video"
+        if req.TelegramAsDocument {
+            method, fileField = "sendDocument", "document"
+        }
+        reqURL := fmt.Sprintf("https://api.telegram.org/bot%s/%s", botToken, method)
+
+        logger.Info("Sending clip to Telegram with %s. File: %s", method, fileName)
+
+        var requestBody bytes.Buffer
+        writer := multipart.NewWriter(&requestBody)
+
+        if err := writer.WriteField("chat_id", chatID); err != nil {
+            return fmt.Errorf("error preparing Telegram request: %v", err)
+        }
+
+        if err := writer.WriteField("caption", captionText); err != nil {
+            return fmt.Errorf("error adding caption to Telegram request: %v", err)
+        }
+
+        if req.TelegramSupportsStreaming && !req.TelegramAsDocument {
+            if err := writer.WriteField("supports_streaming", "true"); err != nil {
+                return fmt.Errorf("error preparing Telegram request: %v", err)
+            }
+        }
+        if req.TelegramDisableNotification {
+            if err := writer.WriteField("disable_notification", "true"); err != nil {
+                return fmt.Errorf("error preparing Telegram request: %v", err)
+            }
+        }
+        if req.TelegramMessageThreadID != "" {
+            if err := writer.WriteField("message_thread_id", req.TelegramMessageThreadID); err != nil {
+                return fmt.Errorf("error preparing Telegram request: %v", err)
+            }
+        }
+
+        part, err := writer.CreateFormFile(fileField, fileName)
+        if err != nil {
+            return fmt.Errorf("error creating file field for Telegram: %v", err)
+        }
+
+        if _, err := io.Copy(part, file); err != nil {
+            return fmt.Errorf("error copying file to Telegram request: %v", err)
+        }
+
+        if err := writer.Close(); err != nil {
+            return fmt.Errorf("error finalizing Telegram request: %v", err)
+        }
+
+        req, err := http.NewRequest("POST", reqURL, &requestBody)
+        if err != nil {
+            return fmt.Errorf("error creating Telegram request: %v", err)
+        }
+
+        req.Header.Set("Content-Type", writer.FormDataContentType())
+
+        resp, err := cm.httpClientFor("telegram").Do(req)
+        if err != nil {
+            return fmt.Errorf("error sending clip to Telegram: %v", err)
+        }
+        defer resp.Body.Close()
+
+        bodyBytes, _ := io.ReadAll(resp.Body)
+        responseBody := string(bodyBytes)
+
+        if resp.StatusCode != http.StatusOK {
+            err := fmt.Errorf("telegram API error: %s - %s", resp.Status, responseBody)
+            if delay := telegramRetryAfter(bodyBytes); resp.StatusCode == http.StatusTooManyRequests && delay > 0 {
+                return &RetryAfterError{Err: err, RetryAfter: delay}
+            }
+            return responseError(resp, err)
+        }
+
+        logger.Success("Clip successfully sent to Telegram")
+        return nil
+    }
+
+    return cm.RetryOperation(logger, operation, "Telegram")
+}
+
+// sendToMattermost uploads the clip, posts it to the channel and returns the post ID
+func (cm *ClipManager) sendToMattermost(logger *Logger, filePath, mattermostURL, token, channelID string, clipReq *ClipRequest) (string, error) {
+    fileName := cm.clipFilename(clipReq, filePath)
+
+    var postID string
+
+    operation := func() error {
+        file, err := os.Open(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open file for sending to Mattermost: %v", err)
+        }
+        defer file.Close()
+
+        var requestBody bytes.Buffer
+        writer := multipart.NewWriter(&requestBody)
+
+        if err := writer.WriteField("channel_id", channelID); err != nil {
+            return fmt.Errorf("error preparing Mattermost request: %v", err)
+        }
+
+        part, err := writer.CreateFormFile("files", fileName)
+        if err != nil {
+            return fmt.Errorf("error creating file field for Mattermost: %v", err)
+        }
+
+        if _, err := io.Copy(part, file); err != nil {
+            return fmt.Errorf("error copying file to Mattermost request: %v", err)
+        }
+
+        if err := writer.Close(); err != nil {
+            return fmt.Errorf("error finalizing Mattermost request: %v", err)
+        }
+
+        fileUploadURL := fmt.Sprintf("%s/api/v4/files", mattermostURL)
+        logger.Info("Uploading file to Mattermost")
+
+        req, err := http.NewRequest("POST", fileUploadURL, &requestBody)
+        if err != nil {
+            return fmt.Errorf("error creating Mattermost upload request: %v", err)
+        }
+
+        req.Header.Set("Content-Type", writer.FormDataContentType())
+        req.Header.Set("Authorization", "Bearer "+token)
+
+        resp, err := cm.httpClientFor("mattermost").Do(req)
+        if err != nil {
+            return fmt.Errorf("error uploading to Mattermost: %v", err)
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode >= 300 {
+            bodyBytes, _ := io.ReadAll(resp.Body)
+            return responseError(resp, fmt.Errorf("mattermost file upload error: %s - %s", resp.Status, string(bodyBytes)))
+        }
+
+        var fileResponse struct {
+            FileInfos []struct {
+                ID string `json:"id"`
+            } `json:"file_infos"`
+        }
+
+        if err := json.NewDecoder(resp.Body).Decode(&fileResponse); err != nil {
+            return fmt.Errorf("error parsing Mattermost response: %v", err)
+        }
+
+        if len(fileResponse.FileInfos) == 0 {
+            return fmt.Errorf("no file IDs returned from Mattermost")
+        }
+
+        messageText := cm.buildClipMessage(withEscapedText(clipReq, markdownEscaper.Replace))
+
+        fileIDs := make([]string, len(fileResponse.FileInfos))
+        for i, fileInfo := range fileResponse.FileInfos {
+            fileIDs[i] = fileInfo.ID
+        }
+
+        postData := map[string]interface{}{
+            "channel_id": channelID,
+            "message":    messageText,
+            "file_ids":   fileIDs,
+        }
+        if clipReq.MattermostRootID != "" {
+            postData["root_id"] = clipReq.MattermostRootID
+        }
+
+        postJSON, err := json.Marshal(postData)
+        if err != nil {
+            return fmt.Errorf("error creating post JSON: %v", err)
+        }
+
+        postURL := fmt.Sprintf("%s/api/v4/posts", mattermostURL)
+        postReq, err := http.NewRequest("POST", postURL, bytes.NewBuffer(postJSON))
+        if err != nil {
+            return fmt.Errorf("error creating post request: %v", err)
+        }
+
+        postReq.Header.Set("Content-Type", "application/json")
+        postReq.Header.Set("Authorization", "Bearer "+token)
+
+        postResp, err := cm.httpClientFor("mattermost").Do(postReq)
+        if err != nil {
+            return fmt.Errorf("error creating Mattermost post: %v", err)
+        }
+        defer postResp.Body.Close()
+
+        if postResp.StatusCode >= 300 {
+            bodyBytes, _ := io.ReadAll(postResp.Body)
+            return responseError(postResp, fmt.Errorf("mattermost post creation error: %s - %s", postResp.Status, string(bodyBytes)))
+        }
+
+        var post struct {
+            ID string `json:"id"`
+        }
+        if err := json.NewDecoder(postResp.Body).Decode(&post); err != nil {
+            logger.Warning("Could not read the Mattermost post ID: %v", err)
+        }
+        postID = post.ID
+
+        logger.Success("Clip successfully sent to Mattermost (post %s)", postID)
+        return nil
+    }
+
+    if err := cm.RetryOperation(logger, operation, "Mattermost"); err != nil {
+        return "", err
+    }
+    return postID, nil
+}
+
+func (cm *ClipManager) sendToDiscord(logger *Logger, filePath, webhookURL string, req *ClipRequest) error {
+    fileName := cm.clipFilename(req, filePath)
+
+    // The embed shows a poster frame, without one it only carries the text
+    var thumbnailPath string
+    if req.DiscordEmbed {
+        thumbnailPath = strings.TrimSuffix(filePath, filepath.Ext(filePath)) + "_discord.jpg"
+        if err := cm.generateThumbnail(filePath, thumbnailPath, defaultThumbnailOffset); err != nil {
+            logger.Warning("Could not generate thumbnail for the Discord embed: %v", err)
+            thumbnailPath = ""
+        } else {
+            defer os.Remove(thumbnailPath)
+        }
+    }
+
+    operation := func() error {
+        file, err := os.Open(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open file for sending to Discord: %v", err)
+        }
+        defer file.Close()
+
+        messageText := cm.buildClipMessage(withEscapedText(req, markdownEscaper.Replace))
+
+        var requestBody bytes.Buffer
+        writer := multipart.NewWriter(&requestBody)
+
+        payload := discordPayload{Content: messageText}
+        if req.DiscordEmbed {
+            payload = discordEmbedPayload(req, fileName, thumbnailPath != "")
+        }
+        // Never ping @everyone, roles or users mentioned in the request text
+        payload.AllowedMentions = &discordAllowedMentions{Parse: []string{}}
+        payload.Username = req.DiscordUsername
+        payload.AvatarURL = req.DiscordAvatarURL
+
+        payloadJSON, err := json.Marshal(payload)
+        if err != nil {
+            return fmt.Errorf("error encoding Discord message: %v", err)
+        }
+        if err := writer.WriteField("payload_json", string(payloadJSON)); err != nil {
+            return fmt.Errorf("error adding message to Discord request: %v", err)
+        }
+
+        part, err := writer.CreateFormFile("files[0]", fileName)
+        if err != nil {
+            return fmt.Errorf("error creating file field for Discord: %v", err)
+        }
+
+        if _, err := io.Copy(part, file); err != nil {
+            return fmt.Errorf("error copying file to Discord request: %v", err)
+        }
+
+        if thumbnailPath != "" {
+            thumbnail, err := os.ReadFile(thumbnailPath)
+            if err != nil {
+                return fmt.Errorf("could not read thumbnail for Discord: %v", err)
+            }
+            part, err := writer.CreateFormFile("files[1]", discordThumbnailName)
+            if err != nil {
+                return fmt.Errorf("error creating thumbnail field for Discord: %v", err)
+            }
+            if _, err := part.Write(thumbnail); err != nil {
+                return fmt.Errorf("error copying thumbnail to Discord request: %v", err)
+            }
+        }
+
+        if err := writer.Close(); err != nil {
+            return fmt.Errorf("error finalizing Discord request: %v", err)
+        }
+
+        logger.Info("Sending clip to Discord. File: %s", fileName)
+
+        req, err := http.NewRequest("POST", webhookURL, &requestBody)
+        if err != nil {
+            return fmt.Errorf("error creating Discord request: %v", err)
+        }
+
+        req.Header.Set("Content-Type", writer.FormDataContentType())
+
+        resp, err := cm.httpClientFor("discord").Do(req)
+        if err != nil {
+            return fmt.Errorf("error sending to Discord: %v", err)
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode >= 300 {
+            bodyBytes, _ := io.ReadAll(resp.Body)
+            err := fmt.Errorf("discord API error: %s - %s", resp.Status, string(bodyBytes))
+            if delay := discordRetryAfter(bodyBytes); resp.StatusCode == http.StatusTooManyRequests && delay > 0 {
+                return &RetryAfterError{Err: err, RetryAfter: delay}
+            }
+            return responseError(resp, err)
+        }
+
+        logger.Success("Clip successfully sent to Discord")
+        return nil
+    }
+
+    return cm.RetryOperation(logger, operation, "Discord")
+}
+
+// sendToWebhook posts the clip to a custom HTTP endpoint as multipart/form-data, with the clip
+// message in req.WebhookTextField and the clip in req.WebhookFileField. The file is streamed
+// from disk instead of being buffered, so large clips don't have to fit in memory.
+func (cm *ClipManager) sendToWebhook(logger *Logger, filePath string, req *ClipRequest) error {
+    fileName := cm.clipFilename(req, filePath)
+
+    operation := func() error {
+        file, err := os.Open(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open file for sending to webhook: %v", err)
+        }
+        defer file.Close()
+        fileInfo, err := file.Stat()
+        if err != nil {
+            return fmt.Errorf("could not stat file for sending to webhook: %v", err)
+        }
+
+        // Write everything around the file content up front so the request has a Content-Length
+        var form bytes.Buffer
+        writer := multipart.NewWriter(&form)
+        if err := writer.WriteField(req.WebhookTextField, cm.buildClipMessage(req)); err != nil {
+            return fmt.Errorf("error adding message to webhook request: %v", err)
+        }
+        partHeader := textproto.MIMEHeader{}
+        partHeader.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+            "name":     req.WebhookFileField,
+            "filename": fileName,
+        }))
+        partHeader.Set("Content-Type", videoContentType(filePath))
+        if _, err := writer.CreatePart(partHeader); err != nil {
+            return fmt.Errorf("error creating file field for webhook: %v", err)
+        }
+        headLength := form.Len()
+        if err := writer.Close(); err != nil {
+            return fmt.Errorf("error finalizing webhook request: %v", err)
+        }
+        head, tail := form.Bytes()[:headLength], form.Bytes()[headLength:]
+
+        body := io.MultiReader(bytes.NewReader(head), file, bytes.NewReader(tail))
+        httpReq, err := http.NewRequest("POST", req.WebhookURL, body)
+        if err != nil {
+            return fmt.Errorf("error creating webhook request: %v", err)
+        }
+        httpReq.ContentLength = int64(len(head)) + fileInfo.Size() + int64(len(tail))
+        httpReq.Header.Set("Content-Type", writer.FormDataContentType())
+        if req.WebhookToken != "" {
+            httpReq.Header.Set("Authorization", "Bearer "+req.WebhookToken)
+        }
+        if req.WebhookHeader != "" {
+            name, value, _ := parseWebhookHeader(req.WebhookHeader)
+            httpReq.Header.Set(name, value)
+        }
+
+        logger.Info("Sending clip to webhook. File: %s", fileName)
+        resp, err := cm.httpClientFor("webhook").Do(httpReq)
+        if err != nil {
+            return fmt.Errorf("error sending to webhook: %v", err)
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode >= 300 {
+            bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+            return responseError(resp, fmt.Errorf("webhook error: %s - %s", resp.Status, string(bodyBytes)))
+        }
+
+        logger.Success("Clip successfully sent to webhook")
+        return nil
+    }
+
+    return cm.RetryOperation(logger, operation, "webhook")
+}
+
+// parseWebhookHeader splits a "Name: value" webhook_header into a valid header name and value
+func parseWebhookHeader(header string) (string, string, error) {
+    name, value, found := strings.Cut(header, ":")
+    name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+    if !found || name == "" {
+        return "", "", fmt.Errorf("must have the form \"Name: value\"")
+    }
+    for _, r := range name {
+        if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) {
+            return "", "", fmt.Errorf("invalid header name %q", name)
+        }
+    }
+    if strings.ContainsAny(value, "\r\n") {
+        return "", "", fmt.Errorf("header value must not contain line breaks")
+    }
+    switch http.CanonicalHeaderKey(name) {
+    case "Content-Type", "Content-Length", "Host", "Transfer-Encoding":
+        return "", "", fmt.Errorf("%s is set by ClipManager", name)
+    }
+    return name, value, nil
+}
+
+// discordThumbnailName is the attachment name of the poster frame in Discord embeds
+const discordThumbnailName = "thumbnail.jpg"
+
+// discordEmbedPayload builds an embed for the clip: the category (or title) as the embed title,
+// the teams as fields and the poster frame, when there is one, as the image. Discord shows the
+// video attachment below the embed.
+func discordEmbedPayload(req *ClipRequest, fileName string, withThumbnail bool) discordPayload {
+    embed := discordEmbed{
+        Title:     "New Clip",
+        Color:     discordEmbedColor,
+        Timestamp: time.Now().UTC().Format(time.RFC3339),
+    }
+    if req.Category != "" {
+        embed.Title = req.Category
+    } else if req.Title != "" {
+        embed.Title = req.Title
+    }
+
+    // The description and field values render Markdown, the title doesn't
+    var description []string
+    if req.Title != "" && req.Title != embed.Title {
+        description = append(description, markdownEscaper.Replace(req.Title))
+    }
+    if req.AdditionalText != "" {
+        description = append(description, markdownEscaper.Replace(req.AdditionalText))
+    }
+    embed.Description = strings.Join(description, "\n")
+
+    if req.Team1 != "" && req.Team2 != "" {
+        embed.Fields = []discordEmbedField{
+            {Name: "Team 1", Value: markdownEscaper.Replace(req.Team1), Inline: true},
+            {Name: "Team 2", Value: markdownEscaper.Replace(req.Team2), Inline: true},
+        }
+    }
+
+    payload := discordPayload{
+        Embeds:      []discordEmbed{embed},
+        Attachments: []discordAttachment{{ID: 0, Filename: fileName}},
+    }
+    if withThumbnail {
+        payload.Embeds[0].Image = &discordEmbedImage{URL: "attachment://" + discordThumbnailName}
+        payload.Attachments = append(payload.Attachments, discordAttachment{ID: 1, Filename: discordThumbnailName})
+    }
+    return payload
+}
+
+// sendToSlack uploads a file to Slack using the external upload flow
+// (files.getUploadURLExternal followed by files.completeUploadExternal)
+func (cm *ClipManager) sendToSlack(logger *Logger, filePath, botToken, channel string, clipReq *ClipRequest) error {
+    fileName := cm.clipFilename(clipReq, filePath)
+
+    operation := func() error {
+        fileData, err := os.ReadFile(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open file for sending to Slack: %v", err)
+        }
+
+        logger.Info("Sending clip to Slack. File: %s", fileName)
+
+        // Step 1: request an upload URL for the file
+        form := url.Values{
+            "filename": {fileName},
+            "length":   {strconv.Itoa(len(fileData))},
+        }
+        req, err := http.NewRequest("POST", "https://slack.com/api/files.getUploadURLExternal", strings.NewReader(form.Encode()))
+        if err != nil {
+            return fmt.Errorf("error creating Slack upload URL request: %v", err)
+        }
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        req.Header.Set("Authorization", "Bearer "+botToken)
+
+        var uploadURLResponse struct {
+            OK        bool   `json:"ok"`
+            Error     string `json:"error"`
+            UploadURL string `json:"upload_url"`
+            FileID    string `json:"file_id"`
+        }
+        if err := cm.doSlackRequest(req, &uploadURLResponse); err != nil {
+            return err
+        }
+        if !uploadURLResponse.OK {
+            return slackError("files.getUploadURLExternal", uploadURLResponse.Error)
+        }
+
+        // Step 2: upload the file contents to the returned URL
+        uploadReq, err := http.NewRequest("POST", uploadURLResponse.UploadURL, bytes.NewReader(fileData))
+        if err != nil {
+            return fmt.Errorf("error creating Slack file upload request: %v", err)
+        }
+        uploadReq.Header.Set("Content-Type", "application/octet-stream")
+
+        uploadResp, err := cm.httpClientFor("slack").Do(uploadReq)
+        if err != nil {
+            return fmt.Errorf("error uploading file to Slack: %v", err)
+        }
+        defer uploadResp.Body.Close()
+
+        if uploadResp.StatusCode >= 300 {
+            bodyBytes, _ := io.ReadAll(uploadResp.Body)
+            return responseError(uploadResp, fmt.Errorf("slack file upload error: %s - %s", uploadResp.Status, string(bodyBytes)))
+        }
+
+        // Step 3: complete the upload and share it in the channel
+        completeData := map[string]interface{}{
+            "files": []map[string]string{
+                {"id": uploadURLResponse.FileID, "title": fileName},
+            },
+            "channel_id":      channel,
+            "initial_comment": cm.buildClipMessage(withEscapedText(clipReq, slackEscaper.Replace)),
+        }
+
+        completeJSON, err := json.Marshal(completeData)
+        if err != nil {
+            return fmt.Errorf("error creating Slack complete upload JSON: %v", err)
+        }
+
+        completeReq, err := http.NewRequest("POST", "https://slack.com/api/files.completeUploadExternal", bytes.NewBuffer(completeJSON))
+        if err != nil {
+            return fmt.Errorf("error creating Slack complete upload request: %v", err)
+        }
+        completeReq.Header.Set("Content-Type", "application/json; charset=utf-8")
+        completeReq.Header.Set("Authorization", "Bearer "+botToken)
+
+        var completeResponse struct {
+            OK    bool   `json:"ok"`
+            Error string `json:"error"`
+        }
+        if err := cm.doSlackRequest(completeReq, &completeResponse); err != nil {
+            return err
+        }
+        if !completeResponse.OK {
+            return slackError("files.completeUploadExternal", completeResponse.Error)
+        }
+
+        logger.Success("Clip successfully sent to Slack")
+        return nil
+    }
+
+    return cm.RetryOperation(logger, operation, "Slack")
+}
+
+// httpClientFor returns the HTTP client for a destination, which applies its <DESTINATION>_TIMEOUT
+func (cm *ClipManager) httpClientFor(destination string) *http.Client {
+    if client, ok := cm.httpClients[destination]; ok {
+        return client
+    }
+    return cm.httpClient
+}
+
+// newHTTPTransport returns a transport like http.DefaultTransport that gives up connecting and
+// on the TLS handshake after destinationConnectTimeout. Requests go through proxy when it is set,
+// otherwise through the proxy from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newHTTPTransport(proxy *url.URL) *http.Transport {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = http.ProxyFromEnvironment
+    if proxy != nil {
+        transport.Proxy = http.ProxyURL(proxy)
+    }
+    transport.DialContext = (&net.Dialer{
+        Timeout:   destinationConnectTimeout,
+        KeepAlive: 30 * time.Second,
+    }).DialContext
+    transport.TLSHandshakeTimeout = destinationConnectTimeout
+    return transport
+}
+
+// TargetGuard keeps requests to caller-chosen URLs away from loopback, private, link-local and
+// unspecified addresses, e.g. the cloud metadata service, unless ALLOWED_PRIVATE_NETWORKS lists
+// them. Hosts are checked when a request is validated and again on every dial, so a DNS record
+// that changes in between can't get around it.
+type TargetGuard struct {
+    allowed []*net.IPNet
+    proxies map[string]bool // host:port of the configured proxies, chosen by the operator and always allowed
+    dialer  *net.Dialer
+}
+
+func NewTargetGuard(allowed []*net.IPNet, proxy *url.URL) *TargetGuard {
+    g := &TargetGuard{allowed: allowed, proxies: make(map[string]bool)}
+    proxies := []*url.URL{proxy}
+    if proxy == nil {
+        proxies = nil
+        for _, key := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+            if parsed, err := url.Parse(os.Getenv(key)); err == nil && parsed.Host != "" {
+                proxies = append(proxies, parsed)
+            }
+        }
+    }
+    for _, p := range proxies {
+        port := p.Port()
+        if port == "" {
+            port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[p.Scheme]
+        }
+        g.proxies[net.JoinHostPort(p.Hostname(), port)] = true
+    }
+
+    g.dialer = &net.Dialer{
+        Timeout:   destinationConnectTimeout,
+        KeepAlive: 30 * time.Second,
+        Control: func(network, address string, c syscall.RawConn) error {
+            host, _, err := net.SplitHostPort(address)
+            if err != nil {
+                return err
+            }
+            return g.checkIP(net.ParseIP(host))
+        },
+    }
+    return g
+}
+
+// CheckHost resolves host and fails if any of its addresses is off limits
+func (g *TargetGuard) CheckHost(host string) error {
+    if ip := net.ParseIP(host); ip != nil {
+        return g.checkIP(ip)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), destinationConnectTimeout)
+    defer cancel()
+    addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+    if err != nil {
+        return fmt.Errorf("could not resolve %s: %v", host, err)
+    }
+    for _, addr := range addrs {
+        if err := g.checkIP(addr.IP); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// DialContext dials like the default transport, refusing off-limits addresses at connect time
+func (g *TargetGuard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    if g.proxies[address] {
+        return (&net.Dialer{Timeout: g.dialer.Timeout, KeepAlive: g.dialer.KeepAlive}).DialContext(ctx, network, address)
+    }
+    return g.dialer.DialContext(ctx, network, address)
+}
+
+func (g *TargetGuard) checkIP(ip net.IP) error {
+    if ip == nil {
+        return fmt.Errorf("invalid address")
+    }
+    for _, network := range g.allowed {
+        if network.Contains(ip) {
+            return nil
+        }
+    }
+
+    ip4 := ip.To4()
+    if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+        ip.IsUnspecified() || ip.IsMulticast() || (ip4 != nil && ip4[0] == 0) {
+        return fmt.Errorf("%s is a private or local address (allow it with ALLOWED_PRIVATE_NETWORKS)", ip)
+    }
+    return nil
+}
+
+// doSlackRequest executes a Slack Web API request and decodes the JSON response.
+// Slack reports most failures with HTTP 200 and "ok": false, so callers must check the decoded result.
+func (cm *ClipManager) doSlackRequest(req *http.Request, result interface{}) error {
+    resp, err := cm.httpClientFor("slack").Do(req)
+    if err != nil {
+        return fmt.Errorf("error sending request to Slack: %v", err)
+    }
+    defer resp.Body.Close()
+
+    bodyBytes, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK {
+        return responseError(resp, fmt.Errorf("slack API error: %s - %s", resp.Status, string(bodyBytes)))
+    }
+
+    if err := json.Unmarshal(bodyBytes, result); err != nil {
+        return fmt.Errorf("error parsing Slack response: %v", err)
+    }
+
+    return nil
+}
+
+// sendToSFTP uploads the clip and returns the remote path it was stored at
+func (cm *ClipManager) sendToSFTP(logger *Logger, filePath, host, port, user, password, privateKey, passphrase, remotePath string, thumbnail bool, req *ClipRequest) (string, error) {
+    // Generate the sidecar thumbnail once, a failure only means the listing has no preview
+    var thumbnailPath string
+    if thumbnail {
+        thumbnailPath = strings.TrimSuffix(filePath, filepath.Ext(filePath)) + "_thumb.jpg"
+        if err := cm.generateThumbnail(filePath, thumbnailPath, defaultThumbnailOffset); err != nil {
+            logger.Warning("Could not generate thumbnail for SFTP upload: %v", err)
+            thumbnailPath = ""
+        } else {
+            defer os.Remove(thumbnailPath)
+        }
+    }
+
+    // The name is fixed up front so every retry resumes the same partial upload
+    remoteFilePath := filepath.Join(remotePath, cm.clipFilename(req, filePath))
+    partPath := remoteFilePath + ".part"
+    var resumeOffset int64 // Bytes of partPath known to be written by an earlier attempt
+
+    var uploadedPath string
+    operation := func() (err error) {
+        // A connection of its own, so closing it on a stall doesn't fail other transfers to the server
+        sftpClient, err := cm.connectToSFTPDedicated(host, port, user, password, privateKey, passphrase)
+        if err != nil {
+            return err
+        }
+        defer func() {
+            // Don't hand a connection that just failed to the retry
+            if err != nil {
+                sftpClient.Discard()
+            }
+            sftpClient.Close()
+        }()
+
+        // Close the connection when the transfer stalls, which fails the copy below
+        if timeout := cm.destinationTimeouts["sftp"]; timeout > 0 {
+            timer := time.AfterFunc(timeout, sftpClient.Abort)
+            defer func() {
+                if !timer.Stop() && err != nil {
+                    err = fmt.Errorf("SFTP upload timed out after %v: %v", timeout, err)
+                }
+            }()
+        }
+
+        // Open local file
+        localFile, err := os.Open(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open local file: %v", err)
+        }
+        defer localFile.Close()
+
+        // Ensure remote path exists
+        if remotePath != "." && remotePath != "" {
+            if err := sftpClient.MkdirAll(remotePath); err != nil {
+                logger.Warning("Could not create remote directory: %v, will try to upload to existing path", err)
+            }
+        }
+
+        if err := cm.uploadSFTPPart(logger, sftpClient.Client, localFile, partPath, &resumeOffset); err != nil {
+            return err
+        }
+        if err := cm.verifySFTPUpload(sftpClient.Client, localFile, partPath); err != nil {
+            // Start the retry from scratch, the partial upload can't be trusted
+            resumeOffset = 0
+            return err
+        }
+
+        // Publish the finished upload under its real name, so listings never show a partial clip
+        if err := sftpClient.PosixRename(partPath, remoteFilePath); err != nil {
+            // Servers without the posix-rename extension refuse to replace an existing file
+            sftpClient.Remove(remoteFilePath)
+            if err := sftpClient.Rename(partPath, remoteFilePath); err != nil {
+                return fmt.Errorf("failed to rename %s to %s: %v", partPath, remoteFilePath, err)
+            }
+        }
+        resumeOffset = 0
+
+        logger.Success("Clip successfully uploaded to SFTP at %s", remoteFilePath)
+
+        if thumbnailPath != "" {
+            remoteThumbnailPath := strings.TrimSuffix(remoteFilePath, filepath.Ext(remoteFilePath)) + ".jpg"
+            if err := uploadSFTPFile(sftpClient.Client, thumbnailPath, remoteThumbnailPath); err != nil {
+                logger.Warning("Could not upload thumbnail to SFTP: %v", err)
+            }
+        }
+
+        cm.broadcastNewClip("sftp", remoteFilePath, req)
+        uploadedPath = remoteFilePath
+        return nil
+    }
+
+    err := cm.RetryOperation(logger, operation, "SFTP")
+    return uploadedPath, err
+}
+
+// uploadSFTPPart writes localFile to partPath with concurrent requests. A previous attempt's
+// partial upload is continued from *resumeOffset, which is then set to how far this attempt got,
+// so a retry doesn't start from zero.
+func (cm *ClipManager) uploadSFTPPart(logger *Logger, client *sftp.Client, localFile *os.File, partPath string, resumeOffset *int64) error {
+    offset := *resumeOffset
+    if offset > 0 {
+        // Concurrent writes can leave data past the failed offset, so only the offset from the
+        // previous attempt is trusted and anything beyond it is cut off
+        if info, err := client.Stat(partPath); err != nil || info.Size() < offset {
+            offset = 0
+        }
+    }
+
+    flags := os.O_WRONLY | os.O_CREATE
+    if offset == 0 {
+        flags |= os.O_TRUNC
+    }
+    remoteFile, err := client.OpenFile(partPath, flags)
+    if err != nil {
+        return fmt.Errorf("failed to create remote file: %v", err)
+    }
+    defer remoteFile.Close()
+
+    if offset > 0 {
+        if err := remoteFile.Truncate(offset); err != nil {
+            return fmt.Errorf("failed to truncate partial upload: %v", err)
+        }
+        if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+            return fmt.Errorf("failed to seek in partial upload: %v", err)
+        }
+        if _, err := localFile.Seek(offset, io.SeekStart); err != nil {
+            return fmt.Errorf("failed to seek in local file: %v", err)
+        }
+        logger.Info("Resuming SFTP upload at %.1f MB", float64(offset)/(1024*1024))
+    }
+
+    if _, err := remoteFile.ReadFrom(localFile); err != nil {
+        // The file offset is where the first failed write started, everything before it arrived
+        if written, seekErr := remoteFile.Seek(0, io.SeekCurrent); seekErr == nil {
+            *resumeOffset = written
+        }
+        return fmt.Errorf("failed to copy file to SFTP server: %v", err)
+    }
+    // Complete, a retry after a failed rename has nothing left to send
+    *resumeOffset, _ = remoteFile.Seek(0, io.SeekCurrent)
+    return remoteFile.Close()
+}
+
+// verifySFTPUpload makes sure the remote file has the local file's size, and with
+// SFTP_VERIFY_CHECKSUM also reads it back to compare SHA-256 checksums
+func (cm *ClipManager) verifySFTPUpload(client *sftp.Client, localFile *os.File, remotePath string) error {
+    localInfo, err := localFile.Stat()
+    if err != nil {
+        return fmt.Errorf("could not stat local file: %v", err)
+    }
+    remoteInfo, err := client.Stat(remotePath)
+    if err != nil {
+        return fmt.Errorf("could not stat uploaded file: %v", err)
+    }
+    if remoteInfo.Size() != localInfo.Size() {
+        return fmt.Errorf("uploaded file is %d bytes but the clip is %d bytes", remoteInfo.Size(), localInfo.Size())
+    }
+    if !cm.sftpVerifyChecksum {
+        return nil
+    }
+
+    localHash := sha256.New()
+    if _, err := localFile.Seek(0, io.SeekStart); err != nil {
+        return fmt.Errorf("failed to seek in local file: %v", err)
+    }
+    if _, err := io.Copy(localHash, localFile); err != nil {
+        return fmt.Errorf("could not read local file: %v", err)
+    }
+
+    remoteFile, err := client.Open(remotePath)
+    if err != nil {
+        return fmt.Errorf("could not open uploaded file: %v", err)
+    }
+    defer remoteFile.Close()
+    remoteHash := sha256.New()
+    if _, err := remoteFile.WriteTo(remoteHash); err != nil {
+        return fmt.Errorf("could not read back uploaded file: %v", err)
+    }
+
+    if !bytes.Equal(localHash.Sum(nil), remoteHash.Sum(nil)) {
+        return fmt.Errorf("uploaded file checksum does not match the clip")
+    }
+    return nil
+}
+
+// sendToEmail mails a clip as an attachment over SMTP.
+// security is starttls (upgrade a plain connection), tls (implicit TLS, usually port 465) or none.
+func (cm *ClipManager) sendToEmail(logger *Logger, filePath, host, port, user, password, security, from, to string, req *ClipRequest) error {
+    var recipients []string
+    for _, addr := range strings.Split(to, ",") {
+        if addr = strings.TrimSpace(addr); addr != "" {
+            recipients = append(recipients, addr)
+        }
+    }
+    if len(recipients) == 0 {
+        return fmt.Errorf("no email recipients given")
+    }
+
+    message := cm.buildClipMessage(req)
+
+    operation := func() error {
+        fileData, err := os.ReadFile(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open file for sending by email: %v", err)
+        }
+
+        fileName := cm.clipFilename(req, filePath)
+        logger.Info("Sending clip by email to %s. File: %s", strings.Join(recipients, ", "), fileName)
+
+        // Build a multipart/mixed message with the clip message as body and the clip as attachment
+        var body bytes.Buffer
+        writer := multipart.NewWriter(&body)
+
+        textHeader := textproto.MIMEHeader{}
+        textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+        textPart, err := writer.CreatePart(textHeader)
+        if err != nil {
+            return fmt.Errorf("error creating email body: %v", err)
+        }
+        textPart.Write([]byte(message + "\r\n"))
+
+        attachmentHeader := textproto.MIMEHeader{}
+        attachmentHeader.Set("Content-Type", videoContentType(filePath))
+        attachmentHeader.Set("Content-Transfer-Encoding", "base64")
+        attachmentHeader.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+        attachmentPart, err := writer.CreatePart(attachmentHeader)
+        if err != nil {
+            return fmt.Errorf("error creating email attachment: %v", err)
+        }
+        encoded := base64.StdEncoding.EncodeToString(fileData)
+        for len(encoded) > 76 {
+            attachmentPart.Write([]byte(encoded[:76] + "\r\n"))
+            encoded = encoded[76:]
+        }
+        attachmentPart.Write([]byte(encoded + "\r\n"))
+        writer.Close()
+
+        var msg bytes.Buffer
+        fmt.Fprintf(&msg, "From: %s\r\n", from)
+        fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(recipients, ", "))
+        fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message))
+        fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+        fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+        fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+        msg.Write(body.Bytes())
+
+        addr := net.JoinHostPort(host, port)
+        tlsConfig := &tls.Config{ServerName: host}
+
+        var conn net.Conn
+        if security == "tls" {
+            conn, err = tls.DialWithDialer(&net.Dialer{Timeout: destinationConnectTimeout}, "tcp", addr, tlsConfig)
+        } else {
+            conn, err = net.DialTimeout("tcp", addr, destinationConnectTimeout)
+        }
+        if err != nil {
+            return fmt.Errorf("could not connect to SMTP server: %v", err)
+        }
+        // A stalled server fails the attempt instead of blocking the request
+        if timeout := cm.destinationTimeouts["email"]; timeout > 0 {
+            conn.SetDeadline(time.Now().Add(timeout))
+        }
+
+        client, err := smtp.NewClient(conn, host)
+        if err != nil {
+            conn.Close()
+            return fmt.Errorf("SMTP handshake failed: %v", err)
+        }
+        defer client.Close()
+
+        if security == "starttls" {
+            if err := client.StartTLS(tlsConfig); err != nil {
+                return fmt.Errorf("STARTTLS failed: %v", err)
+            }
+        }
+
+        if user != "" {
+            if err := client.Auth(smtp.PlainAuth("", user, password, host)); err != nil {
+                return smtpError(err, fmt.Errorf("SMTP authentication failed: %v", err))
+            }
+        }
+
+        if err := client.Mail(from); err != nil {
+            return smtpError(err, fmt.Errorf("SMTP sender rejected: %v", err))
+        }
+        for _, recipient := range recipients {
+            if err := client.Rcpt(recipient); err != nil {
+                return smtpError(err, fmt.Errorf("SMTP recipient %s rejected: %v", recipient, err))
+            }
+        }
+
+        dataWriter, err := client.Data()
+        if err != nil {
+            return fmt.Errorf("SMTP DATA failed: %v", err)
+        }
+        if _, err := dataWriter.Write(msg.Bytes()); err != nil {
+            return fmt.Errorf("error writing email: %v", err)
+        }
+        if err := dataWriter.Close(); err != nil {
+            return smtpError(err, fmt.Errorf("SMTP server rejected the email: %v", err))
+        }
+        client.Quit()
+
+        logger.Success("Clip successfully sent by email")
+        return nil
+    }
+
+    return cm.RetryOperation(logger, operation, "Email")
+}
+
+// refreshYouTubeToken exchanges a refresh token for a new access token
+func (cm *ClipManager) refreshYouTubeToken(refreshToken, clientID, clientSecret string) (string, error) {
+    data := url.Values{
+        "refresh_token": {refreshToken},
+        "client_id":     {clientID},
+        "client_secret": {clientSecret},
+        "grant_type":    {"refresh_token"},
+    }
+
+    resp, err := cm.httpClient.PostForm("https://oauth2.googleapis.com/token", data)
+    if err != nil {
+        return "", fmt.Errorf("error refreshing YouTube access token: %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        bodyBytes, _ := io.ReadAll(resp.Body)
+        return "", responseError(resp, fmt.Errorf("YouTube token refresh error: %s - %s", resp.Status, string(bodyBytes)))
+    }
+
+    var tokenRes struct {
+        AccessToken string `json:"access_token"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&tokenRes); err != nil {
+        return "", fmt.Errorf("error parsing YouTube token response: %v", err)
+    }
+    if tokenRes.AccessToken == "" {
+        return "", fmt.Errorf("YouTube token response did not contain an access token")
+    }
+
+    return tokenRes.AccessToken, nil
+}
+
+// sendToYouTube uploads a clip to YouTube using the Data API resumable upload protocol
+func (cm *ClipManager) sendToYouTube(logger *Logger, filePath, accessToken, refreshToken, clientID, clientSecret, privacy string, req *ClipRequest) error {
+    canRefresh := refreshToken != "" && clientID != "" && clientSecret != ""
+
+    // Refresh before uploading so an expired access token doesn't fail the upload halfway
+    if canRefresh {
+        token, err := cm.refreshYouTubeToken(refreshToken, clientID, clientSecret)
+        if err != nil {
+            if accessToken == "" {
+                return err
+            }
+            logger.Warning("Could not refresh YouTube token, trying the given access token: %v", err)
+        } else {
+            accessToken = token
+        }
+    }
+
+    title := req.Title
+    category := req.Category
+    team1 := req.Team1
+    team2 := req.Team2
+
+    if title == "" && team1 != "" && team2 != "" {
+        title = fmt.Sprintf("%s vs %s", team1, team2)
+        if category != "" {
+            title = category + " - " + title
+        }
+    }
+    if title == "" {
+        title = cm.buildClipMessage(req)
+    }
+    // YouTube rejects titles over 100 characters or containing angle brackets
+    title = strings.NewReplacer("<", "", ">", "").Replace(title)
+    if runes := []rune(title); len(runes) > 100 {
+        title = string(runes[:100])
+    }
+
+    var tags []string
+    for _, tag := range []string{category, team1, team2} {
+        if tag != "" {
+            tags = append(tags, tag)
+        }
+    }
+
+    metadata := map[string]interface{}{
+        "snippet": map[string]interface{}{
+            "title":       title,
+            "description": strings.NewReplacer("<", "", ">", "").Replace(cm.buildClipMessage(req)),
+            "tags":        tags,
+        },
+        "status": map[string]string{
+            "privacyStatus": privacy,
+        },
+    }
+    metadataJSON, err := json.Marshal(metadata)
+    if err != nil {
+        return fmt.Errorf("error creating YouTube metadata JSON: %v", err)
+    }
+
+    operation := func() error {
+        file, err := os.Open(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open file for sending to YouTube: %v", err)
+        }
+        defer file.Close()
+
+        fileInfo, err := file.Stat()
+        if err != nil {
+            return fmt.Errorf("could not get file info: %v", err)
+        }
+
+        logger.Info("Sending clip to YouTube. File: %s", filepath.Base(filePath))
+
+        // Step 1: start a resumable upload session with the video metadata
+        initReq, err := http.NewRequest("POST", "https://www.googleapis.com/upload/youtube/v3/videos?uploadType=resumable&part=snippet,status", bytes.NewReader(metadataJSON))
+        if err != nil {
+            return fmt.Errorf("error creating YouTube upload session request: %v", err)
+        }
+        initReq.Header.Set("Authorization", "Bearer "+accessToken)
+        initReq.Header.Set("Content-Type", "application/json; charset=UTF-8")
+        initReq.Header.Set("X-Upload-Content-Type", videoContentType(filePath))
+        initReq.Header.Set("X-Upload-Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
+
+        initResp, err := cm.httpClientFor("youtube").Do(initReq)
+        if err != nil {
+            return fmt.Errorf("error starting YouTube upload session: %v", err)
+        }
+        initResp.Body.Close()
+
+        if initResp.StatusCode == http.StatusUnauthorized && canRefresh {
+            token, refreshErr := cm.refreshYouTubeToken(refreshToken, clientID, clientSecret)
+            if refreshErr != nil {
+                return refreshErr
+            }
+            accessToken = token
+            return fmt.Errorf("YouTube access token expired, refreshed it for the next attempt")
+        }
+        if initResp.StatusCode != http.StatusOK {
+            return responseError(initResp, fmt.Errorf("YouTube upload session error: %s", initResp.Status))
+        }
+
+        uploadURL := initResp.Header.Get("Location")
+        if uploadURL == "" {
+            return fmt.Errorf("YouTube did not return an upload URL")
+        }
+
+        // Step 2: upload the video to the session URL
+        uploadReq, err := http.NewRequest("PUT", uploadURL, file)
+        if err != nil {
+            return fmt.Errorf("error creating YouTube upload request: %v", err)
+        }
+        uploadReq.ContentLength = fileInfo.Size()
+        uploadReq.Header.Set("Authorization", "Bearer "+accessToken)
+        uploadReq.Header.Set("Content-Type", videoContentType(filePath))
+
+        uploadResp, err := cm.httpClientFor("youtube").Do(uploadReq)
+        if err != nil {
+            return fmt.Errorf("error uploading clip to YouTube: %v", err)
+        }
+        defer uploadResp.Body.Close()
+
+        if uploadResp.StatusCode != http.StatusOK && uploadResp.StatusCode != http.StatusCreated {
+            bodyBytes, _ := io.ReadAll(uploadResp.Body)
+            return responseError(uploadResp, fmt.Errorf("YouTube upload error: %s - %s", uploadResp.Status, string(bodyBytes)))
+        }
+
+        var video struct {
+            ID string `json:"id"`
+        }
+        json.NewDecoder(uploadResp.Body).Decode(&video)
+
+        logger.Success("Clip successfully sent to YouTube: https://youtu.be/%s", video.ID)
+        return nil
+    }
+
+    return cm.RetryOperation(logger, operation, "YouTube")
+}
+
+// sendToS3 uploads a file to an S3-compatible object store (AWS S3, MinIO, ...). Buckets are
+// addressed path-style (endpoint/bucket/key) when pathStyle is set and virtual-hosted
+// (bucket.endpoint/key) otherwise.
+func (cm *ClipManager) sendToS3(logger *Logger, filePath, endpoint, bucket, accessKey, secretKey, region, prefix string, pathStyle bool, clipReq *ClipRequest) (string, error) {
+    if endpoint == "" {
+        endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+    }
+
+    objectName := cm.clipFilename(clipReq, filePath)
+    objectKey := strings.TrimPrefix(path.Join(prefix, objectName), "/")
+
+    operation := func() error {
+        endpointURL, err := parseS3Endpoint(endpoint)
+        if err != nil {
+            return fmt.Errorf("invalid S3 endpoint: %v", err)
+        }
+
+        bucketLookup := minio.BucketLookupDNS
+        if pathStyle {
+            bucketLookup = minio.BucketLookupPath
+        }
+        httpClient := cm.httpClientFor("s3")
+        client, err := minio.New(endpointURL.Host, &minio.Options{
+            Creds:        credentials.NewStaticV4(accessKey, secretKey, ""),
+            Secure:       endpointURL.Scheme == "https",
+            Transport:    httpClient.Transport,
+            Region:       region,
+            BucketLookup: bucketLookup,
+        })
+        if err != nil {
+            return &PermanentError{Err: fmt.Errorf("error creating S3 client: %v", err)}
+        }
+
+        file, err := os.Open(filePath)
+        if err != nil {
+            return fmt.Errorf("could not open file for sending to S3: %v", err)
+        }
+        defer file.Close()
+        fileInfo, err := file.Stat()
+        if err != nil {
+            return fmt.Errorf("could not stat file for sending to S3: %v", err)
+        }
+
+        // The per-attempt timeout of the s3 client, which minio-go doesn't use itself
+        ctx := cm.ctx
+        if httpClient.Timeout > 0 {
+            var cancel context.CancelFunc
+            ctx, cancel = context.WithTimeout(ctx, httpClient.Timeout)
+            defer cancel()
+        }
+
+        logger.Info("Uploading clip to S3 bucket %s as %s", bucket, objectKey)
+        _, err = client.PutObject(ctx, bucket, objectKey, file, fileInfo.Size(), minio.PutObjectOptions{
+            ContentType: videoContentType(filePath),
+        })
+        if err != nil {
+            return s3Error(err)
+        }
+
+        clipPath := fmt.Sprintf("s3://%s/%s", bucket, objectKey)
+        logger.Success("Clip successfully uploaded to %s", clipPath)
+        cm.broadcastNewClip("s3", clipPath, clipReq)
+        return nil
+    }
+
+    if err := cm.RetryOperation(logger, operation, "S3"); err != nil {
+        return "", err
+    }
+    return fmt.Sprintf("s3://%s/%s", bucket, objectKey), nil
+}
+
+func init() {
+	// RetryOperation retries S3 uploads with the configured backoff, so minio-go makes a single
+	// attempt per upload instead of retrying on its own
+	minio.MaxRetry = 1
+}
+
+// s3Error classifies an S3 upload error like responseError: 408, 429 and 5xx responses and
+// network errors can succeed on a retry, other 4xx mean bad credentials or settings
+func s3Error(err error) error {
+    status := minio.ToErrorResponse(err).StatusCode
+    err = fmt.Errorf("error uploading to S3: %v", err)
+    if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+        return &PermanentError{Err: err}
+    }
+    return err
+}
+
+// parseS3Endpoint parses an S3 endpoint, defaulting to https when no scheme is given
+func parseS3Endpoint(endpoint string) (*url.URL, error) {
+    if !strings.Contains(endpoint, "://") {
+        endpoint = "https://" + endpoint
+    }
+
+    endpointURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+    if err != nil {
+        return nil, err
+    }
+    if endpointURL.Host == "" || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") {
+        return nil, fmt.Errorf("endpoint must be an http(s) URL or host name")
+    }
+    if endpointURL.Path != "" || endpointURL.RawQuery != "" {
+        return nil, fmt.Errorf("endpoint can't have a path, give only the scheme, host and port")
+    }
+    return endpointURL, nil
+}
+
+// clipFilename is the name a clip is uploaded under: the filename parameter when given, otherwise
+// one generated from the title, category and teams. The extension follows filePath, whose container
+// can differ from the recorded clip after compression.
+func (cm *ClipManager) clipFilename(req *ClipRequest, filePath string) string {
+    name := req.Filename
+    if name == "" {
+        name = strings.TrimSuffix(cm.generateSFTPFilename(req), ".mp4")
+    }
+    return name + filepath.Ext(filePath)
+}
+
+// sanitizeText turns control characters such as line breaks into spaces, so text from a request
+// stays on one line in captions and email headers, and cuts it off after maxLength characters
+func sanitizeText(text string, maxLength int) string {
+    text = strings.Map(func(r rune) rune {
+        if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+            return ' '
+        }
+        return r
+    }, strings.ToValidUTF8(text, ""))
+    text = strings.TrimSpace(text)
+    if runes := []rune(text); len(runes) > maxLength {
+        text = strings.TrimSpace(string(runes[:maxLength]))
+    }
+    return text
+}
+
+// markdownEscaper escapes the Markdown that Discord and Mattermost render, so request text is
+// shown as typed instead of formatting or linking the rest of the message
+var markdownEscaper = strings.NewReplacer(
+    "\\", "\\\\", "*", "\\*", "_", "\\_", "~", "\\~", "`", "\\`", "|", "\\|",
+    ">", "\\>", "#", "\\#", "[", "\\[", "]", "\\]",
+)
+
+// slackEscaper escapes the characters Slack uses for links and mentions like <!channel>
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// withEscapedText returns a copy of the request with the text shown in messages passed through escape
+func withEscapedText(req *ClipRequest, escape func(string) string) *ClipRequest {
+    escaped := *req
+    escaped.Title = escape(req.Title)
+    escaped.Category = escape(req.Category)
+    escaped.Team1 = escape(req.Team1)
+    escaped.Team2 = escape(req.Team2)
+    escaped.AdditionalText = escape(req.AdditionalText)
+    return &escaped
+}
+
+// sanitizeFilename reduces a user supplied filename to a safe base name without directories or extension
+func sanitizeFilename(name string) string {
+    name = filepath.Base(strings.ReplaceAll(strings.TrimSpace(name), "\\", "/"))
+    name = strings.TrimSuffix(name, filepath.Ext(name))
+    name = regexp.MustCompile("[^a-zA-Z0-9_-]+").ReplaceAllString(name, "_")
+    name = strings.Trim(name, "_")
+    if len(name) > maxFilenameLength {
+        name = name[:maxFilenameLength]
+    }
+    return name
+}
+
+// clipNameSeparator separates the metadata fields of a generated clip filename. sanitizeNamePart
+// never produces two underscores in a row, so the fields can be split apart again.
+const clipNameSeparator = "__"
+
+// namePartPattern matches what sanitizeNamePart replaces, underscores included so that runs of
+// them collapse into one
+var namePartPattern = regexp.MustCompile("[^a-zA-Z0-9-]+")
+
+// sanitizeNamePart reduces a metadata field to letters, digits, hyphens and single underscores
+func sanitizeNamePart(s string) string {
+    return strings.Trim(namePartPattern.ReplaceAllString(strings.TrimSpace(s), "_"), "_")
+}
+
+// clipNamePrefix builds the part of a clip filename before the capture time:
+// title__category, followed by __team1 or __team1__vs__team2. Title and category stand in for
+// each other when one is missing; when only teams are given both are left empty, so the teams
+// keep their place. Returns "" when there is no metadata at all.
+func clipNamePrefix(title, category, team1, team2 string) string {
+    title, category = sanitizeNamePart(title), sanitizeNamePart(category)
+    team1, team2 = sanitizeNamePart(team1), sanitizeNamePart(team2)
+
+    if title == "" {
+        title = category
+    } else if category == "" {
+        category = title
+    }
+    if team1 == "" {
+        team1, team2 = team2, ""
+    }
+    if title == "" && team1 == "" {
+        return ""
+    }
+
+    parts := []string{title, category}
+    if team1 != "" {
+        parts = append(parts, team1)
+    }
+    if team2 != "" {
+        parts = append(parts, "vs", team2)
+    }
+    return strings.Join(parts, clipNameSeparator)
+}
+
+// generateSFTPFilename creates a filename based on request parameters
+func (cm *ClipManager) generateSFTPFilename(req *ClipRequest) string {
+    timestamp := time.Now().Format("2006-01-02_15-04")
+    prefix := clipNamePrefix(req.Title, req.Category, req.Team1, req.Team2)
+    if prefix == "" {
+        return fmt.Sprintf("%s.mp4", timestamp)
+    }
+    return fmt.Sprintf("%s%s%s.mp4", prefix, clipNameSeparator, timestamp)
+}
+
+// SendToChatApp sends a clip to every requested destination and reports the outcome per destination
+func (cm *ClipManager) SendToChatApp(logger *Logger, originalFilePath string, req *ClipRequest) ([]DestinationResult, error) {
+    chatAppList := strings.Split(req.ChatApps, ",")
+
+    // Measure loudness once for all destinations
+    var audioFilter string
+    if normalization, err := req.audioNormalization(); err != nil {
+        logger.Warning("Skipping audio normalization: %v", err)
+    } else if normalization != nil {
+        if _, audioCodec, err := cm.probeCodecs(originalFilePath); err == nil && audioCodec == "" {
+            logger.Warning("Skipping audio normalization: clip has no audio")
+        } else if audioFilter, err = cm.loudnormFilter(logger, originalFilePath, normalization); err != nil {
+            logger.Warning("Skipping audio normalization: %v", err)
+            audioFilter = ""
+        }
+    }
+
+    // Destinations are prepared in their own goroutines, their encodes share cm.encodeSlots.
+    // Destinations with the same compressionKey wait for and reuse the first one's file.
+    compression := req.compressionSettings(cm.currentConfig().Compression)
+    preparedClips := make(map[compressionKey]*preparedClip)
+    var preparedMutex sync.Mutex
+    prepare := func(appLogger *Logger, app string) (string, error) {
+        limit, exists := cm.sizeLimit(app, compression)
+        if !exists {
+            return "", fmt.Errorf("unknown chat app: %s", app)
+        }
+
+        key := compressionKey{SizeMB: limit, Resolution: strings.ToLower(req.Resolution), Encoder: cm.encoder}
+        preparedMutex.Lock()
+        clip, shared := preparedClips[key]
+        if !shared {
+            clip = &preparedClip{done: make(chan struct{})}
+            preparedClips[key] = clip
+        }
+        preparedMutex.Unlock()
+
+        if shared {
+            <-clip.done
+            if clip.filePath != originalFilePath {
+                appLogger.Info("Reusing the clip prepared for another destination with the same %.2f MB limit", limit)
+            }
+            return clip.filePath, clip.err
+        }
+
+        clip.filePath, clip.err = cm.PrepareClipForChatApp(appLogger, originalFilePath, app, req.Resolution, audioFilter, compression)
+        close(clip.done)
+        return clip.filePath, clip.err
+    }
+
+    var wg sync.WaitGroup
+    errors := make(chan error, len(chatAppList))
+    var results []DestinationResult
+    var resultsMutex sync.Mutex
+    addResult := func(app, location, postID string, err error) {
+        result := DestinationResult{Destination: app, Success: err == nil, Location: location, PostID: postID}
+        if err != nil {
+            result.Error = err.Error()
+        }
+        resultsMutex.Lock()
+        results = append(results, result)
+        resultsMutex.Unlock()
+    }
+
+    for _, app := range chatAppList {
+        app = strings.TrimSpace(app)
+
+        wg.Add(1)
+        go func(app string) {
+            defer wg.Done()
+
+            appLogger := logger.With("[%s]", app)
+            filePath, err := prepare(appLogger, app)
+            if err != nil {
+                logger.Error("Error preparing clip for %s: %v", app, err)
+                errors <- fmt.Errorf("error preparing clip for %s: %v", app, err)
+                addResult(app, "", "", err)
+                return
+            }
+
+            var location, postID string
+            switch app {
+            case "telegram":
+                err = cm.sendToTelegram(appLogger, filePath, req.TelegramBotToken, req.TelegramChatID, req)
+            case "mattermost":
+                postID, err = cm.sendToMattermost(appLogger, filePath, req.MattermostURL, req.MattermostToken, req.MattermostChannel, req)
+            case "discord":
+                err = cm.sendToDiscord(appLogger, filePath, req.DiscordWebhookURL, req)
+            case "sftp":
+                location, err = cm.sendToSFTP(appLogger, filePath, req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword, req.SFTPPrivateKey, req.SFTPPassphrase, req.SFTPPath, req.SFTPThumbnail, req)
+            case "slack":
+                err = cm.sendToSlack(appLogger, filePath, req.SlackBotToken, req.SlackChannel, req)
+            case "s3":
+                location, err = cm.sendToS3(appLogger, filePath, req.S3Endpoint, req.S3Bucket, req.S3AccessKey, req.S3SecretKey, req.S3Region, req.S3Prefix, req.S3PathStyle, req)
+            case "email":
+                err = cm.sendToEmail(appLogger, filePath, req.SMTPHost, req.SMTPPort, req.SMTPUser, req.SMTPPassword, req.SMTPSecurity, req.EmailFrom, req.EmailTo, req)
+            case "youtube":
+                err = cm.sendToYouTube(appLogger, filePath, req.YouTubeAccessToken, req.YouTubeRefreshToken, req.YouTubeClientID, req.YouTubeClientSecret, req.YouTubePrivacy, req)
+            case "webhook":
+                err = cm.sendToWebhook(appLogger, filePath, req)
+            default:
+                err = fmt.Errorf("unsupported chat app: %s", app)
+            }
+
+            if err != nil {
+                logger.Error("Error sending clip to %s: %v", app, err)
+                errors <- fmt.Errorf("error sending to %s: %v", app, err)
+                cm.metrics.IncDestinationSend(app, false)
+            } else {
+                logger.Success("Successfully sent clip to %s", app)
+                cm.metrics.IncDestinationSend(app, true)
+            }
+            addResult(app, location, postID, err)
+        }(app)
+    }
+
+    wg.Wait()
+    close(errors)
+
+    // Each shared file is removed once. Failed compressions can leave a file behind too.
+    for key, clip := range preparedClips {
+        if clip.filePath != "" && clip.filePath != originalFilePath {
+            logger.Info("Cleaning up compressed file for the %.2f MB limit: %s", key.SizeMB, clip.filePath)
+            os.Remove(clip.filePath)
+        }
+    }
+
+    var errList []string
+    for err := range errors {
+        errList = append(errList, err.Error())
+    }
+
+    if len(errList) > 0 {
+        return results, fmt.Errorf("errors sending clip: %s", strings.Join(errList, "; "))
+    }
+
+    return results, nil
+}
+
+func (cm *ClipManager) buildClipMessage(req *ClipRequest) string {
+    title, category, team1, team2, additionalText := req.Title, req.Category, req.Team1, req.Team2, req.AdditionalText
+    
+    // Build message components
+    var messageParts []string
+    
+    // Add title if available
+    if title != "" {
+        messageParts = append(messageParts, title)
+    }
+    
+    // Add category if available and different from title
+    if category != "" && category != title {
+        messageParts = append(messageParts, category)
+    }
+    
+    // Join title and category with " - " if both exist
+    messagePrefix := ""
+    if len(messageParts) > 0 {
+        messagePrefix = strings.Join(messageParts, " - ") + " "
+    }
+    
+    // Create the base message with prefix and timestamp
+    base := fmt.Sprintf("New %sClip: %s", messagePrefix, cm.formatCurrentTime())
+
+    // Add team information if available
+    var teams string
+    if team1 != "" && team2 != "" {
+        teams = fmt.Sprintf(" / %s vs %s", team1, team2)
+    }
+
+    // Add additional text if available
+    var extra string
+    if additionalText != "" {
+        extra = fmt.Sprintf(" - %s", additionalText)
+    }
+
+    return base + teams + extra
+}
+
+// optionalCategory adds a space if category is present
+func optionalCategory(category string) string {
+	if category != "" {
+		return category + " "
+	}
+	return ""
+}
+
+// formatCurrentTime returns a formatted current time string
+func (cm *ClipManager) formatCurrentTime() string {
+	return time.Now().Format("2006-01-02")
+}
+
+// serveWebInterface serves the HTML form interface at the root endpoint
+func (cm *ClipManager) serveWebInterface(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join(cm.templatesDir, "index.html")
+
+	_, err := os.Stat(templatePath)
+	if err != nil && !filepath.IsAbs(templatePath) {
+		execPath, err := os.Executable()
+		if err == nil {
+			execDir := filepath.Dir(execPath)
+			templatePath = filepath.Join(execDir, templatePath)
+			}
+		}
+
+	htmlContent, err := os.ReadFile(templatePath)
+	if (err != nil) {
+		cm.log.Warning("Error reading template file: %v, using embedded HTML", err)
+		htmlContent = []byte(getEmbeddedHTML())
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(htmlContent)
+}
+
+// getEmbeddedHTML returns the HTML content as a fallback if the file can't be loaded
+func getEmbeddedHTML() string {
+	return `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>ClipManager</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            line-height: 1.6;
+            color: #333;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #2c3e50;
+            text-align: center;
+        }
+    </style>
+</head>
+<body>
+    <h1>ClipManager</h1>
+    <p>The template file could not be loaded. Please make sure the templates directory exists.</p>
+    <p>API endpoint is still available at: /api/clip</p>
+</body>
+</html>
+`
+}
+
+// ClipInfo represents metadata about a clip file
+type ClipInfo struct {
+    Name      string    `json:"name"`
+    Size      int64     `json:"size"`
+    ModTime   time.Time `json:"mod_time"`
+    Path      string    `json:"path"`
+}
+
+const (
+    defaultClipListLimit = 50
+    maxClipListLimit     = 1000
+    defaultClipListDepth = 3
+    maxClipListDepth     = 10
+    maxClipListEntries   = 10000 // Stop walking once this many clips were found
+)
+
+// ClipListOptions selects which page of the clip listing is returned and in what order
+type ClipListOptions struct {
+    Limit  int    `json:"limit"`  // Page size, defaults to defaultClipListLimit
+    Offset int    `json:"offset"` // Number of clips to skip
+    Sort   string `json:"sort"`   // name, size or modtime (default)
+    Order  string `json:"order"`  // asc or desc (default)
+
+    Recursive bool `json:"recursive"` // Also list clips in subdirectories
+    MaxDepth  int  `json:"max_depth"` // How many directory levels to descend when recursive
+
+    // Filters on the metadata encoded in the filename by generateSFTPFilename. When any is set,
+    // files that don't follow the naming scheme are left out.
+    Category string `json:"filter_category"` // Case-insensitive substring of the category
+    Team     string `json:"filter_team"`     // Case-insensitive substring of either team
+    From     string `json:"from"`            // Earliest clip time, YYYY-MM-DD or RFC 3339
+    To       string `json:"to"`              // Latest clip time, YYYY-MM-DD (whole day) or RFC 3339
+
+    from, to time.Time
+}
+
+// ClipListRequest is the body of /api/clips: SFTP connection parameters plus listing options
+type ClipListRequest struct {
+    ClipRequest
+    ClipListOptions
+}
+
+// ClipListResponse is one page of the clip listing, with the total number of clips available
+type ClipListResponse struct {
+    Clips  []ClipInfo `json:"clips"`
+    Total  int        `json:"total"`
+    Limit  int        `json:"limit"`
+    Offset int        `json:"offset"`
+}
+
+// validate fills in defaults and rejects unknown sort fields or orders
+func (o *ClipListOptions) validate() error {
+    if o.Limit <= 0 {
+        o.Limit = defaultClipListLimit
+    }
+    if o.Limit > maxClipListLimit {
+        o.Limit = maxClipListLimit
+    }
+    if o.Offset < 0 {
+        return fmt.Errorf("offset must be 0 or greater")
+    }
+    o.Sort = strings.ToLower(o.Sort)
+    if o.Sort == "" {
+        o.Sort = "modtime"
+    }
+    if o.Sort != "name" && o.Sort != "size" && o.Sort != "modtime" {
+        return fmt.Errorf("invalid sort '%s', must be name, size or modtime", o.Sort)
+    }
+    o.Order = strings.ToLower(o.Order)
+    if o.Order == "" {
+        o.Order = "desc"
+    }
+    if o.Order != "asc" && o.Order != "desc" {
+        return fmt.Errorf("invalid order '%s', must be asc or desc", o.Order)
+    }
+    if o.MaxDepth <= 0 {
+        o.MaxDepth = defaultClipListDepth
+    }
+    if o.MaxDepth > maxClipListDepth {
+        o.MaxDepth = maxClipListDepth
+    }
+
+    var err error
+    if o.From != "" {
+        if o.from, err = parseClipListTime(o.From, false); err != nil {
+            return fmt.Errorf("invalid from: %v", err)
+        }
+    }
+    if o.To != "" {
+        if o.to, err = parseClipListTime(o.To, true); err != nil {
+            return fmt.Errorf("invalid to: %v", err)
+        }
+    }
+    return nil
+}
+
+// HandleListClips returns a list of clips from the SFTP server
+func (cm *ClipManager) HandleListClips(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use GET or POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // GET takes everything from the query string, e.g. for a dashboard link; POST reads the JSON
+    // body, which query parameters override
+    var req ClipListRequest
+    if err := decodeRequest(r, &req); err != nil {
+        http.Error(w, err.Error(), bodyErrorStatus(err))
+        cm.log.Error("Failed to parse list clips request: %v", err)
+        return
+    }
+    if req.SFTPHost == "" || req.SFTPUser == "" || (req.SFTPPassword == "" && req.SFTPPrivateKey == "") {
+        http.Error(w, "Missing SFTP connection parameters", http.StatusBadRequest)
+        return
+    }
+
+    if err := req.ClipListOptions.validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // Connect to SFTP and list files
+    clips, total, err := cm.listSftpClips(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword, req.SFTPPrivateKey, req.SFTPPassphrase, req.SFTPPath, req.ClipListOptions)
+    if err != nil {
+        http.Error(w, "Failed to list clips: "+err.Error(), http.StatusInternalServerError)
+        cm.log.Error("Failed to list clips: %v", err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(ClipListResponse{
+        Clips:  clips,
+        Total:  total,
+        Limit:  req.Limit,
+        Offset: req.Offset,
+    })
+}
+
+// HandleTestSFTPConnection tests if the SFTP connection works
+func (cm *ClipManager) HandleTestSFTPConnection(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req ClipRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", bodyErrorStatus(err))
+        cm.log.Error("Failed to parse SFTP test request: %v", err)
+        return
+    }
+
+    client, err := cm.connectToSFTP(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword, req.SFTPPrivateKey, req.SFTPPassphrase)
+    if err != nil {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": err.Error()})
+        return
+    }
+    defer client.Close()
+
+    // Try to list the directory to verify permissions
+    path := req.SFTPPath
+    if path == "" {
+        path = "."
+    }
+
+    _, err = client.ReadDir(path)
+    if err != nil {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "success": false, 
+            "message": fmt.Sprintf("Connected to SFTP but failed to read directory '%s': %v", path, err),
+        })
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "message": "Connection successful"})
+}
+
+// HandleDeleteClip deletes a clip from the SFTP server
+func (cm *ClipManager) HandleDeleteClip(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req struct {
+        SFTPHost     string `json:"sftp_host"`
+        SFTPPort     string `json:"sftp_port"`
+        SFTPUser     string `json:"sftp_user"`
+        SFTPPassword string `json:"sftp_password"`
+        SFTPPrivateKey string `json:"sftp_private_key"`
+        SFTPPassphrase string `json:"sftp_passphrase"`
+        Path         string `json:"path"`
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", bodyErrorStatus(err))
+        cm.log.Error("Failed to parse delete request: %v", err)
+        return
+    }
+
+    client, err := cm.connectToSFTP(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword, req.SFTPPrivateKey, req.SFTPPassphrase)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to connect to SFTP: %v", err), http.StatusInternalServerError)
+        return
+    }
+    defer client.Close()
+
+    if err := client.Remove(req.Path); err != nil {
+        http.Error(w, fmt.Sprintf("Failed to delete file: %v", err), http.StatusInternalServerError)
+        cm.log.Error("Failed to delete file %s: %v", req.Path, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "message": "File deleted successfully"})
+}
+
+// uploadSFTPFile copies a local file to a remote path
+func uploadSFTPFile(client *sftp.Client, localPath, remotePath string) error {
+    localFile, err := os.Open(localPath)
+    if err != nil {
+        return fmt.Errorf("could not open local file: %v", err)
+    }
+    defer localFile.Close()
+
+    remoteFile, err := client.Create(remotePath)
+    if err != nil {
+        return fmt.Errorf("failed to create remote file: %v", err)
+    }
+    defer remoteFile.Close()
+
+    if _, err := io.Copy(remoteFile, localFile); err != nil {
+        return fmt.Errorf("failed to copy file to SFTP server: %v", err)
+    }
+    return nil
+}
+
+// downloadSFTPFile copies a remote file to a local path
+func downloadSFTPFile(client *sftp.Client, remotePath, localPath string) error {
+    remoteFile, err := client.Open(remotePath)
+    if err != nil {
+        return fmt.Errorf("failed to open remote clip: %v", err)
+    }
+    defer remoteFile.Close()
+
+    out, err := os.Create(localPath)
+    if err != nil {
+        return fmt.Errorf("failed to create local copy: %v", err)
+    }
+    _, err = io.Copy(out, remoteFile)
+    if closeErr := out.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return fmt.Errorf("failed to download clip: %v", err)
+    }
+    return nil
+}
+
+// generateThumbnail extracts a single JPEG frame at offset seconds, falling back to the
+// first frame for clips shorter than the offset
+func (cm *ClipManager) generateThumbnail(videoPath, outputPath string, offset float64) error {
+    for _, seek := range []float64{offset, 0} {
+        args := []string{
+            "-ss", fmt.Sprintf("%.3f", seek),
+            "-i", videoPath,
+            "-frames:v", "1",
+            "-vf", "scale='min(640,iw)':-2",
+            "-q:v", "3",
+            "-y",
+            outputPath,
+        }
+
+        cmd := exec.Command(cm.ffmpegPath, args...)
+        var stderr bytes.Buffer
+        cmd.Stderr = &stderr
+        err := cmd.Run()
+        if info, statErr := os.Stat(outputPath); err == nil && statErr == nil && info.Size() > 0 {
+            return nil
+        }
+        if seek == 0 {
+            return fmt.Errorf("failed to extract thumbnail: %v\nFFmpeg output: %s", err, stderr.String())
+        }
+    }
+    return nil
+}
+
+// HandleClipThumbnail returns a JPEG poster frame for a clip on the SFTP server.
+// Sidecar thumbnails uploaded with the clip are used when present; otherwise the clip is
+// downloaded and a frame is extracted. Results are cached in tempDir by path and modification time.
+func (cm *ClipManager) HandleClipThumbnail(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+        return
+    }
+
+    path := r.URL.Query().Get("path")
+    if path == "" {
+        http.Error(w, "Missing path parameter", http.StatusBadRequest)
+        return
+    }
+
+    offset := defaultThumbnailOffset
+    if value := r.URL.Query().Get("offset"); value != "" {
+        parsed, err := strconv.ParseFloat(value, 64)
+        if err != nil || parsed < 0 || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+            http.Error(w, "Invalid offset parameter: must be a number of seconds, 0 or greater", http.StatusBadRequest)
+            return
+        }
+        offset = parsed
+    }
+
+    token, ok := cm.lookupStreamToken(r.URL.Query().Get("token"), path)
+    if !ok {
+        http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+        return
+    }
+
+    client, err := cm.connectToSFTP(token.Host, token.Port, token.User, token.Password, token.PrivateKey, token.Passphrase)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to connect to SFTP: %v", err), http.StatusInternalServerError)
+        return
+    }
+    defer client.Close()
+
+    fileInfo, err := client.Stat(path)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusNotFound)
+        return
+    }
+
+    cacheDir := filepath.Join(cm.tempDir, "thumbnails")
+    if err := os.MkdirAll(cacheDir, 0755); err != nil {
+        http.Error(w, fmt.Sprintf("Failed to create thumbnail cache: %v", err), http.StatusInternalServerError)
+        return
+    }
+    cacheKey := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d|%.3f", token.Host, token.Port, path, fileInfo.ModTime().UnixNano(), offset)))
+    cachePath := filepath.Join(cacheDir, hex.EncodeToString(cacheKey[:])+".jpg")
+
+    if _, err := os.Stat(cachePath); err != nil {
+        if err := cm.createThumbnail(client.Client, path, cachePath, offset, r.URL.Query().Has("offset")); err != nil {
+            cm.log.Error("Failed to create thumbnail for %s: %v", path, err)
+            http.Error(w, fmt.Sprintf("Failed to create thumbnail: %v", err), http.StatusInternalServerError)
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "image/jpeg")
+    w.Header().Set("Cache-Control", "private, max-age=3600")
+    http.ServeFile(w, r, cachePath)
+}
+
+// createThumbnail writes a thumbnail for a remote clip to cachePath, preferring a sidecar
+// JPEG unless a specific offset was requested
+func (cm *ClipManager) createThumbnail(client *sftp.Client, remotePath, cachePath string, offset float64, explicitOffset bool) error {
+    tmpPath := strings.TrimSuffix(cachePath, ".jpg") + ".tmp.jpg"
+    defer os.Remove(tmpPath)
+
+    if !explicitOffset {
+        sidecarPath := strings.TrimSuffix(remotePath, filepath.Ext(remotePath)) + ".jpg"
+        if sidecar, err := client.Open(sidecarPath); err == nil {
+            defer sidecar.Close()
+            out, err := os.Create(tmpPath)
+            if err != nil {
+                return err
+            }
+            _, err = io.Copy(out, sidecar)
+            out.Close()
+            if err == nil {
+                return os.Rename(tmpPath, cachePath)
+            }
+        }
+    }
+
+    localClip := filepath.Join(filepath.Dir(cachePath), "download_"+filepath.Base(cachePath)+filepath.Ext(remotePath))
+    defer os.Remove(localClip)
+    if err := downloadSFTPFile(client, remotePath, localClip); err != nil {
+        return err
+    }
+
+    if err := cm.generateThumbnail(localClip, tmpPath, offset); err != nil {
+        return err
+    }
+    return os.Rename(tmpPath, cachePath)
+}
+
+// HandleClipInfo returns the duration, resolution, codecs and bitrate of a clip on the SFTP server.
+// The clip is downloaded and probed once; results are cached in tempDir by path and modification time.
+func (cm *ClipManager) HandleClipInfo(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+        return
+    }
+
+    path := r.URL.Query().Get("path")
+    if path == "" {
+        http.Error(w, "Missing path parameter", http.StatusBadRequest)
+        return
+    }
+
+    token, ok := cm.lookupStreamToken(r.URL.Query().Get("token"), path)
+    if !ok {
+        http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+        return
+    }
+
+    client, err := cm.connectToSFTP(token.Host, token.Port, token.User, token.Password, token.PrivateKey, token.Passphrase)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to connect to SFTP: %v", err), http.StatusInternalServerError)
+        return
+    }
+    defer client.Close()
+
+    fileInfo, err := client.Stat(path)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusNotFound)
+        return
+    }
+
+    cacheDir := filepath.Join(cm.tempDir, "clipinfo")
+    if err := os.MkdirAll(cacheDir, 0755); err != nil {
+        http.Error(w, fmt.Sprintf("Failed to create clip info cache: %v", err), http.StatusInternalServerError)
+        return
+    }
+    cacheKey := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d", token.Host, token.Port, path, fileInfo.ModTime().UnixNano())))
+    cachePath := filepath.Join(cacheDir, hex.EncodeToString(cacheKey[:])+".json")
+
+    var info ClipMetadata
+    data, err := os.ReadFile(cachePath)
+    if err == nil && json.Unmarshal(data, &info) == nil {
+        // Pruning goes by modification time, so results in use are kept
+        now := time.Now()
+        os.Chtimes(cachePath, now, now)
+    } else {
+        info, err = cm.probeClipInfo(r.Context(), client.Client, path, cachePath)
+        if err != nil {
+            cm.log.Error("Failed to probe clip %s: %v", path, err)
+            http.Error(w, fmt.Sprintf("Failed to probe clip: %v", err), http.StatusInternalServerError)
+            return
+        }
+    }
+    info.Path = path
+    info.SizeBytes = fileInfo.Size()
+    info.ModTime = fileInfo.ModTime()
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "private, max-age=3600")
+    json.NewEncoder(w).Encode(info)
+}
+
+// The clip info cache keeps at most clipInfoCacheMaxEntries results and drops results that
+// haven't been read for clipInfoCacheMaxAge
+const (
+    clipInfoCacheMaxEntries = 1000
+    clipInfoCacheMaxAge     = 7 * 24 * time.Hour
+)
+
+// clipInfoProbe is a clip info probe in progress. Requests for the same clip wait for it instead
+// of downloading the clip again.
+type clipInfoProbe struct {
+    done chan struct{}
+    info ClipMetadata
+    err  error
+}
+
+// probeClipInfo runs createClipMetadata once for all concurrent requests for the same cache
+// path, then prunes the cache
+func (cm *ClipManager) probeClipInfo(ctx context.Context, client *sftp.Client, remotePath, cachePath string) (ClipMetadata, error) {
+    cm.clipInfoMutex.Lock()
+    probe, running := cm.clipInfoProbes[cachePath]
+    if !running {
+        probe = &clipInfoProbe{done: make(chan struct{})}
+        cm.clipInfoProbes[cachePath] = probe
+    }
+    cm.clipInfoMutex.Unlock()
+
+    if running {
+        select {
+        case <-probe.done:
+            return probe.info, probe.err
+        case <-ctx.Done():
+            return ClipMetadata{}, ctx.Err()
+        }
+    }
+
+    probe.info, probe.err = cm.createClipMetadata(client, remotePath, cachePath)
+    cm.clipInfoMutex.Lock()
+    delete(cm.clipInfoProbes, cachePath)
+    cm.clipInfoMutex.Unlock()
+    close(probe.done)
+
+    cm.pruneClipInfoCache(filepath.Dir(cachePath))
+    return probe.info, probe.err
+}
+
+// createClipMetadata downloads a remote clip, probes it and writes the result to cachePath
+func (cm *ClipManager) createClipMetadata(client *sftp.Client, remotePath, cachePath string) (ClipMetadata, error) {
+    cacheDir := filepath.Dir(cachePath)
+    download, err := os.CreateTemp(cacheDir, "download-*"+filepath.Ext(remotePath))
+    if err != nil {
+        return ClipMetadata{}, fmt.Errorf("failed to create local copy: %v", err)
+    }
+    localClip := download.Name()
+    download.Close()
+    defer os.Remove(localClip)
+    if err := downloadSFTPFile(client, remotePath, localClip); err != nil {
+        return ClipMetadata{}, err
+    }
+
+    info, err := cm.probeClipMetadata(localClip)
+    if err != nil {
+        return ClipMetadata{}, err
+    }
+
+    data, err := json.Marshal(info)
+    if err != nil {
+        return ClipMetadata{}, err
+    }
+    tmp, err := os.CreateTemp(cacheDir, "info-*.tmp")
+    if err != nil {
+        return ClipMetadata{}, fmt.Errorf("failed to cache clip info: %v", err)
+    }
+    _, err = tmp.Write(data)
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), cachePath)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return ClipMetadata{}, fmt.Errorf("failed to cache clip info: %v", err)
+    }
+    return info, nil
+}
+
+// pruneClipInfoCache removes cached clip info beyond clipInfoCacheMaxEntries, oldest first, and
+// anything in dir older than clipInfoCacheMaxAge, including downloads left behind by a crash
+func (cm *ClipManager) pruneClipInfoCache(dir string) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        cm.log.Warning("Could not read clip info cache: %v", err)
+        return
+    }
+
+    type cachedInfo struct {
+        path    string
+        modTime time.Time
+        result  bool
+    }
+    var files []cachedInfo
+    for _, entry := range entries {
+        if entry.IsDir() {
+            continue
+        }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        files = append(files, cachedInfo{
+            path:    filepath.Join(dir, entry.Name()),
+            modTime: info.ModTime(),
+            result:  filepath.Ext(entry.Name()) == ".json",
+        })
+    }
+
+    // Newest first, so every result past the limit is one of the oldest
+    sort.Slice(files, func(i, j int) bool {
+        return files[i].modTime.After(files[j].modTime)
+    })
+
+    results := 0
+    for _, file := range files {
+        tooMany := false
+        if file.result {
+            results++
+            tooMany = results > clipInfoCacheMaxEntries
+        }
+        if tooMany || time.Since(file.modTime) > clipInfoCacheMaxAge {
+            if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+                cm.log.Warning("Could not prune cached clip info %s: %v", file.path, err)
+            }
+        }
+    }
+}
+
+// streamToken is a short-lived stand-in for SFTP credentials, valid for a single clip path
+// on a single server
+type streamToken struct {
+    Path       string
+    Host       string
+    Port       string
+    User       string
+    Password   string
+    PrivateKey string
+    Passphrase string
+    Expires    time.Time
+}
+
+// HandleStreamToken mints stream tokens so video elements and download links can reference a
+// clip without putting SFTP credentials in the URL. Each path in the request gets its own token.
+func (cm *ClipManager) HandleStreamToken(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req struct {
+        SFTPHost       string   `json:"sftp_host"`
+        SFTPPort       string   `json:"sftp_port"`
+        SFTPUser       string   `json:"sftp_user"`
+        SFTPPassword   string   `json:"sftp_password"`
+        SFTPPrivateKey string   `json:"sftp_private_key"`
+        SFTPPassphrase string   `json:"sftp_passphrase"`
+        Path           string   `json:"path"`
+        Paths          []string `json:"paths"`
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", bodyErrorStatus(err))
+        cm.log.Error("Failed to parse stream token request: %v", err)
+        return
+    }
+
+    if req.SFTPHost == "" || req.SFTPUser == "" || (req.SFTPPassword == "" && req.SFTPPrivateKey == "") {
+        http.Error(w, "Missing SFTP connection parameters", http.StatusBadRequest)
+        return
+    }
+    paths := req.Paths
+    if req.Path != "" {
+        paths = append(paths, req.Path)
+    }
+    if len(paths) == 0 {
+        http.Error(w, "Missing path or paths parameter", http.StatusBadRequest)
+        return
+    }
+    if len(paths) > maxStreamTokenPaths {
+        http.Error(w, fmt.Sprintf("Too many paths: at most %d per request", maxStreamTokenPaths), http.StatusBadRequest)
+        return
+    }
+    port := req.SFTPPort
+    if port == "" {
+        port = "22"
+    }
+
+    expires := time.Now().Add(cm.streamTokenTTL)
+    tokens := make(map[string]string, len(paths))
+    cm.streamTokensMutex.Lock()
+    cm.pruneStreamTokensLocked()
+    for _, path := range paths {
+        if path == "" {
+            continue
+        }
+        id, err := newStreamTokenID()
+        if err != nil {
+            cm.streamTokensMutex.Unlock()
+            http.Error(w, "Failed to create token", http.StatusInternalServerError)
+            cm.log.Error("Failed to create stream token: %v", err)
+            return
+        }
+        cm.streamTokens[id] = &streamToken{
+            Path:       path,
+            Host:       req.SFTPHost,
+            Port:       port,
+            User:       req.SFTPUser,
+            Password:   req.SFTPPassword,
+            PrivateKey: req.SFTPPrivateKey,
+            Passphrase: req.SFTPPassphrase,
+            Expires:    expires,
+        }
+        tokens[path] = id
+    }
+    cm.streamTokensMutex.Unlock()
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "tokens":     tokens,
+        "expires_at": expires.UTC().Format(time.RFC3339),
+    })
+}
+
+// newStreamTokenID returns an unguessable token ID
+func newStreamTokenID() (string, error) {
+    b := make([]byte, 32)
+    if _, err := cryptorand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// lookupStreamToken returns the stream token with the given ID if it is unexpired and was
+// minted for path
+func (cm *ClipManager) lookupStreamToken(id, path string) (*streamToken, bool) {
+    if id == "" {
+        return nil, false
+    }
+    cm.streamTokensMutex.Lock()
+    defer cm.streamTokensMutex.Unlock()
+
+    token, ok := cm.streamTokens[id]
+    if !ok {
+        return nil, false
+    }
+    if time.Now().After(token.Expires) {
+        delete(cm.streamTokens, id)
+        return nil, false
+    }
+    if token.Path != path {
+        return nil, false
+    }
+    return token, true
+}
+
+// pruneStreamTokensLocked drops expired stream tokens, the caller must hold streamTokensMutex
+func (cm *ClipManager) pruneStreamTokensLocked() {
+    now := time.Now()
+    for id, token := range cm.streamTokens {
+        if now.After(token.Expires) {
+            delete(cm.streamTokens, id)
+        }
+    }
+}
+
+// HandleStreamClip streams a clip from the SFTP server. The server and credentials come from
+// a token minted by HandleStreamToken for the requested path.
+func (cm *ClipManager) HandleStreamClip(w http.ResponseWriter, r *http.Request) {
+    path := r.URL.Query().Get("path")
+    if path == "" {
+        http.Error(w, "Missing path parameter", http.StatusBadRequest)
+        return
+    }
+
+    download := r.URL.Query().Get("download") == "true"
+    token, ok := cm.lookupStreamToken(r.URL.Query().Get("token"), path)
+    if !ok {
+        http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+        return
+    }
+
+    client, err := cm.connectToSFTP(token.Host, token.Port, token.User, token.Password, token.PrivateKey, token.Passphrase)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to connect to SFTP: %v", err), http.StatusInternalServerError)
+        return
+    }
+    defer client.Close()
+
+    file, err := client.Open(path)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusNotFound)
+        return
+    }
+    defer file.Close()
+
+    fileInfo, err := file.Stat()
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to get file info: %v", err), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", videoContentType(path))
+    
+    if download {
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(path)))
+    } else {
+        w.Header().Set("Content-Disposition", "inline")
+    }
+    
+    w.Header().Set("Accept-Ranges", "bytes")
+    extendWriteDeadline(w, cm.streamWriteTimeout)
+    http.ServeContent(w, r, filepath.Base(path), fileInfo.ModTime(), newSFTPReadSeeker(file, fileInfo.Size()))
+}
+
+// sftpReadAhead is how much of a remote file sftpReadSeeker fetches per round of requests
+const sftpReadAhead = 1 << 20
+
+// sftpReadSeeker serves a remote file to http.ServeContent. Reading an sftp.File directly costs a
+// round trip per 32 KiB copy buffer and seeking to the end costs a Stat, which makes scrubbing
+// through a video stall. This seeks locally using the known size and reads ahead in large blocks
+// through ReadAt, which the sftp client splits into concurrent requests, so a Range request only
+// fetches the bytes from its offset onward.
+type sftpReadSeeker struct {
+    file   *sftp.File
+    size   int64
+    offset int64
+    buf    []byte
+    bufOff int64 // File offset of buf[0]
+}
+
+func newSFTPReadSeeker(file *sftp.File, size int64) *sftpReadSeeker {
+    return &sftpReadSeeker{file: file, size: size}
+}
+
+func (s *sftpReadSeeker) Read(p []byte) (int, error) {
+    if s.offset >= s.size {
+        return 0, io.EOF
+    }
+
+    // Refill when the offset falls outside the buffered block
+    if s.offset < s.bufOff || s.offset >= s.bufOff+int64(len(s.buf)) {
+        blockSize := int64(sftpReadAhead)
+        if remaining := s.size - s.offset; remaining < blockSize {
+            blockSize = remaining
+        }
+        if cap(s.buf) < int(blockSize) {
+            s.buf = make([]byte, blockSize)
+        }
+        n, err := s.file.ReadAt(s.buf[:blockSize], s.offset)
+        s.buf = s.buf[:n]
+        s.bufOff = s.offset
+        if n == 0 {
+            if err == nil {
+                err = io.ErrUnexpectedEOF
+            }
+            return 0, err
+        }
+    }
+
+    n := copy(p, s.buf[s.offset-s.bufOff:])
+    s.offset += int64(n)
+    return n, nil
+}
+
+func (s *sftpReadSeeker) Seek(offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekStart:
+    case io.SeekCurrent:
+        offset += s.offset
+    case io.SeekEnd:
+        offset += s.size
+    default:
+        return s.offset, fmt.Errorf("invalid whence %d", whence)
+    }
+    if offset < 0 {
+        return s.offset, fmt.Errorf("negative position %d", offset)
+    }
+    s.offset = offset
+    return offset, nil
+}
+
+// sftpHostname accepts an IPv6 address with or without brackets, e.g. [2001:db8::1], and returns
+// it without them for net.JoinHostPort
+func sftpHostname(host string) string {
+    host = strings.TrimSpace(host)
+    if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+        return host[1 : len(host)-1]
+    }
+    return host
+}
+
+// Helper method to connect to SFTP. Connections are taken from the pool when one is available;
+// callers must Close the returned client to hand it back.
+func (cm *ClipManager) connectToSFTP(host, port, user, password, privateKey, passphrase string) (*PooledSFTPClient, error) {
+    key, dial, err := cm.sftpDialer(host, port, user, password, privateKey, passphrase)
+    if err != nil {
+        return nil, err
+    }
+    return cm.sftpPool.get(key, dial)
+}
+
+// connectToSFTPDedicated opens an SFTP connection outside the pool, for transfers that may have to
+// be aborted without failing other requests to the same server
+func (cm *ClipManager) connectToSFTPDedicated(host, port, user, password, privateKey, passphrase string) (*PooledSFTPClient, error) {
+    _, dial, err := cm.sftpDialer(host, port, user, password, privateKey, passphrase)
+    if err != nil {
+        return nil, err
+    }
+    return cm.sftpPool.dedicated(dial)
+}
 
-		compressedSizeMB := float64(compressedInfo.Size()) / 1024 / 1024
-		cm.log.Info("📏 Compressed file size for %s: %.2f MB", chatApp, compressedSizeMB)
+// sftpDialer returns the pool key of an SFTP server and a function that dials it
+func (cm *ClipManager) sftpDialer(host, port, user, password, privateKey, passphrase string) (string, func() (*ssh.Client, *sftp.Client, error), error) {
+    if host == "" || user == "" || (password == "" && privateKey == "") {
+        return "", nil, fmt.Errorf("missing SFTP connection parameters")
+    }
 
-		if compressedSizeMB <= targetSizeMB {
-			cm.log.Success("Compression succeeded for %s with CRF %d", chatApp, crf)
-			return compressedFilePath, nil
-		}
+    if port == "" {
+        port = "22"
+    }
+    host = sftpHostname(host)
 
-		crf += crfStep
-	}
+    // Credentials are part of the key so a request can never borrow a connection it couldn't open itself
+    credentials := sha256.Sum256([]byte(password + "\x00" + privateKey + "\x00" + passphrase))
+    key := fmt.Sprintf("%s:%s:%s:%s", host, port, user, hex.EncodeToString(credentials[:]))
 
-	cm.log.Error("Could not compress file under %.2f MB for %s, even with CRF %d", targetSizeMB, chatApp, maxCRF)
-	return compressedFilePath, fmt.Errorf("file size still exceeds %.2f MB for %s after maximum compression", targetSizeMB, chatApp)
-}
+    dial := func() (*ssh.Client, *sftp.Client, error) {
+        config, err := cm.sshClientConfig(user, password, privateKey, passphrase)
+        if err != nil {
+            return nil, nil, err
+        }
+        config.Timeout = cm.sftpConnectTimeout
 
-func (cm *ClipManager) RetryOperation(operation func() error, serviceName string) error {
-	var err error
+        addr := net.JoinHostPort(host, port)
+        sshClient, err := ssh.Dial("tcp", addr, config)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to connect to SSH: %w", err)
+        }
 
-	err = operation()
-	if err == nil {
-		return nil
-	}
+        // Concurrent writes keep uploads fast on high-latency links
+        sftpClient, err := sftp.NewClient(sshClient, sftp.UseConcurrentWrites(true))
+        if err != nil {
+            sshClient.Close()
+            return nil, nil, fmt.Errorf("failed to create SFTP client: %w", err)
+        }
 
-	cm.log.Error("Error sending clip to %s: %v", serviceName, err)
+        return sshClient, sftpClient, nil
+    }
+    return key, dial, nil
+}
 
-	for attempt := 1; attempt <= cm.maxRetries; attempt++ {
-		cm.log.Warning("Retry %d/%d for %s...", attempt, cm.maxRetries, serviceName)
-		time.Sleep(cm.retryDelay)
+// SFTPPool caches SFTP connections by host, port, user and credentials so browsing clips
+// doesn't dial a new SSH connection for every request. A connection may be shared by
+// concurrent requests; it is closed once it has been idle for idleTimeout.
+type SFTPPool struct {
+    mu          sync.Mutex
+    conns       map[string]*sftpPoolEntry
+    idleTimeout time.Duration // 0 disables caching, connections are closed when released
+}
 
-		err = operation()
-		if err == nil {
-			cm.log.Success("Retry %d/%d for %s succeeded", attempt, cm.maxRetries, serviceName)
-			return nil
-		}
+type sftpPoolEntry struct {
+    key       string
+    ssh       *ssh.Client
+    sftp      *sftp.Client
+    refs      int       // Clients currently handed out
+    lastUsed  time.Time
+    broken    bool      // Evicted; closed when the last client is released
+    dedicated bool      // Never pooled, used by a single client only
+    closeOnce sync.Once
+}
 
-		cm.log.Error("Retry %d/%d for %s failed: %v", attempt, cm.maxRetries, serviceName, err)
-	}
+// PooledSFTPClient is an SFTP client borrowed from the pool. Close returns it to the pool
+// and Discard evicts the connection, e.g. after a transfer failed.
+type PooledSFTPClient struct {
+    *sftp.Client
+    pool     *SFTPPool
+    entry    *sftpPoolEntry
+    released bool
+}
 
-	cm.log.Error("All %d retries failed for %s", cm.maxRetries, serviceName)
-	return fmt.Errorf("failed to send clip to %s after %d attempts: %v", serviceName, cm.maxRetries+1, err)
+func NewSFTPPool(idleTimeout time.Duration) *SFTPPool {
+    return &SFTPPool{
+        conns:       make(map[string]*sftpPoolEntry),
+        idleTimeout: idleTimeout,
+    }
 }
 
-func (cm *ClipManager) sendToTelegram(filePath, botToken, chatID string, r *http.Request) error {
-    operation := func() error {
-        file, err := os.Open(filePath)
-        if (err != nil) {
-            return fmt.Errorf("could not open file for sending to Telegram: %v", err)
+// get returns a pooled connection for key, checking that it still responds, or dials a new one
+func (p *SFTPPool) get(key string, dial func() (*ssh.Client, *sftp.Client, error)) (*PooledSFTPClient, error) {
+    p.mu.Lock()
+    entry, ok := p.conns[key]
+    if ok {
+        entry.refs++
+    }
+    p.mu.Unlock()
+
+    if ok {
+        // Cheap round trip to catch connections the server dropped while idle
+        if _, err := entry.sftp.Getwd(); err == nil {
+            return &PooledSFTPClient{Client: entry.sftp, pool: p, entry: entry}, nil
         }
-        defer file.Close()
+        p.release(entry, true)
+    }
 
-        captionText := cm.buildClipMessage(r)
+    sshClient, sftpClient, err := dial()
+    if err != nil {
+        return nil, err
+    }
 
-        chatID = strings.Trim(chatID, `"'`)
-        if chatID == "" {
-            return fmt.Errorf("error: telegram_chat_id is empty, cannot send to Telegram")
+    entry = &sftpPoolEntry{key: key, ssh: sshClient, sftp: sftpClient, refs: 1, lastUsed: time.Now()}
+    if p.idleTimeout > 0 {
+        p.mu.Lock()
+        // A concurrent request may have dialed too; keep ours and close the other once unused
+        old := p.conns[key]
+        closeOld := false
+        if old != nil {
+            old.broken = true
+            closeOld = old.refs == 0
         }
+        p.conns[key] = entry
+        p.mu.Unlock()
 
-        reqURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendVideo", botToken)
-
-        cm.log.Info("Sending clip to Telegram. File: %s", filepath.Base(filePath))
+        if closeOld {
+            old.close()
+        }
 
-        var requestBody bytes.Buffer
-        writer := multipart.NewWriter(&requestBody)
+        // Evict as soon as the SSH connection drops
+        go func() {
+            sshClient.Wait()
+            p.evict(entry)
+        }()
+    } else {
+        entry.broken = true
+    }
 
-        if err := writer.WriteField("chat_id", chatID); err != nil {
-            return fmt.Errorf("error preparing Telegram request: %v", err)
-        }
+    return &PooledSFTPClient{Client: sftpClient, pool: p, entry: entry}, nil
+}
 
-        if err := writer.WriteField("caption", captionText); err != nil {
-            return fmt.Errorf("error adding caption to Telegram request: %v", err)
-        }
+// dedicated dials a connection that is never shared, so the client may Abort it
+func (p *SFTPPool) dedicated(dial func() (*ssh.Client, *sftp.Client, error)) (*PooledSFTPClient, error) {
+    sshClient, sftpClient, err := dial()
+    if err != nil {
+        return nil, err
+    }
 
-        part, err := writer.CreateFormFile("video", filepath.Base(filePath))
-        if err != nil {
-            return fmt.Errorf("error creating file field for Telegram: %v", err)
-        }
+    entry := &sftpPoolEntry{ssh: sshClient, sftp: sftpClient, refs: 1, lastUsed: time.Now(), broken: true, dedicated: true}
+    return &PooledSFTPClient{Client: sftpClient, pool: p, entry: entry}, nil
+}
 
-        if _, err := io.Copy(part, file); err != nil {
-            return fmt.Errorf("error copying file to Telegram request: %v", err)
-        }
+// Close hands the connection back to the pool
+func (c *PooledSFTPClient) Close() error {
+    if !c.released {
+        c.released = true
+        c.pool.release(c.entry, false)
+    }
+    return nil
+}
 
-        if err := writer.Close(); err != nil {
-            return fmt.Errorf("error finalizing Telegram request: %v", err)
-        }
+// Abort closes a dedicated connection right away, failing the transfer in progress on it. Pooled
+// connections are shared with other requests and are left open.
+func (c *PooledSFTPClient) Abort() {
+    if c.entry.dedicated {
+        c.entry.close()
+    }
+}
 
-        req, err := http.NewRequest("POST", reqURL, &requestBody)
-        if err != nil {
-            return fmt.Errorf("error creating Telegram request: %v", err)
-        }
+// Discard evicts the connection so the next request dials a fresh one
+func (c *PooledSFTPClient) Discard() {
+    if !c.released {
+        c.released = true
+        c.pool.release(c.entry, true)
+    }
+}
 
-        req.Header.Set("Content-Type", writer.FormDataContentType())
+// release drops a reference to entry, closing it when it is broken and no longer used
+func (p *SFTPPool) release(entry *sftpPoolEntry, broken bool) {
+    p.mu.Lock()
+    entry.refs--
+    entry.lastUsed = time.Now()
+    if broken {
+        p.removeLocked(entry)
+    }
+    closeNow := entry.broken && entry.refs == 0
+    p.mu.Unlock()
 
-        resp, err := cm.httpClient.Do(req)
-        if err != nil {
-            return fmt.Errorf("error sending clip to Telegram: %v", err)
-        }
-        defer resp.Body.Close()
+    if closeNow {
+        entry.close()
+    }
+}
 
-        bodyBytes, _ := io.ReadAll(resp.Body)
-        responseBody := string(bodyBytes)
+// evict removes a connection whose SSH transport has gone away
+func (p *SFTPPool) evict(entry *sftpPoolEntry) {
+    p.mu.Lock()
+    p.removeLocked(entry)
+    closeNow := entry.refs == 0
+    p.mu.Unlock()
 
-        if resp.StatusCode != http.StatusOK {
-            return fmt.Errorf("telegram API error: %s - %s", resp.Status, responseBody)
-        }
+    if closeNow {
+        entry.close()
+    }
+}
 
-        cm.log.Success("Clip successfully sent to Telegram")
-        return nil
+// removeLocked marks entry broken and removes it from the pool if it is still the current one
+func (p *SFTPPool) removeLocked(entry *sftpPoolEntry) {
+    entry.broken = true
+    if p.conns[entry.key] == entry {
+        delete(p.conns, entry.key)
     }
+}
 
-    return cm.RetryOperation(operation, "Telegram")
+func (e *sftpPoolEntry) close() {
+    e.closeOnce.Do(func() {
+        e.sftp.Close()
+        e.ssh.Close()
+    })
 }
 
-func (cm *ClipManager) sendToMattermost(filePath, mattermostURL, token, channelID string, r *http.Request) error {
-    operation := func() error {
-        file, err := os.Open(filePath)
-        if err != nil {
-            return fmt.Errorf("could not open file for sending to Mattermost: %v", err)
-        }
-        defer file.Close()
+// expireIdle closes connections that haven't been used for idleTimeout until ctx is cancelled
+func (p *SFTPPool) expireIdle(ctx context.Context) {
+    if p.idleTimeout <= 0 {
+        return
+    }
 
-        var requestBody bytes.Buffer
-        writer := multipart.NewWriter(&requestBody)
+    interval := p.idleTimeout / 2
+    if interval > time.Minute {
+        interval = time.Minute
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
 
-        if err := writer.WriteField("channel_id", channelID); err != nil {
-            return fmt.Errorf("error preparing Mattermost request: %v", err)
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
         }
 
-        part, err := writer.CreateFormFile("files", filepath.Base(filePath))
-        if err != nil {
-            return fmt.Errorf("error creating file field for Mattermost: %v", err)
+        var idle []*sftpPoolEntry
+        p.mu.Lock()
+        for _, entry := range p.conns {
+            if entry.refs == 0 && time.Since(entry.lastUsed) > p.idleTimeout {
+                p.removeLocked(entry)
+                idle = append(idle, entry)
+            }
         }
+        p.mu.Unlock()
 
-        if _, err := io.Copy(part, file); err != nil {
-            return fmt.Errorf("error copying file to Mattermost request: %v", err)
+        for _, entry := range idle {
+            entry.close()
         }
+    }
+}
 
-        if err := writer.Close(); err != nil {
-            return fmt.Errorf("error finalizing Mattermost request: %v", err)
+// CloseAll closes every idle connection and makes connections still in use close when released
+func (p *SFTPPool) CloseAll() {
+    var idle []*sftpPoolEntry
+    p.mu.Lock()
+    for _, entry := range p.conns {
+        p.removeLocked(entry)
+        if entry.refs == 0 {
+            idle = append(idle, entry)
         }
+    }
+    p.mu.Unlock()
 
-        fileUploadURL := fmt.Sprintf("%s/api/v4/files", mattermostURL)
-        cm.log.Info("Uploading file to Mattermost")
+    for _, entry := range idle {
+        entry.close()
+    }
+}
 
-        req, err := http.NewRequest("POST", fileUploadURL, &requestBody)
+// sshClientConfig builds the SSH configuration for an SFTP connection. Key authentication is
+// preferred when a private key is given, with the password (if any) as a fallback.
+func (cm *ClipManager) sshClientConfig(user, password, privateKey, passphrase string) (*ssh.ClientConfig, error) {
+    hostKeyCallback, err := cm.sftpHostKeyCallback()
+    if err != nil {
+        return nil, err
+    }
+
+    var auth []ssh.AuthMethod
+    if privateKey != "" {
+        signer, err := cm.parseSSHPrivateKey(privateKey, passphrase)
         if err != nil {
-            return fmt.Errorf("error creating Mattermost upload request: %v", err)
+            return nil, err
         }
+        auth = append(auth, ssh.PublicKeys(signer))
+    }
+    if password != "" {
+        auth = append(auth, ssh.Password(password))
+    }
 
-        req.Header.Set("Content-Type", writer.FormDataContentType())
-        req.Header.Set("Authorization", "Bearer "+token)
+    return &ssh.ClientConfig{
+        User:            user,
+        Auth:            auth,
+        HostKeyCallback: hostKeyCallback,
+    }, nil
+}
 
-        resp, err := cm.httpClient.Do(req)
+// parseSSHPrivateKey parses a PEM private key, given either as its content or as the name of a
+// key file in SFTP_KEY_DIR. Key files elsewhere on the host are never read, so API callers can't
+// authenticate with the server's own keys.
+func (cm *ClipManager) parseSSHPrivateKey(privateKey, passphrase string) (ssh.Signer, error) {
+    keyData := []byte(privateKey)
+    if !strings.Contains(privateKey, "-----BEGIN") {
+        data, err := readSFTPKeyFile(cm.sftpKeyDir, privateKey)
         if err != nil {
-            return fmt.Errorf("error uploading to Mattermost: %v", err)
+            return nil, err
         }
-        defer resp.Body.Close()
+        keyData = data
+    }
 
-        if resp.StatusCode >= 300 {
-            bodyBytes, _ := io.ReadAll(resp.Body)
-            return fmt.Errorf("mattermost file upload error: %s - %s", resp.Status, string(bodyBytes))
-        }
+    var signer ssh.Signer
+    var err error
+    if passphrase != "" {
+        signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
+    } else {
+        signer, err = ssh.ParsePrivateKey(keyData)
+    }
 
-        var fileResponse struct {
-            FileInfos []struct {
-                ID string `json:"id"`
-            } `json:"file_infos"`
-        }
+    var passphraseErr *ssh.PassphraseMissingError
+    if errors.As(err, &passphraseErr) {
+        return nil, fmt.Errorf("SFTP private key is encrypted: sftp_passphrase is required")
+    }
+    if err != nil {
+        return nil, fmt.Errorf("could not parse SFTP private key: %v", err)
+    }
 
-        if err := json.NewDecoder(resp.Body).Decode(&fileResponse); err != nil {
-            return fmt.Errorf("error parsing Mattermost response: %v", err)
-        }
+    return signer, nil
+}
 
-        if len(fileResponse.FileInfos) == 0 {
-            return fmt.Errorf("no file IDs returned from Mattermost")
+// readSFTPKeyFile reads a private key file named by a request. The name must resolve to a file
+// inside keyDir, symlinks included, and nothing is read when keyDir is not configured.
+func readSFTPKeyFile(keyDir, name string) ([]byte, error) {
+    if keyDir == "" {
+        return nil, fmt.Errorf("sftp_private_key must be PEM key content (key files require SFTP_KEY_DIR)")
+    }
+
+    root, err := filepath.EvalSymlinks(keyDir)
+    if err != nil {
+        return nil, fmt.Errorf("could not open SFTP_KEY_DIR %s: %v", keyDir, err)
+    }
+    // Absolute paths are accepted only when they already point into the key directory
+    relName := name
+    if filepath.IsAbs(name) {
+        if relName, err = filepath.Rel(keyDir, name); err != nil {
+            return nil, fmt.Errorf("SFTP private key file %s is outside SFTP_KEY_DIR", name)
         }
+    }
 
-        messageText := cm.buildClipMessage(r)
+    keyPath, err := filepath.EvalSymlinks(filepath.Join(root, relName))
+    if err != nil {
+        return nil, fmt.Errorf("could not read SFTP private key file %s: %v", name, err)
+    }
+    rel, err := filepath.Rel(root, keyPath)
+    if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return nil, fmt.Errorf("SFTP private key file %s is outside SFTP_KEY_DIR", name)
+    }
 
-        fileIDs := make([]string, len(fileResponse.FileInfos))
-        for i, fileInfo := range fileResponse.FileInfos {
-            fileIDs[i] = fileInfo.ID
-        }
+    data, err := os.ReadFile(keyPath)
+    if err != nil {
+        return nil, fmt.Errorf("could not read SFTP private key file %s: %v", name, err)
+    }
+    return data, nil
+}
 
-        postData := map[string]interface{}{
-            "channel_id": channelID,
-            "message":    messageText,
-            "file_ids":   fileIDs,
+// sftpHostKeyCallback returns the host key verification used for SFTP connections, based on
+// SFTP_KNOWN_HOSTS, SFTP_TRUST_ON_FIRST_USE and SFTP_INSECURE
+func (cm *ClipManager) sftpHostKeyCallback() (ssh.HostKeyCallback, error) {
+    if cm.sftpKnownHosts == "" {
+        if cm.sftpInsecure {
+            return ssh.InsecureIgnoreHostKey(), nil
         }
+        return nil, fmt.Errorf("SFTP host key verification is not configured: set SFTP_KNOWN_HOSTS to a known_hosts file, or SFTP_INSECURE=true to skip verification")
+    }
 
-        postJSON, err := json.Marshal(postData)
-        if err != nil {
-            return fmt.Errorf("error creating post JSON: %v", err)
+    if cm.sftpTrustOnFirstUse {
+        // Make sure the file exists so the first connection can be recorded
+        if err := os.MkdirAll(filepath.Dir(cm.sftpKnownHosts), 0700); err != nil {
+            return nil, fmt.Errorf("failed to create directory for known_hosts file: %v", err)
         }
-
-        postURL := fmt.Sprintf("%s/api/v4/posts", mattermostURL)
-        postReq, err := http.NewRequest("POST", postURL, bytes.NewBuffer(postJSON))
+        file, err := os.OpenFile(cm.sftpKnownHosts, os.O_CREATE|os.O_RDONLY, 0600)
         if err != nil {
-            return fmt.Errorf("error creating post request: %v", err)
+            return nil, fmt.Errorf("failed to create known_hosts file %s: %v", cm.sftpKnownHosts, err)
         }
+        file.Close()
+    }
 
-        postReq.Header.Set("Content-Type", "application/json")
-        postReq.Header.Set("Authorization", "Bearer "+token)
+    cm.knownHostsMutex.Lock()
+    callback, err := knownhosts.New(cm.sftpKnownHosts)
+    cm.knownHostsMutex.Unlock()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load known_hosts file %s: %v", cm.sftpKnownHosts, err)
+    }
 
-        postResp, err := cm.httpClient.Do(postReq)
-        if err != nil {
-            return fmt.Errorf("error creating Mattermost post: %v", err)
+    return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+        err := callback(hostname, remote, key)
+        if err == nil {
+            return nil
         }
-        defer postResp.Body.Close()
 
-        if postResp.StatusCode >= 300 {
-            bodyBytes, _ := io.ReadAll(postResp.Body)
-            return fmt.Errorf("mattermost post creation error: %s - %s", postResp.Status, string(bodyBytes))
+        var keyErr *knownhosts.KeyError
+        if !errors.As(err, &keyErr) {
+            return err
         }
 
-        cm.log.Success("Clip successfully sent to Mattermost")
-        return nil
-    }
+        if len(keyErr.Want) > 0 {
+            return fmt.Errorf("SSH host key mismatch for %s: server presented %s key %s which does not match %s (possible man-in-the-middle attack)",
+                hostname, key.Type(), ssh.FingerprintSHA256(key), cm.sftpKnownHosts)
+        }
+
+        if !cm.sftpTrustOnFirstUse {
+            return fmt.Errorf("SSH host key for %s is unknown (%s key %s): add it to %s or set SFTP_TRUST_ON_FIRST_USE=true",
+                hostname, key.Type(), ssh.FingerprintSHA256(key), cm.sftpKnownHosts)
+        }
 
-    return cm.RetryOperation(operation, "Mattermost")
+        return cm.trustHostKey(hostname, key)
+    }, nil
 }
 
-func (cm *ClipManager) sendToDiscord(filePath, webhookURL string, r *http.Request) error {
-    operation := func() error {
-        file, err := os.Open(filePath)
-        if err != nil {
-            return fmt.Errorf("could not open file for sending to Discord: %v", err)
-        }
-        defer file.Close()
+// trustHostKey appends a previously unknown host key to the known_hosts file
+func (cm *ClipManager) trustHostKey(hostname string, key ssh.PublicKey) error {
+    cm.knownHostsMutex.Lock()
+    defer cm.knownHostsMutex.Unlock()
 
-        messageText := cm.buildClipMessage(r)
+    file, err := os.OpenFile(cm.sftpKnownHosts, os.O_APPEND|os.O_WRONLY, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to open known_hosts file %s: %v", cm.sftpKnownHosts, err)
+    }
+    defer file.Close()
 
-        var requestBody bytes.Buffer
-        writer := multipart.NewWriter(&requestBody)
+    line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+    if _, err := file.WriteString(line + "\n"); err != nil {
+        return fmt.Errorf("failed to write to known_hosts file %s: %v", cm.sftpKnownHosts, err)
+    }
 
-        if err := writer.WriteField("content", messageText); err != nil {
-            return fmt.Errorf("error adding content to Discord request: %v", err)
-        }
+    cm.log.Warning("Trusting new SSH host key for %s on first use (%s key %s)", hostname, key.Type(), ssh.FingerprintSHA256(key))
+    return nil
+}
 
-        part, err := writer.CreateFormFile("file", filepath.Base(filePath))
-        if err != nil {
-            return fmt.Errorf("error creating file field for Discord: %v", err)
-        }
+// List SFTP clips in the specified directory, sorted and paginated according to opts.
+// Returns the requested page and the total number of clips.
+func (cm *ClipManager) listSftpClips(host, port, user, password, privateKey, passphrase, path string, opts ClipListOptions) ([]ClipInfo, int, error) {
+    client, err := cm.connectToSFTP(host, port, user, password, privateKey, passphrase)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer client.Close()
 
-        if _, err := io.Copy(part, file); err != nil {
-            return fmt.Errorf("error copying file to Discord request: %v", err)
-        }
+    if path == "" {
+        path = "."
+    }
 
-        if err := writer.Close(); err != nil {
-            return fmt.Errorf("error finalizing Discord request: %v", err)
-        }
+    depth := 0
+    if opts.Recursive {
+        depth = opts.MaxDepth
+    }
 
-        cm.log.Info("Sending clip to Discord. File: %s", filepath.Base(filePath))
+    clips := []ClipInfo{}
+    if err := cm.collectSftpClips(client.Client, path, depth, opts, &clips); err != nil {
+        return nil, 0, err
+    }
+    if len(clips) >= maxClipListEntries {
+        cm.log.Warning("Clip listing of %s stopped after %d clips", path, maxClipListEntries)
+    }
 
-        req, err := http.NewRequest("POST", webhookURL, &requestBody)
-        if err != nil {
-            return fmt.Errorf("error creating Discord request: %v", err)
-        }
+    sortClips(clips, opts.Sort, opts.Order)
 
-        req.Header.Set("Content-Type", writer.FormDataContentType())
+    total := len(clips)
+    start := opts.Offset
+    if start > total {
+        start = total
+    }
+    end := start + opts.Limit
+    if end > total {
+        end = total
+    }
+    return clips[start:end], total, nil
+}
 
-        resp, err := cm.httpClient.Do(req)
-        if err != nil {
-            return fmt.Errorf("error sending to Discord: %v", err)
+// parseClipListTime parses a date (YYYY-MM-DD, local time) or an RFC 3339 timestamp. A bare date
+// used as an upper bound covers the whole day.
+func parseClipListTime(value string, endOfDay bool) (time.Time, error) {
+    if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+        if endOfDay {
+            t = t.Add(24*time.Hour - time.Nanosecond)
         }
-        defer resp.Body.Close()
+        return t, nil
+    }
+    t, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("'%s' is not YYYY-MM-DD or RFC 3339", value)
+    }
+    return t, nil
+}
 
-        if resp.StatusCode >= 300 {
-            bodyBytes, _ := io.ReadAll(resp.Body)
-            return fmt.Errorf("discord API error: %s - %s", resp.Status, string(bodyBytes))
-        }
+// mattermostIDPattern matches Mattermost post, channel and user IDs
+var mattermostIDPattern = regexp.MustCompile(`^[a-z0-9]{26}$`)
 
-        cm.log.Success("Clip successfully sent to Discord")
-        return nil
-    }
+// clipFilenamePattern matches generateSFTPFilename output: an optional metadata prefix and its
+// separator, the capture time, an optional _N suffix added when a name was already taken and a
+// clip extension. Names from before clipNameSeparator separate the prefix with one underscore.
+var clipFilenamePattern = regexp.MustCompile(`^(?:(.+?)(__|_))?(\d{4}-\d{2}-\d{2}_\d{2}-\d{2})(?:_\d+)?\.(?:mp4|mkv|webm)$`)
 
-    return cm.RetryOperation(operation, "Discord")
+// clipFilenameInfo is the metadata generateSFTPFilename encodes in a clip's filename
+type clipFilenameInfo struct {
+    Title    string
+    Category string
+    Team1    string
+    Team2    string
+    Time     time.Time
 }
 
-// sendToSFTP uploads a file to an SFTP server
-func (cm *ClipManager) sendToSFTP(filePath, host, port, user, password, remotePath string, r *http.Request) error {
-    operation := func() error {
-        // Configure SSH client
-        config := &ssh.ClientConfig{
-            User: user,
-            Auth: []ssh.AuthMethod{
-                ssh.Password(password),
-            },
-            HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Note: Use a proper host key verification in production
-        }
+// parseClipFilename recovers the metadata from a generated clip filename, the same reading the
+// web interface uses. Returns false for files that don't follow the naming scheme.
+func parseClipFilename(name string) (clipFilenameInfo, bool) {
+    match := clipFilenamePattern.FindStringSubmatch(name)
+    if match == nil {
+        return clipFilenameInfo{}, false
+    }
 
-        // Connect to SSH server
-        addr := fmt.Sprintf("%s:%s", host, port)
-        client, err := ssh.Dial("tcp", addr, config)
-        if err != nil {
-            return fmt.Errorf("failed to dial SSH: %v", err)
-        }
-        defer client.Close()
+    captureTime, err := time.ParseInLocation("2006-01-02_15-04", match[3], time.Local)
+    if err != nil {
+        return clipFilenameInfo{}, false
+    }
 
-        // Create SFTP client
-        sftpClient, err := sftp.NewClient(client)
-        if err != nil {
-            return fmt.Errorf("failed to create SFTP client: %v", err)
-        }
-        defer sftpClient.Close()
+    info := clipFilenameInfo{Time: captureTime}
+    if match[1] == "" {
+        return info, true
+    }
 
-        // Open local file
-        localFile, err := os.Open(filePath)
-        if err != nil {
-            return fmt.Errorf("could not open local file: %v", err)
+    if match[2] == clipNameSeparator {
+        // title__category, then __team1 or __team1__vs__team2
+        fields := strings.Split(match[1], clipNameSeparator)
+        if len(fields) == 4 || len(fields) > 5 || (len(fields) == 5 && fields[3] != "vs") {
+            return clipFilenameInfo{}, false
         }
-        defer localFile.Close()
-
-        // Generate remote filename
-        remoteFileName := cm.generateSFTPFilename(r)
-        
-        // Ensure remote path exists
-        if remotePath != "." && remotePath != "" {
-            if err := sftpClient.MkdirAll(remotePath); err != nil {
-                cm.log.Warning("Could not create remote directory: %v, will try to upload to existing path", err)
-            }
+        info.Title, info.Category = fields[0], fields[0]
+        if len(fields) > 1 {
+            info.Category = fields[1]
         }
-        
-        remoteFilePath := filepath.Join(remotePath, remoteFileName)
-        
-        // Create remote file
-        remoteFile, err := sftpClient.Create(remoteFilePath)
-        if err != nil {
-            return fmt.Errorf("failed to create remote file: %v", err)
+        if len(fields) > 2 {
+            info.Team1 = fields[2]
         }
-        defer remoteFile.Close()
-
-        // Copy file content
-        if _, err := io.Copy(remoteFile, localFile); err != nil {
-            return fmt.Errorf("failed to copy file to SFTP server: %v", err)
+        if len(fields) > 4 {
+            info.Team2 = fields[4]
         }
+        return info, true
+    }
 
-        cm.log.Success("Clip successfully uploaded to SFTP at %s", remoteFilePath)
-        cm.broadcastNewClip(remoteFilePath)
-        return nil
+    // Older names separate every field with a single underscore. The title and category are the
+    // first two parts and whatever follows is the team part, which can be ambiguous.
+    parts := strings.SplitN(match[1], "_", 3)
+    info.Title = parts[0]
+    info.Category = parts[0]
+    if len(parts) > 1 {
+        info.Category = parts[1]
+    }
+    if len(parts) > 2 {
+        teams := parts[2]
+        if team1, team2, found := strings.Cut(teams, "_vs_"); found {
+            info.Team1, info.Team2 = team1, team2
+        } else {
+            info.Team1 = teams
+        }
     }
+    return info, true
+}
 
-    return cm.RetryOperation(operation, "SFTP")
+// hasFilters reports whether any filename-based filter is set
+func (o ClipListOptions) hasFilters() bool {
+    return o.Category != "" || o.Team != "" || !o.from.IsZero() || !o.to.IsZero()
 }
 
-// generateSFTPFilename creates a filename based on request parameters
-func (cm *ClipManager) generateSFTPFilename(r *http.Request) string {
-    var title, category, team1, team2 string
-
-    if r.Method == http.MethodGet {
-        title = r.URL.Query().Get("title")
-        category = r.URL.Query().Get("category")
-        team1 = r.URL.Query().Get("team1")
-        team2 = r.URL.Query().Get("team2")
-    } else if r.Method == http.MethodPost {
-        var req ClipRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
-            title = req.Title
-            category = req.Category
-            team1 = req.Team1
-            team2 = req.Team2
-        }
-        r.Body = io.NopCloser(bytes.NewBuffer([]byte{}))
-    }
-
-    // Sanitize inputs to avoid invalid characters
-    sanitize := func(s string) string {
-        reg, _ := regexp.Compile("[^a-zA-Z0-9_-]+")
-        return reg.ReplaceAllString(strings.TrimSpace(s), "_")
-    }
-
-    title = sanitize(title)
-    category = sanitize(category)
-    team1 = sanitize(team1)
-    team2 = sanitize(team2)
-    
-    // Use each field as fallback for the other if one is empty
-    if title == "" && category != "" {
-        title = category
-    } else if category == "" && title != "" {
-        category = title
+// matches reports whether a clip's filename satisfies the filters. Underscores in the filter
+// match spaces, since generateSFTPFilename replaces spaces with underscores.
+func (o ClipListOptions) matches(name string) bool {
+    if !o.hasFilters() {
+        return true
     }
 
-    timestamp := time.Now().Format("2006-01-02_15-04")
-    var parts []string
-    
-    // Add title to parts if it exists
-    if title != "" {
-        parts = append(parts, title)
-    }
-    
-    // Add category to parts if it exists and is different from title
-    if category != "" {
-        parts = append(parts, category)
+    info, ok := parseClipFilename(name)
+    if !ok {
+        return false
     }
 
-    if team1 != "" && team2 != "" {
-        parts = append(parts, fmt.Sprintf("%s_vs_%s", team1, team2))
-    } else if team1 != "" {
-        parts = append(parts, team1)
-    } else if team2 != "" {
-        parts = append(parts, team2)
+    normalize := func(s string) string {
+        return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), " ", "_"))
     }
-
-    if len(parts) == 0 {
-        return fmt.Sprintf("%s.mp4", timestamp)
+    if o.Category != "" && !strings.Contains(strings.ToLower(info.Category), normalize(o.Category)) {
+        return false
     }
-
-    return fmt.Sprintf("%s_%s.mp4", strings.Join(parts, "_"), timestamp)
-}
-
-func (cm *ClipManager) SendToChatApp(originalFilePath string, r *http.Request) error {
-    chatApps := strings.ToLower(r.URL.Query().Get("chat_app"))
-    if chatApps == "" && r.Method == http.MethodPost {
-        var req ClipRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
-            chatApps = strings.ToLower(req.ChatApps)
+    if o.Team != "" {
+        team := normalize(o.Team)
+        if !strings.Contains(strings.ToLower(info.Team1), team) && !strings.Contains(strings.ToLower(info.Team2), team) {
+            return false
         }
-        r.Body = io.NopCloser(bytes.NewBuffer([]byte{}))
     }
+    if !o.from.IsZero() && info.Time.Before(o.from) {
+        return false
+    }
+    if !o.to.IsZero() && info.Time.After(o.to) {
+        return false
+    }
+    return true
+}
 
-    chatAppList := strings.Split(chatApps, ",")
-
-    var wg sync.WaitGroup
-    errors := make(chan error, len(chatAppList))
-    compressedFiles := make(map[string]string)
+// collectSftpClips appends the .mp4 files in dir that match the filters in opts to clips,
+// descending up to depth levels into subdirectories. Hidden directories are skipped and the
+// walk stops at maxClipListEntries.
+func (cm *ClipManager) collectSftpClips(client *sftp.Client, dir string, depth int, opts ClipListOptions, clips *[]ClipInfo) error {
+    files, err := client.ReadDir(dir)
+    if err != nil {
+        return fmt.Errorf("failed to read directory %s: %w", dir, err)
+    }
 
-    for _, app := range chatAppList {
-        app = strings.TrimSpace(app)
+    for _, file := range files {
+        if len(*clips) >= maxClipListEntries {
+            return nil
+        }
 
-        filePath := originalFilePath
-        var err error
-        filePath, err = cm.PrepareClipForChatApp(originalFilePath, app)
-        if err != nil {
-            cm.log.Error("Error preparing clip for %s: %v", app, err)
-            errors <- fmt.Errorf("error preparing clip for %s: %v", app, err)
+        if file.IsDir() {
+            if depth <= 0 || strings.HasPrefix(file.Name(), ".") {
+                continue
+            }
+            subdir := filepath.Join(dir, file.Name())
+            if err := cm.collectSftpClips(client, subdir, depth-1, opts, clips); err != nil {
+                // One unreadable subdirectory shouldn't hide the rest of the listing
+                cm.log.Warning("Skipping %s: %v", subdir, err)
+            }
             continue
         }
 
-        if filePath != originalFilePath {
-            compressedFiles[app] = filePath
+        // Only include clips
+        if isClipFile(file.Name()) && opts.matches(file.Name()) {
+            *clips = append(*clips, ClipInfo{
+                Name:    file.Name(),
+                Size:    file.Size(),
+                ModTime: file.ModTime(),
+                Path:    filepath.Join(dir, file.Name()),
+            })
         }
+    }
 
-        wg.Add(1)
-        go func(app, filePath string) {
-            defer wg.Done()
+    return nil
+}
 
-            var err error
-            switch app {
-            case "telegram":
-                botToken := r.URL.Query().Get("telegram_bot_token")
-                chatID := r.URL.Query().Get("telegram_chat_id")
-                err = cm.sendToTelegram(filePath, botToken, chatID, r)
-            case "mattermost":
-                url := r.URL.Query().Get("mattermost_url")
-                token := r.URL.Query().Get("mattermost_token")
-                channel := r.URL.Query().Get("mattermost_channel")
-                err = cm.sendToMattermost(filePath, url, token, channel, r)
-            case "discord":
-                webhookURL := r.URL.Query().Get("discord_webhook_url")
-                err = cm.sendToDiscord(filePath, webhookURL, r)
-            case "sftp":
-                host := r.URL.Query().Get("sftp_host")
-                port := r.URL.Query().Get("sftp_port")
-                if port == "" {
-                    port = "22"
-                }
-                user := r.URL.Query().Get("sftp_user")
-                password := r.URL.Query().Get("sftp_password")
-                path := r.URL.Query().Get("sftp_path")
-                if path == "" {
-                    path = "."
-                }
-                err = cm.sendToSFTP(filePath, host, port, user, password, path, r)
-            default:
-                err = fmt.Errorf("unsupported chat app: %s", app)
+// sortClips orders clips by name, size or modtime, ties broken by name so pages are stable
+func sortClips(clips []ClipInfo, field, order string) {
+    sort.SliceStable(clips, func(i, j int) bool {
+        a, b := clips[i], clips[j]
+        if order == "desc" {
+            a, b = b, a
+        }
+        switch field {
+        case "size":
+            if a.Size != b.Size {
+                return a.Size < b.Size
             }
-
-            if err != nil {
-                cm.log.Error("Error sending clip to %s: %v", app, err)
-                errors <- fmt.Errorf("error sending to %s: %v", app, err)
-            } else {
-                cm.log.Success("Successfully sent clip to %s", app)
+        case "modtime":
+            if !a.ModTime.Equal(b.ModTime) {
+                return a.ModTime.Before(b.ModTime)
             }
-        }(app, filePath)
-    }
+        }
+        return a.Name < b.Name
+    })
+}
 
-    wg.Wait()
-    close(errors)
+// HandleMetrics serves the metrics registry in the Prometheus text exposition format
+func (cm *ClipManager) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+    cm.metrics.handler.ServeHTTP(w, r)
+}
 
-    for app, filePath := range compressedFiles {
-        cm.log.Info("Cleaning up compressed file for %s: %s", app, filePath)
-        os.Remove(filePath)
-    }
+// CameraHealth describes the recording state of a camera in health responses
+type CameraHealth struct {
+    ID               string     `json:"id"`
+    Recording        bool       `json:"recording"`
+    SegmentCount     int        `json:"segment_count"`
+    LastSegmentTime  *time.Time `json:"last_segment_time,omitempty"`
+    VideoCodec       string     `json:"video_codec,omitempty"`
+    AudioCodec       string     `json:"audio_codec,omitempty"`
+    Healthy          bool       `json:"healthy"`
+}
 
-    var errList []string
-    for err := range errors {
-        errList = append(errList, err.Error())
-    }
+// BufferStatus describes how much footage a camera has buffered, returned by /api/buffer/status
+type BufferStatus struct {
+    CameraID            string     `json:"camera_id"`
+    Recording           bool       `json:"recording"`
+    SegmentCount        int        `json:"segment_count"`
+    BufferedSeconds     int        `json:"buffered_seconds"`
+    MaxBacktrackSeconds int        `json:"max_backtrack_seconds"`
+    EarliestSegment     *time.Time `json:"earliest_segment,omitempty"`
+    LatestSegment       *time.Time `json:"latest_segment,omitempty"`
+    CurrentCycle        int        `json:"current_cycle"`
+    HasAudio            bool       `json:"has_audio"`
+    HasVideo            bool       `json:"has_video"`
+    StreamsProbed       bool       `json:"streams_probed"`
+}
 
-    if len(errList) > 0 {
-        return fmt.Errorf("errors sending clip: %s", strings.Join(errList, "; "))
-    }
+// CameraTracks lists the tracks of a camera stream and how many of them are buffered, returned by /api/tracks
+type CameraTracks struct {
+    CameraID            string        `json:"camera_id"`
+    Tracks              []StreamTrack `json:"tracks"`
+    RecordedVideoTrack  string        `json:"recorded_video_track"` // default, all or a track number, from VIDEO_TRACK
+    RecordedAudioTrack  string        `json:"recorded_audio_track"` // default, all or a track number, from AUDIO_TRACK
+    BufferedVideoTracks int           `json:"buffered_video_tracks"` // video_track must be below this
+    BufferedAudioTracks int           `json:"buffered_audio_tracks"` // audio_track must be below this
+}
 
-    return nil
+// BufferedSegment describes one segment in a camera's buffer, returned by /api/segments
+type BufferedSegment struct {
+    Filename        string    `json:"filename"`
+    Cycle           int       `json:"cycle"`
+    Start           time.Time `json:"start"`
+    End             time.Time `json:"end"`
+    DurationSeconds float64   `json:"duration_seconds"`
+    SizeBytes       int64     `json:"size_bytes"`
+    Missing         bool      `json:"missing,omitempty"` // The file is gone from disk although it is still indexed
 }
 
-func (cm *ClipManager) buildClipMessage(r *http.Request) string {
-    var title, category, team1, team2, additionalText string
-
-    if r.Method == http.MethodGet {
-        title = r.URL.Query().Get("title")
-        category = r.URL.Query().Get("category")
-        team1 = r.URL.Query().Get("team1")
-        team2 = r.URL.Query().Get("team2")
-        additionalText = r.URL.Query().Get("additional_text")
-    } else if r.Method == http.MethodPost {
-        // For POST requests we need to parse the body again if we're not using a ClipRequest
-        var req ClipRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
-            title = req.Title
-            category = req.Category
-            team1 = req.Team1
-            team2 = req.Team2
-            additionalText = req.AdditionalText
-        }
-        // Reset de body zodat deze opnieuw gelezen kan worden elders
-        r.Body = io.NopCloser(bytes.NewBuffer([]byte{}))
-    }
-    
-    // Build message components
-    var messageParts []string
-    
-    // Add title if available
-    if title != "" {
-        messageParts = append(messageParts, title)
+// RecordingStatus is returned by the /api/recording endpoints
+type RecordingStatus struct {
+    CameraID      string     `json:"camera_id"`
+    Recording     bool       `json:"recording"`
+    StartedAt     *time.Time `json:"started_at,omitempty"`
+    UptimeSeconds float64    `json:"uptime_seconds,omitempty"`
+    Message       string     `json:"message"`
+}
+
+// HandleRecording starts, stops or restarts a camera's background recorder, depending on whether
+// it is mounted at /api/recording/start, /stop or /restart. Restarting probes the stream again,
+// which picks up a camera that came back with different streams after an outage.
+func (cm *ClipManager) HandleRecording(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+        return
     }
-    
-    // Add category if available and different from title
-    if category != "" && category != title {
-        messageParts = append(messageParts, category)
+
+    cam, err := cm.getCamera(r.URL.Query().Get("camera_id"))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Invalid camera_id parameter: %v", err), http.StatusBadRequest)
+        return
     }
-    
-    // Join title and category with " - " if both exist
-    messagePrefix := ""
-    if len(messageParts) > 0 {
-        messagePrefix = strings.Join(messageParts, " - ") + " "
+
+    action := path.Base(r.URL.Path)
+    if action != "stop" && cm.acceptCtx.Err() != nil {
+        http.Error(w, "ClipManager is shutting down", http.StatusServiceUnavailable)
+        return
     }
-    
-    // Create the base message with prefix and timestamp
-    base := fmt.Sprintf("New %sClip: %s", messagePrefix, cm.formatCurrentTime())
 
-    // Add team information if available
-    var teams string
-    if team1 != "" && team2 != "" {
-        teams = fmt.Sprintf(" / %s vs %s", team1, team2)
+    var message string
+    status := http.StatusOK
+    switch action {
+    case "start":
+        message = "Background recording started"
+        if !cm.StartBackgroundRecording(cm.ctx, cam) {
+            message = "Background recording is already running"
+            status = http.StatusConflict
+        }
+    case "stop":
+        message = "Background recording stopped"
+        if stopped, err := cam.StopRecording(recorderStopTimeout); err != nil {
+            message = err.Error()
+            status = http.StatusInternalServerError
+        } else if !stopped {
+            message = "Background recording is not running"
+            status = http.StatusConflict
+        }
+    case "restart":
+        message = "Background recording restarted"
+        if _, err := cam.StopRecording(recorderStopTimeout); err != nil {
+            message = err.Error()
+            status = http.StatusInternalServerError
+        } else if !cm.StartBackgroundRecording(cm.ctx, cam) {
+            // Another start request got in between the stop and the start
+            message = "Background recording was started by another request"
+            status = http.StatusConflict
+        }
+    default:
+        http.NotFound(w, r)
+        return
     }
+    cm.log.Info("[camera %s] %s", cam.ID, message)
 
-    // Add additional text if available
-    var extra string
-    if additionalText != "" {
-        extra = fmt.Sprintf(" - %s", additionalText)
+    response := RecordingStatus{CameraID: cam.ID, Recording: cam.IsRecording(), Message: message}
+    if response.Recording {
+        startedAt := cam.RecordingStartTime()
+        response.StartedAt = &startedAt
+        response.UptimeSeconds = time.Since(startedAt).Seconds()
     }
 
-    return base + teams + extra
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(response)
 }
 
-// optionalCategory adds a space if category is present
-func optionalCategory(category string) string {
-	if category != "" {
-		return category + " "
-	}
-	return ""
-}
+// HandleBufferStatus reports how much footage a camera has buffered, so clients can tell whether
+// a long backtrack is available yet
+func (cm *ClipManager) HandleBufferStatus(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+        return
+    }
 
-// formatCurrentTime returns a formatted current time string
-func (cm *ClipManager) formatCurrentTime() string {
-	return time.Now().Format("2006-01-02")
-}
+    cam, err := cm.getCamera(r.URL.Query().Get("camera_id"))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Invalid camera_id parameter: %v", err), http.StatusBadRequest)
+        return
+    }
 
-// serveWebInterface serves the HTML form interface at the root endpoint
-func (cm *ClipManager) serveWebInterface(w http.ResponseWriter, r *http.Request) {
-	templatePath := "templates/index.html"
+    status := BufferStatus{
+        CameraID:            cam.ID,
+        Recording:           cam.IsRecording(),
+        MaxBacktrackSeconds: cm.maxBacktrackSeconds,
+    }
+    status.HasAudio, status.HasVideo, status.StreamsProbed = cam.streams()
+
+    cam.segmentsMutex.RLock()
+    status.SegmentCount = len(cam.segments)
+    status.CurrentCycle = cam.currentCycle
+    var buffered time.Duration
+    for _, segment := range cam.segments {
+        buffered += segment.Duration
+    }
+    if len(cam.segments) > 0 {
+        earliest := cam.segments[0].Timestamp
+        latest := cam.segments[len(cam.segments)-1].End()
+        status.EarliestSegment = &earliest
+        status.LatestSegment = &latest
+    }
+    cam.segmentsMutex.RUnlock()
+    status.BufferedSeconds = int(buffered.Round(time.Second).Seconds())
 
-	_, err := os.Stat(templatePath)
-	if (err != nil) {
-		execPath, err := os.Executable()
-		if err == nil {
-			execDir := filepath.Dir(execPath)
-			templatePath = filepath.Join(execDir, "templates/index.html")
-			}
-		}
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
 
-	htmlContent, err := os.ReadFile(templatePath)
-	if (err != nil) {
-		cm.log.Warning("Error reading template file: %v, using embedded HTML", err)
-		htmlContent = []byte(getEmbeddedHTML())
-	}
+// HandleTracks lists the video and audio tracks of a camera stream so video_track and audio_track
+// can be chosen. The stream is probed again with refresh=true, otherwise the last probe is used.
+func (cm *ClipManager) HandleTracks(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+        return
+    }
 
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(htmlContent)
-}
+    cam, err := cm.getCamera(r.URL.Query().Get("camera_id"))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Invalid camera_id parameter: %v", err), http.StatusBadRequest)
+        return
+    }
 
-// getEmbeddedHTML returns the HTML content as a fallback if the file can't be loaded
-func getEmbeddedHTML() string {
-	return `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>ClipManager</title>
-    <style>
-        body {
-            font-family: Arial, sans-serif;
-            line-height: 1.6;
-            color: #333;
-            max-width: 800px;
-            margin: 0 auto;
-            padding: 20px;
-        }
-        h1 {
-            color: #2c3e50;
-            text-align: center;
-        }
-    </style>
-</head>
-<body>
-    <h1>ClipManager</h1>
-    <p>The template file could not be loaded. Please make sure the templates directory exists.</p>
-    <p>API endpoint is still available at: /api/clip</p>
-</body>
-</html>
-`
-}
+    if _, _, probed := cam.streams(); !probed || r.URL.Query().Get("refresh") == "true" {
+        cm.probeCameraStreams(cam)
+    }
+    if _, _, probed := cam.streams(); !probed {
+        http.Error(w, "Could not probe the camera stream", http.StatusBadGateway)
+        return
+    }
 
-// ClipInfo represents metadata about a clip file
-type ClipInfo struct {
-    Name      string    `json:"name"`
-    Size      int64     `json:"size"`
-    ModTime   time.Time `json:"mod_time"`
-    Path      string    `json:"path"`
+    cam.streamsMutex.Lock()
+    tracks := make([]StreamTrack, len(cam.tracks))
+    copy(tracks, cam.tracks)
+    cam.streamsMutex.Unlock()
+
+    response := CameraTracks{
+        CameraID:            cam.ID,
+        Tracks:              tracks,
+        RecordedVideoTrack:  trackName(cam.trackSelection("video")),
+        RecordedAudioTrack:  trackName(cam.trackSelection("audio")),
+        BufferedVideoTracks: cam.bufferedTracks("video"),
+        BufferedAudioTracks: cam.bufferedTracks("audio"),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
 }
 
-// HandleListClips returns a list of clips from the SFTP server
-func (cm *ClipManager) HandleListClips(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
-        return
+// trackName describes a track selection for /api/tracks
+func trackName(selection int) string {
+    switch selection {
+    case trackDefault:
+        return "default"
+    case trackAll:
+        return "all"
     }
+    return strconv.Itoa(selection)
+}
 
-    var req ClipRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
-        cm.log.Error("Failed to parse list clips request: %v", err)
+// HandleSegments lists the segments in a camera's buffer, oldest first, for diagnosing gaps and
+// timestamp drift
+func (cm *ClipManager) HandleSegments(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
         return
     }
 
-    // Connect to SFTP and list files
-    clips, err := cm.listSftpClips(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword, req.SFTPPath)
+    cam, err := cm.getCamera(r.URL.Query().Get("camera_id"))
     if err != nil {
-        http.Error(w, "Failed to list clips: "+err.Error(), http.StatusInternalServerError)
-        cm.log.Error("Failed to list clips: %v", err)
+        http.Error(w, fmt.Sprintf("Invalid camera_id parameter: %v", err), http.StatusBadRequest)
         return
     }
 
+    cam.segmentsMutex.RLock()
+    segments := make([]SegmentInfo, len(cam.segments))
+    copy(segments, cam.segments)
+    cam.segmentsMutex.RUnlock()
+
+    listed := make([]BufferedSegment, 0, len(segments))
+    for _, segment := range segments {
+        name := filepath.Base(segment.Path)
+        entry := BufferedSegment{
+            Filename:        name,
+            Cycle:           -1,
+            Start:           segment.Timestamp,
+            End:             segment.End(),
+            DurationSeconds: segment.Duration.Seconds(),
+        }
+        if matches := segmentCyclePattern.FindStringSubmatch(name); matches != nil {
+            entry.Cycle, _ = strconv.Atoi(matches[1])
+        }
+        if info, err := os.Stat(segment.Path); err == nil {
+            entry.SizeBytes = info.Size()
+        } else {
+            entry.Missing = true
+        }
+        listed = append(listed, entry)
+    }
+
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(clips)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "camera_id": cam.ID,
+        "segments":  listed,
+    })
 }
 
-// HandleTestSFTPConnection tests if the SFTP connection works
-func (cm *ClipManager) HandleTestSFTPConnection(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+// HandleBufferDownload returns the last seconds of a camera's buffer as an MP4 without trimming,
+// transcoding or sending it anywhere. The footage starts at a segment boundary, so it can be up
+// to one segment longer than asked for.
+func (cm *ClipManager) HandleBufferDownload(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
         return
     }
 
-    var req ClipRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
-        cm.log.Error("Failed to parse SFTP test request: %v", err)
+    cam, err := cm.getCamera(r.URL.Query().Get("camera_id"))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Invalid camera_id parameter: %v", err), http.StatusBadRequest)
         return
     }
 
-    client, err := cm.connectToSFTP(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword)
-    if err != nil {
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": err.Error()})
+    seconds := cm.maxBacktrackSeconds
+    if value := r.URL.Query().Get("seconds"); value != "" {
+        seconds, err = strconv.Atoi(value)
+        if err != nil || seconds < 1 || seconds > cm.maxBacktrackSeconds {
+            http.Error(w, fmt.Sprintf("Invalid seconds parameter: must be between 1 and %d", cm.maxBacktrackSeconds), http.StatusBadRequest)
+            return
+        }
+    }
+
+    cam.segmentsMutex.RLock()
+    segments := make([]SegmentInfo, len(cam.segments))
+    copy(segments, cam.segments)
+    cam.segmentsMutex.RUnlock()
+    if len(segments) == 0 {
+        http.Error(w, "No buffered footage yet", http.StatusServiceUnavailable)
         return
     }
-    defer client.Close()
 
-    // Try to list the directory to verify permissions
-    path := req.SFTPPath
-    if path == "" {
-        path = "."
+    // Take segments from the newest back until they cover the requested seconds
+    first := len(segments) - 1
+    for covered := segments[first].Duration; first > 0 && covered < time.Duration(seconds)*time.Second; {
+        first--
+        covered += segments[first].Duration
     }
+    segments = segments[first:]
 
-    _, err = client.ReadDir(path)
+    logger := cm.log.With("[camera %s]", cam.ID)
+    outputPath := filepath.Join(cm.tempDir, fmt.Sprintf("buffer_%s_%d.mp4", cam.ID, time.Now().UnixNano()))
+    concatListPath, err := writeConcatList(cam, outputPath, segments)
     if err != nil {
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false, 
-            "message": fmt.Sprintf("Connected to SFTP but failed to read directory '%s': %v", path, err),
-        })
+        http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    defer os.Remove(concatListPath)
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "message": "Connection successful"})
-}
+    args := []string{"-f", "concat", "-safe", "0", "-i", concatListPath, "-c", "copy"}
+    args = append(args, muxerArgs(outputPath)...)
+    args = append(args, "-y", outputPath)
 
-// HandleDeleteClip deletes a clip from the SFTP server
-func (cm *ClipManager) HandleDeleteClip(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+    logger.Info("Exporting %d buffered segments (%d seconds requested)", len(segments), seconds)
+    cmd := exec.CommandContext(r.Context(), cm.ffmpegPath, args...)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    defer os.Remove(outputPath)
+    if err := cmd.Run(); err != nil {
+        logger.Error("Buffer export failed: %v\nFFmpeg output: %s", err, stderr.String())
+        http.Error(w, fmt.Sprintf("Failed to export the buffer: %v", err), http.StatusInternalServerError)
         return
     }
 
-    var req struct {
-        SFTPHost     string `json:"sftp_host"`
-        SFTPPort     string `json:"sftp_port"`
-        SFTPUser     string `json:"sftp_user"`
-        SFTPPassword string `json:"sftp_password"`
-        Path         string `json:"path"`
+    filename := fmt.Sprintf("buffer_%s_%s.mp4", cam.ID, segments[0].Timestamp.Format("2006-01-02_15-04-05"))
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+    extendWriteDeadline(w, cm.streamWriteTimeout)
+    http.ServeFile(w, r, outputPath)
+}
+
+// previewStream is a camera's low-res MJPEG pipeline, shared by all viewers and stopped when the
+// last one leaves. It reads the camera separately from the recorder, so the buffer isn't affected.
+type previewStream struct {
+    cancel  context.CancelFunc
+    viewers map[chan []byte]struct{} // Guarded by ClipManager.previewsMutex
+}
+
+// subscribePreview returns a channel of JPEG frames from the camera, starting the preview pipeline
+// for the first viewer. The channel is closed when the pipeline exits.
+func (cm *ClipManager) subscribePreview(cam *Camera) chan []byte {
+    frames := make(chan []byte, 1)
+
+    cm.previewsMutex.Lock()
+    defer cm.previewsMutex.Unlock()
+
+    preview, running := cm.previews[cam.ID]
+    if !running {
+        ctx, cancel := context.WithCancel(cm.ctx)
+        preview = &previewStream{cancel: cancel, viewers: make(map[chan []byte]struct{})}
+        cm.previews[cam.ID] = preview
+        go cm.runPreview(ctx, cam, preview)
     }
+    preview.viewers[frames] = struct{}{}
+    return frames
+}
 
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
-        cm.log.Error("Failed to parse delete request: %v", err)
+// unsubscribePreview removes a viewer and stops the pipeline when it was the last one
+func (cm *ClipManager) unsubscribePreview(cam *Camera, frames chan []byte) {
+    cm.previewsMutex.Lock()
+    defer cm.previewsMutex.Unlock()
+
+    preview, running := cm.previews[cam.ID]
+    if !running {
+        return
+    }
+    if _, ok := preview.viewers[frames]; !ok {
         return
     }
+    delete(preview.viewers, frames)
+    if len(preview.viewers) == 0 {
+        preview.cancel()
+        delete(cm.previews, cam.ID)
+    }
+}
+
+// runPreview runs FFmpeg until ctx is cancelled and hands every frame to the viewers. Slow viewers
+// skip frames instead of holding up the others.
+func (cm *ClipManager) runPreview(ctx context.Context, cam *Camera, preview *previewStream) {
+    logger := cm.log.With("[camera %s]", cam.ID)
+    defer func() {
+        cm.previewsMutex.Lock()
+        if cm.previews[cam.ID] == preview {
+            delete(cm.previews, cam.ID)
+        }
+        for frames := range preview.viewers {
+            close(frames)
+        }
+        preview.viewers = nil
+        cm.previewsMutex.Unlock()
+        preview.cancel()
+    }()
 
-    client, err := cm.connectToSFTP(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword)
+    cmd := exec.CommandContext(ctx, cm.ffmpegPath,
+        "-rtsp_transport", cm.rtspTransport,
+        "-i", cam.URL,
+        "-an",
+        "-vf", fmt.Sprintf("fps=%d,scale='min(%d,iw)':-2", previewFPS, previewWidth),
+        "-q:v", "7",
+        "-f", "mjpeg",
+        "pipe:1",
+    )
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    stdout, err := cmd.StdoutPipe()
     if err != nil {
-        http.Error(w, fmt.Sprintf("Failed to connect to SFTP: %v", err), http.StatusInternalServerError)
+        logger.Error("Could not start the preview: %v", err)
         return
     }
-    defer client.Close()
-
-    if err := client.Remove(req.Path); err != nil {
-        http.Error(w, fmt.Sprintf("Failed to delete file: %v", err), http.StatusInternalServerError)
-        cm.log.Error("Failed to delete file %s: %v", req.Path, err)
+    if err := cmd.Start(); err != nil {
+        logger.Error("Could not start the preview: %v", err)
         return
     }
+    logger.Info("Preview started")
+
+    scanner := bufio.NewScanner(stdout)
+    scanner.Buffer(make([]byte, 0, 64*1024), maxPreviewFrame)
+    scanner.Split(splitJPEG)
+    for scanner.Scan() {
+        frame := append([]byte(nil), scanner.Bytes()...)
+        cm.previewsMutex.Lock()
+        for frames := range preview.viewers {
+            select {
+            case frames <- frame:
+            default:
+            }
+        }
+        cm.previewsMutex.Unlock()
+    }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "message": "File deleted successfully"})
-}
-
-// HandleStreamClip streams a clip from the SFTP server
-func (cm *ClipManager) HandleStreamClip(w http.ResponseWriter, r *http.Request) {
-    path := r.URL.Query().Get("path")
-    if path == "" {
-        http.Error(w, "Missing path parameter", http.StatusBadRequest)
+    // FFmpeg blocks on a full pipe when reading stopped early, so kill it before waiting
+    stopped := ctx.Err() != nil
+    scanErr := scanner.Err()
+    preview.cancel()
+    err = cmd.Wait()
+    if stopped {
+        logger.Info("Preview stopped")
         return
     }
+    if scanErr != nil {
+        err = scanErr
+    }
+    logger.Warning("Preview FFmpeg exited: %v\nFFmpeg output: %s", err, stderr.String())
+}
 
-    host := r.URL.Query().Get("sftp_host")
-    port := r.URL.Query().Get("sftp_port")
-    user := r.URL.Query().Get("sftp_user")
-    password := r.URL.Query().Get("sftp_password")
-    download := r.URL.Query().Get("download") == "true"
-
-    if port == "" {
-        port = "22"
+// splitJPEG is a bufio.SplitFunc for a stream of concatenated JPEG images. The end of image marker
+// can't occur inside the image data, where FFmpeg escapes every 0xFF byte.
+func splitJPEG(data []byte, atEOF bool) (advance int, token []byte, err error) {
+    start := bytes.Index(data, []byte{0xFF, 0xD8})
+    if start < 0 {
+        if atEOF {
+            return len(data), nil, nil
+        }
+        return 0, nil, nil
     }
+    end := bytes.Index(data[start+2:], []byte{0xFF, 0xD9})
+    if end < 0 {
+        if atEOF {
+            return len(data), nil, nil
+        }
+        return start, nil, nil
+    }
+    end += start + 4
+    return end, data[start:end], nil
+}
 
-    client, err := cm.connectToSFTP(host, port, user, password)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Failed to connect to SFTP: %v", err), http.StatusInternalServerError)
+// HandlePreview serves a live MJPEG preview of a camera for checking the framing before taking
+// clips. It can be shown with a plain <img> element.
+func (cm *ClipManager) HandlePreview(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
         return
     }
-    defer client.Close()
-
-    file, err := client.Open(path)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusNotFound)
+    if cm.previewDisabled {
+        http.Error(w, "The preview is disabled (DISABLE_PREVIEW)", http.StatusNotFound)
         return
     }
-    defer file.Close()
 
-    fileInfo, err := file.Stat()
+    cam, err := cm.getCamera(r.URL.Query().Get("camera_id"))
     if err != nil {
-        http.Error(w, fmt.Sprintf("Failed to get file info: %v", err), http.StatusInternalServerError)
+        http.Error(w, fmt.Sprintf("Invalid camera_id parameter: %v", err), http.StatusBadRequest)
         return
     }
 
-    w.Header().Set("Content-Type", "video/mp4")
-    
-    if download {
-        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(path)))
-    } else {
-        w.Header().Set("Content-Disposition", "inline")
+    frames := cm.subscribePreview(cam)
+    defer cm.unsubscribePreview(cam, frames)
+
+    controller := http.NewResponseController(w)
+    writer := multipart.NewWriter(w)
+    w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+writer.Boundary())
+    w.Header().Set("Cache-Control", "no-store")
+
+    for {
+        select {
+        case frame, ok := <-frames:
+            if !ok {
+                return
+            }
+            // The stream runs for as long as the viewer watches, but each frame must go out in time
+            extendWriteDeadline(w, previewWriteTimeout)
+            part, err := writer.CreatePart(textproto.MIMEHeader{
+                "Content-Type":   {"image/jpeg"},
+                "Content-Length": {strconv.Itoa(len(frame))},
+            })
+            if err != nil {
+                return
+            }
+            if _, err := part.Write(frame); err != nil {
+                return
+            }
+            if err := controller.Flush(); err != nil {
+                return
+            }
+        case <-r.Context().Done():
+            return
+        case <-cm.ctx.Done():
+            return
+        }
     }
-    
-    w.Header().Set("Accept-Ranges", "bytes")
-    http.ServeContent(w, r, filepath.Base(path), fileInfo.ModTime(), file)
 }
 
-// Helper method to connect to SFTP
-func (cm *ClipManager) connectToSFTP(host, port, user, password string) (*sftp.Client, error) {
-    if host == "" || user == "" || password == "" {
-        return nil, fmt.Errorf("missing SFTP connection parameters")
+// HandleHealthz reports healthy (200) only when every camera is recording and has
+// produced a segment recently, otherwise 503 so an orchestrator can restart the service
+func (cm *ClipManager) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+    // Allow for long segments when deciding whether the recorder has stalled
+    maxSegmentAge := 30 * time.Second
+    if minAge := time.Duration(2*cm.segmentDuration) * time.Second; minAge > maxSegmentAge {
+        maxSegmentAge = minAge
     }
 
-    if port == "" {
-        port = "22"
+    healthy := true
+    cameraIDs := make([]string, 0, len(cm.cameras))
+    for id := range cm.cameras {
+        cameraIDs = append(cameraIDs, id)
+    }
+    sort.Strings(cameraIDs)
+
+    cameras := make([]CameraHealth, 0, len(cameraIDs))
+    for _, id := range cameraIDs {
+        cam := cm.cameras[id]
+        cam.segmentsMutex.RLock()
+        status := CameraHealth{
+            ID:           cam.ID,
+            Recording:    cam.IsRecording(),
+            SegmentCount: len(cam.segments),
+        }
+        lastSegmentAt := cam.lastSegmentAt
+        cam.segmentsMutex.RUnlock()
+
+        if !lastSegmentAt.IsZero() {
+            status.LastSegmentTime = &lastSegmentAt
+        }
+        codecs := cam.streamCodecs()
+        status.VideoCodec, status.AudioCodec = codecs.Video, codecs.Audio
+        status.Healthy = status.Recording && !lastSegmentAt.IsZero() && time.Since(lastSegmentAt) <= maxSegmentAge
+        if !status.Healthy {
+            healthy = false
+        }
+        cameras = append(cameras, status)
     }
 
-    config := &ssh.ClientConfig{
-        User: user,
-        Auth: []ssh.AuthMethod{
-            ssh.Password(password),
-        },
-        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-        Timeout:         10 * time.Second,
+    processing, queued := cm.clipQueueDepth()
+    response := map[string]interface{}{
+        "healthy":          healthy,
+        "cameras":          cameras,
+        "clips_processing": processing,
+        "clips_queued":     queued,
+    }
+    if availableSpace, err := cm.CheckDiskSpace(); err == nil {
+        response["available_disk_mb"] = availableSpace / (1024 * 1024)
+    } else {
+        response["disk_error"] = err.Error()
     }
 
-    addr := fmt.Sprintf("%s:%s", host, port)
-    sshClient, err := ssh.Dial("tcp", addr, config)
-    if err != nil {
-        return nil, fmt.Errorf("failed to connect to SSH: %w", err)
+    w.Header().Set("Content-Type", "application/json")
+    if !healthy {
+        w.WriteHeader(http.StatusServiceUnavailable)
     }
+    json.NewEncoder(w).Encode(response)
+}
 
-    sftpClient, err := sftp.NewClient(sshClient)
+// checkWritable creates and removes a file in dir to make sure clips and segments can be written there
+func checkWritable(dir string) error {
+    testFile, err := os.CreateTemp(dir, ".write_test_*")
     if err != nil {
-        sshClient.Close()
-        return nil, fmt.Errorf("failed to create SFTP client: %w", err)
+        return fmt.Errorf("%s is not writable: %v", dir, err)
     }
+    testFile.Close()
+    os.Remove(testFile.Name())
+    return nil
+}
 
-    return sftpClient, nil
+// ConfigSettings are the settings POST /api/config can change, named after the environment
+// variables that set them at startup
+type ConfigSettings struct {
+    CompressionMode     string             `json:"compression_mode"`
+    CompressionCRFStart int                `json:"compression_crf_start"`
+    CompressionCRFMax   int                `json:"compression_crf_max"`
+    CompressionCRFStep  int                `json:"compression_crf_step"`
+    MaxFileSizeMB       map[string]float64 `json:"max_file_size_mb"` // Per destination, <DESTINATION>_MAX_FILE_SIZE_MB
+    RateLimit           float64            `json:"rate_limit"`
+    RateBurst           int                `json:"rate_burst"`
+    GlobalRateLimit     float64            `json:"global_rate_limit"`
+    GlobalRateBurst     int                `json:"global_rate_burst"`
+    MaxRetries          int                `json:"max_retries"`
+    RetryBaseDelay      int                `json:"retry_base_delay"` // Seconds
+    RetryFactor         float64            `json:"retry_factor"`
+    RetryMaxDelay       int                `json:"retry_max_delay"` // Seconds
 }
 
-// List SFTP clips in the specified directory
-func (cm *ClipManager) listSftpClips(host, port, user, password, path string) ([]ClipInfo, error) {
-    client, err := cm.connectToSFTP(host, port, user, password)
-    if err != nil {
-        return nil, err
+// ConfigResponse is returned by /api/config
+type ConfigResponse struct {
+    Settings        ConfigSettings         `json:"settings"`
+    RestartRequired map[string]interface{} `json:"restart_required"` // Only change through the environment and a restart
+}
+
+// configSettings converts the runtime config to its JSON form
+func configSettings(config RuntimeConfig) ConfigSettings {
+    limits := make(map[string]float64, len(config.FileSizeLimits))
+    for destination, limit := range config.FileSizeLimits {
+        limits[destination] = limit
     }
-    defer client.Close()
+    return ConfigSettings{
+        CompressionMode:     config.Compression.Mode,
+        CompressionCRFStart: config.Compression.InitialCRF,
+        CompressionCRFMax:   config.Compression.MaxCRF,
+        CompressionCRFStep:  config.Compression.CRFStep,
+        MaxFileSizeMB:       limits,
+        RateLimit:           config.RateLimit,
+        RateBurst:           config.RateBurst,
+        GlobalRateLimit:     config.GlobalRateLimit,
+        GlobalRateBurst:     config.GlobalRateBurst,
+        MaxRetries:          config.MaxRetries,
+        RetryBaseDelay:      int(config.RetryDelay / time.Second),
+        RetryFactor:         config.RetryFactor,
+        RetryMaxDelay:       int(config.RetryMaxDelay / time.Second),
+    }
+}
 
-    if path == "" {
-        path = "."
+// runtimeConfig validates the settings and converts them back to a RuntimeConfig
+func (s ConfigSettings) runtimeConfig() (RuntimeConfig, error) {
+    compression := CompressionSettings{
+        Mode:       strings.ToLower(s.CompressionMode),
+        InitialCRF: s.CompressionCRFStart,
+        MaxCRF:     s.CompressionCRFMax,
+        CRFStep:    s.CompressionCRFStep,
+    }
+    if err := compression.validate(); err != nil {
+        return RuntimeConfig{}, fmt.Errorf("invalid compression settings: %v", err)
+    }
+    for destination, limit := range s.MaxFileSizeMB {
+        if _, ok := defaultFileSizeLimits[destination]; !ok {
+            return RuntimeConfig{}, fmt.Errorf("invalid max_file_size_mb: unknown destination '%s'", destination)
+        }
+        if limit <= 0 {
+            return RuntimeConfig{}, fmt.Errorf("invalid max_file_size_mb for %s: must be greater than 0", destination)
+        }
+    }
+    if s.RateLimit <= 0 {
+        return RuntimeConfig{}, fmt.Errorf("invalid rate_limit: must be greater than 0")
+    }
+    if s.RateBurst < 1 {
+        return RuntimeConfig{}, fmt.Errorf("invalid rate_burst: must be 1 or greater")
+    }
+    if s.GlobalRateLimit <= 0 {
+        return RuntimeConfig{}, fmt.Errorf("invalid global_rate_limit: must be greater than 0")
+    }
+    if s.GlobalRateBurst < 1 {
+        return RuntimeConfig{}, fmt.Errorf("invalid global_rate_burst: must be 1 or greater")
+    }
+    if s.MaxRetries < 0 || s.MaxRetries > maxRetriesLimit {
+        return RuntimeConfig{}, fmt.Errorf("invalid max_retries: must be between 0 and %d", maxRetriesLimit)
+    }
+    if s.RetryBaseDelay < 0 || s.RetryMaxDelay < 0 {
+        return RuntimeConfig{}, fmt.Errorf("invalid retry delay: must be 0 or more seconds")
+    }
+    if s.RetryFactor < 1 {
+        return RuntimeConfig{}, fmt.Errorf("invalid retry_factor: must be at least 1")
+    }
+
+    return RuntimeConfig{
+        Compression:     compression,
+        FileSizeLimits:  s.MaxFileSizeMB,
+        RateLimit:       s.RateLimit,
+        RateBurst:       s.RateBurst,
+        GlobalRateLimit: s.GlobalRateLimit,
+        GlobalRateBurst: s.GlobalRateBurst,
+        MaxRetries:      s.MaxRetries,
+        RetryDelay:      time.Duration(s.RetryBaseDelay) * time.Second,
+        RetryFactor:     s.RetryFactor,
+        RetryMaxDelay:   time.Duration(s.RetryMaxDelay) * time.Second,
+    }, nil
+}
+
+// restartRequired lists the settings that only take effect after a restart, most of them because
+// changing them means restarting the recorders and losing the buffer
+func (cm *ClipManager) restartRequired() map[string]interface{} {
+    return map[string]interface{}{
+        "segment_duration":       cm.segmentDuration,
+        "segment_format":         cm.segmentFormat,
+        "max_backtrack_seconds":  cm.maxBacktrackSeconds,
+        "rtsp_transport":         cm.rtspTransport,
+        "encoder":                cm.encoder,
+        "max_concurrent_encodes": cap(cm.encodeSlots),
+        "max_concurrent_clips":   cap(cm.clipSlots),
+        "clip_queue_size":        cap(cm.clipQueue) - cap(cm.clipSlots),
+    }
+}
+
+// updateConfig applies the settings in a POST /api/config body and returns their names
+func (cm *ClipManager) updateConfig(body []byte) ([]string, error) {
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(body, &fields); err != nil {
+        return nil, fmt.Errorf("invalid request body")
     }
 
-    files, err := client.ReadDir(path)
+    restartRequired := cm.restartRequired()
+    known := map[string]bool{}
+    settingsType := reflect.TypeOf(ConfigSettings{})
+    for i := 0; i < settingsType.NumField(); i++ {
+        known[strings.Split(settingsType.Field(i).Tag.Get("json"), ",")[0]] = true
+    }
+    changed := make([]string, 0, len(fields))
+    for name := range fields {
+        if _, ok := restartRequired[name]; ok {
+            return nil, fmt.Errorf("%s can't be changed at runtime, set %s and restart ClipManager", name, strings.ToUpper(name))
+        }
+        if !known[name] {
+            return nil, fmt.Errorf("unknown setting '%s'", name)
+        }
+        changed = append(changed, name)
+    }
+    sort.Strings(changed)
+
+    // Concurrent updates are applied one after the other so neither loses the other's changes
+    cm.configMutex.Lock()
+    defer cm.configMutex.Unlock()
+
+    // Decoding over the current settings only changes the fields in the body, and adds
+    // max_file_size_mb entries to the copied limits
+    settings := configSettings(cm.config)
+    if err := json.Unmarshal(body, &settings); err != nil {
+        return nil, fmt.Errorf("invalid request body: %v", err)
+    }
+    config, err := settings.runtimeConfig()
     if err != nil {
-        return nil, fmt.Errorf("failed to read directory %s: %w", path, err)
+        return nil, err
     }
+    cm.config = config
+    cm.ipLimiters.setLimit(config.RateLimit, config.RateBurst)
+    cm.limiter.SetLimit(rate.Limit(config.GlobalRateLimit))
+    cm.limiter.SetBurst(config.GlobalRateBurst)
+    return changed, nil
+}
 
-    var clips []ClipInfo
-    for _, file := range files {
-        // Only include .mp4 files
-        if (!file.IsDir() && strings.HasSuffix(strings.ToLower(file.Name()), ".mp4")) {
-            clips = append(clips, ClipInfo{
-                Name:    file.Name(),
-                Size:    file.Size(),
-                ModTime: file.ModTime(),
-                Path:    filepath.Join(path, file.Name()),
-            })
+// HandleConfig returns the effective runtime settings on GET and changes some of them on POST.
+// A POST body holds only the settings to change; the changes last until the next restart.
+func (cm *ClipManager) HandleConfig(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPost:
+        body, err := io.ReadAll(r.Body)
+        if err != nil {
+            http.Error(w, "Invalid request body", bodyErrorStatus(err))
+            return
         }
+        changed, err := cm.updateConfig(body)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        cm.log.Info("Runtime configuration changed: %s", strings.Join(changed, ", "))
+    default:
+        http.Error(w, "Method not allowed, use GET or POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(ConfigResponse{
+        Settings:        configSettings(cm.currentConfig()),
+        RestartRequired: cm.restartRequired(),
+    })
+}
+
+// HandleReadyz reports ready (200) when FFmpeg and ffprobe are available and the clips directory is writable
+func (cm *ClipManager) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+    checks := map[string]string{}
+    ready := true
+
+    for binary, binaryPath := range map[string]string{"ffmpeg": cm.ffmpegPath, "ffprobe": cm.ffprobePath} {
+        if _, err := exec.LookPath(binaryPath); err != nil {
+            checks[binary] = err.Error()
+            ready = false
+        } else {
+            checks[binary] = "ok"
+        }
+    }
+
+    if err := checkWritable(cm.tempDir); err != nil {
+        checks["temp_dir"] = err.Error()
+        ready = false
+    } else {
+        checks["temp_dir"] = "ok"
     }
 
-    return clips, nil
+    w.Header().Set("Content-Type", "application/json")
+    if !ready {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "ready":  ready,
+        "checks": checks,
+    })
 }
 
 // WebSocket handling
@@ -1833,6 +8946,32 @@ var upgrader = websocket.Upgrader{
     },
 }
 
+// WebSocket keepalive: the server pings every wsPingInterval and drops clients that send nothing,
+// not even a pong, for wsPongWait. Writes that take longer than wsWriteWait fail.
+const (
+    wsPingInterval = 30 * time.Second
+    wsPongWait     = 60 * time.Second
+    wsWriteWait    = 10 * time.Second
+)
+
+// wsClient is a connected WebSocket client. gorilla/websocket allows only one concurrent writer
+// per connection, and broadcasts come from whichever goroutine finished a clip, so data writes
+// are serialized with writeMutex. Control frames (pings, close) use WriteControl, which is safe
+// to call concurrently.
+type wsClient struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+}
+
+// writeMessage writes one message with a deadline, waiting for any write already in progress
+func (c *wsClient) writeMessage(messageType int, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
 // HandleWebSocket manages WebSocket connections for real-time notifications
 func (cm *ClipManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
     conn, err := upgrader.Upgrade(w, r, nil)
@@ -1841,19 +8980,32 @@ func (cm *ClipManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    client := &wsClient{conn: conn}
     cm.wsClientsLock.Lock()
-    cm.wsClients[conn] = true
+    cm.wsClients[conn] = client
+    total := len(cm.wsClients)
     cm.wsClientsLock.Unlock()
 
-    cm.log.Info("New WebSocket client connected, total clients: %d", len(cm.wsClients))
+    cm.log.Info("New WebSocket client connected, total clients: %d", total)
+
+    // Any message from the client, including pongs, proves the connection is alive
+    conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    conn.SetPongHandler(func(string) error {
+        return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    })
+
+    done := make(chan struct{})
+    go cm.pingWebSocket(conn, done)
 
     // Keep the connection open and handle disconnection
     defer func() {
+        close(done)
         conn.Close()
         cm.wsClientsLock.Lock()
         delete(cm.wsClients, conn)
+        remaining := len(cm.wsClients)
         cm.wsClientsLock.Unlock()
-        cm.log.Info("WebSocket client disconnected, remaining clients: %d", len(cm.wsClients))
+        cm.log.Info("WebSocket client disconnected, remaining clients: %d", remaining)
     }()
 
     // Simple ping/pong to keep connection alive
@@ -1863,10 +9015,11 @@ func (cm *ClipManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
             cm.log.Warning("WebSocket read error: %v", err)
             break
         }
+        conn.SetReadDeadline(time.Now().Add(wsPongWait))
 
         // Handle built-in WebSocket ping frames
         if messageType == websocket.PingMessage {
-            if err := conn.WriteMessage(websocket.PongMessage, []byte{}); err != nil {
+            if err := client.writeMessage(websocket.PongMessage, []byte{}); err != nil {
                 cm.log.Warning("Failed to send pong: %v", err)
                 break
             }
@@ -1882,7 +9035,7 @@ func (cm *ClipManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
                     // Respond with a pong
                     pongResponse := map[string]string{"type": "pong"}
                     if pongData, err := json.Marshal(pongResponse); err == nil {
-                        if err := conn.WriteMessage(websocket.TextMessage, pongData); err != nil {
+                        if err := client.writeMessage(websocket.TextMessage, pongData); err != nil {
                             cm.log.Warning("Failed to send pong message: %v", err)
                             break
                         }
@@ -1893,29 +9046,115 @@ func (cm *ClipManager) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
     }
 }
 
-// broadcastNewClip sends a notification to all connected WebSocket clients
-func (cm *ClipManager) broadcastNewClip(clipPath string) {
-    cm.wsClientsLock.RLock()
-    defer cm.wsClientsLock.RUnlock()
+// pingWebSocket pings a client every wsPingInterval until done is closed. A failed ping closes
+// the connection, which ends the read loop in HandleWebSocket and removes the client.
+func (cm *ClipManager) pingWebSocket(conn *websocket.Conn, done chan struct{}) {
+    ticker := time.NewTicker(wsPingInterval)
+    defer ticker.Stop()
 
-    if len(cm.wsClients) == 0 {
-        return // No clients connected
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+            // WriteControl is safe to call concurrently with the other write methods
+            if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+                cm.log.Warning("WebSocket ping failed, closing connection: %v", err)
+                conn.Close()
+                return
+            }
+        }
     }
+}
+
+// WebSocket event types sent to web interface clients
+const (
+    EventRecordingStarted  = "recording_started"
+    EventRecordingFinished = "recording_finished"
+    EventDestinationResult = "destination_result"
+    EventClipUploaded      = "clip_uploaded"
+    EventError             = "error"
+)
+
+// WSEvent is the envelope for every event broadcast to WebSocket clients
+type WSEvent struct {
+    Type      string      `json:"type"`
+    Timestamp time.Time   `json:"timestamp"`
+    Payload   interface{} `json:"payload"`
+}
+
+// ClipEventPayload describes the clip an event is about. Fields that don't apply to an event are omitted.
+type ClipEventPayload struct {
+    RequestID        string     `json:"request_id,omitempty"`
+    CameraID         string     `json:"camera_id,omitempty"`
+    ClipPath         string     `json:"clip_path,omitempty"`
+    Destination      string     `json:"destination,omitempty"`
+    Success          *bool      `json:"success,omitempty"`
+    Error            string     `json:"error,omitempty"`
+    BacktrackSeconds float64    `json:"backtrack_seconds,omitempty"`
+    DurationSeconds  float64    `json:"duration_seconds,omitempty"`
+    FileSizeBytes    int64      `json:"file_size_bytes,omitempty"`
+    StartTime        *time.Time `json:"start_time,omitempty"`
+    EndTime          *time.Time `json:"end_time,omitempty"`
+    Gaps             []ClipGap  `json:"gaps,omitempty"`
+}
+
+// broadcastClipEvent broadcasts an event about a clip request, filling in its request and camera ID
+func (cm *ClipManager) broadcastClipEvent(eventType string, req *ClipRequest, payload ClipEventPayload) {
+    payload.RequestID = req.RequestID
+    payload.CameraID = req.CameraID
+    cm.broadcastEvent(eventType, payload)
+}
+
+// broadcastNewClip tells WebSocket clients that a clip is available at a destination
+func (cm *ClipManager) broadcastNewClip(destination, clipPath string, req *ClipRequest) {
+    cm.broadcastClipEvent(EventClipUploaded, req, ClipEventPayload{ClipPath: clipPath, Destination: destination})
+}
 
-    notification := map[string]string{"clip_path": clipPath}
-    message, err := json.Marshal(notification)
+// broadcastEvent sends an event to all connected WebSocket clients
+func (cm *ClipManager) broadcastEvent(eventType string, payload interface{}) {
+    message, err := json.Marshal(WSEvent{Type: eventType, Timestamp: time.Now(), Payload: payload})
     if err != nil {
-        cm.log.Error("Failed to marshal WebSocket notification: %v", err)
+        cm.log.Error("Failed to marshal WebSocket event: %v", err)
+        return
+    }
+
+    var failed []*websocket.Conn
+    cm.wsClientsLock.RLock()
+    if len(cm.wsClients) > 0 {
+        cm.log.Info("Broadcasting %s event to %d clients", eventType, len(cm.wsClients))
+    }
+    for conn, client := range cm.wsClients {
+        if err := client.writeMessage(websocket.TextMessage, message); err != nil {
+            cm.log.Warning("Failed to send WebSocket message, dropping client: %v", err)
+            failed = append(failed, conn)
+        }
+    }
+    cm.wsClientsLock.RUnlock()
+
+    if len(failed) == 0 {
         return
     }
 
-    cm.log.Info("Broadcasting new clip notification to %d clients", len(cm.wsClients))
+    // The read loop of a dead connection may never return, so don't wait for it to clean up
+    cm.wsClientsLock.Lock()
+    for _, client := range failed {
+        delete(cm.wsClients, client)
+        client.Close()
+    }
+    cm.wsClientsLock.Unlock()
+}
+
+// closeWebSocketClients sends a close frame to all WebSocket clients and disconnects them
+func (cm *ClipManager) closeWebSocketClients() {
+    cm.wsClientsLock.Lock()
+    defer cm.wsClientsLock.Unlock()
+
+    closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
     for client := range cm.wsClients {
-        err := client.WriteMessage(websocket.TextMessage, message)
-        if err != nil {
-            cm.log.Warning("Failed to send WebSocket message: %v", err)
-            // Let the main goroutine handle the disconnection
-        }
+        client.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+        client.Close()
+        delete(cm.wsClients, client)
     }
 }
 
@@ -1931,18 +9170,20 @@ func (cm *ClipManager) HandleEditClip(w http.ResponseWriter, r *http.Request) {
         SFTPPort     string `json:"sftp_port"`
         SFTPUser     string `json:"sftp_user"`
         SFTPPassword string `json:"sftp_password"`
+        SFTPPrivateKey string `json:"sftp_private_key"`
+        SFTPPassphrase string `json:"sftp_passphrase"`
         Path         string `json:"path"`
         Title        string `json:"title"`
         Category     string `json:"category"`
     }
 
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        http.Error(w, "Invalid request body", bodyErrorStatus(err))
         cm.log.Error("Failed to parse edit request: %v", err)
         return
     }
 
-    client, err := cm.connectToSFTP(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword)
+    client, err := cm.connectToSFTP(req.SFTPHost, req.SFTPPort, req.SFTPUser, req.SFTPPassword, req.SFTPPrivateKey, req.SFTPPassphrase)
     if err != nil {
         http.Error(w, fmt.Sprintf("Failed to connect to SFTP: %v", err), http.StatusInternalServerError)
         return
@@ -1954,7 +9195,7 @@ func (cm *ClipManager) HandleEditClip(w http.ResponseWriter, r *http.Request) {
     oldDir := filepath.Dir(req.Path)
     
     // Extract the timestamp part using regex
-    re := regexp.MustCompile(`(\d{4}-\d{2}-\d{2}_\d{2}-\d{2})\.mp4$`)
+    re := regexp.MustCompile(`(\d{4}-\d{2}-\d{2}_\d{2}-\d{2})\.(?:mp4|mkv|webm)$`)
     matches := re.FindStringSubmatch(oldName)
     if len(matches) < 2 {
         http.Error(w, "Failed to parse timestamp from filename", http.StatusBadRequest)
@@ -1962,49 +9203,12 @@ func (cm *ClipManager) HandleEditClip(w http.ResponseWriter, r *http.Request) {
     }
     timestamp := matches[1]
     
-    // Parse original filename to get team information
-    fileInfo := parseFileName(oldName)
-    
-    // Sanitize inputs
-    sanitize := func(s string) string {
-        reg, _ := regexp.Compile("[^a-zA-Z0-9_-]+")
-        return reg.ReplaceAllString(strings.TrimSpace(s), "_")
-    }
-    
-    title := sanitize(req.Title)
-    category := sanitize(req.Category)
-    
-    // Use each field as fallback for the other if one is empty
-    if title == "" && category != "" {
-        title = category
-    } else if category == "" && title != "" {
-        category = title
-    }
-    
-    // Create new filename
-    var parts []string
-    
-    // Add title if it exists
-    if title != "" {
-        parts = append(parts, title)
-    }
-    
-    // Add category if it exists
-    if category != "" {
-        parts = append(parts, category)
+    // Keep the teams from the original filename
+    fileInfo, _ := parseClipFilename(oldName)
+    newFilename := timestamp + filepath.Ext(oldName)
+    if prefix := clipNamePrefix(req.Title, req.Category, fileInfo.Team1, fileInfo.Team2); prefix != "" {
+        newFilename = prefix + clipNameSeparator + newFilename
     }
-    
-    // Add team information if available
-    if fileInfo.Team1 != "" && fileInfo.Team2 != "" {
-        parts = append(parts, fmt.Sprintf("%s_vs_%s", fileInfo.Team1, fileInfo.Team2))
-    } else if fileInfo.Team1 != "" {
-        parts = append(parts, fileInfo.Team1)
-    } else if fileInfo.Team2 != "" {
-        parts = append(parts, fileInfo.Team2)
-    }
-    
-    // Add timestamp
-    newFilename := fmt.Sprintf("%s_%s.mp4", strings.Join(parts, "_"), timestamp)
     newPath := filepath.Join(oldDir, newFilename)
     
     // Rename the file
@@ -2024,61 +9228,6 @@ func (cm *ClipManager) HandleEditClip(w http.ResponseWriter, r *http.Request) {
     })
 }
 
-// FileInfo represents parsed information from a filename
-type FileInfo struct {
-    Title    string
-    Category string
-    Team1    string
-    Team2    string
-}
-
-// parseFileName extracts metadata from a filename
-func parseFileName(filename string) FileInfo {
-    // Remove .mp4 extension and split by underscore
-    parts := strings.Split(strings.TrimSuffix(filename, ".mp4"), "_")
-    
-    // Find date part (format: YYYY-MM-DD)
-    dateIndex := -1
-    for i, part := range parts {
-        if regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`).MatchString(part) {
-            dateIndex = i
-            break
-        }
-    }
-    
-    if dateIndex == -1 {
-        return FileInfo{}
-    }
-    
-    var info FileInfo
-    
-    if dateIndex > 0 {
-        // First part is the title in the new format
-        info.Title = parts[0]
-        
-        // If we have at least 3 parts before the date (title, category, and something else)
-        if dateIndex > 1 {
-            // Second part is the category
-            info.Category = parts[1]
-            
-            // Check for team vs team format in the remaining parts
-            remainingParts := strings.Join(parts[2:dateIndex], "_")
-            teamMatch := regexp.MustCompile(`(.+)_vs_(.+)`).FindStringSubmatch(remainingParts)
-            
-            if len(teamMatch) > 2 {
-                info.Team1 = teamMatch[1]
-                info.Team2 = teamMatch[2]
-            } else if dateIndex > 2 {
-                // If no vs pattern but there are parts between category and date,
-                // assume it's just team1
-                info.Team1 = remainingParts
-            }
-        }
-    }
-    
-    return info
-}
-
 func main() {
 	log.Println("Starting ClipManager...")
 
@@ -2086,9 +9235,18 @@ func main() {
 		log.Printf("Warning: Error loading .env file: %v", err)
 	}
 
-	cameraIP := os.Getenv("CAMERA_IP")
-	if cameraIP == "" {
-		log.Fatal("CAMERA_IP environment variable must be set")
+	cameraURLs := getCameraURLs()
+	if len(cameraURLs) == 0 {
+		log.Fatal("CAMERA_IP or at least one CAMERA_IP_<ID> environment variable must be set")
+	}
+
+	// Fail fast on a missing or broken FFmpeg instead of on the first recording attempt
+	for _, binary := range []struct{ path, envVar string }{{getFFmpegPath(), "FFMPEG_PATH"}, {getFFprobePath(), "FFPROBE_PATH"}} {
+		version, err := binaryVersion(binary.path)
+		if err != nil {
+			log.Fatalf("Could not run '%s' (set %s to the binary's location): %v", binary.path, binary.envVar, err)
+		}
+		log.Printf("Using %s (%s)", version, binary.path)
 	}
 
 	containerPort := "5000"
@@ -2097,25 +9255,91 @@ func main() {
 		log.Fatal("HOST_PORT environment variable must be set")
 	}
 
-	clipManager, err := NewClipManager("clips", hostPort, cameraIP)
+	// Serve HTTPS when a certificate is configured, so credentials in requests are encrypted in transit
+	tlsCertFile, tlsKeyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	useTLS := tlsCertFile != ""
+	if useTLS {
+		if _, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile); err != nil {
+			log.Fatalf("Could not load the TLS certificate from TLS_CERT_FILE and TLS_KEY_FILE: %v", err)
+		}
+	}
+	redirectPort := os.Getenv("HTTP_REDIRECT_PORT")
+	if redirectPort != "" && !useTLS {
+		log.Printf("Warning: HTTP_REDIRECT_PORT is set without TLS_CERT_FILE and TLS_KEY_FILE, not redirecting")
+		redirectPort = ""
+	}
+
+	clipManager, err := NewClipManager(getClipsDir(), hostPort, cameraURLs)
 	if err != nil {
 		log.Fatalf("Failed to initialize ClipManager: %v", err)
 	}
 
-	go clipManager.StartBackgroundRecording()
+	if clipManager.sftpKnownHosts != "" {
+		clipManager.log.Info("Verifying SFTP host keys against %s", clipManager.sftpKnownHosts)
+	} else if clipManager.sftpInsecure {
+		clipManager.log.Warning("SFTP_INSECURE is enabled, SFTP host keys will not be verified")
+	}
+
+	if err := clipManager.checkEncoders(); err != nil {
+		log.Fatalf("FFmpeg preflight check failed: %v", err)
+	}
+	clipManager.log.Info("Compressing clips with %s", clipManager.encoder)
+	clipManager.log.Info("Using RTSP transport %s", clipManager.rtspTransport)
+
+	if clipManager.keepLocalClips {
+		clipManager.log.Info("Keeping a local copy of every clip in %s", clipManager.archiveDir)
+	}
+
+	if clipManager.apiKey != "" {
+		clipManager.log.Info("API key authentication is enabled")
+	} else {
+		clipManager.log.Warning("API_KEY is not set, the API is open to anyone who can reach this port")
+	}
+
+	clipManager.log.Info("Recording %d-second segments, keeping up to %d segments per camera (%d seconds of backtrack)",
+		clipManager.segmentDuration, clipManager.maxSegments, clipManager.maxBacktrackSeconds)
 
-	os.MkdirAll("templates", 0755)
-	os.MkdirAll("static/css", 0755)
-	os.MkdirAll("static/img", 0755)
+	for _, cam := range clipManager.cameras {
+		clipManager.log.Info("Configured camera '%s'", cam.ID)
+		clipManager.StartBackgroundRecording(clipManager.ctx, cam)
+	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	http.HandleFunc("/api/clip", clipManager.RateLimit(clipManager.HandleClipRequest))
-	http.HandleFunc("/api/clips", clipManager.RateLimit(clipManager.HandleListClips))
-	http.HandleFunc("/api/clips/test", clipManager.RateLimit(clipManager.HandleTestSFTPConnection))
-	http.HandleFunc("/api/clips/delete", clipManager.RateLimit(clipManager.HandleDeleteClip))
-	http.HandleFunc("/api/clips/edit", clipManager.RateLimit(clipManager.HandleEditClip))
-	http.HandleFunc("/api/clip/stream", clipManager.RateLimit(clipManager.HandleStreamClip))
-	http.HandleFunc("/ws", clipManager.HandleWebSocket)
+	staticDir := getStaticDir()
+	os.MkdirAll(clipManager.templatesDir, 0755)
+	os.MkdirAll(filepath.Join(staticDir, "css"), 0755)
+	os.MkdirAll(filepath.Join(staticDir, "img"), 0755)
+
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
+	http.HandleFunc("/api/clip", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleClipRequest))))
+	http.HandleFunc("/api/clips", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleListClips))))
+	http.HandleFunc("/api/clips/test", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleTestSFTPConnection))))
+	http.HandleFunc("/api/clips/delete", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleDeleteClip))))
+	http.HandleFunc("/api/clips/edit", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleEditClip))))
+	http.HandleFunc("/api/clip/status", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleClipStatus))))
+	http.HandleFunc("/api/clip/info", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleClipInfo))))
+	http.HandleFunc("/api/clip/thumbnail", clipManager.RateLimit(clipManager.HandleClipThumbnail)) // Authenticated by its stream token
+	http.HandleFunc("/api/clip/token", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleStreamToken))))
+	http.HandleFunc("/api/clip/stream", clipManager.RateLimit(clipManager.HandleStreamClip)) // Authenticated by its stream token
+	http.HandleFunc("/api/schedule", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleCreateSchedule))))
+	http.HandleFunc("/api/schedules", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleListSchedules))))
+	http.HandleFunc("/api/schedule/cancel", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleCancelSchedule))))
+	http.HandleFunc("/api/recording/start", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleRecording))))
+	http.HandleFunc("/api/recording/stop", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleRecording))))
+	http.HandleFunc("/api/recording/restart", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleRecording))))
+	http.HandleFunc("/api/preview", clipManager.RequireAPIKey(clipManager.RateLimit(clipManager.HandlePreview)))
+	http.HandleFunc("/api/segments", clipManager.RequireAPIKey(GzipJSON(clipManager.HandleSegments)))
+	http.HandleFunc("/api/tracks", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleTracks))))
+	http.HandleFunc("/api/buffer/status", clipManager.RequireAPIKey(GzipJSON(clipManager.HandleBufferStatus)))
+	http.HandleFunc("/api/buffer/download", clipManager.RequireAPIKey(clipManager.RateLimit(clipManager.HandleBufferDownload)))
+	http.HandleFunc("/ws", clipManager.RequireAPIKey(clipManager.HandleWebSocket))
+	http.HandleFunc("/api/auth/token", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleAuthToken))))
+	http.HandleFunc("/api/config", clipManager.RequireAPIKey(clipManager.RateLimit(GzipJSON(clipManager.HandleConfig))))
+	http.HandleFunc("/healthz", clipManager.RequireAPIKey(GzipJSON(clipManager.HandleHealthz)))
+	http.HandleFunc("/readyz", clipManager.RequireAPIKey(GzipJSON(clipManager.HandleReadyz)))
+	http.HandleFunc("/metrics", clipManager.RequireAPIKey(clipManager.HandleMetrics))
 	http.HandleFunc("/", clipManager.serveWebInterface)
 	
 	// OAuth2 callback handler for YouTube integration
@@ -2211,11 +9435,85 @@ func main() {
 		clipManager.log.Success("YouTube OAuth2 authorization complete")
 	})
 
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
 	clipManager.log.Info("ClipManager is running!")
-	clipManager.log.Info("Access the web interface at: http://localhost:%s/", hostPort)
-	clipManager.log.Info("API endpoint available at: http://localhost:%s/api/clip", hostPort)
+	clipManager.log.Info("Access the web interface at: %s://localhost:%s/", scheme, hostPort)
+	clipManager.log.Info("API endpoint available at: %s://localhost:%s/api/clip", scheme, hostPort)
+
+	server := &http.Server{
+		Addr:         ":" + containerPort,
+		Handler:      clipManager.LimitRequestBody(http.DefaultServeMux),
+		ReadTimeout:  time.Duration(getEnvInt("HTTP_READ_TIMEOUT", defaultHTTPReadTimeout)) * time.Second,
+		WriteTimeout: clipManager.writeTimeout,
+		IdleTimeout:  time.Duration(getEnvInt("HTTP_IDLE_TIMEOUT", defaultHTTPIdleTimeout)) * time.Second,
+	}
+
+	go func() {
+		var err error
+		if useTLS {
+			err = server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+
+	var redirectServer *http.Server
+	if redirectPort != "" {
+		redirectServer = &http.Server{
+			Addr:         ":" + redirectPort,
+			Handler:      httpsRedirect(hostPort),
+			ReadTimeout:  server.ReadTimeout,
+			WriteTimeout: server.WriteTimeout,
+			IdleTimeout:  server.IdleTimeout,
+		}
+		clipManager.log.Info("Redirecting plain HTTP on port %s to HTTPS", redirectPort)
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("HTTP redirect server error: %v", err)
+			}
+		}()
+	}
+
+	// Wait for SIGINT/SIGTERM, then stop accepting requests and drain in-flight clips
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	clipManager.log.Info("Shutdown signal received")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		clipManager.log.Warning("HTTP server shutdown error: %v", err)
+	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+
+	clipManager.Shutdown(shutdownTimeout)
+}
 
-	log.Fatal(http.ListenAndServe(":"+containerPort, nil))
+// httpsRedirect redirects every request to the same URL over HTTPS on httpsPort, the port clients
+// reach the HTTPS server on. 308 keeps the method, so API clients repeat POSTs on HTTPS.
+func httpsRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
 }
 
 func getHostPort() string {
@@ -2224,4 +9522,576 @@ func getHostPort() string {
 		return "5001"
 	}
 	return hostPort
-}
\ No newline at end of file
+}
+
+// getCameraURLs collects camera streams from CAMERA_IP (camera "default") and CAMERA_IP_<ID> variables
+func getCameraURLs() map[string]string {
+	cameras := make(map[string]string)
+
+	if cameraIP := os.Getenv("CAMERA_IP"); cameraIP != "" {
+		cameras["default"] = cameraIP
+	}
+
+	for _, env := range os.Environ() {
+		key, value, found := strings.Cut(env, "=")
+		if !found || value == "" || !strings.HasPrefix(key, "CAMERA_IP_") {
+			continue
+		}
+		id := strings.ToLower(strings.TrimPrefix(key, "CAMERA_IP_"))
+		if id != "" {
+			cameras[id] = value
+		}
+	}
+
+	return cameras
+}
+
+// getCameraTrack returns which video or audio track the camera records from prefix (camera "default")
+// or prefix_<ID): a track number, "all" for every track, or trackDefault when unset
+func getCameraTrack(prefix, cameraID string) int {
+	key := prefix
+	if cameraID != "default" {
+		key = prefix + "_" + strings.ToUpper(cameraID)
+	}
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	if value == "" {
+		return trackDefault
+	}
+	if value == "all" {
+		return trackAll
+	}
+
+	track, err := strconv.Atoi(value)
+	if err != nil || track < 0 {
+		log.Printf("Warning: Invalid %s '%s' (must be a track number of 0 or more, or all), using the default track", key, value)
+		return trackDefault
+	}
+	return track
+}
+
+// getPlaceholder returns the video generated for audio-only cameras from PLACEHOLDER_SIZE,
+// PLACEHOLDER_FRAMERATE, PLACEHOLDER_COLOR and PLACEHOLDER_IMAGE
+func getPlaceholder() Placeholder {
+	placeholder := Placeholder{
+		Size:      defaultPlaceholderSize,
+		Framerate: defaultPlaceholderFramerate,
+		Color:     defaultPlaceholderColor,
+	}
+
+	if value := os.Getenv("PLACEHOLDER_SIZE"); value != "" {
+		if _, _, err := parsePlaceholderSize(value); err != nil {
+			log.Printf("Warning: Invalid PLACEHOLDER_SIZE %v, using %s", err, defaultPlaceholderSize)
+		} else {
+			placeholder.Size = value
+		}
+	}
+
+	if value := os.Getenv("PLACEHOLDER_FRAMERATE"); value != "" {
+		framerate, err := strconv.Atoi(value)
+		if err != nil || framerate < 1 || framerate > maxPlaceholderFramerate {
+			log.Printf("Warning: Invalid PLACEHOLDER_FRAMERATE '%s' (must be 1-%d), using %d", value, maxPlaceholderFramerate, defaultPlaceholderFramerate)
+		} else {
+			placeholder.Framerate = framerate
+		}
+	}
+
+	if value := os.Getenv("PLACEHOLDER_COLOR"); value != "" {
+		if !placeholderColorPattern.MatchString(value) {
+			log.Printf("Warning: Invalid PLACEHOLDER_COLOR '%s' (must be a color name or hex like #1a1a2e), using %s", value, defaultPlaceholderColor)
+		} else {
+			placeholder.Color = value
+		}
+	}
+
+	if value := os.Getenv("PLACEHOLDER_IMAGE"); value != "" {
+		if _, err := os.Stat(value); err != nil {
+			log.Printf("Warning: PLACEHOLDER_IMAGE '%s' can't be read (%v), using a solid color", value, err)
+		} else {
+			placeholder.Image = value
+		}
+	}
+
+	return placeholder
+}
+
+// getOutboundProxy returns the proxy for outbound HTTP requests from OUTBOUND_PROXY, or nil to
+// use HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func getOutboundProxy() *url.URL {
+	value := strings.TrimSpace(os.Getenv("OUTBOUND_PROXY"))
+	if value == "" {
+		return nil
+	}
+
+	proxy, err := url.Parse(value)
+	if err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5") || proxy.Host == "" {
+		log.Printf("Warning: Invalid OUTBOUND_PROXY (must be an http, https or socks5 URL like http://proxy:3128), using HTTP_PROXY/HTTPS_PROXY")
+		return nil
+	}
+	log.Printf("Sending outbound HTTP requests through proxy %s", proxy.Redacted())
+	return proxy
+}
+
+// getAllowedPrivateNetworks returns the private networks callback_url and webhook_url may reach
+// from ALLOWED_PRIVATE_NETWORKS, a comma separated list of CIDRs or single addresses
+func getAllowedPrivateNetworks() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("ALLOWED_PRIVATE_NETWORKS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidr := entry
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Warning: Invalid ALLOWED_PRIVATE_NETWORKS entry '%s' (must be a CIDR like 192.168.1.0/24 or an address), ignoring it", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// getSegmentDuration returns the segment length in seconds from SEGMENT_DURATION (default 5)
+func getSegmentDuration() int {
+	value := os.Getenv("SEGMENT_DURATION")
+	if value == "" {
+		return defaultSegmentDuration
+	}
+
+	duration, err := strconv.Atoi(value)
+	if err != nil || duration < minSegmentDuration || duration > maxSegmentDuration {
+		log.Printf("Warning: Invalid SEGMENT_DURATION '%s' (must be %d-%d seconds), using %d seconds",
+			value, minSegmentDuration, maxSegmentDuration, defaultSegmentDuration)
+		return defaultSegmentDuration
+	}
+	return duration
+}
+
+// getCleanOnStart returns the startup cleanup mode from CLEAN_ON_START: stale (default) removes
+// files from a previous run that are older than the rewind window, all empties the buffer and
+// none keeps everything
+func getCleanOnStart() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("CLEAN_ON_START")))
+	switch value {
+	case "", "stale", "true", "1", "yes":
+		return "stale"
+	case "all":
+		return "all"
+	case "none", "false", "0", "no":
+		return "none"
+	default:
+		log.Printf("Warning: Invalid CLEAN_ON_START '%s' (must be stale, all or none), using stale", value)
+		return "stale"
+	}
+}
+
+// getSegmentFormat returns the segment container from SEGMENT_FORMAT: mpegts (default) or mp4,
+// which records fragmented MP4 segments and suits H.265 cameras better
+func getSegmentFormat() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("SEGMENT_FORMAT")))
+	switch value {
+	case "", "mpegts", "ts":
+		return "mpegts"
+	case "mp4", "fmp4":
+		return "mp4"
+	default:
+		log.Printf("Warning: Invalid SEGMENT_FORMAT '%s' (must be mpegts or mp4), using mpegts", value)
+		return "mpegts"
+	}
+}
+
+// segmentExtension returns the file extension of segments in the given format
+func segmentExtension(format string) string {
+	if format == "mp4" {
+		return ".mp4"
+	}
+	return ".ts"
+}
+
+// getDefaultClipSeconds returns the clip default in seconds from key, or 0 when it is unset or
+// outside min-max. Fractions of a second are allowed.
+func getDefaultClipSeconds(key string, min, max float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds < min || seconds > max {
+		log.Printf("Warning: Invalid %s '%s' (must be %g-%g seconds), ignoring it", key, value, min, max)
+		return 0
+	}
+	return seconds
+}
+
+// getMaxBacktrackSeconds returns the backtrack window in seconds from MAX_BACKTRACK_SECONDS (default 300)
+func getMaxBacktrackSeconds() int {
+	value := os.Getenv("MAX_BACKTRACK_SECONDS")
+	if value == "" {
+		return defaultMaxBacktrackSeconds
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < minMaxBacktrackSeconds || seconds > maxMaxBacktrackSeconds {
+		log.Printf("Warning: Invalid MAX_BACKTRACK_SECONDS '%s' (must be %d-%d seconds), using %d seconds",
+			value, minMaxBacktrackSeconds, maxMaxBacktrackSeconds, defaultMaxBacktrackSeconds)
+		return defaultMaxBacktrackSeconds
+	}
+	return seconds
+}
+
+// getAPIKeyExemptPaths returns the paths from API_KEY_EXEMPT (comma-separated, e.g. /healthz,/metrics)
+// that are served without an API key
+func getAPIKeyExemptPaths() map[string]bool {
+	exempt := make(map[string]bool)
+	for _, path := range strings.Split(os.Getenv("API_KEY_EXEMPT"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			exempt[path] = true
+		}
+	}
+	return exempt
+}
+
+// getRTSPTransport returns the RTSP transport from RTSP_TRANSPORT (default tcp)
+func getRTSPTransport() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("RTSP_TRANSPORT")))
+	switch value {
+	case "":
+		return "tcp"
+	case "tcp", "udp", "udp_multicast", "http":
+		return value
+	default:
+		log.Printf("Warning: Invalid RTSP_TRANSPORT '%s' (must be tcp, udp, udp_multicast or http), using tcp", value)
+		return "tcp"
+	}
+}
+
+// getEncoder returns the video encoder from ENCODER (default libx264).
+// Hardware encoders that this FFmpeg build doesn't provide fall back to libx264.
+func getEncoder(ffmpegPath string) string {
+	encoder := strings.ToLower(strings.TrimSpace(os.Getenv("ENCODER")))
+	switch encoder {
+	case "", "libx264":
+		return "libx264"
+	case "h264_nvenc", "h264_qsv", "h264_vaapi":
+	default:
+		log.Printf("Warning: Invalid ENCODER '%s' (must be libx264, h264_nvenc, h264_qsv or h264_vaapi), using libx264", encoder)
+		return "libx264"
+	}
+
+	encoders, err := listEncoders(ffmpegPath)
+	if err != nil {
+		log.Printf("Warning: Could not list FFmpeg encoders (%v), using libx264", err)
+		return "libx264"
+	}
+	if encoders[encoder] {
+		return encoder
+	}
+
+	log.Printf("Warning: ENCODER '%s' is not available in this FFmpeg build, using libx264", encoder)
+	return "libx264"
+}
+
+// listEncoders returns the names of the encoders this FFmpeg build provides
+func listEncoders(ffmpegPath string) (map[string]bool, error) {
+	out, err := exec.Command(ffmpegPath, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	encoders := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders, nil
+}
+
+// getFFmpegPath returns the FFmpeg binary from FFMPEG_PATH (default "ffmpeg", looked up on PATH)
+func getFFmpegPath() string {
+	if path := strings.TrimSpace(os.Getenv("FFMPEG_PATH")); path != "" {
+		return path
+	}
+	return "ffmpeg"
+}
+
+// getFFprobePath returns the ffprobe binary from FFPROBE_PATH (default "ffprobe", looked up on PATH)
+func getFFprobePath() string {
+	if path := strings.TrimSpace(os.Getenv("FFPROBE_PATH")); path != "" {
+		return path
+	}
+	return "ffprobe"
+}
+
+// binaryVersion runs the binary with -version and returns the first line of its output,
+// which fails when the binary is missing or not executable
+func binaryVersion(binary string) (string, error) {
+	out, err := exec.Command(binary, "-version").Output()
+	if err != nil {
+		return "", err
+	}
+	version := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	if i := strings.Index(version, " Copyright"); i >= 0 {
+		version = version[:i]
+	}
+	return version, nil
+}
+
+// getClipsDir returns the directory for segments and clips in progress from CLIPS_DIR (default "clips")
+func getClipsDir() string {
+	if dir := os.Getenv("CLIPS_DIR"); dir != "" {
+		return dir
+	}
+	return "clips"
+}
+
+// getTemplatesDir returns the web interface template directory from TEMPLATES_DIR (default "templates")
+func getTemplatesDir() string {
+	if dir := os.Getenv("TEMPLATES_DIR"); dir != "" {
+		return dir
+	}
+	return "templates"
+}
+
+// getStaticDir returns the directory served under /static/ from STATIC_DIR (default "static")
+func getStaticDir() string {
+	if dir := os.Getenv("STATIC_DIR"); dir != "" {
+		return dir
+	}
+	return "static"
+}
+
+// getSFTPKeyDir returns the absolute directory that requests may name SFTP private key files
+// from (SFTP_KEY_DIR), or "" when only inline keys are accepted
+func getSFTPKeyDir() string {
+	dir := strings.TrimSpace(os.Getenv("SFTP_KEY_DIR"))
+	if dir == "" {
+		return ""
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Printf("Warning: Invalid SFTP_KEY_DIR '%s' (%v), only inline private keys are accepted", dir, err)
+		return ""
+	}
+	return absDir
+}
+
+// getArchiveDir returns the directory for kept clips from ARCHIVE_DIR (default "archive")
+func getArchiveDir() string {
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		return dir
+	}
+	return "archive"
+}
+
+// getEnvInt returns a non-negative integer environment variable, or fallback when unset or invalid
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		log.Printf("Warning: Invalid %s '%s' (must be 0 or greater), using %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvBool reports whether the environment variable is set to a true value (true, 1, yes)
+func getEnvBool(key string) bool {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	return value == "true" || value == "1" || value == "yes"
+}
+
+// getRateLimit returns a limit in requests per second from the environment variable name
+func getRateLimit(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	limit, err := strconv.ParseFloat(value, 64)
+	if err != nil || limit <= 0 {
+		log.Printf("Warning: Invalid %s '%s' (must be a number greater than 0), using %g", name, value, fallback)
+		return fallback
+	}
+	return limit
+}
+
+// getRateBurst returns how many requests may be made at once from the environment variable name
+func getRateBurst(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	burst, err := strconv.Atoi(value)
+	if err != nil || burst < 1 {
+		log.Printf("Warning: Invalid %s '%s' (must be 1 or greater), using %d", name, value, fallback)
+		return fallback
+	}
+	return burst
+}
+
+// getMaxConcurrentClips returns how many clip requests are processed at once from MAX_CONCURRENT_CLIPS
+func getMaxConcurrentClips() int {
+	value := os.Getenv("MAX_CONCURRENT_CLIPS")
+	if value == "" {
+		return defaultMaxConcurrentClips
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		log.Printf("Warning: Invalid MAX_CONCURRENT_CLIPS '%s' (must be 1 or greater), using %d", value, defaultMaxConcurrentClips)
+		return defaultMaxConcurrentClips
+	}
+	return limit
+}
+
+// getMaxConcurrentEncodes returns how many FFmpeg encodes may run at once from MAX_CONCURRENT_ENCODES,
+// by default half the CPUs since libx264 already uses several threads per encode
+func getMaxConcurrentEncodes() int {
+	fallback := runtime.NumCPU() / 2
+	if fallback < 1 {
+		fallback = 1
+	}
+
+	value := os.Getenv("MAX_CONCURRENT_ENCODES")
+	if value == "" {
+		return fallback
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		log.Printf("Warning: Invalid MAX_CONCURRENT_ENCODES '%s' (must be 1 or greater), using %d", value, fallback)
+		return fallback
+	}
+	return limit
+}
+
+// getStreamTokenTTL returns how long stream tokens stay valid from STREAM_TOKEN_TTL in seconds
+func getStreamTokenTTL() time.Duration {
+	value := os.Getenv("STREAM_TOKEN_TTL")
+	if value == "" {
+		return defaultStreamTokenTTL * time.Second
+	}
+
+	ttl, err := strconv.Atoi(value)
+	if err != nil || ttl < 1 {
+		log.Printf("Warning: Invalid STREAM_TOKEN_TTL '%s' (must be 1 or greater), using %d", value, defaultStreamTokenTTL)
+		return defaultStreamTokenTTL * time.Second
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// defaultFileSizeLimits are the upload limits of each destination in MB
+var defaultFileSizeLimits = map[string]float64{
+	"discord":    10.0,
+	"telegram":   50.0,
+	"mattermost": 100.0,
+	"sftp":       10000.0, // High value to avoid compression for SFTP
+	"slack":      1000.0,
+	"s3":         5000.0,  // S3 single PUT limit is 5 GB
+	"youtube":    10000.0, // High value to avoid compression, YouTube transcodes uploads itself
+	"email":      18.0,    // Stays under the common 25 MB message limit after base64 encoding
+	"webhook":    100.0,
+}
+
+// defaultDestinationTimeouts bound each send attempt to a destination in seconds, upload included.
+// Destinations with small size limits fail fast, those that take large clips get more time.
+var defaultDestinationTimeouts = map[string]int{
+	"discord":    60,
+	"telegram":   120,
+	"email":      120,
+	"mattermost": 300,
+	"slack":      300,
+	"webhook":    300,
+	"sftp":       1800,
+	"s3":         1800,
+	"youtube":    1800,
+}
+
+// getDestinationTimeouts returns the timeout per destination, overridden by <DESTINATION>_TIMEOUT
+// in seconds (0 = no timeout)
+func getDestinationTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, len(defaultDestinationTimeouts))
+	for destination, fallback := range defaultDestinationTimeouts {
+		key := strings.ToUpper(destination) + "_TIMEOUT"
+		timeouts[destination] = time.Duration(getEnvInt(key, fallback)) * time.Second
+	}
+	return timeouts
+}
+
+// getFileSizeLimits returns the size limit per destination, overridden by <DESTINATION>_MAX_FILE_SIZE_MB
+// (e.g. DISCORD_MAX_FILE_SIZE_MB=50 for a boosted Discord server)
+func getFileSizeLimits() map[string]float64 {
+	limits := make(map[string]float64, len(defaultFileSizeLimits))
+	for destination, fallback := range defaultFileSizeLimits {
+		key := strings.ToUpper(destination) + "_MAX_FILE_SIZE_MB"
+		limits[destination] = fallback
+
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || limit <= 0 {
+			log.Printf("Warning: Invalid %s '%s' (must be a number greater than 0), using %g", key, value, fallback)
+			continue
+		}
+		limits[destination] = limit
+	}
+	return limits
+}
+
+// getRetryFactor returns the retry backoff multiplier from RETRY_FACTOR (default 2, at least 1)
+func getRetryFactor() float64 {
+	value := os.Getenv("RETRY_FACTOR")
+	if value == "" {
+		return defaultRetryFactor
+	}
+
+	factor, err := strconv.ParseFloat(value, 64)
+	if err != nil || factor < 1 {
+		log.Printf("Warning: Invalid RETRY_FACTOR '%s' (must be a number of at least 1), using %g", value, defaultRetryFactor)
+		return defaultRetryFactor
+	}
+	return factor
+}
+
+// getCompressionSettings returns the mode from COMPRESSION_MODE (default crf) and the CRF range from
+// COMPRESSION_CRF_START, COMPRESSION_CRF_MAX and COMPRESSION_CRF_STEP (default 23, 40 and 5)
+func getCompressionSettings() CompressionSettings {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("COMPRESSION_MODE")))
+	if mode == "" {
+		mode = compressionModeCRF
+	}
+	if mode != compressionModeCRF && mode != compressionModeBitrate {
+		log.Printf("Warning: Invalid COMPRESSION_MODE '%s' (must be %s or %s), using %s", mode, compressionModeCRF, compressionModeBitrate, compressionModeCRF)
+		mode = compressionModeCRF
+	}
+
+	settings := CompressionSettings{
+		Mode:       mode,
+		InitialCRF: getEnvInt("COMPRESSION_CRF_START", defaultInitialCRF),
+		MaxCRF:     getEnvInt("COMPRESSION_CRF_MAX", defaultMaxCRF),
+		CRFStep:    getEnvInt("COMPRESSION_CRF_STEP", defaultCRFStep),
+	}
+	if err := settings.validate(); err != nil {
+		log.Printf("Warning: Invalid compression settings (%v), using CRF %d to %d in steps of %d", err, defaultInitialCRF, defaultMaxCRF, defaultCRFStep)
+		return CompressionSettings{Mode: mode, InitialCRF: defaultInitialCRF, MaxCRF: defaultMaxCRF, CRFStep: defaultCRFStep}
+	}
+	return settings
+}
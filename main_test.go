@@ -0,0 +1,1281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// newTestClipManager returns a ClipManager with one camera and its clips in a temporary directory.
+// No recorder is started.
+func newTestClipManager(t *testing.T) *ClipManager {
+	t.Helper()
+	cm, err := NewClipManager(t.TempDir(), "localhost:8080", map[string]string{"default": "rtsp://camera.invalid/stream"})
+	if err != nil {
+		t.Fatalf("NewClipManager: %v", err)
+	}
+	t.Cleanup(cm.cancel)
+	return cm
+}
+
+func TestPostMetadataReachesCaptionAndFilename(t *testing.T) {
+	var caption, uploadName string
+	discord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("Discord request is not multipart: %v", err)
+			return
+		}
+		var payload discordPayload
+		if err := json.Unmarshal([]byte(r.FormValue("payload_json")), &payload); err != nil {
+			t.Errorf("invalid payload_json: %v", err)
+		}
+		caption = payload.Content
+		if files := r.MultipartForm.File["files[0]"]; len(files) == 1 {
+			uploadName = files[0].Filename
+		}
+	}))
+	defer discord.Close()
+
+	cm := newTestClipManager(t)
+	body := `{"chat_app": "discord", "discord_webhook_url": "` + discord.URL + `", "duration_seconds": 10,
+		"category": "Goal", "team1": "Home", "team2": "Away"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/clip", strings.NewReader(body))
+	req, err := cm.parseClipRequest(r)
+	if err != nil {
+		t.Fatalf("parseClipRequest: %v", err)
+	}
+	if err := cm.validateRequest(req); err != nil {
+		t.Fatalf("validateRequest: %v", err)
+	}
+
+	clipPath := filepath.Join(cm.tempDir, "clip.mp4")
+	if err := os.WriteFile(clipPath, []byte("clip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.sendToDiscord(cm.log, clipPath, req.DiscordWebhookURL, req); err != nil {
+		t.Fatalf("sendToDiscord: %v", err)
+	}
+
+	if !strings.Contains(caption, "Goal") || !strings.Contains(caption, "Home vs Away") {
+		t.Errorf("Discord caption %q is missing the category or teams", caption)
+	}
+	for _, name := range []string{uploadName, cm.generateSFTPFilename(req)} {
+		if !strings.Contains(name, "Goal") || !strings.Contains(name, "Home") || !strings.Contains(name, "Away") {
+			t.Errorf("filename %q is missing the category or teams", name)
+		}
+	}
+}
+
+func TestSegmentSubscriberIsNotified(t *testing.T) {
+	cm := newTestClipManager(t)
+	cam := cm.cameras["default"]
+
+	// Segment files of a fake recorder, written up front so only addSegment runs in goroutines
+	names := make([]string, 50)
+	for i := range names {
+		names[i] = fmt.Sprintf("segment_cycle0_%03d.ts", i)
+		if err := os.WriteFile(filepath.Join(cam.segmentDir, names[i]), []byte("segment"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addSegment := func(name string) {
+		cm.addSegment(cam, name, time.Now(), 5*time.Second)
+	}
+
+	updates := cm.subscribeSegments(cam)
+	go addSegment(names[0])
+	select {
+	case segment := <-updates:
+		if want := filepath.Join(cam.segmentDir, names[0]); segment.Path != want {
+			t.Errorf("subscriber received %s, want %s", segment.Path, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber was not notified of the new segment")
+	}
+
+	// A subscriber that doesn't keep up must not stall the recorder
+	done := make(chan struct{})
+	go func() {
+		for _, name := range names[1 : len(names)-1] {
+			addSegment(name)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("addSegment blocked on a subscriber with a full buffer")
+	}
+
+	cm.unsubscribeSegments(cam, updates)
+	for len(updates) > 0 {
+		<-updates
+	}
+	addSegment(names[len(names)-1])
+	if len(updates) != 0 {
+		t.Error("unsubscribed channel still received a segment")
+	}
+}
+
+// startTestSFTPServer serves the local file system over SFTP on a loopback port, accepting any
+// user with the password "secret", and returns its host and port
+func startTestSFTPServer(t *testing.T) (string, string) {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTP(conn, config)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return host, port
+}
+
+func serveTestSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range channelRequests {
+				req.Reply(req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		go func() {
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+func TestStreamClipRangeRequest(t *testing.T) {
+	host, port := startTestSFTPServer(t)
+	cm := newTestClipManager(t)
+	cm.sftpInsecure = true
+
+	// Larger than sftpReadAhead, so the range spans more than one read-ahead block
+	content := make([]byte, 3*sftpReadAhead)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	clipPath := filepath.Join(t.TempDir(), "clip.mp4")
+	if err := os.WriteFile(clipPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cm.streamTokens["token"] = &streamToken{
+		Path:     clipPath,
+		Host:     host,
+		Port:     port,
+		User:     "clips",
+		Password: "secret",
+		Expires:  time.Now().Add(time.Minute),
+	}
+	start, end := int64(sftpReadAhead/2), int64(2*sftpReadAhead+100)
+	r := httptest.NewRequest(http.MethodGet, "/api/clip/stream?token=token&path="+url.QueryEscape(clipPath), nil)
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	w := httptest.NewRecorder()
+	cm.HandleStreamClip(w, r)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want 206: %s", w.Code, w.Body.String())
+	}
+	if got, want := w.Header().Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)); got != want {
+		t.Errorf("Content-Range %q, want %q", got, want)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content[start:end+1]) {
+		t.Errorf("body is %d bytes and doesn't match the requested range of %d bytes", w.Body.Len(), end-start+1)
+	}
+}
+
+// dialTestWebSocket connects to a test server's WebSocket endpoint
+func dialTestWebSocket(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitForWebSocketClients waits until n clients are registered
+func waitForWebSocketClients(t *testing.T, cm *ClipManager, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cm.wsClientsLock.RLock()
+		count := len(cm.wsClients)
+		cm.wsClientsLock.RUnlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d WebSocket clients registered, want %d", count, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroadcastEvictsClientWhoseWriteFails(t *testing.T) {
+	cm := newTestClipManager(t)
+	healthy := httptest.NewServer(http.HandlerFunc(cm.HandleWebSocket))
+	defer healthy.Close()
+
+	// A dead client whose read loop never returns: it is registered but nothing reads from it,
+	// so only the broadcast can notice that it's gone
+	var dead *websocket.Conn
+	registered := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		cm.wsClientsLock.Lock()
+		cm.wsClients[conn] = &wsClient{conn: conn}
+		cm.wsClientsLock.Unlock()
+		dead = conn
+		close(registered)
+		<-release
+	}))
+	defer stuck.Close()
+
+	client := dialTestWebSocket(t, healthy)
+	dialTestWebSocket(t, stuck)
+	<-registered
+	waitForWebSocketClients(t, cm, 2)
+	dead.UnderlyingConn().Close()
+
+	cm.broadcastEvent(EventError, ClipEventPayload{Error: "test"})
+
+	cm.wsClientsLock.RLock()
+	_, stillThere := cm.wsClients[dead]
+	remaining := len(cm.wsClients)
+	cm.wsClientsLock.RUnlock()
+	if stillThere || remaining != 1 {
+		t.Errorf("after one broadcast the dead client is registered: %v, %d clients remain, want 1", stillThere, remaining)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event WSEvent
+	if err := client.ReadJSON(&event); err != nil || event.Type != EventError {
+		t.Errorf("healthy client got event %q, error %v", event.Type, err)
+	}
+}
+
+// Run with -race: broadcasts from concurrent clips must not write to a connection at the same time
+func TestConcurrentBroadcasts(t *testing.T) {
+	cm := newTestClipManager(t)
+	server := httptest.NewServer(http.HandlerFunc(cm.HandleWebSocket))
+	defer server.Close()
+
+	const clients, broadcasters, events = 3, 8, 20
+	conns := make([]*websocket.Conn, clients)
+	for i := range conns {
+		conns[i] = dialTestWebSocket(t, server)
+	}
+	waitForWebSocketClients(t, cm, clients)
+
+	var wg sync.WaitGroup
+	for i := 0; i < broadcasters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				cm.broadcastEvent(EventClipUploaded, ClipEventPayload{RequestID: fmt.Sprintf("req_%d_%d", i, j)})
+			}
+		}(i)
+	}
+
+	// Every client gets every event as an intact frame
+	for _, conn := range conns {
+		seen := make(map[string]bool)
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for len(seen) < broadcasters*events {
+			var event struct {
+				Type    string           `json:"type"`
+				Payload ClipEventPayload `json:"payload"`
+			}
+			if err := conn.ReadJSON(&event); err != nil {
+				t.Fatalf("read event %d: %v", len(seen), err)
+			}
+			seen[event.Payload.RequestID] = true
+		}
+	}
+	wg.Wait()
+}
+
+// Run with -race: the recording state is shared by the recorder, the recording endpoints and /healthz
+func TestConcurrentStartStopRecording(t *testing.T) {
+	cm := newTestClipManager(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+	cm.ffmpegPath, cm.ffprobePath = missing, missing
+	cam := cm.cameras["default"]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				switch (i + j) % 3 {
+				case 0:
+					cm.StartBackgroundRecording(cm.ctx, cam)
+				case 1:
+					if _, err := cam.StopRecording(5 * time.Second); err != nil {
+						t.Error(err)
+					}
+				default:
+					if cam.IsRecording() && cam.RecordingStartTime().IsZero() {
+						t.Error("recording without a start time")
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err := cam.StopRecording(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if cam.IsRecording() {
+		t.Error("camera is still recording after StopRecording")
+	}
+	if !waitTimeout(&cm.recordersWG, 5*time.Second) {
+		t.Error("recorders did not exit")
+	}
+}
+
+func TestRetryBackoffGrowsUpToMaximum(t *testing.T) {
+	config := RuntimeConfig{RetryDelay: 2 * time.Second, RetryFactor: 2, RetryMaxDelay: 30 * time.Second}
+
+	// With jitter each delay falls between half and all of the attempt's backoff, which doubles
+	// per attempt until RetryMaxDelay
+	tests := []struct {
+		attempt int
+		backoff time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 16 * time.Second},
+		{5, 30 * time.Second}, // 32s capped at RetryMaxDelay
+		{8, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		var lowest, highest time.Duration
+		for i := 0; i < 200; i++ {
+			delay := retryBackoff(config, tt.attempt)
+			if delay < tt.backoff/2 || delay > tt.backoff {
+				t.Fatalf("attempt %d: delay %v outside %v to %v", tt.attempt, delay, tt.backoff/2, tt.backoff)
+			}
+			if i == 0 || delay < lowest {
+				lowest = delay
+			}
+			if delay > highest {
+				highest = delay
+			}
+		}
+		if lowest == highest {
+			t.Errorf("attempt %d: every delay is %v, expected jitter", tt.attempt, lowest)
+		}
+	}
+}
+
+func TestWatchSegmentDirIndexesCompletedSegments(t *testing.T) {
+	cm := newTestClipManager(t)
+	cam := cm.cameras["default"]
+	updates := cm.subscribeSegments(cam)
+	defer cm.unsubscribeSegments(cam, updates)
+
+	processDone := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		cm.watchSegmentDir(cam, 0, ".ts", processDone)
+		close(watchDone)
+	}()
+
+	writeSegment := func(name string) {
+		if err := os.WriteFile(filepath.Join(cam.segmentDir, name), []byte("segment"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectSegment := func(name string, within time.Duration) {
+		t.Helper()
+		select {
+		case segment := <-updates:
+			if filepath.Base(segment.Path) != name {
+				t.Errorf("indexed %s, want %s", filepath.Base(segment.Path), name)
+			}
+		case <-time.After(within):
+			t.Fatalf("%s was not indexed within %v", name, within)
+		}
+	}
+
+	// Give the watcher a moment to start, then let FFmpeg's next segment complete the first one
+	time.Sleep(100 * time.Millisecond)
+	writeSegment("segment_cycle0_000.ts")
+	writeSegment("segment_cycle0_001.ts")
+	// Well before segmentRescanInterval, so the file system event triggered the scan
+	expectSegment("segment_cycle0_000.ts", segmentRescanInterval/2)
+	select {
+	case segment := <-updates:
+		t.Fatalf("%s was indexed while FFmpeg may still be writing it", segment.Path)
+	case <-time.After(2 * segmentEventDebounce):
+	}
+
+	// The last segment is complete once FFmpeg exits
+	close(processDone)
+	expectSegment("segment_cycle0_001.ts", time.Second)
+	<-watchDone
+}
+
+func TestRewindWindowMapsToSegmentsAndFrames(t *testing.T) {
+	cm := newTestClipManager(t)
+	cam := cm.cameras["default"]
+
+	// A cycle with the uneven segment lengths FFmpeg produces when it cuts on keyframes. Each
+	// file's modification time is when it finished, the segment list has its exact length.
+	lengths := []float64{4.0, 6.5, 3.2, 5.3}
+	base := time.Now().Add(-time.Minute).Truncate(time.Second)
+	list := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-TARGETDURATION:7\n"
+	end := base
+	for i, length := range lengths {
+		name := fmt.Sprintf("segment_cycle0_%03d.ts", i)
+		path := filepath.Join(cam.segmentDir, name)
+		if err := os.WriteFile(path, []byte("segment"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		end = end.Add(secondsDuration(length))
+		if err := os.Chtimes(path, end, end); err != nil {
+			t.Fatal(err)
+		}
+		list += fmt.Sprintf("#EXTINF:%f,\n%s\n", length, name)
+	}
+	if err := os.WriteFile(segmentListPath(cam.segmentDir, 0), []byte(list+"#EXT-X-ENDLIST\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cm.rebuildSegmentIndex(cam)
+
+	// Each segment starts where the previous one ended, not a whole SEGMENT_DURATION earlier
+	start := base
+	for i, segment := range cam.segments {
+		if !segment.Timestamp.Equal(start) || segment.Duration != secondsDuration(lengths[i]) {
+			t.Errorf("segment %d starts at +%v and lasts %v, want +%v and %vs", i,
+				segment.Timestamp.Sub(base), segment.Duration, start.Sub(base), lengths[i])
+		}
+		start = start.Add(secondsDuration(lengths[i]))
+	}
+
+	const fps = 25
+	tests := []struct {
+		name       string
+		from, to   float64 // Seconds after the first segment started
+		segments   []int
+		firstFrame int // Frame of the first selected segment the clip starts on
+	}{
+		{"inside one segment", 5, 9, []int{1}, 25},
+		{"across segments", 3, 12, []int{0, 1, 2}, 75},
+		{"starting on a boundary", 10.5, 14, []int{2, 3}, 0},
+		{"one frame before a boundary", 13.66, 18, []int{2, 3}, 79},
+		{"before the buffer", -2, 1, []int{0}, 0},
+	}
+	for _, tt := range tests {
+		from, to := base.Add(secondsDuration(tt.from)), base.Add(secondsDuration(tt.to))
+		selected := overlappingSegments(cam.segments, from, to)
+
+		var got []int
+		for _, segment := range selected {
+			got = append(got, segmentNumber(filepath.Base(segment.Path)))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.segments) {
+			t.Errorf("%s: selected segments %v, want %v", tt.name, got, tt.segments)
+			continue
+		}
+		if frame := int(math.Round(clipStartOffset(selected, from).Seconds() * fps)); frame != tt.firstFrame {
+			t.Errorf("%s: clip starts on frame %d, want %d", tt.name, frame, tt.firstFrame)
+		}
+	}
+}
+
+// writeFakeFFmpeg installs shell scripts as FFmpeg and ffprobe. FFmpeg writes its arguments to
+// the returned file, one per line, and creates the output; ffprobe reports the given streams for
+// the camera and 8 seconds for a clip.
+func writeFakeFFmpeg(t *testing.T, cm *ClipManager, streams string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake FFmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "ffmpeg_args")
+	scripts := map[string]string{
+		"ffmpeg":  "#!/bin/sh\nprintf '%s\\n' \"$@\" > '" + argsPath + "'\nfor last; do :; done\necho clip > \"$last\"\n",
+		"ffprobe": "#!/bin/sh\ncase \"$*\" in\n*format=duration*) echo 8.000 ;;\n*) echo '" + streams + "' ;;\nesac\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm.ffmpegPath, cm.ffprobePath = filepath.Join(dir, "ffmpeg"), filepath.Join(dir, "ffprobe")
+	return argsPath
+}
+
+func TestAudioOnlyClipGetsPlaceholderVideo(t *testing.T) {
+	tests := []struct {
+		name        string
+		placeholder Placeholder
+	}{
+		{"solid color", Placeholder{Size: "640x360", Framerate: 5, Color: "black"}},
+		{"background image", Placeholder{Size: "640x360", Framerate: 5, Color: "black", Image: "/images/background.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestClipManager(t)
+			argsPath := writeFakeFFmpeg(t, cm, `{"streams":[{"index":0,"codec_type":"audio","codec_name":"aac","channels":2,"sample_rate":"48000"}]}`)
+			cam := cm.cameras["default"]
+
+			now := time.Now()
+			for i := 0; i < 4; i++ {
+				name := fmt.Sprintf("segment_cycle0_%03d.ts", i)
+				if err := os.WriteFile(filepath.Join(cam.segmentDir, name), []byte("segment"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				cm.addSegment(cam, name, now.Add(time.Duration(i-3)*5*time.Second), 5*time.Second)
+			}
+
+			outputPath := filepath.Join(cm.tempDir, "clip.mp4")
+			if _, err := cm.RecordClip(cm.ctx, cm.log, cam, 12, 8, outputPath, RecordOptions{Placeholder: tt.placeholder}, now); err != nil {
+				t.Fatalf("RecordClip: %v", err)
+			}
+
+			data, err := os.ReadFile(argsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := " " + strings.ReplaceAll(strings.TrimSpace(string(data)), "\n", " ") + " "
+
+			// The placeholder is the second input, after the buffer and its input seek
+			concatInput := strings.Index(args, " -i "+filepath.Join(cam.segmentDir, "concat_list_clip.txt")+" ")
+			placeholderInput := strings.Index(args, " "+strings.Join(tt.placeholder.inputArgs(), " ")+" ")
+			if seek := strings.Index(args, " -ss "); concatInput < 0 || seek > concatInput {
+				t.Errorf("buffer input missing or not seeked on the input: %s", args)
+			}
+			if placeholderInput < concatInput {
+				t.Errorf("placeholder input %v missing or before the buffer: %s", tt.placeholder.inputArgs(), args)
+			}
+			for _, want := range [][]string{{"-map", "0:a", "-map", "1:v"}, tt.placeholder.filterArgs(), {"-shortest"}} {
+				if len(want) > 0 && !strings.Contains(args, " "+strings.Join(want, " ")+" ") {
+					t.Errorf("arguments are missing %v: %s", want, args)
+				}
+			}
+		})
+	}
+}
+
+func TestSFTPPoolClosesReplacedIdleConnection(t *testing.T) {
+	host, port := startTestSFTPServer(t)
+	cm := newTestClipManager(t)
+	cm.sftpInsecure = true
+	key, dial, err := cm.sftpDialer(host, port, "clips", "secret", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewSFTPPool(time.Minute)
+
+	// A second request dials and releases its connection while the first is still dialing
+	var concurrent *PooledSFTPClient
+	client, err := pool.get(key, func() (*ssh.Client, *sftp.Client, error) {
+		if concurrent, err = pool.get(key, dial); err != nil {
+			return nil, nil, err
+		}
+		concurrent.Close()
+		return dial()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Getwd(); err != nil {
+		t.Errorf("pooled connection doesn't work: %v", err)
+	}
+	if _, err := concurrent.Getwd(); err == nil {
+		t.Error("replaced idle connection is still open")
+	}
+	if pool.conns[key] != client.entry {
+		t.Error("pool doesn't hold the newest connection")
+	}
+}
+
+func TestGlobalRateLimitKeepsClientTokens(t *testing.T) {
+	cm := newTestClipManager(t)
+	cm.ipLimiters = NewIPRateLimiter(0.001, 2)
+	cm.limiter = rate.NewLimiter(0.001, 1)
+	handler := cm.RateLimit(func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func() int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/clips", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		handler(w, r)
+		return w.Code
+	}
+
+	// The global token goes to the first request, the second is rejected by the global limit
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("first request got status %d", code)
+	}
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Fatalf("second request got status %d, want 429 from the global limit", code)
+	}
+
+	// The rejected request must not have used up the client's second token
+	cm.limiter = rate.NewLimiter(0.001, 1)
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("client was charged for a request the global limit rejected, got status %d", code)
+	}
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Errorf("client exceeded its own burst, got status %d", code)
+	}
+}
+
+func TestGlobalRateLimitFollowsConfig(t *testing.T) {
+	t.Setenv("GLOBAL_RATE_LIMIT", "50")
+	t.Setenv("GLOBAL_RATE_BURST", "60")
+	cm := newTestClipManager(t)
+	if cm.limiter.Limit() != 50 || cm.limiter.Burst() != 60 {
+		t.Fatalf("global limiter is %v with burst %d, want 50 with burst 60", cm.limiter.Limit(), cm.limiter.Burst())
+	}
+
+	if _, err := cm.updateConfig([]byte(`{"global_rate_limit": 5, "global_rate_burst": 2}`)); err != nil {
+		t.Fatalf("updateConfig: %v", err)
+	}
+	if cm.limiter.Limit() != 5 || cm.limiter.Burst() != 2 {
+		t.Errorf("global limiter is %v with burst %d after the update, want 5 with burst 2", cm.limiter.Limit(), cm.limiter.Burst())
+	}
+	if settings := configSettings(cm.currentConfig()); settings.GlobalRateLimit != 5 || settings.GlobalRateBurst != 2 {
+		t.Errorf("config reports global_rate_limit %g and global_rate_burst %d", settings.GlobalRateLimit, settings.GlobalRateBurst)
+	}
+
+	if _, err := cm.updateConfig([]byte(`{"global_rate_limit": 0}`)); err == nil {
+		t.Error("updateConfig accepted a global_rate_limit of 0")
+	}
+	if cm.limiter.Limit() != 5 {
+		t.Errorf("rejected update changed the global limit to %v", cm.limiter.Limit())
+	}
+}
+
+func TestDefaultClipSecondsRejectsNonFiniteValues(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"", 0},
+		{"12.5", 12.5},
+		{"-1", 0},
+		{"301", 0},
+		{"NaN", 0},
+		{"nan", 0},
+		{"Inf", 0},
+		{"-Inf", 0},
+		{"seconds", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("DEFAULT_DURATION_SECONDS", tt.value)
+		if got := getDefaultClipSeconds("DEFAULT_DURATION_SECONDS", 0, 300); got != tt.want {
+			t.Errorf("getDefaultClipSeconds with %q = %g, want %g", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConcurrentClipInfoRequestsProbeOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffprobe is a shell script")
+	}
+	host, port := startTestSFTPServer(t)
+	cm := newTestClipManager(t)
+	cm.sftpInsecure = true
+
+	// The fake ffprobe counts its runs and takes long enough for the requests to overlap
+	dir := t.TempDir()
+	runsPath := filepath.Join(dir, "runs")
+	script := "#!/bin/sh\necho run >> '" + runsPath + "'\nsleep 0.3\n" +
+		`echo '{"format":{"duration":"8.000","bit_rate":"1000000"},"streams":[{"codec_type":"video","codec_name":"h264","width":1280,"height":720}]}'` + "\n"
+	cm.ffprobePath = filepath.Join(dir, "ffprobe")
+	if err := os.WriteFile(cm.ffprobePath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	clipPath := filepath.Join(dir, "clip.mp4")
+	if err := os.WriteFile(clipPath, []byte("clip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cm.streamTokens["token"] = &streamToken{Path: clipPath, Host: host, Port: port, User: "clips", Password: "secret", Expires: time.Now().Add(time.Minute)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			cm.HandleClipInfo(w, httptest.NewRequest(http.MethodGet, "/api/clip/info?token=token&path="+url.QueryEscape(clipPath), nil))
+			var info ClipMetadata
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &info) != nil || info.VideoCodec != "h264" {
+				t.Errorf("status %d: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	runs, err := os.ReadFile(runsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(runs), "run"); n != 1 {
+		t.Errorf("ffprobe ran %d times for concurrent requests, want 1", n)
+	}
+	entries, err := os.ReadDir(filepath.Join(cm.tempDir, "clipinfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || filepath.Ext(entries[0].Name()) != ".json" {
+		t.Errorf("cache should hold only the result, found %d files", len(entries))
+	}
+}
+
+func TestPruneClipInfoCache(t *testing.T) {
+	cm := newTestClipManager(t)
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for i := 0; i < clipInfoCacheMaxEntries; i++ {
+		write(fmt.Sprintf("%04d.json", i), time.Duration(i)*time.Second)
+	}
+	beyondLimit := write("beyond-limit.json", time.Hour)
+	stale := write("stale.json", clipInfoCacheMaxAge+time.Hour)
+	leftover := write("download-123.mp4", clipInfoCacheMaxAge+time.Hour)
+	download := write("download-456.mp4", time.Minute)
+
+	cm.pruneClipInfoCache(dir)
+
+	for _, path := range []string{beyondLimit, stale, leftover} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not pruned", filepath.Base(path))
+		}
+	}
+	if _, err := os.Stat(download); err != nil {
+		t.Errorf("recent download was pruned: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != clipInfoCacheMaxEntries+1 {
+		t.Errorf("%d files left, want %d results and the download", len(entries), clipInfoCacheMaxEntries)
+	}
+}
+
+func TestClipFilenameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name                          string
+		title, category, team1, team2 string
+		want                          clipFilenameInfo
+	}{
+		{"all fields", "Final", "Goal", "Home", "Away", clipFilenameInfo{Title: "Final", Category: "Goal", Team1: "Home", Team2: "Away"}},
+		{"spaces and underscores", "Last _ minute", "Free__kick", "FC vs United", "Real_Club", clipFilenameInfo{Title: "Last_minute", Category: "Free_kick", Team1: "FC_vs_United", Team2: "Real_Club"}},
+		{"team named vs", "Goal", "vs", "vs", "", clipFilenameInfo{Title: "Goal", Category: "vs", Team1: "vs"}},
+		{"only category", "", "Save", "", "", clipFilenameInfo{Title: "Save", Category: "Save"}},
+		{"only teams", "", "", "Home", "Away", clipFilenameInfo{Team1: "Home", Team2: "Away"}},
+		{"only team2", "Goal", "", "", "Away", clipFilenameInfo{Title: "Goal", Category: "Goal", Team1: "Away"}},
+		{"punctuation only", "!!", "??", "", "", clipFilenameInfo{}},
+	}
+	cm := newTestClipManager(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := cm.generateSFTPFilename(&ClipRequest{Title: tt.title, Category: tt.category, Team1: tt.team1, Team2: tt.team2})
+			got, ok := parseClipFilename(name)
+			if !ok {
+				t.Fatalf("%q doesn't parse", name)
+			}
+			got.Time = time.Time{}
+			if got != tt.want {
+				t.Errorf("%q parses as %+v, want %+v", name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLegacyClipFilename(t *testing.T) {
+	got, ok := parseClipFilename("Final_Goal_Home_vs_Away_2024-05-01_18-30_2.mp4")
+	want := clipFilenameInfo{Title: "Final", Category: "Goal", Team1: "Home", Team2: "Away",
+		Time: time.Date(2024, 5, 1, 18, 30, 0, 0, time.Local)}
+	if !ok || got != want {
+		t.Errorf("got %+v, %v, want %+v", got, ok, want)
+	}
+}
+
+func TestHardwareFallbackCountsOneCompression(t *testing.T) {
+	cm := newTestClipManager(t)
+	writeFakeFFmpeg(t, cm, `{"streams":[{"width":1280,"height":720}]}`)
+
+	// The hardware encoder is listed but fails, like with a missing GPU driver
+	runsPath := filepath.Join(t.TempDir(), "runs")
+	script := "#!/bin/sh\necho \"$*\" >> '" + runsPath + "'\ncase \"$*\" in\n*h264_nvenc*) exit 1 ;;\nesac\nfor last; do :; done\necho clip > \"$last\"\n"
+	if err := os.WriteFile(cm.ffmpegPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cm.encoder = "h264_nvenc"
+
+	clipPath := filepath.Join(cm.tempDir, "clip.mp4")
+	if err := os.WriteFile(clipPath, make([]byte, 2*1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	compression := CompressionSettings{Mode: compressionModeCRF, InitialCRF: 23, MaxCRF: 35, CRFStep: 4, MaxFileSizeMB: 1}
+	compressed, err := cm.PrepareClipForChatApp(cm.log, clipPath, "discord", "", "", compression)
+	if err != nil {
+		t.Fatalf("PrepareClipForChatApp: %v", err)
+	}
+	if compressed == clipPath {
+		t.Fatal("clip was not compressed")
+	}
+
+	runs, err := os.ReadFile(runsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(runs)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "libx264") {
+		t.Fatalf("want a failed hardware run and a libx264 retry, FFmpeg ran with:\n%s", runs)
+	}
+	if got := testutil.ToFloat64(cm.metrics.compressions.WithLabelValues("discord")); got != 1 {
+		t.Errorf("counted %g compressions, want 1", got)
+	}
+}
+
+// ffmpegToken reads a token the way FFmpeg's av_get_token does: a backslash escapes the next
+// character, single quotes quote everything up to the next one, and any of terms ends the token.
+// Returns the token and the unparsed rest.
+func ffmpegToken(s, terms string) (string, string) {
+	var token strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			token.WriteByte(s[i])
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			token.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case strings.IndexByte(terms, c) >= 0:
+			return token.String(), s[i:]
+		default:
+			token.WriteByte(c)
+		}
+	}
+	return token.String(), ""
+}
+
+func TestEscapeFilterValueSurvivesFilterParsing(t *testing.T) {
+	for _, path := range []string{
+		"/tmp/clips/clip_overlay.txt",
+		`C:\clips\clip_overlay.txt`,
+		"/tmp/it's here/clip.txt",
+		"/fonts/[bold], wide; 10:30.ttf",
+	} {
+		drawtext := "drawtext=textfile=" + escapeFilterValue(path) + ":fontsize=24"
+
+		// The filtergraph parser splits the filters, then the filter splits its options
+		filter, rest := ffmpegToken(drawtext, "[],;")
+		if rest != "" {
+			t.Errorf("%q: filtergraph stopped early at %q", path, rest)
+			continue
+		}
+		value, rest := ffmpegToken(strings.TrimPrefix(filter, "drawtext=textfile="), ":")
+		if value != path || rest != ":fontsize=24" {
+			t.Errorf("%q parses as textfile %q followed by %q", path, value, rest)
+		}
+	}
+}
+
+func TestOverlayDrawsPercentSignsLiterally(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake FFmpeg is a shell script")
+	}
+	cm := newTestClipManager(t)
+	dir := t.TempDir()
+	argsPath, textPath := filepath.Join(dir, "ffmpeg_args"), filepath.Join(dir, "overlay_text")
+	// Keeps a copy of the overlay text file, which applyOverlay removes once FFmpeg is done
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > '" + argsPath + "'\nfor last; do :; done\n" +
+		"cp \"${last%_overlay.*}_overlay.txt\" '" + textPath + "'\necho clip > \"$last\"\n"
+	cm.ffmpegPath = filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(cm.ffmpegPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	clipPath := filepath.Join(cm.tempDir, "clip.mp4")
+	if err := os.WriteFile(clipPath, []byte("clip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &ClipRequest{Team1: "100% Club", Team2: "%{localtime}", Category: "Goal"}
+	captureTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := cm.applyOverlay(cm.log, clipPath, req, captureTime); err != nil {
+		t.Fatalf("applyOverlay: %v", err)
+	}
+
+	text, err := os.ReadFile(textPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "100% Club vs %{localtime}\nGoal\n2024-05-01 12:00:00"; string(text) != want {
+		t.Errorf("overlay text is %q, want %q", text, want)
+	}
+
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var drawtext string
+	for i := range args[:len(args)-1] {
+		if args[i] == "-vf" {
+			drawtext = args[i+1]
+		}
+	}
+	filter, _ := ffmpegToken(drawtext, "[],;")
+	options := strings.TrimPrefix(filter, "drawtext=")
+	expansion := ""
+	for options != "" {
+		var option string
+		option, options = ffmpegToken(options, ":")
+		options = strings.TrimPrefix(options, ":")
+		if value, ok := strings.CutPrefix(option, "expansion="); ok {
+			expansion = value
+		}
+	}
+	if expansion != "none" {
+		t.Errorf("drawtext expansion is %q, want none: %s", expansion, drawtext)
+	}
+	if strings.Contains(drawtext, "Club") {
+		t.Errorf("team names are in the filtergraph: %s", drawtext)
+	}
+}
+
+func TestS3UploadHonorsPathStyle(t *testing.T) {
+	type upload struct{ host, path, auth, body string }
+	uploads := make(chan upload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploads <- upload{r.Host, r.URL.EscapedPath(), r.Header.Get("Authorization"), string(body)}
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	cm := newTestClipManager(t)
+	// Every host name resolves to the test server, so virtual-hosted buckets reach it too
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}}
+	cm.httpClients["s3"] = &http.Client{Transport: transport}
+	clipPath := filepath.Join(cm.tempDir, "clip.mp4")
+	if err := os.WriteFile(clipPath, []byte("clip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := "http://storage.example.com:" + port
+	for _, tt := range []struct {
+		pathStyle bool
+		host      string
+		path      string
+	}{
+		{true, "storage.example.com:" + port, "/clips/matches/goal%20clip.mp4"},
+		{false, "clips.storage.example.com:" + port, "/matches/goal%20clip.mp4"},
+	} {
+		location, err := cm.sendToS3(cm.log, clipPath, endpoint, "clips", "access", "secret", "us-east-1", "matches", tt.pathStyle, &ClipRequest{Filename: "goal clip"})
+		if err != nil {
+			t.Fatalf("path style %v: sendToS3: %v", tt.pathStyle, err)
+		}
+		got := <-uploads
+		if got.host != tt.host || got.path != tt.path {
+			t.Errorf("path style %v: uploaded to %s%s, want %s%s", tt.pathStyle, got.host, got.path, tt.host, tt.path)
+		}
+		// Plain HTTP uploads are sent in signed chunks
+		if !strings.HasPrefix(got.auth, "AWS4-HMAC-SHA256 Credential=access/") || !strings.Contains(got.body, "\r\nclip\r\n") {
+			t.Errorf("path style %v: unsigned or incomplete upload: %q, body %q", tt.pathStyle, got.auth, got.body)
+		}
+		if location != "s3://clips/matches/goal clip.mp4" {
+			t.Errorf("path style %v: location %s", tt.pathStyle, location)
+		}
+	}
+
+	if _, err := parseS3Endpoint(endpoint + "/s3"); err == nil {
+		t.Error("parseS3Endpoint accepted an endpoint with a path")
+	}
+}
+
+func TestPruneArchiveOnlyRemovesClips(t *testing.T) {
+	cm := newTestClipManager(t)
+	cm.archiveDir = t.TempDir()
+	cm.archiveMaxClips = 1
+
+	now := time.Now()
+	files := []string{
+		"Final__Goal__2024-05-01_18-32.mp4", // Newest clip, kept
+		"Final__Goal__2024-05-01_18-31_2.mkv",
+		"Goal_2024-05-01_18-30.webm",
+		"notes.txt",
+		"my highlight.mp4",
+		"2024-05-01_18-29.mp4.part",
+	}
+	for i, name := range files {
+		path := filepath.Join(cm.archiveDir, name)
+		if err := os.WriteFile(path, []byte("clip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cm.pruneArchive(cm.log)
+
+	var left []string
+	entries, _ := os.ReadDir(cm.archiveDir)
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	want := []string{"2024-05-01_18-29.mp4.part", "Final__Goal__2024-05-01_18-32.mp4", "my highlight.mp4", "notes.txt"}
+	if strings.Join(left, ",") != strings.Join(want, ",") {
+		t.Errorf("archive holds %v after pruning, want %v", left, want)
+	}
+}
+
+func TestScheduledCaptureUsesClipQueue(t *testing.T) {
+	cm := newTestClipManager(t)
+	writeFakeFFmpeg(t, cm, `{"streams":[{"index":0,"codec_type":"audio","codec_name":"aac","channels":2,"sample_rate":"48000"}]}`)
+	cam := cm.cameras["default"]
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("segment_cycle0_%03d.ts", i)
+		if err := os.WriteFile(filepath.Join(cam.segmentDir, name), []byte("segment"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cm.addSegment(cam, name, now.Add(time.Duration(i-3)*5*time.Second), 5*time.Second)
+	}
+	template := &ClipRequest{CameraID: cam.ID, BacktrackSeconds: 10, DurationSeconds: 5, DryRun: true}
+
+	// Every slot is taken by a running clip, so the capture has to wait in the queue
+	for i := 0; i < cap(cm.clipSlots); i++ {
+		cm.clipQueue <- struct{}{}
+		cm.clipSlots <- struct{}{}
+	}
+	type capture struct {
+		requestID string
+		captured  bool
+	}
+	done := make(chan capture, 1)
+	go func() {
+		requestID, captured := cm.captureScheduledClip(cm.log, cam, template)
+		done <- capture{requestID, captured}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("capture ran while every clip slot was taken")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, queued := cm.clipQueueDepth(); queued != 1 {
+		t.Errorf("%d captures queued, want 1", queued)
+	}
+
+	<-cm.clipSlots
+	<-cm.clipQueue
+	select {
+	case result := <-done:
+		if !result.captured || result.requestID == "" {
+			t.Errorf("capture didn't run once a slot was free: %+v", result)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("capture didn't start once a slot was free")
+	}
+	if len(cm.clipQueue) != len(cm.clipSlots) {
+		t.Errorf("capture left %d entries in the queue and %d in the slots", len(cm.clipQueue), len(cm.clipSlots))
+	}
+
+	// A full queue turns the capture away instead of piling up more work
+	for len(cm.clipQueue) < cap(cm.clipQueue) {
+		cm.clipQueue <- struct{}{}
+	}
+	if requestID, captured := cm.captureScheduledClip(cm.log, cam, template); captured || requestID != "" {
+		t.Errorf("capture ran with a full queue as %s", requestID)
+	}
+	if got := testutil.ToFloat64(cm.metrics.clipsRejected); got != 1 {
+		t.Errorf("%g clips counted as rejected, want 1", got)
+	}
+}
+
+func TestRequireAPIKeyOnlyAcceptsHeadersAndSingleUseTokens(t *testing.T) {
+	cm := newTestClipManager(t)
+	cm.apiKey = "secret"
+	handler := cm.RequireAPIKey(func(w http.ResponseWriter, r *http.Request) {})
+	status := func(target string, header http.Header) int {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	mintToken := func(path string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cm.HandleAuthToken(w, httptest.NewRequest(http.MethodPost, "/api/auth/token", strings.NewReader(`{"path": "`+path+`"}`)))
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("minting a token for %s: status %d, %v", path, w.Code, err)
+		}
+		return resp.Token
+	}
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		header http.Header
+		want   int
+	}{
+		{"X-API-Key header", "/api/clips", http.Header{"X-Api-Key": {"secret"}}, http.StatusOK},
+		{"bearer token", "/api/clips", http.Header{"Authorization": {"Bearer secret"}}, http.StatusOK},
+		{"wrong key", "/api/clips", http.Header{"X-Api-Key": {"guess"}}, http.StatusUnauthorized},
+		{"no key", "/api/clips", nil, http.StatusUnauthorized},
+		{"key in the query", "/api/clips?api_key=secret", nil, http.StatusUnauthorized},
+	} {
+		if got := status(tt.target, tt.header); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	token := mintToken("/ws")
+	if got := status("/api/preview?token="+token, nil); got != http.StatusUnauthorized {
+		t.Errorf("a /ws token opened /api/preview: status %d", got)
+	}
+	token = mintToken("/ws")
+	if got := status("/ws?token="+token, nil); got != http.StatusOK {
+		t.Errorf("first use of a /ws token: status %d, want %d", got, http.StatusOK)
+	}
+	if got := status("/ws?token="+token, nil); got != http.StatusUnauthorized {
+		t.Errorf("second use of a /ws token: status %d, want %d", got, http.StatusUnauthorized)
+	}
+
+	w := httptest.NewRecorder()
+	cm.HandleAuthToken(w, httptest.NewRequest(http.MethodPost, "/api/auth/token", strings.NewReader(`{"path": "/api/clips"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("minting a token for /api/clips: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleMetricsServesCountersAndGauges(t *testing.T) {
+	cm := newTestClipManager(t)
+	cm.metrics.IncClipsRequested()
+	cm.metrics.IncDestinationSend(`web"hook`, true)
+
+	rec := httptest.NewRecorder()
+	cm.HandleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"clipmanager_clips_requested_total 1\n",
+		"clipmanager_clips_failed_total 0\n",
+		`clipmanager_destination_sends_total{destination="web\"hook",result="success"} 1` + "\n",
+		`clipmanager_segments{camera="default"} 0` + "\n",
+		"clipmanager_clips_queued 0\n",
+		"clipmanager_websocket_clients 0\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics is missing %q:\n%s", want, body)
+		}
+	}
+}